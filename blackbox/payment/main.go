@@ -10,6 +10,7 @@ import (
 	"payment/config"
 	pb "payment/pb"
 	"payment/server"
+	"payment/tracing"
 
 	"google.golang.org/grpc"
 )
@@ -42,12 +43,23 @@ func main() {
 	}
 	log.Printf("HTTP Port%s, gRPC Port%s\n", c.HttpPort, c.GrpcPort)
 
+	//setup tracing
+	err := tracing.Configure(tracing.Config{
+		Exporter:    os.Getenv("TRACING_EXPORTER"),
+		File:        os.Getenv("TRACING_FILE"),
+		Endpoint:    os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		ServiceName: os.Getenv("OTEL_SERVICE_NAME"),
+	})
+	if err != nil {
+		log.Fatalf("failed to configure tracing: %s", err)
+	}
+
 	//setup grpc server
 	lis, err := net.Listen("tcp", c.GrpcPort)
 	if err != nil {
 		log.Fatalf("listen error: %s\n", err)
 	}
-	g := grpc.NewServer()
+	g := grpc.NewServer(grpc.UnaryInterceptor(tracing.UnaryServerInterceptor))
 
 	s, err := server.NewNetworkServer()
 	if err != nil {
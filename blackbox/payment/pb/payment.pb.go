@@ -173,6 +173,7 @@ type PaymentInformation struct {
 	Datetime             *timestamp.Timestamp `protobuf:"bytes,3,opt,name=datetime,proto3" json:"datetime,omitempty"`
 	Amount               int32                `protobuf:"varint,4,opt,name=amount,proto3" json:"amount,omitempty"`
 	IsCanceled           bool                 `protobuf:"varint,5,opt,name=is_canceled,json=isCanceled,proto3" json:"is_canceled,omitempty"`
+	RefundedAmount       int32                `protobuf:"varint,6,opt,name=refunded_amount,json=refundedAmount,proto3" json:"refunded_amount,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}             `json:"-"`
 	XXX_unrecognized     []byte               `json:"-"`
 	XXX_sizecache        int32                `json:"-"`
@@ -238,6 +239,13 @@ func (m *PaymentInformation) GetIsCanceled() bool {
 	return false
 }
 
+func (m *PaymentInformation) GetRefundedAmount() int32 {
+	if m != nil {
+		return m.RefundedAmount
+	}
+	return 0
+}
+
 type ExecutePaymentRequest struct {
 	PaymentInformation   *PaymentInformation `protobuf:"bytes,1,opt,name=payment_information,json=paymentInformation,proto3" json:"payment_information,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}            `json:"-"`
@@ -761,6 +769,100 @@ func (m *GetResultResponse) GetIsOk() bool {
 	return false
 }
 
+type RefundPaymentRequest struct {
+	PaymentId            string   `protobuf:"bytes,1,opt,name=payment_id,json=paymentId,proto3" json:"payment_id,omitempty"`
+	Amount               int32    `protobuf:"varint,2,opt,name=amount,proto3" json:"amount,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RefundPaymentRequest) Reset()         { *m = RefundPaymentRequest{} }
+func (m *RefundPaymentRequest) String() string { return proto.CompactTextString(m) }
+func (*RefundPaymentRequest) ProtoMessage()    {}
+func (*RefundPaymentRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_595799929d632654, []int{17}
+}
+
+func (m *RefundPaymentRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RefundPaymentRequest.Unmarshal(m, b)
+}
+func (m *RefundPaymentRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RefundPaymentRequest.Marshal(b, m, deterministic)
+}
+func (m *RefundPaymentRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RefundPaymentRequest.Merge(m, src)
+}
+func (m *RefundPaymentRequest) XXX_Size() int {
+	return xxx_messageInfo_RefundPaymentRequest.Size(m)
+}
+func (m *RefundPaymentRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_RefundPaymentRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RefundPaymentRequest proto.InternalMessageInfo
+
+func (m *RefundPaymentRequest) GetPaymentId() string {
+	if m != nil {
+		return m.PaymentId
+	}
+	return ""
+}
+
+func (m *RefundPaymentRequest) GetAmount() int32 {
+	if m != nil {
+		return m.Amount
+	}
+	return 0
+}
+
+type RefundPaymentResponse struct {
+	IsOk                 bool     `protobuf:"varint,1,opt,name=is_ok,json=isOk,proto3" json:"is_ok,omitempty"`
+	RefundedAmount       int32    `protobuf:"varint,2,opt,name=refunded_amount,json=refundedAmount,proto3" json:"refunded_amount,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RefundPaymentResponse) Reset()         { *m = RefundPaymentResponse{} }
+func (m *RefundPaymentResponse) String() string { return proto.CompactTextString(m) }
+func (*RefundPaymentResponse) ProtoMessage()    {}
+func (*RefundPaymentResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_595799929d632654, []int{18}
+}
+
+func (m *RefundPaymentResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RefundPaymentResponse.Unmarshal(m, b)
+}
+func (m *RefundPaymentResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RefundPaymentResponse.Marshal(b, m, deterministic)
+}
+func (m *RefundPaymentResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RefundPaymentResponse.Merge(m, src)
+}
+func (m *RefundPaymentResponse) XXX_Size() int {
+	return xxx_messageInfo_RefundPaymentResponse.Size(m)
+}
+func (m *RefundPaymentResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_RefundPaymentResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RefundPaymentResponse proto.InternalMessageInfo
+
+func (m *RefundPaymentResponse) GetIsOk() bool {
+	if m != nil {
+		return m.IsOk
+	}
+	return false
+}
+
+func (m *RefundPaymentResponse) GetRefundedAmount() int32 {
+	if m != nil {
+		return m.RefundedAmount
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*CardInformation)(nil), "paymentpb.CardInformation")
 	proto.RegisterType((*RegistCardRequest)(nil), "paymentpb.RegistCardRequest")
@@ -779,61 +881,67 @@ func init() {
 	proto.RegisterType((*GetResultRequest)(nil), "paymentpb.GetResultRequest")
 	proto.RegisterType((*RawData)(nil), "paymentpb.RawData")
 	proto.RegisterType((*GetResultResponse)(nil), "paymentpb.GetResultResponse")
+	proto.RegisterType((*RefundPaymentRequest)(nil), "paymentpb.RefundPaymentRequest")
+	proto.RegisterType((*RefundPaymentResponse)(nil), "paymentpb.RefundPaymentResponse")
 }
 
 func init() { proto.RegisterFile("pb/payment.proto", fileDescriptor_595799929d632654) }
 
 var fileDescriptor_595799929d632654 = []byte{
-	// 774 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x55, 0x51, 0x6b, 0xd3, 0x50,
-	0x14, 0x26, 0xdb, 0xba, 0xb6, 0xa7, 0xac, 0x6b, 0x6f, 0xed, 0xec, 0x62, 0xcb, 0x66, 0x54, 0x9c,
-	0x43, 0x1b, 0x98, 0x4c, 0x50, 0xf0, 0xc5, 0x6d, 0xcc, 0x81, 0x4c, 0x89, 0x83, 0x81, 0x82, 0xe5,
-	0xb6, 0xb9, 0x2b, 0xd7, 0xb6, 0x49, 0x96, 0xdc, 0x74, 0x9b, 0xe2, 0x8b, 0xf8, 0x22, 0xf8, 0xe6,
-	0x1f, 0xf0, 0xff, 0xf8, 0xe8, 0x5f, 0xf0, 0x87, 0xc8, 0xbd, 0xb9, 0x49, 0x93, 0x36, 0xed, 0x26,
-	0xec, 0xad, 0xf7, 0xdc, 0x73, 0xbf, 0xef, 0x7c, 0xdf, 0xc9, 0x39, 0x85, 0x92, 0xd3, 0xd6, 0x1d,
-	0x7c, 0x31, 0x20, 0x16, 0x6b, 0x3a, 0xae, 0xcd, 0x6c, 0x94, 0x97, 0x47, 0xa7, 0xad, 0xd6, 0xbb,
-	0xb6, 0xdd, 0xed, 0x13, 0x1d, 0x3b, 0x54, 0xc7, 0x96, 0x65, 0x33, 0xcc, 0xa8, 0x6d, 0x79, 0x41,
-	0xa2, 0xba, 0x26, 0x6f, 0xc5, 0xa9, 0xed, 0x9f, 0xe8, 0x8c, 0x0e, 0x88, 0xc7, 0xf0, 0xc0, 0x09,
-	0x12, 0x34, 0x02, 0xcb, 0x3b, 0xd8, 0x35, 0x0f, 0xac, 0x13, 0xdb, 0x1d, 0x88, 0xa7, 0x68, 0x0d,
-	0x0a, 0x1d, 0xec, 0x9a, 0x2d, 0xcb, 0x1f, 0xb4, 0x89, 0x5b, 0x53, 0xd6, 0x95, 0x8d, 0xbc, 0x01,
-	0x3c, 0x74, 0x28, 0x22, 0xa8, 0x04, 0xf3, 0x9d, 0xe1, 0xb0, 0x36, 0x27, 0x2e, 0xf8, 0x4f, 0xfe,
-	0x84, 0x9c, 0x3b, 0xd4, 0xbd, 0x68, 0x99, 0x98, 0x91, 0xda, 0x7c, 0xf0, 0x24, 0x08, 0xed, 0x62,
-	0x46, 0xb4, 0x77, 0x50, 0x36, 0x48, 0x97, 0x7a, 0x8c, 0x93, 0x19, 0xe4, 0xd4, 0x27, 0x1e, 0x43,
-	0x7b, 0x50, 0x12, 0x44, 0x74, 0x44, 0x2e, 0xd8, 0x0a, 0x5b, 0x6a, 0x33, 0x12, 0xd8, 0x1c, 0x2b,
-	0xcf, 0x58, 0xee, 0x24, 0x03, 0xda, 0x4b, 0x40, 0x71, 0x6c, 0xcf, 0xb1, 0x2d, 0x8f, 0xa0, 0x06,
-	0x88, 0x92, 0x5b, 0xcc, 0xee, 0x11, 0x4b, 0x8a, 0xc8, 0xf3, 0xc8, 0x11, 0x0f, 0xa0, 0x0a, 0x64,
-	0xa8, 0xd7, 0xb2, 0x7b, 0x42, 0x45, 0xce, 0x58, 0xa0, 0xde, 0xeb, 0x9e, 0xf6, 0x5b, 0x01, 0xf4,
-	0x26, 0x20, 0x8e, 0x1b, 0x72, 0x09, 0xd4, 0x3d, 0x28, 0xba, 0xc4, 0x23, 0xee, 0x50, 0x64, 0xb7,
-	0xa8, 0x29, 0x30, 0x33, 0xc6, 0x52, 0x2c, 0x7a, 0x60, 0xa2, 0x27, 0x90, 0xe3, 0xe6, 0xf0, 0x06,
-	0x08, 0x83, 0xb8, 0xca, 0xa0, 0x3b, 0xcd, 0xb0, 0x3b, 0xcd, 0xa3, 0xb0, 0x3b, 0x46, 0x94, 0x8b,
-	0x56, 0x60, 0x11, 0x0f, 0x6c, 0xdf, 0x62, 0xb5, 0x05, 0x01, 0x2b, 0x4f, 0xdc, 0x73, 0xea, 0xb5,
-	0x3a, 0xd8, 0xea, 0x90, 0x3e, 0x31, 0x6b, 0x19, 0xa1, 0x03, 0xa8, 0xb7, 0x23, 0x23, 0x5a, 0x17,
-	0xaa, 0x7b, 0xe7, 0xa4, 0xe3, 0x33, 0x22, 0x35, 0x85, 0xbe, 0x1f, 0x42, 0x45, 0xda, 0x9b, 0x62,
-	0x7d, 0x23, 0x66, 0xfd, 0xa4, 0x17, 0x06, 0x72, 0x26, 0x62, 0xda, 0x2b, 0x58, 0x19, 0x27, 0x1a,
-	0x35, 0x21, 0x62, 0x32, 0x43, 0xe7, 0x42, 0x04, 0x33, 0xbd, 0x09, 0xdb, 0x70, 0x23, 0x90, 0x30,
-	0x56, 0xf5, 0x6c, 0x2c, 0xed, 0x21, 0x54, 0xc7, 0x9e, 0xc9, 0x1a, 0x22, 0x12, 0x25, 0x46, 0xf2,
-	0x14, 0x6a, 0x2f, 0xfc, 0x7e, 0xef, 0x4a, 0x44, 0xf3, 0x49, 0xa2, 0x6d, 0x58, 0x4d, 0x79, 0x2a,
-	0xc9, 0x6a, 0x90, 0x35, 0x49, 0x9f, 0x30, 0x12, 0x54, 0x98, 0x31, 0xc2, 0xa3, 0xf6, 0x1c, 0xea,
-	0xfb, 0x84, 0xa5, 0x38, 0x7a, 0x35, 0x79, 0xdf, 0x14, 0x68, 0x4c, 0x79, 0x2f, 0xa9, 0xaf, 0xb9,
-	0xab, 0xe9, 0xcd, 0xa9, 0x40, 0xf9, 0xc0, 0xa2, 0x8c, 0xe2, 0x3e, 0xfd, 0x44, 0x64, 0xe9, 0xda,
-	0x03, 0x40, 0xf1, 0xe0, 0x2c, 0xdf, 0x11, 0x94, 0xf6, 0x09, 0xb7, 0xcb, 0xef, 0x87, 0x7e, 0x6b,
-	0xbf, 0x14, 0xc8, 0x1a, 0xf8, 0x6c, 0x17, 0x33, 0x7c, 0xed, 0x22, 0xd2, 0x56, 0xcc, 0xdc, 0xff,
-	0xaf, 0x98, 0x63, 0x28, 0xc7, 0xca, 0x96, 0x02, 0x1f, 0x41, 0xce, 0xc5, 0x67, 0x7c, 0xe3, 0x61,
-	0xf1, 0x95, 0x14, 0xb6, 0x50, 0x0c, 0x53, 0x2a, 0x32, 0xb2, 0xae, 0x94, 0x96, 0xe6, 0xe7, 0xd6,
-	0x8f, 0x45, 0x28, 0x4a, 0x29, 0x6f, 0x89, 0x3b, 0xa4, 0x1d, 0x82, 0xde, 0x03, 0x8c, 0xd6, 0x19,
-	0xaa, 0xc7, 0x21, 0xc7, 0x37, 0xa8, 0xda, 0x98, 0x72, 0x1b, 0x54, 0xa8, 0x95, 0xbe, 0xfe, 0xf9,
-	0xfb, 0x73, 0x0e, 0xb4, 0x8c, 0xce, 0x05, 0x3d, 0x53, 0x36, 0xd1, 0x47, 0x28, 0x26, 0x47, 0x15,
-	0xad, 0xc7, 0x20, 0x52, 0xd7, 0x85, 0x7a, 0x7b, 0x46, 0x86, 0x24, 0xaa, 0x08, 0xa2, 0x25, 0x2d,
-	0x17, 0xfe, 0x4f, 0x71, 0xae, 0x53, 0x58, 0x4a, 0x0c, 0x09, 0x5a, 0x4b, 0x58, 0x3e, 0x39, 0x79,
-	0xea, 0xfa, 0xf4, 0x04, 0x49, 0xd4, 0x10, 0x44, 0x37, 0x37, 0xab, 0x21, 0x91, 0xfe, 0x79, 0x34,
-	0x35, 0x5f, 0xd0, 0x05, 0x94, 0x27, 0x66, 0x13, 0xdd, 0x89, 0xa1, 0x4e, 0x1b, 0x7a, 0xf5, 0xee,
-	0xec, 0x24, 0x49, 0xbf, 0x2a, 0xe8, 0x2b, 0x5a, 0x31, 0xa2, 0x6f, 0xb5, 0xfd, 0x7e, 0x8f, 0xab,
-	0xfd, 0xae, 0x40, 0x35, 0x75, 0x40, 0xd1, 0xfd, 0x18, 0xf4, 0xac, 0x15, 0xa0, 0x6e, 0x5c, 0x9e,
-	0x98, 0xb4, 0x01, 0x4d, 0xb1, 0xe1, 0x03, 0xc0, 0x68, 0x20, 0x13, 0x9f, 0xd0, 0xc4, 0xf0, 0x26,
-	0x3e, 0xa1, 0xc9, 0x29, 0x8e, 0x3a, 0x5b, 0xd0, 0xe9, 0x08, 0xf1, 0x18, 0xf2, 0xd1, 0x38, 0xa0,
-	0x5b, 0xc9, 0xaa, 0x13, 0xb3, 0xad, 0xd6, 0xd3, 0x2f, 0x25, 0xf8, 0xb2, 0x00, 0xcf, 0xa3, 0xac,
-	0xee, 0x8a, 0x8b, 0xf6, 0xa2, 0xf8, 0x27, 0x7c, 0xfc, 0x2f, 0x00, 0x00, 0xff, 0xff, 0xaf, 0xe9,
-	0x76, 0xa4, 0xf2, 0x08, 0x00, 0x00,
+	// 845 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xad, 0x56, 0xdb, 0x6e, 0xd3, 0x40,
+	0x14, 0x94, 0xd3, 0xa6, 0x49, 0x4e, 0x94, 0xdb, 0xa6, 0x29, 0xa9, 0x49, 0xd4, 0x76, 0x01, 0xa5,
+	0x54, 0x10, 0x4b, 0x45, 0x45, 0x02, 0x89, 0x07, 0x28, 0x15, 0x54, 0x82, 0x82, 0x4c, 0x51, 0x25,
+	0x90, 0x88, 0x9c, 0x78, 0x1b, 0x99, 0x24, 0xb6, 0xeb, 0x4b, 0x2f, 0x54, 0xbc, 0x20, 0x5e, 0xfa,
+	0xcc, 0x0f, 0xf0, 0x4f, 0xfc, 0x02, 0x9f, 0xc0, 0x07, 0xe0, 0x5d, 0xaf, 0x13, 0x3b, 0x71, 0xd2,
+	0x56, 0xea, 0x5b, 0x7c, 0x7c, 0x76, 0xe6, 0xcc, 0x99, 0xcd, 0x24, 0x50, 0x34, 0xdb, 0x92, 0xa9,
+	0x9c, 0x0d, 0x88, 0xee, 0x34, 0x4d, 0xcb, 0x70, 0x0c, 0x94, 0xe1, 0x8f, 0x66, 0x5b, 0xac, 0x75,
+	0x0d, 0xa3, 0xdb, 0x27, 0x92, 0x62, 0x6a, 0x92, 0xa2, 0xeb, 0x86, 0xa3, 0x38, 0x9a, 0xa1, 0xdb,
+	0x7e, 0xa3, 0xb8, 0xc2, 0xdf, 0xb2, 0xa7, 0xb6, 0x7b, 0x28, 0x39, 0xda, 0x80, 0xd8, 0x8e, 0x32,
+	0x30, 0xfd, 0x06, 0x4c, 0xa0, 0xb0, 0xad, 0x58, 0xea, 0xae, 0x7e, 0x68, 0x58, 0x03, 0x76, 0x14,
+	0xad, 0x40, 0xb6, 0xe3, 0x95, 0x5a, 0xba, 0x3b, 0x68, 0x13, 0xab, 0x2a, 0xac, 0x0a, 0xeb, 0x19,
+	0x19, 0x68, 0x69, 0x8f, 0x55, 0x50, 0x11, 0xe6, 0x3a, 0xc7, 0xc7, 0xd5, 0x04, 0x7b, 0x41, 0x3f,
+	0xd2, 0x23, 0xe4, 0xd4, 0xd4, 0xac, 0xb3, 0x96, 0xaa, 0x38, 0xa4, 0x3a, 0xe7, 0x1f, 0xf1, 0x4b,
+	0x2f, 0xbd, 0x0a, 0xfe, 0x04, 0x25, 0x99, 0x74, 0x35, 0xdb, 0xa1, 0x64, 0x32, 0x39, 0x72, 0xbd,
+	0x21, 0xd0, 0x0e, 0x14, 0x19, 0x91, 0x36, 0x22, 0x67, 0x6c, 0xd9, 0x4d, 0xb1, 0x39, 0x14, 0xd8,
+	0x1c, 0x1b, 0x4f, 0x2e, 0x74, 0xa2, 0x05, 0xfc, 0x1a, 0x50, 0x18, 0xdb, 0x36, 0x3d, 0xf9, 0x04,
+	0xd5, 0x81, 0x8d, 0xdc, 0x72, 0x8c, 0x1e, 0xd1, 0xb9, 0x88, 0x0c, 0xad, 0xec, 0xd3, 0x02, 0x2a,
+	0x43, 0x52, 0xb3, 0x5b, 0x46, 0x8f, 0xa9, 0x48, 0xcb, 0xf3, 0x9a, 0xfd, 0xae, 0x87, 0xff, 0x09,
+	0x80, 0xde, 0xfb, 0xc4, 0xe1, 0x85, 0x5c, 0x02, 0x75, 0x0f, 0xf2, 0x16, 0xb1, 0x89, 0x75, 0xcc,
+	0xba, 0x5b, 0x9a, 0xca, 0x30, 0x93, 0x72, 0x2e, 0x54, 0xdd, 0x55, 0xd1, 0x63, 0x48, 0xd3, 0xe5,
+	0x50, 0x03, 0xd8, 0x82, 0xa8, 0x4a, 0xdf, 0x9d, 0x66, 0xe0, 0x4e, 0x73, 0x3f, 0x70, 0x47, 0x1e,
+	0xf6, 0xa2, 0x25, 0x58, 0x50, 0x06, 0x86, 0xab, 0x3b, 0xd5, 0x79, 0x06, 0xcb, 0x9f, 0xe8, 0xce,
+	0x3d, 0x05, 0x1d, 0x45, 0xef, 0x90, 0x3e, 0x51, 0xab, 0x49, 0xa6, 0x03, 0x34, 0x7b, 0x9b, 0x57,
+	0x50, 0x03, 0x0a, 0x16, 0x39, 0x74, 0x75, 0x95, 0xa8, 0x2d, 0x8e, 0xb0, 0xc0, 0x10, 0xf2, 0x41,
+	0xf9, 0x39, 0xab, 0xe2, 0x2e, 0x54, 0x76, 0x4e, 0x49, 0xc7, 0x75, 0x08, 0x17, 0x1f, 0x18, 0xb4,
+	0x07, 0x65, 0xee, 0x43, 0x8c, 0x47, 0xf5, 0x90, 0x47, 0x93, 0x4b, 0x93, 0x91, 0x39, 0x51, 0xc3,
+	0x6f, 0x60, 0x69, 0x9c, 0x68, 0xe4, 0xd6, 0x90, 0x49, 0x0d, 0x56, 0x1c, 0x20, 0xa8, 0xf1, 0x6e,
+	0x6d, 0xc1, 0xa2, 0xaf, 0x75, 0x6c, 0xea, 0xd9, 0x58, 0xf8, 0x01, 0x54, 0xc6, 0x8e, 0xf1, 0x19,
+	0x86, 0x24, 0x42, 0x88, 0xe4, 0x09, 0x54, 0x5f, 0xb8, 0xfd, 0xde, 0x95, 0x88, 0xe6, 0xa2, 0x44,
+	0x5b, 0xb0, 0x1c, 0x73, 0x94, 0x93, 0x55, 0x21, 0xa5, 0x7a, 0x2e, 0x39, 0xc4, 0x9f, 0x30, 0x29,
+	0x07, 0x8f, 0xf8, 0x19, 0xd4, 0x5e, 0x11, 0x27, 0x66, 0xa3, 0x57, 0x93, 0xf7, 0x53, 0x80, 0xfa,
+	0x94, 0xf3, 0x9c, 0xfa, 0x86, 0x5d, 0x8d, 0x37, 0xa7, 0x0c, 0xa5, 0x5d, 0x5d, 0x73, 0x34, 0xa5,
+	0xaf, 0x7d, 0x23, 0x7c, 0x74, 0x7c, 0x1f, 0x50, 0xb8, 0x38, 0x6b, 0xef, 0x08, 0x8a, 0x9e, 0x0a,
+	0xaf, 0xc7, 0xed, 0x07, 0xfb, 0xc6, 0xbf, 0x05, 0x48, 0xc9, 0xca, 0x89, 0x17, 0x28, 0xca, 0x8d,
+	0x8b, 0x88, 0xcb, 0xa2, 0xc4, 0xf5, 0xb3, 0xe8, 0x00, 0x4a, 0xa1, 0xb1, 0xb9, 0xc0, 0x87, 0x90,
+	0xb6, 0x94, 0x13, 0x1a, 0x8d, 0x0a, 0xbb, 0x25, 0xd9, 0x4d, 0x14, 0xc2, 0xe4, 0x8a, 0xe4, 0x94,
+	0xc5, 0xa5, 0xc5, 0xee, 0xf3, 0x2d, 0x2c, 0xca, 0xec, 0x5b, 0x7b, 0xad, 0xcb, 0x1e, 0x0a, 0x8f,
+	0x44, 0x38, 0x3c, 0xf0, 0x47, 0xa8, 0x8c, 0xc1, 0xcd, 0x30, 0x23, 0x2e, 0x49, 0x12, 0x71, 0x49,
+	0xb2, 0x79, 0x91, 0x82, 0x3c, 0x47, 0xfc, 0xe0, 0x45, 0x9f, 0xd6, 0x21, 0xe8, 0x33, 0xc0, 0x28,
+	0x9d, 0x51, 0x2d, 0x2c, 0x7c, 0xfc, 0x07, 0x41, 0xac, 0x4f, 0x79, 0xeb, 0xcf, 0x86, 0x8b, 0x3f,
+	0xfe, 0xfc, 0xfd, 0x95, 0x00, 0x9c, 0x94, 0xe8, 0xda, 0x9f, 0x0a, 0x1b, 0xe8, 0x2b, 0xe4, 0xa3,
+	0x81, 0x82, 0x56, 0x43, 0x10, 0xb1, 0xa1, 0x26, 0xae, 0xcd, 0xe8, 0xe0, 0x44, 0x65, 0x46, 0x94,
+	0xc3, 0xe9, 0xe0, 0x67, 0x97, 0x72, 0x1d, 0x41, 0x2e, 0xf2, 0x55, 0x46, 0x2b, 0x91, 0x8b, 0x31,
+	0x99, 0x0f, 0xe2, 0xea, 0xf4, 0x06, 0x4e, 0x54, 0x67, 0x44, 0xb7, 0x36, 0x2a, 0x01, 0x91, 0x74,
+	0x3e, 0x72, 0xf3, 0x3b, 0x3a, 0x87, 0x5c, 0xc4, 0xa5, 0x08, 0x65, 0xdc, 0x75, 0x88, 0x50, 0xc6,
+	0x1a, 0x8c, 0x1b, 0x8c, 0x72, 0x0d, 0xd7, 0x62, 0x29, 0x25, 0xdf, 0x50, 0xaa, 0xf7, 0x0c, 0x4a,
+	0x13, 0xf1, 0x85, 0xee, 0x84, 0xf0, 0xa7, 0xe5, 0xa2, 0x78, 0x77, 0x76, 0x13, 0x1f, 0x64, 0x99,
+	0x0d, 0x52, 0xc6, 0xf9, 0xe1, 0x20, 0xad, 0xb6, 0xd7, 0x4c, 0xa9, 0x2f, 0x04, 0xa8, 0xc4, 0x66,
+	0x18, 0x6a, 0x84, 0xa0, 0x67, 0xa5, 0xa4, 0xb8, 0x7e, 0x79, 0x63, 0xd4, 0x03, 0x34, 0xc5, 0x83,
+	0x2f, 0x00, 0xa3, 0xcc, 0x8a, 0xdc, 0xdf, 0x89, 0x7c, 0x8b, 0xdc, 0xdf, 0xc9, 0xa0, 0x1b, 0x5e,
+	0xab, 0xac, 0xa4, 0x8d, 0x10, 0x0f, 0x20, 0x33, 0x4c, 0x0c, 0x74, 0x3b, 0x3a, 0x75, 0x24, 0xfe,
+	0xc4, 0x5a, 0xfc, 0x4b, 0x0e, 0x5e, 0x60, 0xe0, 0x19, 0x94, 0xf2, 0x2c, 0xa4, 0x2f, 0xda, 0x0b,
+	0xec, 0x5f, 0xc5, 0xa3, 0xff, 0xbb, 0xac, 0x3a, 0x7c, 0x3e, 0x0a, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -854,6 +962,8 @@ type PaymentServiceClient interface {
 	ExecutePayment(ctx context.Context, in *ExecutePaymentRequest, opts ...grpc.CallOption) (*ExecutePaymentResponse, error)
 	//決済をキャンセルする
 	CancelPayment(ctx context.Context, in *CancelPaymentRequest, opts ...grpc.CallOption) (*CancelPaymentResponse, error)
+	//決済をキャンセルし、指定した金額だけ返金する
+	RefundPayment(ctx context.Context, in *RefundPaymentRequest, opts ...grpc.CallOption) (*RefundPaymentResponse, error)
 	//決済をバルクでキャンセルする
 	BulkCancelPayment(ctx context.Context, in *BulkCancelPaymentRequest, opts ...grpc.CallOption) (*BulkCancelPaymentResponse, error)
 	//決済情報を取得する
@@ -899,6 +1009,15 @@ func (c *paymentServiceClient) CancelPayment(ctx context.Context, in *CancelPaym
 	return out, nil
 }
 
+func (c *paymentServiceClient) RefundPayment(ctx context.Context, in *RefundPaymentRequest, opts ...grpc.CallOption) (*RefundPaymentResponse, error) {
+	out := new(RefundPaymentResponse)
+	err := c.cc.Invoke(ctx, "/paymentpb.PaymentService/RefundPayment", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *paymentServiceClient) BulkCancelPayment(ctx context.Context, in *BulkCancelPaymentRequest, opts ...grpc.CallOption) (*BulkCancelPaymentResponse, error) {
 	out := new(BulkCancelPaymentResponse)
 	err := c.cc.Invoke(ctx, "/paymentpb.PaymentService/BulkCancelPayment", in, out, opts...)
@@ -943,6 +1062,8 @@ type PaymentServiceServer interface {
 	ExecutePayment(context.Context, *ExecutePaymentRequest) (*ExecutePaymentResponse, error)
 	//決済をキャンセルする
 	CancelPayment(context.Context, *CancelPaymentRequest) (*CancelPaymentResponse, error)
+	//決済をキャンセルし、指定した金額だけ返金する
+	RefundPayment(context.Context, *RefundPaymentRequest) (*RefundPaymentResponse, error)
 	//決済をバルクでキャンセルする
 	BulkCancelPayment(context.Context, *BulkCancelPaymentRequest) (*BulkCancelPaymentResponse, error)
 	//決済情報を取得する
@@ -966,6 +1087,9 @@ func (*UnimplementedPaymentServiceServer) ExecutePayment(ctx context.Context, re
 func (*UnimplementedPaymentServiceServer) CancelPayment(ctx context.Context, req *CancelPaymentRequest) (*CancelPaymentResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method CancelPayment not implemented")
 }
+func (*UnimplementedPaymentServiceServer) RefundPayment(ctx context.Context, req *RefundPaymentRequest) (*RefundPaymentResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RefundPayment not implemented")
+}
 func (*UnimplementedPaymentServiceServer) BulkCancelPayment(ctx context.Context, req *BulkCancelPaymentRequest) (*BulkCancelPaymentResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method BulkCancelPayment not implemented")
 }
@@ -1037,6 +1161,24 @@ func _PaymentService_CancelPayment_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _PaymentService_RefundPayment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RefundPaymentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PaymentServiceServer).RefundPayment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/paymentpb.PaymentService/RefundPayment",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PaymentServiceServer).RefundPayment(ctx, req.(*RefundPaymentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _PaymentService_BulkCancelPayment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(BulkCancelPaymentRequest)
 	if err := dec(in); err != nil {
@@ -1125,6 +1267,10 @@ var _PaymentService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "CancelPayment",
 			Handler:    _PaymentService_CancelPayment_Handler,
 		},
+		{
+			MethodName: "RefundPayment",
+			Handler:    _PaymentService_RefundPayment_Handler,
+		},
 		{
 			MethodName: "BulkCancelPayment",
 			Handler:    _PaymentService_BulkCancelPayment_Handler,
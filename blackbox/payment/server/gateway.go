@@ -7,6 +7,7 @@ import (
 
 	"payment/config"
 	pb "payment/pb"
+	"payment/tracing"
 
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"google.golang.org/grpc"
@@ -15,6 +16,8 @@ import (
 func newGateway(c config.Config, ctx context.Context, opts ...runtime.ServeMuxOption) (http.Handler, error) {
 	opts = []runtime.ServeMuxOption{
 		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{OrigName: true, EmitDefaults: true}),
+		// webapp から引き継いだトレースを gRPC のハンドラに渡す
+		runtime.WithMetadata(tracing.GatewayMetadata),
 	}
 	mux := runtime.NewServeMux(opts...)
 	dialOpts := []grpc.DialOption{grpc.WithInsecure()}
@@ -40,5 +43,5 @@ func StartGRPCGateway(c config.Config, opts ...runtime.ServeMuxOption) error {
 		return err
 	}
 
-	return http.ListenAndServe(c.HttpPort, gw)
+	return http.ListenAndServe(c.HttpPort, tracing.HTTPMiddleware(gw))
 }
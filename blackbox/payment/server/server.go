@@ -143,6 +143,7 @@ func (s *Server) CancelPayment(ctx context.Context, req *pb.CancelPaymentRequest
 		if ok {
 			s.mu.Lock()
 			paydata.IsCanceled = true
+			paydata.RefundedAmount = paydata.Amount
 			s.PayInfoMap[req.PaymentId] = paydata
 			s.mu.Unlock()
 			done <- struct{}{}
@@ -160,6 +161,53 @@ func (s *Server) CancelPayment(ctx context.Context, req *pb.CancelPaymentRequest
 	}
 }
 
+//決済をキャンセルし、指定した金額だけ返金する(残りはキャンセル料として扱う)
+func (s *Server) RefundPayment(ctx context.Context, req *pb.RefundPaymentRequest) (*pb.RefundPaymentResponse, error) {
+	done := make(chan int32, 1)
+	ec := make(chan error, 1)
+	s.cancelLock.Lock()
+	defer s.cancelLock.Unlock()
+	go func() {
+		s.mu.RLock()
+		paydata, ok := s.PayInfoMap[req.PaymentId]
+		s.mu.RUnlock()
+		time.Sleep(1 * time.Second)
+		if !ok {
+			log.Println("PaymentID Not Found")
+			ec <- status.Errorf(codes.NotFound, "PaymentID Not Found")
+			return
+		}
+		if paydata.IsCanceled {
+			// 同じ金額での再送は、前回の返金が届かなかった場合のやり直しとして成功させる
+			if paydata.RefundedAmount == req.Amount {
+				done <- req.Amount
+				return
+			}
+			log.Println("Payment Already Canceled")
+			ec <- status.Errorf(codes.FailedPrecondition, "Payment Already Canceled")
+			return
+		}
+		if req.Amount < 0 || req.Amount > paydata.Amount {
+			log.Println("Invalid Refund Amount")
+			ec <- status.Errorf(codes.InvalidArgument, "Invalid Refund Amount")
+			return
+		}
+
+		s.mu.Lock()
+		paydata.IsCanceled = true
+		paydata.RefundedAmount = req.Amount
+		s.PayInfoMap[req.PaymentId] = paydata
+		s.mu.Unlock()
+		done <- req.Amount
+	}()
+	select {
+	case amount := <-done:
+		return &pb.RefundPaymentResponse{IsOk: true, RefundedAmount: amount}, nil
+	case err := <-ec:
+		return &pb.RefundPaymentResponse{IsOk: false}, err
+	}
+}
+
 //バルクで決済をキャンセルする
 func (s *Server) BulkCancelPayment(ctx context.Context, req *pb.BulkCancelPaymentRequest) (*pb.BulkCancelPaymentResponse, error) {
 	done := make(chan int32, 1)
@@ -178,6 +226,7 @@ func (s *Server) BulkCancelPayment(ctx context.Context, req *pb.BulkCancelPaymen
 			paydata, ok := s.PayInfoMap[v]
 			if ok {
 				paydata.IsCanceled = true
+				paydata.RefundedAmount = paydata.Amount
 				s.PayInfoMap[v] = paydata
 			} else {
 				i--
@@ -264,6 +313,7 @@ func (s *Server) GetResult(ctx context.Context, req *pb.GetResultRequest) (*pb.G
 			rawData.PaymentInformation.Datetime = v.Datetime
 			rawData.PaymentInformation.Amount = v.Amount
 			rawData.PaymentInformation.IsCanceled = v.IsCanceled
+			rawData.PaymentInformation.RefundedAmount = v.RefundedAmount
 
 			rawData.CardInformation.CardNumber = s.CardInfoMap[t].CardNumber
 			rawData.CardInformation.Cvv = s.CardInfoMap[t].Cvv
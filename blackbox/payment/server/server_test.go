@@ -25,6 +25,8 @@ import (
 	・誤った内容のキャンセル(1種類)
 	・誤った内容のバルクキャンセル(1種類)
 	・ベンチマーカー用生データ取得(決済4回分のデータが出てくる)
+	・一部返金(1回)と返金額の確認
+	・誤った内容の返金(キャンセル済み/返金額が決済額を超える)
 */
 func TestServer(t *testing.T) {
 	//setup grpc server
@@ -369,4 +371,59 @@ func TestServer(t *testing.T) {
 			t.Logf("[Ex] ExpiryDate OK. Expected:%v, Got:%v", v.CardInformation.ExpiryDate, cardlist[life].ExpiryDate)
 		}
 	})
+	var refundid string
+	t.Run("RefundPayment", func(t *testing.T) {
+		ctx := context.Background()
+		pay := &pb.PaymentInformation{
+			CardToken: tokenlist[0],
+			Amount:    5000,
+		}
+		r, err := c.ExecutePayment(ctx, &pb.ExecutePaymentRequest{PaymentInformation: pay})
+		if err != nil {
+			t.Fatal(err)
+		}
+		refundid = r.PaymentId
+
+		rr, err := c.RefundPayment(ctx, &pb.RefundPaymentRequest{PaymentId: refundid, Amount: 3500})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rr.RefundedAmount != 3500 {
+			t.Fatalf("Failed. Expected:3500 but %d\n", rr.RefundedAmount)
+		}
+
+		ir, err := c.GetPaymentInformation(ctx, &pb.GetPaymentInformationRequest{PaymentId: refundid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ir.PaymentInformation.IsCanceled || ir.PaymentInformation.RefundedAmount != 3500 {
+			t.Fatalf("Failed. %#v\n", ir.PaymentInformation)
+		}
+	})
+
+	t.Run("RefundPayment retried with the same amount", func(t *testing.T) {
+		ctx := context.Background()
+		rr, err := c.RefundPayment(ctx, &pb.RefundPaymentRequest{PaymentId: refundid, Amount: 3500})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rr.IsOk || rr.RefundedAmount != 3500 {
+			t.Fatalf("Failed. %#v\n", rr)
+		}
+	})
+
+	t.Run("RefundPayment with invalid parameters", func(t *testing.T) {
+		ctx := context.Background()
+		r, err := c.RefundPayment(ctx, &pb.RefundPaymentRequest{PaymentId: refundid, Amount: 100})
+		if err == nil {
+			t.Fatal("should failed") // 別の金額で返金済み
+		}
+		t.Logf("%#v", r)
+
+		r, err = c.RefundPayment(ctx, &pb.RefundPaymentRequest{PaymentId: payidlist2[0], Amount: 100000})
+		if err == nil {
+			t.Fatal("should failed") // 決済額を超える
+		}
+		t.Logf("%#v", r)
+	})
 }
@@ -0,0 +1,460 @@
+// Package tracing は webapp から引き継いだトレースに決済APIのスパンを記録する。
+//
+// webapp と同じく W3C Trace Context の traceparent を読み、OTLP/JSON で書き出す。
+// grpc-gateway の HTTP リクエストと gRPC の呼び出しごとにサーバスパンを作り、
+// gateway から gRPC へは traceparent をメタデータで渡す。
+package tracing
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	TraceparentHeader = "traceparent"
+
+	spanKindServer  = 2
+	spanStatusError = 2
+
+	exportInterval = time.Second
+	batchSize      = 512
+)
+
+// Config は書き出し先の設定
+type Config struct {
+	// none (記録しない)・file・otlp
+	Exporter string
+	// Exporter が file のときに OTLP/JSON を追記するファイル
+	File string
+	// Exporter が otlp のときの OTLP/HTTP のエンドポイント (/v1/traces に送る)
+	Endpoint    string
+	ServiceName string
+}
+
+// SpanContext はプロセスをまたいで引き継ぐスパンの識別子
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent は traceparent ヘッダの値
+func (sc SpanContext) Traceparent() string {
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-01"
+}
+
+// ParseTraceparent は traceparent ヘッダを読む (不正な値なら ok は false)
+func ParseTraceparent(s string) (SpanContext, bool) {
+	sc := SpanContext{}
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.DecodeString(parts[3]); err != nil {
+		return sc, false
+	}
+	return sc, sc.IsValid()
+}
+
+type Span struct {
+	mu         sync.Mutex
+	sc         SpanContext
+	parent     [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        string
+}
+
+func newSpan(parent SpanContext, name string, kind int) *Span {
+	s := &Span{name: name, kind: kind, start: time.Now(), attributes: map[string]interface{}{}}
+	crand.Read(s.sc.SpanID[:])
+	if parent.IsValid() {
+		s.sc.TraceID, s.parent = parent.TraceID, parent.SpanID
+	} else {
+		crand.Read(s.sc.TraceID[:])
+	}
+	return s
+}
+
+func (s *Span) Context() SpanContext {
+	return s.sc
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+func (s *Span) End() {
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	defaultTracer.enqueue(s)
+}
+
+type spanKey struct{}
+
+// FromContext は ctx のスパン (なければ nil)
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+func withSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// Exporter は終わったスパンを書き出す
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+type tracer struct {
+	mu       sync.Mutex
+	exporter Exporter
+	queue    chan *Span
+	flushed  chan chan struct{}
+}
+
+var defaultTracer = &tracer{}
+
+func (t *tracer) enabled() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.exporter != nil
+}
+
+func (t *tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		// 書き出しが追いつかなければ捨てる
+	}
+}
+
+func (t *tracer) start(exporter Exporter) {
+	t.mu.Lock()
+	t.exporter = exporter
+	t.queue = make(chan *Span, batchSize*4)
+	t.flushed = make(chan chan struct{})
+	t.mu.Unlock()
+	go t.run()
+}
+
+func (t *tracer) run() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, batchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			log.Printf("failed to export %d spans: %s", len(batch), err)
+		}
+		batch = make([]*Span, 0, batchSize)
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case done := <-t.flushed:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			export()
+			close(done)
+		}
+	}
+}
+
+// Flush はたまっているスパンを書き出す
+func Flush() {
+	if !defaultTracer.enabled() {
+		return
+	}
+	done := make(chan struct{})
+	defaultTracer.flushed <- done
+	<-done
+}
+
+// Configure は設定に従ってスパンの書き出しを始める
+func Configure(c Config) error {
+	if c.ServiceName == "" {
+		c.ServiceName = "isutrain-payment"
+	}
+	switch c.Exporter {
+	case "", "none":
+		return nil
+	case "file":
+		if c.File == "" {
+			return fmt.Errorf("TRACING_FILE is required for the file exporter")
+		}
+		defaultTracer.start(FileExporter{ServiceName: c.ServiceName, Path: c.File})
+	case "otlp":
+		if c.Endpoint == "" {
+			return fmt.Errorf("OTEL_EXPORTER_OTLP_ENDPOINT is required for the otlp exporter")
+		}
+		defaultTracer.start(OTLPHTTPExporter{ServiceName: c.ServiceName, Endpoint: c.Endpoint, Client: &http.Client{Timeout: 5 * time.Second}})
+	default:
+		return fmt.Errorf("unknown tracing exporter %q", c.Exporter)
+	}
+	return nil
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// HTTPMiddleware は grpc-gateway へのリクエストごとにサーバスパンを作る
+func HTTPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !defaultTracer.enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		parent, _ := ParseTraceparent(r.Header.Get(TraceparentHeader))
+		s := newSpan(parent, r.Method+" "+r.URL.Path, spanKindServer)
+		s.SetAttribute("http.method", r.Method)
+		s.SetAttribute("http.target", r.URL.RequestURI())
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(withSpan(r.Context(), s)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.SetAttribute("http.status_code", rec.status)
+		if rec.status >= 500 {
+			s.SetError(fmt.Errorf("%d %s", rec.status, http.StatusText(rec.status)))
+		}
+		s.End()
+	})
+}
+
+// GatewayMetadata は gateway のスパンを gRPC の呼び出しに引き継ぐ (runtime.WithMetadata に渡す)
+func GatewayMetadata(ctx context.Context, r *http.Request) metadata.MD {
+	s := FromContext(r.Context())
+	if s == nil {
+		return nil
+	}
+	return metadata.Pairs(TraceparentHeader, s.sc.Traceparent())
+}
+
+// UnaryServerInterceptor は gRPC の呼び出しごとにサーバスパンを作る
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !defaultTracer.enabled() {
+		return handler(ctx, req)
+	}
+	parent := SpanContext{}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(TraceparentHeader); len(v) > 0 {
+			parent, _ = ParseTraceparent(v[0])
+		}
+	}
+	s := newSpan(parent, info.FullMethod, spanKindServer)
+	s.SetAttribute("rpc.system", "grpc")
+	s.SetAttribute("rpc.method", info.FullMethod)
+
+	resp, err := handler(withSpan(ctx, s), req)
+	s.SetAttribute("rpc.grpc.status_code", int(status.Code(err)))
+	s.SetError(err)
+	s.End()
+	return resp, err
+}
+
+// OTLP/JSON (opentelemetry/proto/collector/trace/v1 の ExportTraceServiceRequest)
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attrs))
+	for k, v := range attrs {
+		out = append(out, otlpAttribute{Key: k, Value: otlpValue(v)})
+	}
+	return out
+}
+
+func encode(service string, spans []*Span) otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.sc.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.sc.SpanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+		}
+		if s.parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != "" {
+			o.Status = otlpStatus{Code: spanStatusError, Message: s.err}
+		}
+		s.mu.Unlock()
+		out = append(out, o)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes(map[string]interface{}{"service.name": service})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "payment"},
+			Spans: out,
+		}},
+	}}}
+}
+
+// FileExporter は OTLP/JSON を1行ずつファイルに追記する
+type FileExporter struct {
+	ServiceName string
+	Path        string
+}
+
+func (e FileExporter) Export(spans []*Span) error {
+	b, err := json.Marshal(encode(e.ServiceName, spans))
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(e.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// OTLPHTTPExporter は OTLP/HTTP (JSON) で collector に送る
+type OTLPHTTPExporter struct {
+	ServiceName string
+	Endpoint    string
+	Client      *http.Client
+}
+
+func (e OTLPHTTPExporter) Export(spans []*Span) error {
+	b, err := json.Marshal(encode(e.ServiceName, spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.Client.Post(strings.TrimSuffix(e.Endpoint, "/")+"/v1/traces", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp endpoint returned %d", resp.StatusCode)
+	}
+	return nil
+}
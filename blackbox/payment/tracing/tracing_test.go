@@ -0,0 +1,128 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const incoming = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *recordingExporter) Export(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func startTestTracer(e Exporter) func() {
+	saved := defaultTracer
+	defaultTracer = &tracer{}
+	defaultTracer.start(e)
+	return func() { defaultTracer = saved }
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := ParseTraceparent(incoming)
+	if !ok || sc.Traceparent() != incoming {
+		t.Errorf("ParseTraceparent(%q) = %s, %v", incoming, sc.Traceparent(), ok)
+	}
+	for _, s := range []string{"", "00-abc-def-01", "00-00000000000000000000000000000000-00f067aa0ba902b7-01"} {
+		if _, ok := ParseTraceparent(s); ok {
+			t.Errorf("ParseTraceparent(%q) accepted", s)
+		}
+	}
+}
+
+// gateway のスパンが webapp のトレースを引き継ぎ、gRPC のスパンがその子になる
+func TestGatewayToGRPCPropagation(t *testing.T) {
+	exporter := &recordingExporter{}
+	defer startTestTracer(exporter)()
+
+	var md metadata.MD
+	h := HTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		md = GatewayMetadata(r.Context(), r)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/payment", nil)
+	req.Header.Set(TraceparentHeader, incoming)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+	info := &grpc.UnaryServerInfo{FullMethod: "/paymentapi.PaymentService/ExecutePayment"}
+	_, err := UnaryServerInterceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		if FromContext(ctx) == nil {
+			t.Error("handler context has no span")
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid POST data")
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("err = %v", err)
+	}
+	Flush()
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("spans = %d, want 2", len(exporter.spans))
+	}
+	gateway, rpc := exporter.spans[0], exporter.spans[1]
+	want, _ := ParseTraceparent(incoming)
+	if gateway.sc.TraceID != want.TraceID || gateway.parent != want.SpanID {
+		t.Errorf("gateway span did not continue the incoming trace")
+	}
+	if rpc.sc.TraceID != want.TraceID || rpc.parent != gateway.sc.SpanID {
+		t.Errorf("gRPC span should be a child of the gateway span")
+	}
+	if gateway.attributes["http.status_code"] != http.StatusBadRequest || rpc.err == "" {
+		t.Errorf("gateway = %v, rpc err = %q", gateway.attributes, rpc.err)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	f, err := ioutil.TempFile("", "traces-*.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	parent, _ := ParseTraceparent(incoming)
+	s := newSpan(parent, "/paymentapi.PaymentService/RefundPayment", spanKindServer)
+	s.SetAttribute("rpc.system", "grpc")
+	if err := (FileExporter{ServiceName: "isutrain-payment", Path: f.Name()}).Export([]*Span{s}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	sc := bufio.NewScanner(r)
+	if !sc.Scan() {
+		t.Fatal("no line written")
+	}
+	req := otlpRequest{}
+	if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+		t.Fatal(err)
+	}
+	got := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if got.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || got.ParentSpanID != "00f067aa0ba902b7" || got.Kind != spanKindServer {
+		t.Errorf("span = %+v", got)
+	}
+}
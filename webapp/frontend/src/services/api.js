@@ -77,8 +77,9 @@ class ApiService {
     }
 
     async login(data) {
-      return await this.httpService.post('/api/auth/login', data).then(function(res){
-        return res
+      return await this.httpService.post('/api/auth/login', data).then((res) => {
+        // CSRFトークン (XSRF-TOKEN クッキー) を受け取っておく
+        return this.getAuth().then(() => res)
       });
     }
 
@@ -96,6 +97,7 @@ class ApiService {
         adult: condition.adult,
         column: condition.column,
         seats: condition.seats,
+        promo_code: condition.promo_code,
       }
 
       return await this.httpService.post('/api/train/reserve', request).then(function(resp){
@@ -117,8 +119,12 @@ class ApiService {
       return await this.httpService.get('/api/user/reservations/' + reservationId)
     }
 
-    async cancelReservation(id) {
-      return await this.httpService.post('/api/user/reservations/' + id + "/cancel")
+    async getCancelQuote(id) {
+      return await this.httpService.get('/api/user/reservations/' + id + "/cancel/quote")
+    }
+
+    async cancelReservation(id, refundAmount) {
+      return await this.httpService.post('/api/user/reservations/' + id + "/cancel", {refund_amount: refundAmount})
     }
 
     async tokenizeCard (data) {
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+	メールアドレスの確認とパスワードの再設定
+
+	どちらもメールで送ったリンクのトークンで本人確認する
+	トークンは email_tokens にハッシュだけを保存し、有効期限付き・1回限り有効
+	同じ用途のトークンを発行し直すと、それ以前の未使用トークンは無効になる
+*/
+
+const (
+	emailTokenVerifyEmail   = "verify_email"
+	emailTokenResetPassword = "reset_password"
+
+	verifyEmailTokenTTL   = 24 * time.Hour
+	resetPasswordTokenTTL = time.Hour
+)
+
+var (
+	// メールのリンク先 (フロントエンドのURL)
+	appBaseURL = "http://localhost:8080"
+
+	// true ならメールアドレス未確認のユーザはログインできない
+	requireEmailVerification = false
+)
+
+type EmailToken struct {
+	ID        int64      `db:"id"`
+	UserID    int64      `db:"user_id"`
+	Purpose   string     `db:"purpose"`
+	TokenHash string     `db:"token_hash"`
+	CreatedAt time.Time  `db:"created_at"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	UsedAt    *time.Time `db:"used_at"`
+}
+
+type EmailTokenRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+// issueEmailToken はトークンを発行し、同じ用途の未使用トークンを無効にする
+func issueEmailToken(ctx context.Context, userID int64, purpose string, ttl time.Duration) (string, error) {
+	token := secureRandomStr(32)
+	now := time.Now()
+
+	tx, err := dbx.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(
+		"UPDATE `email_tokens` SET `used_at` = ? WHERE `user_id` = ? AND `purpose` = ? AND `used_at` IS NULL",
+		now, userID, purpose,
+	)
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO `email_tokens` (`user_id`, `purpose`, `token_hash`, `created_at`, `expires_at`) VALUES (?, ?, ?, ?, ?)",
+		userID, purpose, hashSecretToken(token), now, now.Add(ttl),
+	)
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// consumeEmailToken はトークンを使用済みにして持ち主のユーザIDを返す
+// 見つからない・期限切れ・使用済みの場合は 0 を返す
+func consumeEmailToken(tx *sqlx.Tx, token, purpose string) (int64, error) {
+	emailToken := EmailToken{}
+	err := tx.Get(
+		&emailToken,
+		"SELECT * FROM `email_tokens` WHERE `token_hash` = ? AND `purpose` = ? FOR UPDATE",
+		hashSecretToken(token), purpose,
+	)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	if emailToken.UsedAt != nil || !emailToken.ExpiresAt.After(now) {
+		return 0, nil
+	}
+	_, err = tx.Exec("UPDATE `email_tokens` SET `used_at` = ? WHERE `id` = ?", now, emailToken.ID)
+	if err != nil {
+		return 0, err
+	}
+	return emailToken.UserID, nil
+}
+
+func emailLink(path, token string) string {
+	return appBaseURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// sendVerificationMail は確認メールを送る (失敗してもユーザ登録は成功させる)
+func sendVerificationMail(ctx context.Context, userID int64, email string) {
+	token, err := issueEmailToken(ctx, userID, emailTokenVerifyEmail, verifyEmailTokenTTL)
+	if err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return
+	}
+	err = mailer.Send(Mail{
+		To:      email,
+		Subject: "[ISUTRAIN] メールアドレスの確認",
+		Body: fmt.Sprintf(
+			"ISUTRAINへのご登録ありがとうございます。\n\n次のリンクからメールアドレスを確認してください (有効期限 %d時間)。\n%s\n",
+			int(verifyEmailTokenTTL.Hours()), emailLink("/verify", token),
+		),
+	})
+	if err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+	}
+}
+
+func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		メールアドレスの確認
+		POST /api/auth/verify
+	*/
+
+	req := EmailTokenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errorResponse(w, r, ErrInvalidRequest)
+		return
+	}
+	if verrs := validateStruct(req); len(verrs) > 0 {
+		validationErrorResponse(w, r, verrs)
+		return
+	}
+
+	tx, err := dbx.BeginTxx(r.Context(), nil)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	userID, err := consumeEmailToken(tx, req.Token, emailTokenVerifyEmail)
+	if err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if userID == 0 {
+		tx.Rollback()
+		errorResponse(w, r, ErrInvalidEmailToken)
+		return
+	}
+	_, err = tx.Exec("UPDATE `users` SET `email_verified_at` = ? WHERE `id` = ? AND `email_verified_at` IS NULL", time.Now(), userID)
+	if err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	messageResponse(w, "email verified")
+}
+
+func resendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		確認メールの再送
+		POST /api/auth/verify/resend
+	*/
+
+	user, errCode := getSessionUser(r)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
+		return
+	}
+	if user.EmailVerifiedAt != nil {
+		messageResponse(w, "already verified")
+		return
+	}
+
+	sendVerificationMail(r.Context(), user.ID, user.Email)
+	messageResponse(w, "verification mail sent")
+}
+
+func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		パスワード再設定メールの送信
+		POST /api/auth/password/forgot
+
+		登録の有無を推測されないよう、ユーザが存在しなくても同じレスポンスを返す
+	*/
+
+	req := ForgotPasswordRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errorResponse(w, r, ErrInvalidRequest)
+		return
+	}
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		validationErrorResponse(w, r, ValidationErrors{{"email", "email", ""}})
+		return
+	}
+
+	user, err := repo.UserByEmail(r.Context(), email)
+	if err != nil && err != sql.ErrNoRows {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if err == nil {
+		token, err := issueEmailToken(r.Context(), user.ID, emailTokenResetPassword, resetPasswordTokenTTL)
+		if err != nil {
+			loggerFromContext(r.Context()).Error(err.Error())
+			errorResponse(w, r, ErrDatabase)
+			return
+		}
+		err = mailer.Send(Mail{
+			To:      user.Email,
+			Subject: "[ISUTRAIN] パスワードの再設定",
+			Body: fmt.Sprintf(
+				"次のリンクからパスワードを再設定してください (有効期限 %d分)。\n%s\n\nお心当たりがない場合はこのメールを破棄してください。\n",
+				int(resetPasswordTokenTTL.Minutes()), emailLink("/password/reset", token),
+			),
+		})
+		if err != nil {
+			loggerFromContext(r.Context()).Error(err.Error())
+		}
+	}
+
+	messageResponse(w, "password reset mail sent if the address is registered")
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		パスワードの再設定
+		POST /api/auth/password/reset
+	*/
+
+	req := ResetPasswordRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errorResponse(w, r, ErrInvalidRequest)
+		return
+	}
+	if verrs := validateStruct(req); len(verrs) > 0 {
+		validationErrorResponse(w, r, verrs)
+		return
+	}
+
+	tx, err := dbx.BeginTxx(r.Context(), nil)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	userID, err := consumeEmailToken(tx, req.Token, emailTokenResetPassword)
+	if err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if userID == 0 {
+		tx.Rollback()
+		errorResponse(w, r, ErrInvalidEmailToken)
+		return
+	}
+
+	user := User{}
+	if err := tx.Get(&user, "SELECT * FROM `users` WHERE `id` = ? FOR UPDATE", userID); err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if verrs := passwordPolicy.Check(user.Email, req.Password); len(verrs) > 0 {
+		tx.Rollback()
+		validationErrorResponse(w, r, verrs)
+		return
+	}
+	hashed, err := hashPassword(req.Password)
+	if err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrInternal)
+		return
+	}
+
+	// メールのリンクを開けたのでメールアドレスも確認済みとする
+	_, err = tx.Exec(
+		"UPDATE `users` SET `salt` = ?, `super_secure_password` = ?, `email_verified_at` = IFNULL(`email_verified_at`, ?) WHERE `id` = ?",
+		[]byte{}, hashed, time.Now(), userID,
+	)
+	if err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	// 乗っ取られていた場合に備えて既存のセッションはすべて無効にする
+	if err := sessionStore.DeleteByUser(userID); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+	}
+	if err := loginThrottle.Success(user.Email); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+	}
+
+	messageResponse(w, "password reset")
+}
+
+// 設定からメールアドレス確認の設定を読み込む
+func configureAccountRecovery(cfg Config) {
+	appBaseURL = cfg.BaseURL
+	requireEmailVerification = cfg.Features.RequireEmailVerification
+}
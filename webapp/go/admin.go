@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+
+	"goji.io/pat"
+)
+
+/*
+	管理用API
+
+	X-Admin-Token ヘッダが設定 admin.token (ADMIN_TOKEN) と一致する場合のみ受け付ける
+	admin.token が未設定なら管理用APIはすべて無効
+*/
+
+const adminTokenHeader = "X-Admin-Token"
+
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return requireSharedToken(func() string { return appConfig.Admin.Token }, adminTokenHeader, ErrAdminForbidden, h)
+}
+
+// requireSharedToken はヘッダの値が expected() と一致する場合のみ h を呼ぶ
+// expected() が空なら常に拒否する
+func requireSharedToken(expected func() string, header string, code ErrorCode, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := expected()
+		given := r.Header.Get(header)
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(given)) != 1 {
+			errorResponse(w, r, code)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func adminRevokeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		指定ユーザのセッションをすべて失効させる
+		DELETE /api/admin/users/:user_id/sessions
+	*/
+
+	userID, err := strconv.ParseInt(pat.Param(r, "user_id"), 10, 64)
+	if err != nil || userID <= 0 {
+		errorResponse(w, r, ErrInvalidRequest)
+		return
+	}
+
+	if err := sessionStore.DeleteByUser(userID); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrSession)
+		return
+	}
+	messageResponse(w, "sessions revoked")
+}
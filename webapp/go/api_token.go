@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"goji.io/pat"
+)
+
+/*
+	パーソナルアクセストークン
+
+	スクリプトなどからセッションクッキーなしでAPIを使うためのトークン
+	Authorization: Bearer <token> で送られたものを getUser で受け付ける
+		read:reservations   予約の参照 (一覧・詳細・キャンセル料の見積もり・電子チケット・カレンダー) と GET /api/auth
+		write:reservations  予約・支払い・キャンセル
+	必要なスコープは各ハンドラが getUser に渡す
+	トークンそのものは発行時に一度だけ返し、DBには SHA-256 のハッシュだけを保存する
+	アカウントの管理に使うAPI (トークン・購読用URL・全端末ログアウト・ポイント・領収書など) は getSessionUser を使い、トークンでは呼び出せない
+*/
+
+const (
+	apiTokenPrefix = "isu_"
+
+	ScopeReadReservations  = "read:reservations"
+	ScopeWriteReservations = "write:reservations"
+)
+
+var APITokenScopeList = []string{ScopeReadReservations, ScopeWriteReservations}
+
+type APIToken struct {
+	ID         int64      `db:"id"`
+	UserID     int64      `db:"user_id"`
+	Name       string     `db:"name"`
+	TokenHash  string     `db:"token_hash"`
+	Prefix     string     `db:"prefix"`
+	Scopes     string     `db:"scopes"`
+	CreatedAt  time.Time  `db:"created_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+	ExpiresAt  *time.Time `db:"expires_at"`
+	RevokedAt  *time.Time `db:"revoked_at"`
+}
+
+type APITokenUsage struct {
+	ID       int64     `json:"-" db:"id"`
+	TokenID  int64     `json:"-" db:"token_id"`
+	UsedAt   time.Time `json:"used_at" db:"used_at"`
+	Method   string    `json:"method" db:"method"`
+	Path     string    `json:"path" db:"path"`
+	RemoteIP string    `json:"remote_ip" db:"remote_ip"`
+}
+
+type APITokenRequest struct {
+	Name          string   `json:"name" validate:"required,max=100"`
+	Scopes        []string `json:"scopes" validate:"required,api_token_scopes"`
+	ExpiresInDays int      `json:"expires_in_days" validate:"min=0,max=365"`
+}
+
+type APITokenResponse struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	// 発行時のみ
+	Token string `json:"token,omitempty"`
+}
+
+func (t APIToken) scopeList() []string {
+	return strings.Split(t.Scopes, " ")
+}
+
+func (t APIToken) response() APITokenResponse {
+	return APITokenResponse{
+		ID:         t.ID,
+		Name:       t.Name,
+		Prefix:     t.Prefix,
+		Scopes:     t.scopeList(),
+		CreatedAt:  t.CreatedAt,
+		LastUsedAt: t.LastUsedAt,
+		ExpiresAt:  t.ExpiresAt,
+		RevokedAt:  t.RevokedAt,
+	}
+}
+
+// hashSecretToken はトークンを保存・照合するためのハッシュ
+func hashSecretToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken は Authorization: Bearer ヘッダのトークンを返す
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[7:]), true
+}
+
+func getTokenUser(r *http.Request, token, scope string) (user User, errCode ErrorCode) {
+	apiToken, err := repo.APITokenByHash(r.Context(), hashSecretToken(token))
+	if err == sql.ErrNoRows {
+		return user, ErrInvalidAPIToken
+	}
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		return user, ErrDatabase
+	}
+
+	now := time.Now()
+	if apiToken.RevokedAt != nil || (apiToken.ExpiresAt != nil && !apiToken.ExpiresAt.After(now)) {
+		return user, ErrInvalidAPIToken
+	}
+	if !containsString(apiToken.scopeList(), scope) {
+		return user, ErrInsufficientScope
+	}
+
+	user, err = repo.User(r.Context(), apiToken.UserID)
+	if err == sql.ErrNoRows {
+		return user, ErrUserNotFound
+	}
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		return user, ErrDatabase
+	}
+
+	setLogField(r.Context(), "user_id", user.ID)
+	recordAPITokenUsage(apiToken, r, now)
+	return user, ""
+}
+
+// 監査用に利用履歴を残す (失敗してもリクエストは止めない)
+func recordAPITokenUsage(apiToken APIToken, r *http.Request, now time.Time) {
+	err := repo.RecordAPITokenUsage(r.Context(), APITokenUsage{
+		TokenID:  apiToken.ID,
+		UsedAt:   now,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		RemoteIP: clientIP(r),
+	})
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+	}
+}
+
+func createAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		トークン発行
+		POST /api/user/tokens
+	*/
+
+	user, errCode := getSessionUser(r)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
+		return
+	}
+
+	req := APITokenRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errorResponse(w, r, ErrInvalidRequest)
+		return
+	}
+	if verrs := validateStruct(req); len(verrs) > 0 {
+		validationErrorResponse(w, r, verrs)
+		return
+	}
+
+	token := apiTokenPrefix + secureRandomStr(20)
+	apiToken := APIToken{
+		UserID:    user.ID,
+		Name:      req.Name,
+		TokenHash: hashSecretToken(token),
+		Prefix:    token[:len(apiTokenPrefix)+8],
+		Scopes:    strings.Join(req.Scopes, " "),
+		CreatedAt: time.Now().Truncate(time.Second),
+	}
+	if req.ExpiresInDays > 0 {
+		expiresAt := apiToken.CreatedAt.AddDate(0, 0, req.ExpiresInDays)
+		apiToken.ExpiresAt = &expiresAt
+	}
+
+	if err := repo.CreateAPIToken(r.Context(), &apiToken); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	resp := apiToken.response()
+	resp.Token = token
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func listAPITokensHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		トークン一覧
+		GET /api/user/tokens
+	*/
+
+	user, errCode := getSessionUser(r)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
+		return
+	}
+
+	tokens, err := repo.ListUserAPITokens(r.Context(), user.ID)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	resp := []APITokenResponse{}
+	for _, t := range tokens {
+		resp = append(resp, t.response())
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// getOwnAPIToken は URL の :token_id のトークンを返す (他のユーザのものは見つからない扱い)
+func getOwnAPIToken(w http.ResponseWriter, r *http.Request) (APIToken, bool) {
+	apiToken := APIToken{}
+
+	user, errCode := getSessionUser(r)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
+		return apiToken, false
+	}
+	tokenID, err := strconv.ParseInt(pat.Param(r, "token_id"), 10, 64)
+	if err != nil || tokenID <= 0 {
+		errorResponse(w, r, ErrInvalidRequest)
+		return apiToken, false
+	}
+
+	apiToken, err = repo.UserAPIToken(r.Context(), tokenID, user.ID)
+	if err == sql.ErrNoRows {
+		errorResponse(w, r, ErrAPITokenNotFound)
+		return apiToken, false
+	}
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return apiToken, false
+	}
+	return apiToken, true
+}
+
+func revokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		トークン失効
+		DELETE /api/user/tokens/:token_id
+	*/
+
+	apiToken, ok := getOwnAPIToken(w, r)
+	if !ok {
+		return
+	}
+
+	if err := repo.RevokeAPIToken(r.Context(), apiToken.ID, time.Now()); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	messageResponse(w, "token revoked")
+}
+
+func apiTokenUsagesHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		トークンの利用履歴 (新しい順に100件)
+		GET /api/user/tokens/:token_id/usages
+	*/
+
+	apiToken, ok := getOwnAPIToken(w, r)
+	if !ok {
+		return
+	}
+
+	usages, err := repo.ListAPITokenUsages(r.Context(), apiToken.ID, 100)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(usages)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		token  string
+		ok     bool
+	}{
+		{"Bearer isu_abc", "isu_abc", true},
+		{"bearer isu_abc", "isu_abc", true},
+		{"Basic dXNlcjpwYXNz", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/user/reservations", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		token, ok := bearerToken(r)
+		if token != tt.token || ok != tt.ok {
+			t.Errorf("%q: got (%q, %v), want (%q, %v)", tt.header, token, ok, tt.token, tt.ok)
+		}
+	}
+}
+
+func TestValidateAPITokenRequest(t *testing.T) {
+	req := APITokenRequest{Name: "script", Scopes: []string{ScopeReadReservations, "admin"}}
+	errs := validateStruct(req)
+	if len(errs) != 1 || errs[0].Field != "scopes" || errs[0].Rule != "api_token_scopes" {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	req.Scopes = []string{ScopeReadReservations}
+	if errs := validateStruct(req); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
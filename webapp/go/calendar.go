@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	予約のiCalendarフィード
+
+	GET /api/user/reservations.ics はセッション (またはトークン) でログインしていれば使えるが、
+	カレンダーアプリからはクッキーを送れないので、購読用URLのトークン (?token=) でも受け付ける
+	購読用トークンはユーザごとに1つで、発行し直すと古いURLは使えなくなる
+*/
+
+const calendarTimezone = serviceTimezone
+
+type CalendarTokenResponse struct {
+	URL string `json:"url"`
+}
+
+// icsEscape は TEXT 型の値をエスケープする (RFC 5545 3.3.11)
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// icsLine は75オクテットを超える行を折り返して書く (RFC 5545 3.1)
+// UTF-8 の文字の途中では折り返さない
+func icsLine(buf *bytes.Buffer, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !isUTF8Boundary(line, cut) {
+			cut--
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		// 継続行は先頭の空白も数える
+		limit = 74
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+func isUTF8Boundary(s string, i int) bool {
+	return i >= len(s) || s[i]&0xC0 != 0x80
+}
+
+// reservationTimes は予約日と時刻表の "15:04:05" から発着日時を求める (日付をまたぐ場合は到着を翌日にする)
+func reservationTimes(date time.Time, departureTime, arrivalTime string) (time.Time, time.Time, error) {
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, jst)
+	parse := func(s string) (time.Time, error) {
+		t, err := time.Parse("15:04:05", s)
+		if err != nil {
+			return t, err
+		}
+		return day.Add(time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second), nil
+	}
+
+	departure, err := parse(departureTime)
+	if err != nil {
+		return departure, departure, err
+	}
+	arrival, err := parse(arrivalTime)
+	if err != nil {
+		return departure, arrival, err
+	}
+	if arrival.Before(departure) {
+		arrival = arrival.AddDate(0, 0, 1)
+	}
+	return departure, arrival, nil
+}
+
+type calendarEvent struct {
+	Reservation Reservation
+	Response    ReservationResponse
+}
+
+func renderCalendar(events []calendarEvent, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, line := range []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//ISUTRAIN//Reservations//JA",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:ISUTRAIN 予約",
+		"X-WR-TIMEZONE:" + calendarTimezone,
+		"BEGIN:VTIMEZONE",
+		"TZID:" + calendarTimezone,
+		"BEGIN:STANDARD",
+		"DTSTART:19700101T000000",
+		"TZOFFSETFROM:+0900",
+		"TZOFFSETTO:+0900",
+		"TZNAME:JST",
+		"END:STANDARD",
+		"END:VTIMEZONE",
+	} {
+		icsLine(&buf, line)
+	}
+
+	for _, e := range events {
+		reservation, resp := e.Reservation, e.Response
+		departure, arrival, err := reservationTimes(*reservation.Date, resp.DepartureTime, resp.ArrivalTime)
+		if err != nil {
+			return nil, err
+		}
+
+		// place は号車と座席 (自由席なら座席クラスだけ)
+		seats := SeatClassLabels[resp.SeatClass]
+		place := seats
+		if resp.CarNumber != 0 {
+			list := []string{}
+			for _, seat := range resp.Seats {
+				list = append(list, fmt.Sprintf("%d%s", seat.SeatRow, seat.SeatColumn))
+			}
+			place = fmt.Sprintf("%d号車 %s", resp.CarNumber, strings.Join(list, ", "))
+			seats += " " + place
+		}
+		section := reservation.Departure + " → " + reservation.Arrival
+		description := fmt.Sprintf("予約番号: %d\n区間: %s\n座席: %s\n人数: %s\n金額: %s",
+			reservation.ReservationId, section, seats, reservation.passengerCounts().Label(), formatYen(reservation.Amount))
+
+		for _, line := range []string{
+			"BEGIN:VEVENT",
+			fmt.Sprintf("UID:reservation-%d@isutrain", reservation.ReservationId),
+			"DTSTAMP:" + now.UTC().Format("20060102T150405Z"),
+			fmt.Sprintf("DTSTART;TZID=%s:%s", calendarTimezone, departure.Format("20060102T150405")),
+			fmt.Sprintf("DTEND;TZID=%s:%s", calendarTimezone, arrival.Format("20060102T150405")),
+			"SUMMARY:" + icsEscape(fmt.Sprintf("%s %s号 %s→%s", TrainClassMap[reservation.TrainClass], reservation.TrainName, reservation.Departure, reservation.Arrival)),
+			"LOCATION:" + icsEscape(section+" "+place),
+			"DESCRIPTION:" + icsEscape(description),
+			"STATUS:CONFIRMED",
+			"END:VEVENT",
+		} {
+			icsLine(&buf, line)
+		}
+	}
+
+	icsLine(&buf, "END:VCALENDAR")
+	return buf.Bytes(), nil
+}
+
+// getCalendarUser は購読用トークン、なければセッション (またはBearerトークン) からユーザを返す
+func getCalendarUser(r *http.Request) (user User, errCode ErrorCode) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return getUser(r, ScopeReadReservations)
+	}
+
+	user, err := repo.CalendarTokenUser(r.Context(), hashSecretToken(token))
+	if err == sql.ErrNoRows {
+		return user, ErrInvalidCalendarToken
+	}
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		return user, ErrDatabase
+	}
+	return user, ""
+}
+
+func userReservationsCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		予約一覧 (iCalendar)
+		GET /api/user/reservations.ics
+	*/
+	user, errCode := getCalendarUser(r)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
+		return
+	}
+
+	reservations, err := repo.ListUserReservations(r.Context(), user.ID)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	// 支払い済みの予約を乗車日の順に (仮予約は乗車が確定していないので出さない)
+	reservationList := []Reservation{}
+	for _, reservation := range reservations {
+		if reservation.Status == "done" {
+			reservationList = append(reservationList, reservation)
+		}
+	}
+	sort.SliceStable(reservationList, func(i, j int) bool {
+		return reservationList[i].Date.Before(*reservationList[j].Date)
+	})
+
+	events := []calendarEvent{}
+	for _, reservation := range reservationList {
+		resp, err := makeReservationResponse(r.Context(), reservation)
+		if err != nil {
+			loggerFromContext(r.Context()).Error(err.Error())
+			errorResponse(w, r, ErrDatabase)
+			return
+		}
+		events = append(events, calendarEvent{reservation, resp})
+	}
+
+	ics, err := renderCalendar(events, clock.Now())
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrInternal)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar;charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="isutrain.ics"`)
+	w.Write(ics)
+}
+
+func calendarFeedURL(r *http.Request, token string) string {
+	scheme := "http"
+	if r.TLS != nil || (trustProxyHeaders && r.Header.Get("X-Forwarded-Proto") == "https") {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/api/user/reservations.ics?token=%s", scheme, r.Host, url.QueryEscape(token))
+}
+
+func createCalendarTokenHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		購読用URLの発行 (発行し直すと古いURLは無効になる)
+		POST /api/user/calendar/token
+	*/
+	user, errCode := getSessionUser(r)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
+		return
+	}
+
+	token := secureRandomStr(32)
+	if err := repo.PutCalendarToken(r.Context(), user.ID, hashSecretToken(token), time.Now()); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(CalendarTokenResponse{calendarFeedURL(r, token)})
+}
+
+func deleteCalendarTokenHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		購読用URLの無効化
+		DELETE /api/user/calendar/token
+	*/
+	user, errCode := getSessionUser(r)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
+		return
+	}
+
+	if err := repo.DeleteCalendarToken(r.Context(), user.ID); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	messageResponse(w, "calendar token deleted")
+}
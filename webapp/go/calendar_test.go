@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIcsLineFolding(t *testing.T) {
+	var buf bytes.Buffer
+	line := "DESCRIPTION:" + strings.Repeat("予約", 30)
+	icsLine(&buf, line)
+
+	folded := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+	if len(folded) < 2 {
+		t.Fatalf("line was not folded: %q", buf.String())
+	}
+	unfolded := folded[0]
+	for _, l := range folded[1:] {
+		if !strings.HasPrefix(l, " ") {
+			t.Fatalf("continuation line does not start with a space: %q", l)
+		}
+		unfolded += l[1:]
+	}
+	for _, l := range folded {
+		if len(l) > 75 {
+			t.Errorf("line is longer than 75 octets: %d", len(l))
+		}
+	}
+	if unfolded != line {
+		t.Errorf("unfolded line = %q, want %q", unfolded, line)
+	}
+}
+
+func TestReservationTimes(t *testing.T) {
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	departure, arrival, err := reservationTimes(date, "23:30:00", "01:15:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := departure.Format("20060102T150405-0700"); got != "20200101T233000+0900" {
+		t.Errorf("departure = %s", got)
+	}
+	if got := arrival.Format("20060102T150405"); got != "20200102T011500" {
+		t.Errorf("arrival = %s, want next day", got)
+	}
+}
+
+func TestRenderCalendar(t *testing.T) {
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []calendarEvent{{
+		Reservation: Reservation{ReservationId: 7, Date: &date, TrainClass: "express", TrainName: "12", Departure: "東京", Arrival: "大阪", Status: "done", Adult: 1, Amount: 10000},
+		Response:    ReservationResponse{DepartureTime: "06:00:00", ArrivalTime: "08:30:00", CarNumber: 2, SeatClass: "reserved", Seats: []SeatReservation{{SeatRow: 3, SeatColumn: "A"}}},
+	}}
+	ics, err := renderCalendar(events, time.Date(2019, 12, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 折り返した行をつなげて調べる
+	s := strings.Replace(string(ics), "\r\n ", "", -1)
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"UID:reservation-7@isutrain\r\n",
+		"DTSTART;TZID=Asia/Tokyo:20200101T060000\r\n",
+		"DTEND;TZID=Asia/Tokyo:20200101T083000\r\n",
+		"STATUS:CONFIRMED\r\n",
+		"LOCATION:東京 → 大阪 2号車 3A\r\n",
+		`区間: 東京 → 大阪\n座席: 指定席 2号車 3A`,
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("calendar does not contain %q:\n%s", want, s)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+	現在時刻とタイムトラベル
+
+	予約受付期間・販売締め切り・列車検索・プロモーションの有効期間・ポイントの有効期限・払い戻し・改札など
+	運行や予約に関わる「今」は time.Now() ではなく clock.Now() で求める
+	セッション・アクセストークン・ログイン試行回数・メールのリンクなど認証まわりは実際の時刻 (time.Now()) のまま
+	日付はすべて日本時間 (jst) で扱う
+
+	features.time_travel (環境変数 TIME_TRAVEL=1) で起動すると、管理用APIで現在時刻を設定・早送りできる (検証環境向け)
+		設定した時刻からは実際の時間の経過に合わせて進む (frozen なら止まったまま)
+		clock.now (CLOCK_NOW、RFC3339) を指定すると、その時刻から起動する
+*/
+
+const serviceTimezone = "Asia/Tokyo"
+
+// jst はサービスのタイムゾーン (tzdata がなくても動くよう固定オフセットで代用する)
+var jst = func() *time.Location {
+	loc, err := time.LoadLocation(serviceTimezone)
+	if err != nil {
+		return time.FixedZone("JST", 9*60*60)
+	}
+	return loc
+}()
+
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now().In(jst)
+}
+
+var clock Clock = systemClock{}
+
+// travelClock は管理用APIで動かせる時計。設定されるまでは実際の時刻を返す
+type travelClock struct {
+	mu sync.Mutex
+	// base を設定した実際の時刻 (ゼロ値なら未設定)
+	setAt  time.Time
+	base   time.Time
+	frozen bool
+	// 実際の時刻の代わり (テスト用)
+	real func() time.Time
+}
+
+var timeTravel = &travelClock{real: time.Now}
+
+func (c *travelClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now()
+}
+
+func (c *travelClock) now() time.Time {
+	real := c.real()
+	switch {
+	case c.setAt.IsZero():
+		return real.In(jst)
+	case c.frozen:
+		return c.base.In(jst)
+	}
+	return c.base.Add(real.Sub(c.setAt)).In(jst)
+}
+
+func (c *travelClock) Set(t time.Time, frozen bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setAt, c.base, c.frozen = c.real(), t, frozen
+}
+
+// Advance は現在時刻を d だけ進める (未設定なら実際の時刻から進める)
+func (c *travelClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setAt, c.base = c.real(), c.now().Add(d)
+}
+
+// Reset は実際の時刻に戻す
+func (c *travelClock) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setAt, c.base, c.frozen = time.Time{}, time.Time{}, false
+}
+
+type ClockResponse struct {
+	Now       time.Time `json:"now"`
+	Simulated bool      `json:"simulated"`
+	Frozen    bool      `json:"frozen"`
+}
+
+type SetClockRequest struct {
+	Now    string `json:"now" validate:"required,rfc3339"`
+	Frozen bool   `json:"frozen"`
+}
+
+type AdvanceClockRequest struct {
+	// Go の time.ParseDuration の形式 ("72h", "90m" など)
+	Duration string `json:"duration" validate:"required,duration"`
+}
+
+func (c *travelClock) response() ClockResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ClockResponse{Now: c.now(), Simulated: !c.setAt.IsZero(), Frozen: c.frozen}
+}
+
+func writeClock(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(timeTravel.response())
+}
+
+func adminGetClockHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		現在時刻
+		GET /api/admin/clock
+	*/
+	writeClock(w)
+}
+
+func adminSetClockHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		現在時刻の設定
+		PUT /api/admin/clock
+	*/
+	req := SetClockRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errorResponse(w, r, ErrInvalidRequest)
+		return
+	}
+	if verrs := validateStruct(req); len(verrs) > 0 {
+		validationErrorResponse(w, r, verrs)
+		return
+	}
+
+	now, _ := time.Parse(time.RFC3339, req.Now)
+	timeTravel.Set(now, req.Frozen)
+	writeClock(w)
+}
+
+func adminAdvanceClockHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		現在時刻を進める
+		POST /api/admin/clock/advance
+	*/
+	req := AdvanceClockRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errorResponse(w, r, ErrInvalidRequest)
+		return
+	}
+	if verrs := validateStruct(req); len(verrs) > 0 {
+		validationErrorResponse(w, r, verrs)
+		return
+	}
+
+	d, _ := time.ParseDuration(req.Duration)
+	timeTravel.Advance(d)
+	writeClock(w)
+}
+
+func adminResetClockHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		実際の時刻に戻す
+		DELETE /api/admin/clock
+	*/
+	timeTravel.Reset()
+	writeClock(w)
+}
+
+// 設定から時計を設定する (clock.now は time_travel が有効な場合だけ指定できることを loadConfig で検証済み)
+func configureClock(timeTravelEnabled bool, cfg ClockConfig) error {
+	if !timeTravelEnabled {
+		return nil
+	}
+	if cfg.Now != "" {
+		now, err := time.Parse(time.RFC3339, cfg.Now)
+		if err != nil {
+			return err
+		}
+		timeTravel.Set(now, false)
+	}
+	clock = timeTravel
+	return nil
+}
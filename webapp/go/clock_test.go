@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestTravelClock(t *testing.T) {
+	real := time.Date(2026, 10, 18, 12, 0, 0, 0, jst)
+	c := &travelClock{real: func() time.Time { return real }}
+
+	if got := c.Now(); !got.Equal(real) {
+		t.Fatalf("unset clock = %s, want real time %s", got, real)
+	}
+
+	gw := time.Date(2020, 5, 2, 6, 0, 0, 0, jst)
+	c.Set(gw, false)
+	real = real.Add(90 * time.Minute)
+	if got, want := c.Now(), gw.Add(90*time.Minute); !got.Equal(want) {
+		t.Errorf("running clock = %s, want %s", got, want)
+	}
+
+	c.Advance(24 * time.Hour)
+	if got, want := c.Now(), gw.Add(24*time.Hour+90*time.Minute); !got.Equal(want) {
+		t.Errorf("advanced clock = %s, want %s", got, want)
+	}
+
+	c.Set(gw, true)
+	real = real.Add(time.Hour)
+	if got := c.Now(); !got.Equal(gw) {
+		t.Errorf("frozen clock = %s, want %s", got, gw)
+	}
+	c.Advance(-time.Hour)
+	if got, want := c.Now(), gw.Add(-time.Hour); !got.Equal(want) {
+		t.Errorf("frozen clock rewound = %s, want %s", got, want)
+	}
+
+	c.Reset()
+	if got := c.Now(); !got.Equal(real) {
+		t.Errorf("reset clock = %s, want real time %s", got, real)
+	}
+	if got := c.Now().Location(); got != jst {
+		t.Errorf("location = %s, want %s", got, jst)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+/*
+	アプリケーションの設定
+
+	CONFIG_FILE に指定した YAML を defaultConfig に重ね、さらに env タグの環境変数で上書きする
+	起動時に検証し、不正な値があれば起動しない
+	GET /api/admin/config はパスワードとシークレット (トークン・署名鍵を含む) を伏せて現在の設定を返す
+	旅客区分・ポイント・払い戻し・予約受付期間などの業務ルールは個別の JSON ファイルに書き、そのパスをこの設定で指定する
+*/
+
+type Config struct {
+	Listen string `json:"listen" yaml:"listen" env:"LISTEN_ADDR" validate:"required"`
+	// メールに書くリンク (メールアドレスの確認・パスワードの再設定) の起点
+	BaseURL string `json:"base_url" yaml:"base_url" env:"APP_BASE_URL" validate:"required,http_url"`
+	// 終了時に /readyz を 503 にしてから接続の受け付けをやめるまでの時間と、処理中のリクエストを待つ上限
+	ShutdownDelay   Duration      `json:"shutdown_delay" yaml:"shutdown_delay" env:"SHUTDOWN_DELAY" validate:"min=0"`
+	ShutdownTimeout Duration      `json:"shutdown_timeout" yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" validate:"min=1"`
+	DB              DBConfig      `json:"db" yaml:"db"`
+	Payment         PaymentConfig `json:"payment" yaml:"payment"`
+	Session         SessionConfig `json:"session" yaml:"session"`
+	Features        FeatureFlags  `json:"features" yaml:"features"`
+	Tracing         TracingConfig `json:"tracing" yaml:"tracing"`
+	Log             LogConfig     `json:"log" yaml:"log"`
+
+	Password      PasswordConfig      `json:"password" yaml:"password"`
+	LoginThrottle LoginThrottleConfig `json:"login_throttle" yaml:"login_throttle"`
+	CSRF          CSRFConfig          `json:"csrf" yaml:"csrf"`
+	Admin         AdminConfig         `json:"admin" yaml:"admin"`
+	Mail          MailConfig          `json:"mail" yaml:"mail"`
+	Ticket        TicketConfig        `json:"ticket" yaml:"ticket"`
+	Clock         ClockConfig         `json:"clock" yaml:"clock"`
+
+	Refund            RefundConfig            `json:"refund" yaml:"refund"`
+	Passenger         PassengerConfig         `json:"passenger" yaml:"passenger"`
+	Loyalty           LoyaltyConfig           `json:"loyalty" yaml:"loyalty"`
+	ReservationWindow ReservationWindowConfig `json:"reservation_window" yaml:"reservation_window"`
+}
+
+type DBConfig struct {
+	Host     string `json:"host" yaml:"host" env:"MYSQL_HOSTNAME" validate:"required"`
+	Port     int    `json:"port" yaml:"port" env:"MYSQL_PORT" validate:"min=1,max=65535"`
+	User     string `json:"user" yaml:"user" env:"MYSQL_USER" validate:"required"`
+	Password string `json:"password" yaml:"password" env:"MYSQL_PASSWORD"`
+	Name     string `json:"name" yaml:"name" env:"MYSQL_DATABASE" validate:"required"`
+	// 0 は無制限 (database/sql の既定)
+	MaxOpenConns    int      `json:"max_open_conns" yaml:"max_open_conns" env:"DB_MAX_OPEN_CONNS" validate:"min=0"`
+	MaxIdleConns    int      `json:"max_idle_conns" yaml:"max_idle_conns" env:"DB_MAX_IDLE_CONNS" validate:"min=0"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime" yaml:"conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME" validate:"min=0"`
+}
+
+type PaymentConfig struct {
+	// webapp から決済APIを呼ぶときのURL
+	URL string `json:"url" yaml:"url" env:"PAYMENT_API" validate:"required,http_url"`
+	// ブラウザに教える決済APIのURL (GET /api/settings)。PAYMENT_API を設定すればこちらも同じになる
+	PublicURL string `json:"public_url" yaml:"public_url" env:"PAYMENT_API,PAYMENT_PUBLIC_URL" validate:"required,http_url"`
+}
+
+type SessionConfig struct {
+	Store string `json:"store" yaml:"store" env:"SESSION_STORE" validate:"oneof=mysql memory"`
+	// 空なら起動ごとに生成する (再起動でセッションが無効になる)
+	Secret          string   `json:"secret" yaml:"secret" env:"SESSION_SECRET" validate:"min=16"`
+	IdleTimeout     Duration `json:"idle_timeout" yaml:"idle_timeout" env:"SESSION_IDLE_TIMEOUT" validate:"min=1"`
+	AbsoluteTimeout Duration `json:"absolute_timeout" yaml:"absolute_timeout" env:"SESSION_ABSOLUTE_TIMEOUT" validate:"min=1"`
+	CookieSameSite  string   `json:"cookie_samesite" yaml:"cookie_samesite" env:"SESSION_COOKIE_SAMESITE" validate:"oneof=lax strict"`
+}
+
+type FeatureFlags struct {
+	RequireEmailVerification bool `json:"require_email_verification" yaml:"require_email_verification" env:"REQUIRE_EMAIL_VERIFICATION"`
+	// X-Forwarded-For / X-Forwarded-Proto を信用する (リバースプロキシの内側で動かす場合)
+	TrustProxyHeaders bool `json:"trust_proxy_headers" yaml:"trust_proxy_headers" env:"TRUST_PROXY_HEADERS"`
+	// 管理用APIで現在時刻を変更できるようにする (検証環境のみ)
+	TimeTravel bool `json:"time_travel" yaml:"time_travel" env:"TIME_TRAVEL"`
+}
+
+type TracingConfig struct {
+	// none (記録しない)・file・otlp
+	Exporter string `json:"exporter" yaml:"exporter" env:"TRACING_EXPORTER" validate:"oneof=none file otlp"`
+	// exporter が file のときに OTLP/JSON を追記するファイル
+	File string `json:"file" yaml:"file" env:"TRACING_FILE"`
+	// exporter が otlp のときの OTLP/HTTP のエンドポイント (/v1/traces に送る)
+	Endpoint    string `json:"endpoint" yaml:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	ServiceName string `json:"service_name" yaml:"service_name" env:"OTEL_SERVICE_NAME" validate:"required"`
+}
+
+type LogConfig struct {
+	// これより低いレベルのログは書かない。debug にすると検索・予約の途中経過も出る
+	Level string `json:"level" yaml:"level" env:"LOG_LEVEL" validate:"oneof=debug info warn error"`
+}
+
+type PasswordConfig struct {
+	// 新規ハッシュと再ハッシュに使うアルゴリズム
+	Hasher    string `json:"hasher" yaml:"hasher" env:"PASSWORD_HASHER" validate:"oneof=argon2id 2a 2b 2y pbkdf2-sha256"`
+	MinLength int    `json:"min_length" yaml:"min_length" env:"PASSWORD_MIN_LENGTH" validate:"min=1"`
+	// 0 は無制限
+	MaxLength int `json:"max_length" yaml:"max_length" env:"PASSWORD_MAX_LENGTH" validate:"min=0"`
+	// 漏洩パスワードのリスト (1行1パスワード)
+	DenylistFile string `json:"denylist_file" yaml:"denylist_file" env:"PASSWORD_DENYLIST_FILE"`
+}
+
+type LoginThrottleConfig struct {
+	// 失敗回数の保存先。memory はプロセス内に保持する
+	Store              string   `json:"store" yaml:"store" env:"LOGIN_THROTTLE_STORE" validate:"oneof=memory mysql"`
+	Window             Duration `json:"window" yaml:"window" env:"LOGIN_THROTTLE_WINDOW" validate:"min=1"`
+	MaxAccountFailures int      `json:"max_account_failures" yaml:"max_account_failures" env:"LOGIN_MAX_ACCOUNT_FAILURES" validate:"min=1"`
+	MaxIPFailures      int      `json:"max_ip_failures" yaml:"max_ip_failures" env:"LOGIN_MAX_IP_FAILURES" validate:"min=1"`
+	Lockout            Duration `json:"lockout" yaml:"lockout" env:"LOGIN_LOCKOUT" validate:"min=0"`
+	BaseDelay          Duration `json:"base_delay" yaml:"base_delay" env:"LOGIN_BASE_DELAY" validate:"min=0"`
+	MaxDelay           Duration `json:"max_delay" yaml:"max_delay" env:"LOGIN_MAX_DELAY" validate:"min=0"`
+}
+
+type CSRFConfig struct {
+	// CSRF 対策の対象外とする機械クライアントの User-Agent (前方一致)。環境変数ではカンマ区切りで書く
+	ExemptUserAgents []string `json:"exempt_user_agents" yaml:"exempt_user_agents" env:"CSRF_EXEMPT_USER_AGENTS"`
+}
+
+type AdminConfig struct {
+	// 管理用APIの X-Admin-Token。空なら管理用APIはすべて無効
+	Token string `json:"token" yaml:"token" env:"ADMIN_TOKEN" validate:"min=16"`
+}
+
+type MailConfig struct {
+	// log (宛先と件名だけをログに出す)・file・smtp
+	Mailer string `json:"mailer" yaml:"mailer" env:"MAILER" validate:"oneof=log file smtp"`
+	// mailer が file のときに .eml を書き出すディレクトリ
+	Dir  string `json:"dir" yaml:"dir" env:"MAIL_DIR" validate:"required"`
+	From string `json:"from" yaml:"from" env:"SMTP_FROM" validate:"required"`
+	// mailer が smtp のときのサーバ (host:port)。ユーザ名があれば PLAIN 認証する
+	SMTPAddr     string `json:"smtp_addr" yaml:"smtp_addr" env:"SMTP_ADDR"`
+	SMTPUsername string `json:"smtp_username" yaml:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword string `json:"smtp_password" yaml:"smtp_password" env:"SMTP_PASSWORD"`
+}
+
+type TicketConfig struct {
+	// 電子チケットの署名鍵。空なら起動ごとに生成する (再起動前のチケットは使えなくなる)
+	SigningKey string `json:"signing_key" yaml:"signing_key" env:"TICKET_SIGNING_KEY" validate:"min=16"`
+	// 改札用APIの X-Gate-Token。空なら改札用APIはすべて無効
+	GateToken string `json:"gate_token" yaml:"gate_token" env:"GATE_TOKEN" validate:"min=16"`
+}
+
+type ClockConfig struct {
+	// 起動時の現在時刻 (RFC3339)。features.time_travel が有効な場合のみ指定できる
+	Now string `json:"now" yaml:"now" env:"CLOCK_NOW" validate:"rfc3339"`
+}
+
+type RefundConfig struct {
+	// 払い戻し規定の JSON ファイル。空なら既定の規定を使う
+	PolicyFile string `json:"policy_file" yaml:"policy_file" env:"REFUND_POLICY_FILE"`
+}
+
+type PassengerConfig struct {
+	// 旅客区分の JSON ファイル。空なら既定の区分を使う
+	CategoriesFile string `json:"categories_file" yaml:"categories_file" env:"PASSENGER_CATEGORIES_FILE"`
+}
+
+type LoyaltyConfig struct {
+	// ポイントの付与規定の JSON ファイル。空なら既定の規定を使う
+	PolicyFile string `json:"policy_file" yaml:"policy_file" env:"LOYALTY_POLICY_FILE"`
+}
+
+type ReservationWindowConfig struct {
+	// 予約受付期間の JSON ファイル。空なら既定の期間を使う (管理用APIでDBに保存した設定が優先する)
+	File string `json:"file" yaml:"file" env:"RESERVATION_WINDOW_FILE"`
+}
+
+// Duration は YAML・環境変数・JSON で "30m" のように書ける time.Duration
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func defaultConfig() Config {
+	return Config{
+		Listen:          ":8000",
+		BaseURL:         "http://localhost:8080",
+		ShutdownTimeout: Duration(30 * time.Second),
+		DB: DBConfig{
+			Host:         "127.0.0.1",
+			Port:         3306,
+			User:         "isutrain",
+			Password:     "isutrain",
+			Name:         "isutrain",
+			MaxIdleConns: 2,
+		},
+		// webapp からは compose のサービス名、ブラウザからは localhost で届く
+		Payment: PaymentConfig{
+			URL:       "http://payment:5000",
+			PublicURL: "http://localhost:5000",
+		},
+		Session: SessionConfig{
+			Store:           "mysql",
+			IdleTimeout:     Duration(defaultSessionIdleTimeout),
+			AbsoluteTimeout: Duration(defaultSessionAbsoluteTimeout),
+			CookieSameSite:  "lax",
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			ServiceName: "isutrain-webapp",
+		},
+		Log: LogConfig{
+			Level: "info",
+		},
+		// ベンチマーカーの登録に使うパスワードは4文字
+		Password: PasswordConfig{
+			Hasher:    "argon2id",
+			MinLength: 4,
+			MaxLength: 128,
+		},
+		LoginThrottle: LoginThrottleConfig{
+			Store:              "memory",
+			Window:             Duration(15 * time.Minute),
+			MaxAccountFailures: 10,
+			MaxIPFailures:      100,
+			Lockout:            Duration(15 * time.Minute),
+			BaseDelay:          Duration(time.Second),
+			MaxDelay:           Duration(30 * time.Second),
+		},
+		CSRF: CSRFConfig{
+			ExemptUserAgents: []string{"isutrain-benchmaker/"},
+		},
+		Mail: MailConfig{
+			Mailer: "log",
+			Dir:    "mail",
+			From:   "ISUTRAIN <noreply@isutrain.example.com>",
+		},
+	}
+}
+
+var appConfig = defaultConfig()
+
+func (c Config) Validate() ValidationErrors {
+	errs := ValidationErrors{}
+	validateValue(reflect.ValueOf(c.DB), "db.", &errs)
+	validateValue(reflect.ValueOf(c.Payment), "payment.", &errs)
+	validateValue(reflect.ValueOf(c.Session), "session.", &errs)
+	validateValue(reflect.ValueOf(c.Tracing), "tracing.", &errs)
+	validateValue(reflect.ValueOf(c.Log), "log.", &errs)
+	validateValue(reflect.ValueOf(c.Password), "password.", &errs)
+	validateValue(reflect.ValueOf(c.LoginThrottle), "login_throttle.", &errs)
+	validateValue(reflect.ValueOf(c.Admin), "admin.", &errs)
+	validateValue(reflect.ValueOf(c.Mail), "mail.", &errs)
+	validateValue(reflect.ValueOf(c.Ticket), "ticket.", &errs)
+	validateValue(reflect.ValueOf(c.Clock), "clock.", &errs)
+	if c.DB.MaxOpenConns > 0 && c.DB.MaxIdleConns > c.DB.MaxOpenConns {
+		errs = append(errs, FieldError{"db.max_idle_conns", "max", strconv.Itoa(c.DB.MaxOpenConns)})
+	}
+	if c.Password.MaxLength > 0 && c.Password.MaxLength < c.Password.MinLength {
+		errs = append(errs, FieldError{"password.max_length", "min", strconv.Itoa(c.Password.MinLength)})
+	}
+	if c.LoginThrottle.MaxDelay < c.LoginThrottle.BaseDelay {
+		errs = append(errs, FieldError{"login_throttle.max_delay", "min", time.Duration(c.LoginThrottle.BaseDelay).String()})
+	}
+	switch {
+	case c.Tracing.Exporter == "file" && c.Tracing.File == "":
+		errs = append(errs, FieldError{"tracing.file", "required", ""})
+	case c.Tracing.Exporter == "otlp" && !isHTTPURL(c.Tracing.Endpoint):
+		errs = append(errs, FieldError{"tracing.endpoint", "http_url", ""})
+	}
+	if c.Mail.Mailer == "smtp" && c.Mail.SMTPAddr == "" {
+		errs = append(errs, FieldError{"mail.smtp_addr", "required", ""})
+	}
+	// 時刻を指定できるのはタイムトラベルを有効にした場合だけ
+	if c.Clock.Now != "" && !c.Features.TimeTravel {
+		errs = append(errs, FieldError{"features.time_travel", "required", ""})
+	}
+	return errs
+}
+
+// DSN は go-sql-driver/mysql の接続文字列
+func (c DBConfig) DSN() string {
+	return fmt.Sprintf(
+		"%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=true&loc=Local",
+		c.User,
+		c.Password,
+		c.Host,
+		c.Port,
+		c.Name,
+	)
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// redacted はパスワードとシークレットを伏せた設定
+func (c Config) redacted() Config {
+	const mask = "********"
+	for _, secret := range []*string{
+		&c.DB.Password,
+		&c.Session.Secret,
+		&c.Admin.Token,
+		&c.Mail.SMTPPassword,
+		&c.Ticket.SigningKey,
+		&c.Ticket.GateToken,
+	} {
+		if *secret != "" {
+			*secret = mask
+		}
+	}
+	return c
+}
+
+// loadConfig は path の YAML (空なら読まない) と環境変数から設定を読み込んで検証する
+func loadConfig(path string, getenv func(string) string) (Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+			return cfg, fmt.Errorf("%s: %s", path, err.Error())
+		}
+	}
+	if err := applyEnvOverrides(reflect.ValueOf(&cfg).Elem(), getenv); err != nil {
+		return cfg, err
+	}
+	cfg.Session.CookieSameSite = strings.ToLower(cfg.Session.CookieSameSite)
+	if verrs := validateStruct(cfg); len(verrs) > 0 {
+		return cfg, verrs
+	}
+	return cfg, nil
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// applyEnvOverrides は env タグの環境変数が空でなければその値で上書きする
+func applyEnvOverrides(v reflect.Value, getenv func(string) string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f, field := t.Field(i), v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnvOverrides(field, getenv); err != nil {
+				return err
+			}
+			continue
+		}
+		// 複数の環境変数を指定した場合は後のものを優先する
+		name, s := "", ""
+		for _, n := range strings.Split(f.Tag.Get("env"), ",") {
+			if v := getenv(n); v != "" {
+				name, s = n, v
+			}
+		}
+		if s == "" {
+			continue
+		}
+
+		switch {
+		case f.Type == durationType:
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err.Error())
+			}
+			field.SetInt(int64(d))
+		case field.Kind() == reflect.String:
+			field.SetString(s)
+		case field.Kind() == reflect.Int:
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err.Error())
+			}
+			field.SetInt(int64(n))
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+			list := []string{}
+			for _, item := range strings.Split(s, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+		case field.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err.Error())
+			}
+			field.SetBool(b)
+		default:
+			panic(fmt.Sprintf("config: unsupported env field %s", f.Name))
+		}
+	}
+	return nil
+}
+
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		現在の設定 (パスワードとシークレットは伏せる)
+		GET /api/admin/config
+	*/
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(appConfig.redacted())
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mapEnv(env map[string]string) func(string) string {
+	return func(name string) string {
+		return env[name]
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig("", mapEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":8000" {
+		t.Errorf("listen = %q", cfg.Listen)
+	}
+	if got := cfg.DB.DSN(); got != "isutrain:isutrain@tcp(127.0.0.1:3306)/isutrain?charset=utf8mb4&parseTime=true&loc=Local" {
+		t.Errorf("dsn = %q", got)
+	}
+	// webapp とブラウザで既定の決済APIのURLが違う
+	if cfg.Payment.URL != "http://payment:5000" || cfg.Payment.PublicURL != "http://localhost:5000" {
+		t.Errorf("payment = %+v", cfg.Payment)
+	}
+	if cfg.Password.Hasher != "argon2id" || cfg.Password.MinLength != 4 || cfg.LoginThrottle.Store != "memory" {
+		t.Errorf("password = %+v, login_throttle = %+v", cfg.Password, cfg.LoginThrottle)
+	}
+	// トークンと署名鍵は未設定 (管理用API・改札は無効、署名鍵は起動ごとに生成)
+	if cfg.Mail.Mailer != "log" || cfg.Admin.Token != "" || cfg.Ticket.SigningKey != "" || cfg.Ticket.GateToken != "" {
+		t.Errorf("mail = %+v, admin = %+v, ticket = %+v", cfg.Mail, cfg.Admin, cfg.Ticket)
+	}
+}
+
+func TestLoadConfigFileAndEnv(t *testing.T) {
+	path := writeConfigFile(t, `
+listen: ":9000"
+db:
+  host: db.internal
+  max_open_conns: 20
+  max_idle_conns: 10
+  conn_max_lifetime: 5m
+session:
+  secret: file-secret-0123456789
+  idle_timeout: 1h
+features:
+  require_email_verification: true
+password:
+  min_length: 8
+login_throttle:
+  max_delay: 1m
+csrf:
+  exempt_user_agents: []
+`)
+	defer os.Remove(path)
+
+	cfg, err := loadConfig(path, mapEnv(map[string]string{
+		"MYSQL_HOSTNAME":            "mysql",
+		"PAYMENT_API":               "http://payment.internal:5000",
+		"SESSION_COOKIE_SAMESITE":   "Strict",
+		"TIME_TRAVEL":               "1",
+		"PASSWORD_HASHER":           "2a",
+		"LOGIN_THROTTLE_STORE":      "mysql",
+		"LOGIN_LOCKOUT":             "1h",
+		"REFUND_POLICY_FILE":        "refund_policy.json",
+		"APP_BASE_URL":              "https://isutrain.example.com",
+		"ADMIN_TOKEN":               "admin-token-0123456789",
+		"GATE_TOKEN":                "gate-token-0123456789",
+		"TICKET_SIGNING_KEY":        "ticket-key-0123456789",
+		"MAILER":                    "smtp",
+		"SMTP_ADDR":                 "smtp.internal:25",
+		"SMTP_PASSWORD":             "smtp-password",
+		"CLOCK_NOW":                 "2020-01-01T06:00:00+09:00",
+		"PASSENGER_CATEGORIES_FILE": "passenger_categories.json",
+		"LOYALTY_POLICY_FILE":       "loyalty_policy.json",
+		"RESERVATION_WINDOW_FILE":   "reservation_window.json",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":9000" || cfg.DB.Host != "mysql" || cfg.DB.MaxOpenConns != 20 || time.Duration(cfg.DB.ConnMaxLifetime) != 5*time.Minute {
+		t.Errorf("cfg = %+v", cfg)
+	}
+	// PAYMENT_API はブラウザ向けのURLにも使う
+	if cfg.Payment.URL != "http://payment.internal:5000" || cfg.Payment.PublicURL != "http://payment.internal:5000" {
+		t.Errorf("payment = %+v", cfg.Payment)
+	}
+	if time.Duration(cfg.Session.IdleTimeout) != time.Hour || time.Duration(cfg.Session.AbsoluteTimeout) != defaultSessionAbsoluteTimeout {
+		t.Errorf("session = %+v", cfg.Session)
+	}
+	if cfg.Session.CookieSameSite != "strict" {
+		t.Errorf("cookie_samesite = %q", cfg.Session.CookieSameSite)
+	}
+	if !cfg.Features.RequireEmailVerification || !cfg.Features.TimeTravel || cfg.Features.TrustProxyHeaders {
+		t.Errorf("features = %+v", cfg.Features)
+	}
+	if cfg.Password.Hasher != "2a" || cfg.Password.MinLength != 8 || cfg.Password.MaxLength != 128 {
+		t.Errorf("password = %+v", cfg.Password)
+	}
+	if cfg.LoginThrottle.Store != "mysql" || time.Duration(cfg.LoginThrottle.Lockout) != time.Hour || time.Duration(cfg.LoginThrottle.MaxDelay) != time.Minute {
+		t.Errorf("login_throttle = %+v", cfg.LoginThrottle)
+	}
+	if len(cfg.CSRF.ExemptUserAgents) != 0 || cfg.Refund.PolicyFile != "refund_policy.json" {
+		t.Errorf("csrf = %+v, refund = %+v", cfg.CSRF, cfg.Refund)
+	}
+	if cfg.BaseURL != "https://isutrain.example.com" || cfg.Admin.Token != "admin-token-0123456789" || cfg.Ticket.GateToken != "gate-token-0123456789" || cfg.Ticket.SigningKey != "ticket-key-0123456789" {
+		t.Errorf("base_url = %q, admin = %+v, ticket = %+v", cfg.BaseURL, cfg.Admin, cfg.Ticket)
+	}
+	if cfg.Mail.Mailer != "smtp" || cfg.Mail.SMTPAddr != "smtp.internal:25" || cfg.Mail.Dir != "mail" || cfg.Clock.Now != "2020-01-01T06:00:00+09:00" {
+		t.Errorf("mail = %+v, clock = %+v", cfg.Mail, cfg.Clock)
+	}
+	if cfg.Passenger.CategoriesFile != "passenger_categories.json" || cfg.Loyalty.PolicyFile != "loyalty_policy.json" || cfg.ReservationWindow.File != "reservation_window.json" {
+		t.Errorf("passenger = %+v, loyalty = %+v, reservation_window = %+v", cfg.Passenger, cfg.Loyalty, cfg.ReservationWindow)
+	}
+
+	cfg, err = loadConfig(path, mapEnv(map[string]string{
+		"PAYMENT_API":        "http://payment.internal:5000",
+		"PAYMENT_PUBLIC_URL": "https://pay.example.com",
+		// カンマ区切りの一覧
+		"CSRF_EXEMPT_USER_AGENTS": "isutrain-benchmaker/, monitor/ ,",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Payment.URL != "http://payment.internal:5000" || cfg.Payment.PublicURL != "https://pay.example.com" {
+		t.Errorf("payment = %+v", cfg.Payment)
+	}
+	if got := cfg.CSRF.ExemptUserAgents; len(got) != 2 || got[0] != "isutrain-benchmaker/" || got[1] != "monitor/" {
+		t.Errorf("csrf.exempt_user_agents = %q", got)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	cases := []struct {
+		yaml string
+		env  map[string]string
+		want string
+	}{
+		{"", map[string]string{"MYSQL_PORT": "abc"}, "MYSQL_PORT"},
+		{"", map[string]string{"MYSQL_PORT": "70000"}, "db.port"},
+		{"", map[string]string{"PAYMENT_API": "payment:5000"}, "payment.url"},
+		{"", map[string]string{"SESSION_SECRET": "short"}, "session.secret"},
+		{"", map[string]string{"SESSION_STORE": "redis"}, "session.store"},
+		// SameSite=None は Go 1.13 から。Dockerfile の Go 1.12 では使えない
+		{"", map[string]string{"SESSION_COOKIE_SAMESITE": "none"}, "session.cookie_samesite"},
+		{"", map[string]string{"TIME_TRAVEL": "yes"}, "TIME_TRAVEL"},
+		{"", map[string]string{"TRACING_EXPORTER": "jaeger"}, "tracing.exporter"},
+		{"", map[string]string{"TRACING_EXPORTER": "file"}, "tracing.file"},
+		{"", map[string]string{"TRACING_EXPORTER": "otlp", "OTEL_EXPORTER_OTLP_ENDPOINT": "collector:4318"}, "tracing.endpoint"},
+		{"", map[string]string{"LOG_LEVEL": "verbose"}, "log.level"},
+		{"", map[string]string{"PASSWORD_HASHER": "md5"}, "password.hasher"},
+		{"", map[string]string{"PASSWORD_MIN_LENGTH": "0"}, "password.min_length"},
+		{"", map[string]string{"PASSWORD_MIN_LENGTH": "200"}, "password.max_length"},
+		{"", map[string]string{"LOGIN_THROTTLE_STORE": "redis"}, "login_throttle.store"},
+		{"", map[string]string{"LOGIN_MAX_IP_FAILURES": "many"}, "LOGIN_MAX_IP_FAILURES"},
+		{"", map[string]string{"LOGIN_THROTTLE_WINDOW": "0s"}, "login_throttle.window"},
+		{"", map[string]string{"LOGIN_BASE_DELAY": "1m"}, "login_throttle.max_delay"},
+		{"", map[string]string{"APP_BASE_URL": "isutrain.example.com"}, "base_url"},
+		{"", map[string]string{"ADMIN_TOKEN": "admin"}, "admin.token"},
+		{"", map[string]string{"GATE_TOKEN": "gate"}, "ticket.gate_token"},
+		{"", map[string]string{"TICKET_SIGNING_KEY": "key"}, "ticket.signing_key"},
+		{"", map[string]string{"MAILER": "sendmail"}, "mail.mailer"},
+		{"", map[string]string{"MAILER": "smtp"}, "mail.smtp_addr"},
+		{"", map[string]string{"CLOCK_NOW": "2020-01-01", "TIME_TRAVEL": "1"}, "clock.now"},
+		{"", map[string]string{"CLOCK_NOW": "2020-01-01T06:00:00+09:00"}, "features.time_travel"},
+		{"db:\n  max_open_conns: 5\n  max_idle_conns: 10\n", nil, "db.max_idle_conns"},
+		{"session:\n  idle_timeout: forever\n", nil, "forever"},
+		{"unknown_key: 1\n", nil, "unknown_key"},
+	}
+	for _, c := range cases {
+		path := ""
+		if c.yaml != "" {
+			path = writeConfigFile(t, c.yaml)
+		}
+		_, err := loadConfig(path, mapEnv(c.env))
+		if path != "" {
+			os.Remove(path)
+		}
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("loadConfig(%q, %v) = %v, want error about %s", c.yaml, c.env, err, c.want)
+		}
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Session.Secret = "super-secret-value"
+	cfg.Admin.Token = "admin-secret-value"
+	cfg.Mail.SMTPPassword = "smtp-secret-value"
+	cfg.Ticket.SigningKey = "ticket-secret-value"
+	cfg.Ticket.GateToken = "gate-secret-value"
+	b, err := json.Marshal(cfg.redacted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(b)
+	if strings.Contains(s, "secret-value") || strings.Contains(s, `"password":"isutrain"`) {
+		t.Errorf("secrets leaked: %s", s)
+	}
+	if !strings.Contains(s, `"idle_timeout":"30m0s"`) {
+		t.Errorf("durations should be strings: %s", s)
+	}
+	if cfg.Session.Secret != "super-secret-value" {
+		t.Error("redacted must not modify the original")
+	}
+}
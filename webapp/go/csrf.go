@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+/*
+	CSRF対策
+
+	GET /api/auth でセッションに紐づくトークンを発行し、レスポンスボディと XSRF-TOKEN クッキーで返す
+	POST などの状態を変えるリクエストでは X-XSRF-TOKEN (または X-CSRF-Token) ヘッダのトークンとセッションのトークンを照合する
+	(axios は XSRF-TOKEN クッキーを X-XSRF-TOKEN ヘッダに自動で載せる)
+
+	次のリクエストは検査しない
+		- csrfExemptPaths のパス (ログイン前に呼ばれるもの、管理用API)
+		- CSRF_EXEMPT_USER_AGENTS (カンマ区切り、前方一致) に一致する User-Agent の機械クライアント
+		- Authorization: Bearer で認証するリクエスト (ブラウザが自動で付けることはない)
+*/
+
+const (
+	csrfSessionKey = "csrf_token"
+	csrfCookieName = "XSRF-TOKEN"
+)
+
+var (
+	csrfHeaderNames = []string{"X-XSRF-TOKEN", "X-CSRF-Token"}
+
+	csrfExemptPaths = []string{
+		"/initialize",
+		"/api/auth/signup",
+		"/api/auth/login",
+		"/api/auth/verify",
+		"/api/auth/password/forgot",
+		"/api/auth/password/reset",
+	}
+	csrfExemptPathPrefixes = []string{
+		"/api/admin/",
+		"/api/gate/",
+	}
+
+	csrfExemptUserAgents = []string{"isutrain-benchmaker/"}
+)
+
+func csrfProtect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !csrfRequired(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		expected, _ := getSession(r).Values[csrfSessionKey].(string)
+		given := ""
+		for _, name := range csrfHeaderNames {
+			if given = r.Header.Get(name); given != "" {
+				break
+			}
+		}
+		if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(given)) != 1 {
+			errorResponse(w, r, ErrCSRFTokenInvalid)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func csrfRequired(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return false
+	}
+	if containsString(csrfExemptPaths, r.URL.Path) {
+		return false
+	}
+	for _, prefix := range csrfExemptPathPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return false
+		}
+	}
+	if _, ok := bearerToken(r); ok {
+		return false
+	}
+	ua := r.UserAgent()
+	for _, prefix := range csrfExemptUserAgents {
+		if ua != "" && strings.HasPrefix(ua, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// issueCSRFToken はセッションのトークンを返す (なければ発行してセッションに保存する)
+func issueCSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	session := getSession(r)
+	token, _ := session.Values[csrfSessionKey].(string)
+	if token == "" {
+		token = secureRandomStr(32)
+		session.Values[csrfSessionKey] = token
+		if err := session.Save(r, w); err != nil {
+			return "", err
+		}
+	}
+
+	// JavaScript から読めるように HttpOnly にはしない
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token, nil
+}
+
+// 設定から CSRF 対策の除外設定を読み込む
+func configureCSRF(cfg CSRFConfig) {
+	csrfExemptUserAgents = cfg.ExemptUserAgents
+}
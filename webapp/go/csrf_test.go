@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	// トークンを発行してセッションクッキーとトークンを得る
+	r := httptest.NewRequest("GET", "/api/auth", nil)
+	w := httptest.NewRecorder()
+	token, err := issueCSRFToken(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	h := csrfProtect(ok)
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		header    string
+		userAgent string
+		status    int
+	}{
+		{"safe method", "GET", "/api/train/search", "", "", http.StatusOK},
+		{"missing token", "POST", "/api/train/reserve", "", "", http.StatusForbidden},
+		{"wrong token", "POST", "/api/train/reserve", "x" + token, "", http.StatusForbidden},
+		{"valid token", "POST", "/api/train/reserve", token, "", http.StatusOK},
+		{"exempt path", "POST", "/api/auth/login", "", "", http.StatusOK},
+		{"exempt user agent", "POST", "/api/train/reserve", "", "isutrain-benchmaker/0.0.1", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		if tt.header != "" {
+			r.Header.Set("X-XSRF-TOKEN", tt.header)
+		}
+		if tt.userAgent != "" {
+			r.Header.Set("User-Agent", tt.userAgent)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
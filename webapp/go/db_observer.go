@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+	クエリの観測
+
+	dbx は go-sql-driver/mysql のコネクションを包み、クエリを実行するたびに queryObservers を呼ぶ
+	クエリは「動詞 + 最初のテーブル名」(select train_master, insert reservations など) の名前でまとめる
+	プレースホルダのあるクエリはドライバがプリペアドステートメントで実行するので、その実行を観測する
+	トランザクション内のクエリ (tx.Exec など) には BeginTx に渡したコンテキストを渡す
+*/
+
+type QueryEvent struct {
+	// statementName で求めたクエリの名前
+	Statement string
+	Query     string
+	Start     time.Time
+	Duration  time.Duration
+	Err       error
+}
+
+var queryObservers []func(ctx context.Context, ev QueryEvent)
+
+func observeQuery(ctx context.Context, query string, start time.Time, err error) {
+	// ドライバがプリペアドステートメントでの実行を求めた場合は、そちらで観測する
+	if err == driver.ErrSkip || len(queryObservers) == 0 {
+		return
+	}
+	ev := QueryEvent{
+		Statement: statementName(query),
+		Query:     query,
+		Start:     start,
+		Duration:  time.Since(start),
+		Err:       err,
+	}
+	for _, observe := range queryObservers {
+		observe(ctx, ev)
+	}
+}
+
+var statementVerbs = map[string]string{
+	"select":   "from",
+	"delete":   "from",
+	"insert":   "into",
+	"replace":  "into",
+	"update":   "",
+	"truncate": "",
+}
+
+// statementName はクエリを「動詞 + 最初のテーブル名」にまとめる (分からなければ動詞だけ、知らない動詞なら other)
+func statementName(query string) string {
+	fields := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		switch r {
+		case ' ', '\t', '\n', '\r', '`', '(', ')', ',', ';':
+			return true
+		}
+		return false
+	})
+	if len(fields) == 0 {
+		return "other"
+	}
+	verb := fields[0]
+	keyword, ok := statementVerbs[verb]
+	if !ok {
+		return "other"
+	}
+
+	rest := fields[1:]
+	if keyword != "" {
+		rest = nil
+		for i, f := range fields {
+			if f == keyword {
+				rest = fields[i+1:]
+				break
+			}
+		}
+	}
+	for _, f := range rest {
+		switch f {
+		case "table", "ignore", "low_priority", "into", "select":
+			continue
+		}
+		return verb + " " + f
+	}
+	return verb
+}
+
+// openObservedDB は dsn に接続する、クエリを観測する *sqlx.DB を返す
+func openObservedDB(dsn string) (*sqlx.DB, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return sqlx.NewDb(sql.OpenDB(observedConnector{connector}), "mysql"), nil
+}
+
+type observedConnector struct {
+	driver.Connector
+}
+
+func (c observedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &observedConn{Conn: conn}, nil
+}
+
+// observedConn は go-sql-driver/mysql のコネクションが実装しているインタフェースをそのまま引き継ぐ
+type observedConn struct {
+	driver.Conn
+	// トランザクション中なら BeginTx に渡したコンテキスト (コネクションはトランザクションが占有する)
+	txCtx context.Context
+}
+
+// queryContext はコンテキストなしで呼ばれた (ctx が context.Background() の) ときはトランザクションのコンテキストを返す
+func (c *observedConn) queryContext(ctx context.Context) context.Context {
+	if c.txCtx != nil && ctx == context.Background() {
+		return c.txCtx
+	}
+	return ctx
+}
+
+func (c *observedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &observedStmt{Stmt: stmt, conn: c, query: query}, nil
+}
+
+func (c *observedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	tx, err := c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.txCtx = ctx
+	return &observedTx{Tx: tx, conn: c}, nil
+}
+
+func (c *observedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	res, err := c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	observeQuery(c.queryContext(ctx), query, start, err)
+	return res, err
+}
+
+func (c *observedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	observeQuery(c.queryContext(ctx), query, start, err)
+	return rows, err
+}
+
+func (c *observedConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *observedConn) ResetSession(ctx context.Context) error {
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *observedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	return c.Conn.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
+
+func (c *observedConn) IsValid() bool {
+	v, ok := c.Conn.(interface{ IsValid() bool })
+	return !ok || v.IsValid()
+}
+
+type observedTx struct {
+	driver.Tx
+	conn *observedConn
+}
+
+func (tx *observedTx) Commit() error {
+	tx.conn.txCtx = nil
+	return tx.Tx.Commit()
+}
+
+func (tx *observedTx) Rollback() error {
+	tx.conn.txCtx = nil
+	return tx.Tx.Rollback()
+}
+
+type observedStmt struct {
+	driver.Stmt
+	conn  *observedConn
+	query string
+}
+
+func (s *observedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	res, err := s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+	observeQuery(s.conn.queryContext(ctx), s.query, start, err)
+	return res, err
+}
+
+func (s *observedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	observeQuery(s.conn.queryContext(ctx), s.query, start, err)
+	return rows, err
+}
+
+func (s *observedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	return s.Stmt.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
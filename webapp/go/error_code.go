@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrorCode はクライアントが機械的に判別できるエラー識別子
+// 一度公開したコードの意味は変えないこと
+type ErrorCode string
+
+const (
+	ErrInvalidRequest         ErrorCode = "INVALID_REQUEST"
+	ErrValidationFailed       ErrorCode = "VALIDATION_FAILED"
+	ErrInvalidDate            ErrorCode = "INVALID_DATE"
+	ErrInvalidItemID          ErrorCode = "INVALID_ITEM_ID"
+	ErrOutOfReservationWindow ErrorCode = "OUT_OF_RESERVATION_WINDOW"
+	ErrDateClosed             ErrorCode = "DATE_CLOSED"
+	ErrSalesClosed            ErrorCode = "SALES_CLOSED"
+	ErrStationNotFound        ErrorCode = "STATION_NOT_FOUND"
+	ErrTrainNotFound          ErrorCode = "TRAIN_NOT_FOUND"
+	ErrUnknownTrainClass      ErrorCode = "UNKNOWN_TRAIN_CLASS"
+	ErrUnknownSeatClass       ErrorCode = "UNKNOWN_SEAT_CLASS"
+	ErrStationNotServed       ErrorCode = "STATION_NOT_SERVED"
+	ErrSectionNotServed       ErrorCode = "SECTION_NOT_SERVED"
+	ErrSeatNotFound           ErrorCode = "SEAT_NOT_FOUND"
+	ErrSeatTaken              ErrorCode = "SEAT_TAKEN"
+	ErrNoAvailableSeats       ErrorCode = "NO_AVAILABLE_SEATS"
+	ErrReservationNotFound    ErrorCode = "RESERVATION_NOT_FOUND"
+	ErrReservationForbidden   ErrorCode = "RESERVATION_FORBIDDEN"
+	ErrReservationPaid        ErrorCode = "RESERVATION_ALREADY_PAID"
+	ErrReservationRejected    ErrorCode = "RESERVATION_REJECTED"
+	ErrReservationNotPaid     ErrorCode = "RESERVATION_NOT_PAID"
+	ErrPaymentDeclined        ErrorCode = "PAYMENT_DECLINED"
+	ErrPaymentUnavailable     ErrorCode = "PAYMENT_UNAVAILABLE"
+	ErrPaymentCancelFailed    ErrorCode = "PAYMENT_CANCEL_FAILED"
+	ErrRefundQuoteChanged     ErrorCode = "REFUND_QUOTE_CHANGED"
+	ErrPromoCodeNotFound      ErrorCode = "PROMO_CODE_NOT_FOUND"
+	ErrPromoCodeNotActive     ErrorCode = "PROMO_CODE_NOT_ACTIVE"
+	ErrPromoCodeNotApplicable ErrorCode = "PROMO_CODE_NOT_APPLICABLE"
+	ErrPromoCodeExhausted     ErrorCode = "PROMO_CODE_EXHAUSTED"
+	ErrPromoCodeTaken         ErrorCode = "PROMO_CODE_ALREADY_EXISTS"
+	ErrInsufficientPoints     ErrorCode = "INSUFFICIENT_POINTS"
+	ErrNoSession              ErrorCode = "NO_SESSION"
+	ErrUserNotFound           ErrorCode = "USER_NOT_FOUND"
+	ErrTargetUserNotFound     ErrorCode = "TARGET_USER_NOT_FOUND"
+	ErrAuthenticationFailed   ErrorCode = "AUTHENTICATION_FAILED"
+	ErrRegistrationFailed     ErrorCode = "REGISTRATION_FAILED"
+	ErrEmailTaken             ErrorCode = "EMAIL_ALREADY_REGISTERED"
+	ErrEmailNotVerified       ErrorCode = "EMAIL_NOT_VERIFIED"
+	ErrInvalidEmailToken      ErrorCode = "INVALID_EMAIL_TOKEN"
+	ErrTooManyLoginAttempts   ErrorCode = "TOO_MANY_LOGIN_ATTEMPTS"
+	ErrInvalidAPIToken        ErrorCode = "INVALID_API_TOKEN"
+	ErrInsufficientScope      ErrorCode = "INSUFFICIENT_SCOPE"
+	ErrAPITokenNotAllowed     ErrorCode = "API_TOKEN_NOT_ALLOWED"
+	ErrAPITokenNotFound       ErrorCode = "API_TOKEN_NOT_FOUND"
+	ErrInvalidCalendarToken   ErrorCode = "INVALID_CALENDAR_TOKEN"
+	ErrCSRFTokenInvalid       ErrorCode = "CSRF_TOKEN_INVALID"
+	ErrAdminForbidden         ErrorCode = "ADMIN_FORBIDDEN"
+	ErrInvalidTicket          ErrorCode = "INVALID_TICKET"
+	ErrTicketExpired          ErrorCode = "TICKET_EXPIRED"
+	ErrStationOutsideSection  ErrorCode = "STATION_OUTSIDE_SECTION"
+	ErrTicketAlreadyUsed      ErrorCode = "TICKET_ALREADY_USED"
+	ErrTicketNotEntered       ErrorCode = "TICKET_NOT_ENTERED"
+	ErrGateForbidden          ErrorCode = "GATE_FORBIDDEN"
+	ErrSession                ErrorCode = "SESSION_ERROR"
+	ErrDatabase               ErrorCode = "DATABASE_ERROR"
+	ErrInternal               ErrorCode = "INTERNAL_ERROR"
+)
+
+type errorDefinition struct {
+	Status int
+	Ja     string
+	En     string
+}
+
+// エラーコードごとのHTTPステータスとメッセージ
+// メッセージには fmt の verb を含めてよい (errorResponse の args で埋める)
+var errorCatalog = map[ErrorCode]errorDefinition{
+	ErrInvalidRequest:         {http.StatusBadRequest, "リクエストの形式が不正です", "malformed request"},
+	ErrValidationFailed:       {http.StatusBadRequest, "入力内容に誤りがあります", "request validation failed"},
+	ErrInvalidDate:            {http.StatusBadRequest, "日時の形式が不正です", "malformed date"},
+	ErrInvalidItemID:          {http.StatusBadRequest, "予約IDが不正です", "incorrect item id"},
+	ErrOutOfReservationWindow: {http.StatusNotFound, "予約可能期間外です", "the date is outside the reservation window"},
+	ErrDateClosed:             {http.StatusNotFound, "指定した日の予約は受け付けていません", "reservations are not accepted for the date"},
+	ErrSalesClosed:            {http.StatusBadRequest, "出発時刻が近いため、この列車の予約受付は終了しました", "reservations for the train have closed"},
+	ErrStationNotFound:        {http.StatusNotFound, "駅データがみつかりません %s", "station not found: %s"},
+	ErrTrainNotFound:          {http.StatusNotFound, "列車データがみつかりません", "train not found"},
+	ErrUnknownTrainClass:      {http.StatusBadRequest, "リクエストされた列車クラスが不明です", "unknown train class"},
+	ErrUnknownSeatClass:       {http.StatusBadRequest, "リクエストされた座席クラスが不明です", "unknown seat class"},
+	ErrStationNotServed:       {http.StatusBadRequest, "%sの止まらない駅です", "%s trains do not stop at the requested station"},
+	ErrSectionNotServed:       {http.StatusBadRequest, "リクエストされた区間に列車が運行していない区間が含まれています", "the requested section is not served by the train"},
+	ErrSeatNotFound:           {http.StatusNotFound, "リクエストされた座席情報は存在しません。号車・喫煙席・座席クラスなど組み合わせを見直してください", "the requested seats do not exist; check the car number, smoking flag and seat class"},
+	ErrSeatTaken:              {http.StatusConflict, "リクエストに既に予約された席が含まれています", "some of the requested seats are already reserved"},
+	ErrNoAvailableSeats:       {http.StatusNotFound, "あいまい座席予約ができませんでした。指定した席、もしくは1車両内に希望の席数をご用意できませんでした。", "not enough vacant seats in a single car for the request"},
+	ErrReservationNotFound:    {http.StatusNotFound, "予約情報がみつかりません", "reservation not found"},
+	ErrReservationForbidden:   {http.StatusForbidden, "他のユーザIDの予約は操作できません", "the reservation belongs to another user"},
+	ErrReservationPaid:        {http.StatusForbidden, "既に支払いが完了している予約IDです", "the reservation is already paid"},
+	ErrReservationRejected:    {http.StatusConflict, "何らかの理由により予約はRejected状態です", "the reservation has been rejected"},
+	ErrReservationNotPaid:     {http.StatusConflict, "支払いが完了していない予約です", "the reservation has not been paid"},
+	ErrPaymentDeclined:        {http.StatusPaymentRequired, "決済に失敗しました。カードトークンや支払いIDが間違っている可能性があります", "payment was declined; the card token may be invalid"},
+	ErrPaymentUnavailable:     {http.StatusBadGateway, "決済サービスとの通信に失敗しました", "failed to communicate with the payment service"},
+	ErrPaymentCancelFailed:    {http.StatusBadGateway, "決済のキャンセルに失敗しました", "failed to cancel the payment"},
+	ErrRefundQuoteChanged:     {http.StatusConflict, "払い戻し額が見積もりから変わりました。もう一度ご確認ください", "the refund amount has changed since the quote"},
+	ErrPromoCodeNotFound:      {http.StatusNotFound, "プロモーションコードがみつかりません", "promotion code not found"},
+	ErrPromoCodeNotActive:     {http.StatusBadRequest, "プロモーションコードの有効期間外です", "the promotion code is not active"},
+	ErrPromoCodeNotApplicable: {http.StatusBadRequest, "この予約にはプロモーションコードを適用できません", "the promotion code does not apply to this reservation"},
+	ErrPromoCodeExhausted:     {http.StatusConflict, "プロモーションコードの利用回数の上限に達しています", "the promotion code has reached its usage limit"},
+	ErrPromoCodeTaken:         {http.StatusConflict, "このプロモーションコードは既に登録されています", "the promotion code already exists"},
+	ErrInsufficientPoints:     {http.StatusConflict, "ポイントが足りません", "not enough points"},
+	ErrNoSession:              {http.StatusUnauthorized, "ログインしていません", "no session"},
+	ErrUserNotFound:           {http.StatusUnauthorized, "ユーザがみつかりません", "user not found"},
+	ErrTargetUserNotFound:     {http.StatusNotFound, "指定したユーザがみつかりません", "the specified user does not exist"},
+	ErrAuthenticationFailed:   {http.StatusForbidden, "認証に失敗しました", "authentication failed"},
+	ErrRegistrationFailed:     {http.StatusBadRequest, "ユーザ登録に失敗しました", "user registration failed"},
+	ErrEmailTaken:             {http.StatusConflict, "このメールアドレスは既に登録されています", "the email address is already registered"},
+	ErrEmailNotVerified:       {http.StatusForbidden, "メールアドレスの確認が完了していません", "the email address has not been verified"},
+	ErrInvalidEmailToken:      {http.StatusBadRequest, "リンクが無効か、有効期限が切れています", "the link is invalid, expired or already used"},
+	ErrTooManyLoginAttempts:   {http.StatusTooManyRequests, "ログイン試行回数が多すぎます。しばらくしてから再度お試しください", "too many login attempts; retry later"},
+	ErrInvalidAPIToken:        {http.StatusUnauthorized, "アクセストークンが無効です", "invalid, expired or revoked access token"},
+	ErrInsufficientScope:      {http.StatusForbidden, "アクセストークンにこの操作の権限がありません", "the access token lacks the required scope"},
+	ErrAPITokenNotAllowed:     {http.StatusForbidden, "この操作はアクセストークンでは行えません", "this endpoint requires a session, not an access token"},
+	ErrAPITokenNotFound:       {http.StatusNotFound, "アクセストークンがみつかりません", "access token not found"},
+	ErrInvalidCalendarToken:   {http.StatusUnauthorized, "カレンダーの購読用URLが無効です", "invalid calendar subscription token"},
+	ErrCSRFTokenInvalid:       {http.StatusForbidden, "CSRFトークンが不正です。ページを再読み込みしてください", "missing or invalid CSRF token"},
+	ErrAdminForbidden:         {http.StatusForbidden, "管理用APIへのアクセスが許可されていません", "admin access denied"},
+	ErrInvalidTicket:          {http.StatusBadRequest, "無効なチケットです", "invalid or cancelled ticket"},
+	ErrTicketExpired:          {http.StatusForbidden, "チケットの有効期限が切れています", "the ticket has expired"},
+	ErrStationOutsideSection:  {http.StatusForbidden, "チケットの乗車区間外の駅です", "the station is outside the ticket's section"},
+	ErrTicketAlreadyUsed:      {http.StatusConflict, "このチケットは既に使用されています", "the ticket has already been used"},
+	ErrTicketNotEntered:       {http.StatusConflict, "入場記録のないチケットです", "the ticket has no entry record"},
+	ErrGateForbidden:          {http.StatusForbidden, "改札用APIへのアクセスが許可されていません", "gate access denied"},
+	ErrSession:                {http.StatusInternalServerError, "セッションの処理に失敗しました", "session error"},
+	ErrDatabase:               {http.StatusInternalServerError, "データベースの処理に失敗しました", "database error"},
+	ErrInternal:               {http.StatusInternalServerError, "サーバ内部でエラーが発生しました", "internal server error"},
+}
+
+// preferredLanguage は Accept-Language から応答言語を決める
+// 英語が日本語より優先されている場合のみ "en" を返し、それ以外は "ja"
+func preferredLanguage(r *http.Request) string {
+	if r == nil {
+		return "ja"
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag := strings.ToLower(strings.TrimSpace(strings.SplitN(part, ";", 2)[0]))
+		switch {
+		case strings.HasPrefix(tag, "ja"):
+			return "ja"
+		case strings.HasPrefix(tag, "en"):
+			return "en"
+		}
+	}
+	return "ja"
+}
+
+func (code ErrorCode) Status() int {
+	def, ok := errorCatalog[code]
+	if !ok {
+		return http.StatusInternalServerError
+	}
+	return def.Status
+}
+
+func (code ErrorCode) Message(lang string, args ...interface{}) string {
+	def, ok := errorCatalog[code]
+	if !ok {
+		def = errorCatalog[ErrInternal]
+	}
+	format := def.Ja
+	if lang == "en" {
+		format = def.En
+	}
+	if len(args) == 0 {
+		return strings.TrimRight(strings.Replace(format, "%s", "", -1), " :")
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+func errorResponse(w http.ResponseWriter, r *http.Request, code ErrorCode, args ...interface{}) {
+	e := map[string]interface{}{
+		"is_error": true,
+		"code":     code,
+		"message":  code.Message(preferredLanguage(r), args...),
+	}
+	errResp, _ := json.Marshal(e)
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(code.Status())
+	w.Write(errResp)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPreferredLanguage(t *testing.T) {
+	cases := map[string]string{
+		"":                       "ja",
+		"en-US,en;q=0.9":         "en",
+		"ja,en-US;q=0.8":         "ja",
+		"fr-FR, en;q=0.5":        "en",
+		"de":                     "ja",
+		" EN-gb ; q=1.0, ja;q=0": "en",
+	}
+	for header, want := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Language", header)
+		if got := preferredLanguage(r); got != want {
+			t.Errorf("preferredLanguage(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Language", "en")
+	w := httptest.NewRecorder()
+
+	errorResponse(w, r, ErrStationNotFound, "東京")
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	want := `{"code":"STATION_NOT_FOUND","is_error":true,"message":"station not found: 東京"}`
+	if got := w.Body.String(); got != want {
+		t.Fatalf("body = %s, want %s", got, want)
+	}
+}
+
+func TestErrorCodeMessageWithoutArgs(t *testing.T) {
+	if got := ErrStationNotFound.Message("ja"); got != "駅データがみつかりません" {
+		t.Fatalf("got %q", got)
+	}
+	if got := ErrorCode("NO_SUCH_CODE").Status(); got != http.StatusInternalServerError {
+		t.Fatalf("unknown code status = %d", got)
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClient はセッションのクッキーと CSRF トークンを保持して API を呼ぶ
+type testClient struct {
+	t         *testing.T
+	baseURL   string
+	client    *http.Client
+	csrfToken string
+	// bearer があれば Authorization: Bearer で送る
+	bearer string
+}
+
+// do はリクエストを送り、成功したらレスポンスの本文を out にデコードしてステータスを返す
+func (c *testClient) do(method, path string, body, out interface{}) int {
+	c.t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.csrfToken != "" {
+		req.Header.Set("X-CSRF-Token", c.csrfToken)
+	}
+	if c.bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+c.bearer)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if out != nil && resp.StatusCode/100 == 2 {
+		if err := json.Unmarshal(b, out); err != nil {
+			c.t.Fatalf("%s %s: %v: %s", method, path, err, b)
+		}
+	}
+	return resp.StatusCode
+}
+
+// setupHandlerTest はフィクスチャを入れた MemoryRepository と決済サービスの代わりでサーバを立てる
+// 時刻は予約受付期間 (2020-01-01 から10日) の前の 2019-12-25 に固定する
+func setupHandlerTest(t *testing.T) (*MemoryRepository, *testClient, func()) {
+	m := newTestRepository()
+	savedRepo, savedPaymentURL := repo, appConfig.Payment.URL
+	repo = m
+	stationIndex.entries = nil
+	restoreWindow := setReservationWindow(defaultReservationWindow, map[string]string{}, time.Date(2019, 12, 25, 12, 0, 0, 0, jst))
+
+	payment := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/payment":
+			json.NewEncoder(w).Encode(PaymentResponse{PaymentId: "p1", IsOk: true})
+		case strings.HasSuffix(r.URL.Path, "/refund"):
+			req := RefundPaymentRequest{}
+			json.NewDecoder(r.Body).Decode(&req)
+			json.NewEncoder(w).Encode(RefundPaymentResponse{IsOk: true, RefundedAmount: req.Amount})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	appConfig.Payment.URL = payment.URL
+	server := httptest.NewServer(newMux())
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, baseURL: server.URL, client: &http.Client{Jar: jar}}
+	return m, c, func() {
+		server.Close()
+		payment.Close()
+		restoreWindow()
+		repo, appConfig.Payment.URL = savedRepo, savedPaymentURL
+		stationIndex.entries = nil
+	}
+}
+
+// login はユーザを登録してログインし、CSRF トークンを受け取る
+func (c *testClient) login(m *MemoryRepository, email string) User {
+	c.t.Helper()
+	hashed, err := hashPassword("isutrain-password")
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	now := time.Now()
+	user := User{Email: email, HashedPassword: hashed, EmailVerifiedAt: &now}
+	if err := m.CreateUser(context.Background(), &user); err != nil {
+		c.t.Fatal(err)
+	}
+	if status := c.do("POST", "/api/auth/login", map[string]string{"email": email, "password": "isutrain-password"}, nil); status != http.StatusOK {
+		c.t.Fatalf("login: status = %d", status)
+	}
+	auth := AuthResponse{}
+	if status := c.do("GET", "/api/auth", nil, &auth); status != http.StatusOK || auth.Email != email || auth.CSRFToken == "" {
+		c.t.Fatalf("auth: status = %d, %+v", status, auth)
+	}
+	c.csrfToken = auth.CSRFToken
+	return user
+}
+
+func TestStationsAndSearchHandlers(t *testing.T) {
+	_, c, teardown := setupHandlerTest(t)
+	defer teardown()
+
+	stations := []Station{}
+	if status := c.do("GET", "/api/stations", nil, &stations); status != http.StatusOK || len(stations) != 3 || stations[0].Name != "東京" {
+		t.Fatalf("stations: status = %d, %v", status, stations)
+	}
+
+	q := url.Values{"use_at": {"2020-01-01T05:00:00+09:00"}, "from": {"toukyou"}, "to": {"名古屋"}, "adult": {"1"}}
+	trains := []TrainSearchResponse{}
+	if status := c.do("GET", "/api/train/search?"+q.Encode(), nil, &trains); status != http.StatusOK || len(trains) != 1 {
+		t.Fatalf("search: status = %d, %v", status, trains)
+	}
+	train := trains[0]
+	if train.Departure != "東京" || train.DepartureTime != "06:00:00" || train.ArrivalTime != "07:30:00" {
+		t.Errorf("train = %+v", train)
+	}
+	// 距離366の運賃3000 × 指定席1.5
+	if train.Fare["reserved"] != 4500 || train.SeatAvailability["reserved"] != "△" {
+		t.Errorf("fare = %v, availability = %v", train.Fare, train.SeatAvailability)
+	}
+
+	// 乗りたい時刻より前に出る列車は返さない
+	q.Set("use_at", "2020-01-01T06:30:00+09:00")
+	if status := c.do("GET", "/api/train/search?"+q.Encode(), nil, &trains); status != http.StatusOK || len(trains) != 0 {
+		t.Errorf("late search: status = %d, %v", status, trains)
+	}
+}
+
+func TestReservationHandlers(t *testing.T) {
+	m, c, teardown := setupHandlerTest(t)
+	defer teardown()
+	user := c.login(m, "isutrain@example.com")
+
+	reserve := map[string]interface{}{
+		"date":        "2020-01-01T05:00:00+09:00",
+		"train_class": "最速",
+		"train_name":  "1",
+		"car_number":  2,
+		"seat_class":  "reserved",
+		"departure":   "東京",
+		"arrival":     "名古屋",
+		"adult":       1,
+		"seats":       []RequestSeat{{Row: 1, Column: "A"}},
+	}
+	reserved := TrainReservationResponse{}
+	if status := c.do("POST", "/api/train/reserve", reserve, &reserved); status != http.StatusOK || !reserved.IsOk || reserved.Amount != 4500 {
+		t.Fatalf("reserve: status = %d, %+v", status, reserved)
+	}
+
+	// 存在しない列の座席は入力検証ではなく座席の検索で 404 になる
+	reserve["seats"] = []RequestSeat{{Row: 1, Column: "G"}}
+	if status := c.do("POST", "/api/train/reserve", reserve, nil); status != http.StatusNotFound {
+		t.Errorf("unknown column: status = %d", status)
+	}
+	reserve["seats"] = []RequestSeat{{Row: 1, Column: "A"}}
+
+	// 区間が重なる同じ席は予約できず、書き込みは残らない
+	reserve["arrival"] = "大阪"
+	if status := c.do("POST", "/api/train/reserve", reserve, nil); status != http.StatusConflict {
+		t.Errorf("double booking: status = %d", status)
+	}
+	if list, _ := m.ListUserReservations(context.Background(), user.ID); len(list) != 1 {
+		t.Errorf("reservations = %v", list)
+	}
+
+	q := url.Values{
+		"date": {"2020-01-01T05:00:00+09:00"}, "train_class": {"最速"}, "train_name": {"1"},
+		"car_number": {"2"}, "from": {"東京"}, "to": {"大阪"},
+	}
+	car := CarInformation{}
+	if status := c.do("GET", "/api/train/seats?"+q.Encode(), nil, &car); status != http.StatusOK {
+		t.Fatalf("seats: status = %d", status)
+	}
+	if len(car.SeatInformationList) != 4 || !car.SeatInformationList[0].IsOccupied || car.SeatInformationList[1].IsOccupied {
+		t.Errorf("seats = %+v", car.SeatInformationList)
+	}
+	if len(car.Cars) != 2 || car.Cars[0].SeatClass != "premium" || car.Cars[1].SeatClass != "reserved" {
+		t.Errorf("cars = %+v", car.Cars)
+	}
+
+	paid := ReservationPaymentResponse{}
+	commit := ReservationPaymentRequest{CardToken: "card", ReservationId: int(reserved.ReservationId)}
+	if status := c.do("POST", "/api/train/reservation/commit", commit, &paid); status != http.StatusOK || !paid.IsOk {
+		t.Fatalf("commit: status = %d", status)
+	}
+	if status := c.do("POST", "/api/train/reservation/commit", commit, nil); status == http.StatusOK {
+		t.Error("paid twice")
+	}
+
+	list := []ReservationResponse{}
+	if status := c.do("GET", "/api/user/reservations", nil, &list); status != http.StatusOK || len(list) != 1 {
+		t.Fatalf("reservations: status = %d, %v", status, list)
+	}
+	if r := list[0]; r.SeatClass != "reserved" || r.CarNumber != 2 || r.DepartureTime != "06:00:00" || len(r.Seats) != 1 {
+		t.Errorf("reservation = %+v", r)
+	}
+
+	// ほかのユーザの予約は見えない
+	other := &testClient{t: t, baseURL: c.baseURL, client: &http.Client{}}
+	other.client.Jar, _ = cookiejar.New(nil)
+	other.login(m, "other@example.com")
+	if status := other.do("GET", "/api/user/reservations/1", nil, nil); status != http.StatusNotFound {
+		t.Errorf("other user's reservation: status = %d", status)
+	}
+
+	// 出発の1週間前なので最低手数料だけ差し引いて払い戻す
+	canceled := CancelReservationResponse{}
+	if status := c.do("POST", "/api/user/reservations/1/cancel", nil, &canceled); status != http.StatusOK || canceled.RefundAmount != 4500-340 {
+		t.Fatalf("cancel: status = %d, %+v", status, canceled)
+	}
+	if list, _ := m.ListUserReservations(context.Background(), user.ID); len(list) != 0 {
+		t.Errorf("reservations after cancel = %v", list)
+	}
+	if seats, _ := m.ListSeatReservations(context.Background(), reserved.ReservationId); len(seats) != 0 {
+		t.Errorf("seats after cancel = %v", seats)
+	}
+}
+
+func TestVagueReservationHandler(t *testing.T) {
+	m, c, teardown := setupHandlerTest(t)
+	defer teardown()
+	user := c.login(m, "isutrain@example.com")
+
+	// 座席を指定しなければ空いている席から選ぶ
+	reserve := map[string]interface{}{
+		"date":        "2020-01-01T05:00:00+09:00",
+		"train_class": "最速",
+		"train_name":  "1",
+		"seat_class":  "premium",
+		"departure":   "東京",
+		"arrival":     "大阪",
+		"adult":       2,
+		"Column":      "B",
+	}
+	reserved := TrainReservationResponse{}
+	if status := c.do("POST", "/api/train/reserve", reserve, &reserved); status != http.StatusOK || !reserved.IsOk {
+		t.Fatalf("reserve: status = %d, %+v", status, reserved)
+	}
+	seats, err := m.ListSeatReservations(context.Background(), reserved.ReservationId)
+	if err != nil || len(seats) != 2 || seats[0].CarNumber != 1 || seats[0].SeatColumn != "B" {
+		t.Fatalf("seats = %+v, %v", seats, err)
+	}
+
+	// 残りの2席も埋まると空席がない
+	if status := c.do("POST", "/api/train/reserve", reserve, nil); status != http.StatusOK {
+		t.Fatalf("second reserve: status = %d", status)
+	}
+	if status := c.do("POST", "/api/train/reserve", reserve, nil); status != http.StatusNotFound {
+		t.Errorf("full car: status = %d", status)
+	}
+	if list, _ := m.ListUserReservations(context.Background(), user.ID); len(list) != 2 {
+		t.Errorf("reservations = %v", list)
+	}
+}
+
+// 決済サービスが返金を断った場合は予約を残し、もう一度キャンセルできる
+func TestCancelReservationHandlerRefundDeclined(t *testing.T) {
+	m, c, teardown := setupHandlerTest(t)
+	defer teardown()
+	user := c.login(m, "isutrain@example.com")
+
+	reserve := map[string]interface{}{
+		"date":        "2020-01-01T05:00:00+09:00",
+		"train_class": "最速",
+		"train_name":  "1",
+		"car_number":  2,
+		"seat_class":  "reserved",
+		"departure":   "東京",
+		"arrival":     "名古屋",
+		"adult":       1,
+		"seats":       []RequestSeat{{Row: 1, Column: "A"}},
+	}
+	reserved := TrainReservationResponse{}
+	if status := c.do("POST", "/api/train/reserve", reserve, &reserved); status != http.StatusOK {
+		t.Fatalf("reserve: status = %d", status)
+	}
+	commit := ReservationPaymentRequest{CardToken: "card", ReservationId: int(reserved.ReservationId)}
+	if status := c.do("POST", "/api/train/reservation/commit", commit, nil); status != http.StatusOK {
+		t.Fatalf("commit: status = %d", status)
+	}
+
+	paymentURL := appConfig.Payment.URL
+	declining := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Payment Already Canceled"})
+	}))
+	defer declining.Close()
+	appConfig.Payment.URL = declining.URL
+	if status := c.do("POST", "/api/user/reservations/1/cancel", nil, nil); status != http.StatusBadGateway {
+		t.Errorf("cancel: status = %d", status)
+	}
+	reservation, err := m.UserReservation(context.Background(), reserved.ReservationId, user.ID)
+	if err != nil || reservation.Status != "done" {
+		t.Fatalf("reservation = %+v, %v", reservation, err)
+	}
+	if seats, _ := m.ListSeatReservations(context.Background(), reserved.ReservationId); len(seats) != 1 {
+		t.Errorf("seats = %v", seats)
+	}
+
+	appConfig.Payment.URL = paymentURL
+	if status := c.do("POST", "/api/user/reservations/1/cancel", nil, nil); status != http.StatusOK {
+		t.Errorf("retry: status = %d", status)
+	}
+	if _, err := m.UserReservation(context.Background(), reserved.ReservationId, user.ID); err != sql.ErrNoRows {
+		t.Errorf("reservation after cancel: %v", err)
+	}
+}
+
+func TestCalendarHandler(t *testing.T) {
+	m, c, teardown := setupHandlerTest(t)
+	defer teardown()
+	c.login(m, "isutrain@example.com")
+
+	reserve := map[string]interface{}{
+		"date":        "2020-01-01T05:00:00+09:00",
+		"train_class": "最速",
+		"train_name":  "1",
+		"car_number":  2,
+		"seat_class":  "reserved",
+		"departure":   "東京",
+		"arrival":     "大阪",
+		"adult":       1,
+		"seats":       []RequestSeat{{Row: 1, Column: "A"}},
+	}
+	paid := TrainReservationResponse{}
+	if status := c.do("POST", "/api/train/reserve", reserve, &paid); status != http.StatusOK {
+		t.Fatalf("reserve: status = %d", status)
+	}
+	commit := ReservationPaymentRequest{CardToken: "card", ReservationId: int(paid.ReservationId)}
+	if status := c.do("POST", "/api/train/reservation/commit", commit, nil); status != http.StatusOK {
+		t.Fatalf("commit: status = %d", status)
+	}
+	// 支払っていない予約はフィードに出さない
+	reserve["seats"] = []RequestSeat{{Row: 2, Column: "B"}}
+	if status := c.do("POST", "/api/train/reserve", reserve, nil); status != http.StatusOK {
+		t.Fatalf("second reserve: status = %d", status)
+	}
+
+	token := CalendarTokenResponse{}
+	if status := c.do("POST", "/api/user/calendar/token", nil, &token); status != http.StatusOK {
+		t.Fatalf("calendar token: status = %d", status)
+	}
+	// 購読用URLはクッキーなしで使える
+	resp, err := http.Get(token.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	ics := strings.Replace(string(b), "\r\n ", "", -1)
+	if resp.StatusCode != http.StatusOK || strings.Count(ics, "BEGIN:VEVENT") != 1 {
+		t.Fatalf("calendar: status = %d\n%s", resp.StatusCode, ics)
+	}
+	if !strings.Contains(ics, "LOCATION:東京 → 大阪 2号車 1A\r\n") {
+		t.Errorf("calendar does not locate the paid seat:\n%s", ics)
+	}
+
+	if status := c.do("DELETE", "/api/user/calendar/token", nil, nil); status != http.StatusOK {
+		t.Fatalf("delete calendar token: status = %d", status)
+	}
+	resp, err = http.Get(token.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("deleted token: status = %d", resp.StatusCode)
+	}
+}
+
+func TestAPITokenHandlers(t *testing.T) {
+	m, c, teardown := setupHandlerTest(t)
+	defer teardown()
+	c.login(m, "isutrain@example.com")
+
+	tokenClient := func(scopes ...string) *testClient {
+		issued := APITokenResponse{}
+		req := map[string]interface{}{"name": "script", "scopes": scopes}
+		if status := c.do("POST", "/api/user/tokens", req, &issued); status != http.StatusCreated {
+			t.Fatalf("create token: status = %d", status)
+		}
+		return &testClient{t: t, baseURL: c.baseURL, client: &http.Client{}, bearer: issued.Token}
+	}
+	reader := tokenClient(ScopeReadReservations)
+	writer := tokenClient(ScopeReadReservations, ScopeWriteReservations)
+
+	if status := reader.do("GET", "/api/user/reservations", nil, nil); status != http.StatusOK {
+		t.Errorf("read with read scope: status = %d", status)
+	}
+	reserve := map[string]interface{}{
+		"date":        "2020-01-01T05:00:00+09:00",
+		"train_class": "最速",
+		"train_name":  "1",
+		"car_number":  2,
+		"seat_class":  "reserved",
+		"departure":   "東京",
+		"arrival":     "名古屋",
+		"adult":       1,
+		"seats":       []RequestSeat{{Row: 1, Column: "A"}},
+	}
+	if status := reader.do("POST", "/api/train/reserve", reserve, nil); status != http.StatusForbidden {
+		t.Errorf("reserve with read scope: status = %d", status)
+	}
+	if status := writer.do("POST", "/api/train/reserve", reserve, nil); status != http.StatusOK {
+		t.Errorf("reserve with write scope: status = %d", status)
+	}
+
+	// アカウントの管理に使うAPIはスコープによらずトークンでは呼び出せない
+	for _, req := range []struct{ method, path string }{
+		{"GET", "/api/user/points"},
+		{"GET", "/api/user/reservations/1/receipt"},
+		{"POST", "/api/user/calendar/token"},
+		{"POST", "/api/auth/logout/all"},
+		{"GET", "/api/user/tokens"},
+		{"GET", "/api/user/tokens/1/usages"},
+	} {
+		if status := writer.do(req.method, req.path, nil, nil); status != http.StatusForbidden {
+			t.Errorf("%s %s with token: status = %d", req.method, req.path, status)
+		}
+	}
+
+	// トークンを付けると、セッションのクッキーがあってもトークンとして扱う
+	c.bearer = writer.bearer
+	if status := c.do("GET", "/api/user/tokens", nil, nil); status != http.StatusForbidden {
+		t.Errorf("token with session cookie: status = %d", status)
+	}
+	c.bearer = ""
+
+	usages := []APITokenUsage{}
+	if status := c.do("GET", "/api/user/tokens/2/usages", nil, &usages); status != http.StatusOK || len(usages) != 1 || usages[0].Path != "/api/train/reserve" {
+		t.Errorf("usages: status = %d, %+v", status, usages)
+	}
+	if status := c.do("DELETE", "/api/user/tokens/1", nil, nil); status != http.StatusOK {
+		t.Fatalf("revoke: status = %d", status)
+	}
+	if status := reader.do("GET", "/api/user/reservations", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("revoked token: status = %d", status)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	死活監視と graceful shutdown
+
+	GET /healthz はプロセスが動いていれば常に 200
+	GET /readyz は DB・決済API・キャッシュ (駅の索引) を確認し、どれかが使えなければ 503
+	SIGTERM / SIGINT を受けると、まず /readyz を 503 にしてロードバランサから外れるのを shutdown_delay だけ待ち、
+	新しい接続の受け付けをやめて処理中のリクエストが終わるのを shutdown_timeout まで待ってから終了する
+*/
+
+const readinessCheckTimeout = 2 * time.Second
+
+type readinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+var readinessChecks = []readinessCheck{
+	{"database", checkDatabase},
+	{"payment", checkPayment},
+	{"station_index", checkStationIndex},
+}
+
+// 終了処理を始めたら 1
+var draining int32
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+func checkDatabase(ctx context.Context) error {
+	return dbx.PingContext(ctx)
+}
+
+// checkPayment は決済APIに接続できるかを確かめる (応答のステータスは問わない)
+func checkPayment(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, appConfig.Payment.URL+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// checkStationIndex は駅の索引を読み込み済みにする
+func checkStationIndex(ctx context.Context) error {
+	_, err := loadStationIndex(ctx)
+	return err
+}
+
+func writeHealth(w http.ResponseWriter, status int, resp HealthResponse) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		プロセスの死活
+		GET /healthz
+	*/
+	writeHealth(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		リクエストを受け付けられるか
+		GET /readyz
+	*/
+	if isDraining() {
+		writeHealth(w, http.StatusServiceUnavailable, HealthResponse{Status: "draining"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(readinessChecks))
+	for _, c := range readinessChecks {
+		go func(c readinessCheck) {
+			results <- result{c.Name, c.Check(ctx)}
+		}(c)
+	}
+
+	resp := HealthResponse{Status: "ok", Checks: map[string]string{}}
+	status := http.StatusOK
+	for range readinessChecks {
+		res := <-results
+		if res.err != nil {
+			loggerFromContext(r.Context()).Warn("readiness check failed", "check", res.name, "error", res.err)
+			resp.Checks[res.name] = res.err.Error()
+			resp.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		resp.Checks[res.name] = "ok"
+	}
+	writeHealth(w, status, resp)
+}
+
+// serve は stop に通知が来るまで ln でリクエストを受け付け、処理中のリクエストを待ってから戻る
+func serve(srv *http.Server, ln net.Listener, stop <-chan os.Signal, delay, timeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-stop:
+		logger.Info("shutting down", "signal", sig.String())
+	}
+
+	atomic.StoreInt32(&draining, 1)
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("requests still in flight after %s: %s", timeout, err.Error())
+	}
+	return nil
+}
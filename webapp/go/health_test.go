@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	saved := readinessChecks
+	defer func() { readinessChecks = saved }()
+
+	ok := func(ctx context.Context) error { return nil }
+	readinessChecks = []readinessCheck{{"database", ok}, {"payment", ok}}
+
+	w := httptest.NewRecorder()
+	readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	readinessChecks = []readinessCheck{{"database", ok}, {"payment", func(ctx context.Context) error {
+		return errors.New("connection refused")
+	}}}
+	w = httptest.NewRecorder()
+	readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", w.Code)
+	}
+	resp := HealthResponse{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Status != "unavailable" || resp.Checks["database"] != "ok" || resp.Checks["payment"] != "connection refused" {
+		t.Errorf("resp = %+v", resp)
+	}
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	defer atomic.StoreInt32(&draining, 0)
+
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + ln.Addr().String()
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(&http.Server{Handler: mux}, ln, stop, 100*time.Millisecond, 5*time.Second)
+	}()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+
+	<-started
+	stop <- syscall.SIGTERM
+	time.Sleep(50 * time.Millisecond)
+
+	// 接続の受け付けをやめるまでは /readyz が 503 を返す
+	resp, err := http.Get(url + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("readyz while draining = %d, want 503", resp.StatusCode)
+	}
+
+	if got := <-body; got != "done" {
+		t.Errorf("in-flight request = %q, want done", got)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve = %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	構造化ログ
+
+	1件を1行の JSON (time・level・msg・caller と任意のフィールド) にして標準エラー出力に書く
+	log.level (LOG_LEVEL) より低いレベルのログは書かない。既定は info なので、検索・予約の途中経過を出す debug ログは出ない
+
+	requestIDMiddleware がリクエストごとに ID を振り、X-Request-ID ヘッダで返す
+		リクエストに X-Request-ID があればそれを使う (英数字と -_.: の64文字まで)
+		そのリクエストの処理中に loggerFromContext(ctx) で書いたログには request_id (トレース中なら trace_id も) が付く
+		ログイン中のユーザ・扱っている予約がわかった時点で setLogField で user_id・reservation_id を付け足す
+*/
+
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+func (l logLevel) String() string {
+	for name, level := range logLevelNames {
+		if level == l {
+			return name
+		}
+	}
+	return strconv.Itoa(int(l))
+}
+
+const requestIDHeader = "X-Request-ID"
+
+var (
+	minLogLevel = int32(levelInfo)
+
+	logOutputMu sync.Mutex
+	logOutput   io.Writer = os.Stderr
+)
+
+func logEnabled(level logLevel) bool {
+	return int32(level) >= atomic.LoadInt32(&minLogLevel)
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// Logger はログに付けるフィールドを持つ
+type Logger struct {
+	mu     sync.Mutex
+	fields []logField
+}
+
+// logger はリクエストの外 (起動時やバックグラウンドの処理) で使う
+var logger = &Logger{}
+
+// With は kv (キーと値を交互に並べる) のフィールドを付け足したロガーを返す
+func (l *Logger) With(kv ...interface{}) *Logger {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fields := make([]logField, len(l.fields), len(l.fields)+len(kv)/2)
+	copy(fields, l.fields)
+	return &Logger{fields: appendLogFields(fields, kv)}
+}
+
+// set はフィールドを付け足す (同じキーがあれば置き換える)
+func (l *Logger) set(key string, value interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.fields {
+		if l.fields[i].key == key {
+			l.fields[i].value = value
+			return
+		}
+	}
+	l.fields = append(l.fields, logField{key, value})
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+func (l *Logger) log(level logLevel, msg string, kv []interface{}) {
+	if !logEnabled(level) {
+		return
+	}
+	fields := []logField{
+		{"time", time.Now()},
+		{"level", level.String()},
+		{"msg", msg},
+	}
+	if _, file, line, ok := runtime.Caller(2); ok {
+		fields = append(fields, logField{"caller", filepath.Base(file) + ":" + strconv.Itoa(line)})
+	}
+	l.mu.Lock()
+	fields = append(fields, l.fields...)
+	l.mu.Unlock()
+	fields = appendLogFields(fields, kv)
+
+	buf := bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(f.key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(marshalLogValue(f.value))
+	}
+	buf.WriteString("}\n")
+
+	logOutputMu.Lock()
+	defer logOutputMu.Unlock()
+	logOutput.Write(buf.Bytes())
+}
+
+func appendLogFields(fields []logField, kv []interface{}) []logField {
+	for i := 0; i < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+		var value interface{}
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		fields = append(fields, logField{key, value})
+	}
+	return fields
+}
+
+func marshalLogValue(v interface{}) []byte {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return b
+}
+
+type loggerContextKey struct{}
+
+// loggerFromContext はリクエストのロガーを返す (リクエストの外なら logger)
+func loggerFromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerContextKey{}).(*Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// setLogField はこのリクエストの以降のログにフィールドを付ける (リクエストの外なら何もしない)
+func setLogField(ctx context.Context, key string, value interface{}) {
+	if l, ok := ctx.Value(loggerContextKey{}).(*Logger); ok {
+		l.set(key, value)
+	}
+}
+
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !isValidRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		l := logger.With("request_id", id)
+		if s := spanFromContext(r.Context()); s != nil {
+			l.set("trace_id", hex.EncodeToString(s.sc.TraceID[:]))
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loggerContextKey{}, l)))
+	})
+}
+
+func configureLogging(cfg LogConfig) error {
+	level, ok := logLevelNames[cfg.Level]
+	if !ok {
+		return fmt.Errorf("unknown log level %q", cfg.Level)
+	}
+	atomic.StoreInt32(&minLogLevel, int32(level))
+	return nil
+}
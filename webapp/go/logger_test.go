@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// captureLogs はログを level 以上で buf に書くようにし、元に戻す関数を返す
+func captureLogs(level string) (*bytes.Buffer, func()) {
+	buf := &bytes.Buffer{}
+	savedOutput, savedLevel := logOutput, atomic.LoadInt32(&minLogLevel)
+	logOutput = buf
+	configureLogging(LogConfig{Level: level})
+	return buf, func() {
+		logOutput = savedOutput
+		atomic.StoreInt32(&minLogLevel, savedLevel)
+	}
+}
+
+func decodeLogs(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	entries := []map[string]interface{}{}
+	sc := bufio.NewScanner(buf)
+	for sc.Scan() {
+		e := map[string]interface{}{}
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("%v: %s", err, sc.Text())
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestLogLevel(t *testing.T) {
+	buf, restore := captureLogs("info")
+	defer restore()
+
+	logger.Debug("fare multiplier", "multiplier", 1.5)
+	logger.Error("payment declined", "status", 400, "error", errors.New("card expired"))
+	entries := decodeLogs(t, buf)
+	if len(entries) != 1 {
+		t.Fatalf("entries = %v, want only the error", entries)
+	}
+	e := entries[0]
+	if e["level"] != "error" || e["msg"] != "payment declined" || e["status"] != 400.0 || e["error"] != "card expired" {
+		t.Errorf("entry = %v", e)
+	}
+	if caller, _ := e["caller"].(string); !strings.HasPrefix(caller, "logger_test.go:") {
+		t.Errorf("caller = %q", caller)
+	}
+
+	configureLogging(LogConfig{Level: "debug"})
+	logger.Debug("fare multiplier", "multiplier", 1.5)
+	if entries := decodeLogs(t, buf); len(entries) != 1 || entries[0]["level"] != "debug" {
+		t.Errorf("entries = %v", entries)
+	}
+
+	if err := configureLogging(LogConfig{Level: "verbose"}); err == nil {
+		t.Error("unknown level accepted")
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	buf, restore := captureLogs("info")
+	defer restore()
+
+	h := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setLogField(r.Context(), "user_id", int64(7))
+		setLogField(r.Context(), "reservation_id", int64(42))
+		loggerFromContext(r.Context()).Error("payment unavailable")
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/train/reservation/commit", nil))
+	id := w.Header().Get(requestIDHeader)
+	if len(id) != 16 {
+		t.Fatalf("X-Request-ID = %q", id)
+	}
+	entries := decodeLogs(t, buf)
+	if len(entries) != 1 || entries[0]["request_id"] != id || entries[0]["user_id"] != 7.0 || entries[0]["reservation_id"] != 42.0 {
+		t.Errorf("entries = %v", entries)
+	}
+
+	// 上流で振られた ID は引き継ぎ、ログを壊すような値は使わない
+	for header, reuse := range map[string]bool{
+		"nginx-0f1e2d3c":                   true,
+		"abc\"}\n{\"level\":\"error\"":     false,
+		strings.Repeat("a", 65):            false,
+		"2c4a0d1f-5c1e-4a5b-9d6e-7f8a9b0c": true,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/stations", nil)
+		req.Header.Set(requestIDHeader, header)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if got := w.Header().Get(requestIDHeader); (got == header) != reuse {
+			t.Errorf("X-Request-ID %q -> %q", header, got)
+		}
+	}
+
+	// リクエストのフィールドはほかのリクエストや logger に漏れない
+	buf.Reset()
+	logger.Error("outside")
+	if entries := decodeLogs(t, buf); len(entries) != 1 || entries[0]["request_id"] != nil || entries[0]["user_id"] != nil {
+		t.Errorf("entries = %v", entries)
+	}
+}
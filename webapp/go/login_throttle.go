@@ -0,0 +1,289 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+	ログイン試行の制限
+
+	アカウント (メールアドレス) ごとと接続元IPごとに、直近 Window の失敗回数を数える
+		- アカウント: 失敗するたびに次の試行まで BaseDelay, 2*BaseDelay, 4*BaseDelay ... (MaxDelay まで) 待たせる
+		- どちらも失敗回数が上限に達したら LockoutDuration の間ロックする
+	待つ必要がある場合は 429 と Retry-After を返す (パスワードの照合より前に判定する)
+	ログインに成功したらアカウントの失敗回数はリセットする
+*/
+
+type LoginAttemptStore interface {
+	AddFailure(key string, at time.Time) error
+	// Failures は since 以降の失敗時刻を古い順に返す
+	Failures(key string, since time.Time) ([]time.Time, error)
+	Reset(key string) error
+	SetLockout(key string, until time.Time) error
+	// Lockout はロック解除時刻を返す (ロックされていなければゼロ値)
+	Lockout(key string) (time.Time, error)
+	DeleteAll() error
+}
+
+type LoginThrottle struct {
+	Store LoginAttemptStore
+
+	Window              time.Duration
+	MaxAccountFailures  int
+	MaxIPFailures       int
+	LockoutDuration     time.Duration
+	BaseDelay, MaxDelay time.Duration
+}
+
+var loginThrottle = &LoginThrottle{
+	Store:              NewMemoryLoginAttemptStore(),
+	Window:             15 * time.Minute,
+	MaxAccountFailures: 10,
+	MaxIPFailures:      100,
+	LockoutDuration:    15 * time.Minute,
+	BaseDelay:          time.Second,
+	MaxDelay:           30 * time.Second,
+}
+
+// プロキシの X-Forwarded-For を接続元として信用するかどうか
+var trustProxyHeaders = false
+
+func accountThrottleKey(email string) string { return "account:" + strings.ToLower(email) }
+func ipThrottleKey(ip string) string         { return "ip:" + ip }
+
+// Wait はログインを試行できるようになるまでの時間を返す
+func (t *LoginThrottle) Wait(now time.Time, email, ip string) (time.Duration, error) {
+	accountWait, err := t.wait(now, accountThrottleKey(email), true)
+	if err != nil {
+		return 0, err
+	}
+	ipWait, err := t.wait(now, ipThrottleKey(ip), false)
+	if err != nil {
+		return 0, err
+	}
+	if ipWait > accountWait {
+		return ipWait, nil
+	}
+	return accountWait, nil
+}
+
+func (t *LoginThrottle) wait(now time.Time, key string, progressive bool) (time.Duration, error) {
+	until, err := t.Store.Lockout(key)
+	if err != nil {
+		return 0, err
+	}
+	if until.After(now) {
+		return until.Sub(now), nil
+	}
+	if !progressive {
+		return 0, nil
+	}
+
+	failures, err := t.Store.Failures(key, now.Add(-t.Window))
+	if err != nil || len(failures) == 0 {
+		return 0, err
+	}
+	next := failures[len(failures)-1].Add(t.delay(len(failures)))
+	if next.After(now) {
+		return next.Sub(now), nil
+	}
+	return 0, nil
+}
+
+// delay は n 回目の失敗の後に待たせる時間
+func (t *LoginThrottle) delay(n int) time.Duration {
+	d := float64(t.BaseDelay) * math.Pow(2, float64(n-1))
+	if d > float64(t.MaxDelay) {
+		return t.MaxDelay
+	}
+	return time.Duration(d)
+}
+
+func (t *LoginThrottle) Failure(now time.Time, email, ip string) error {
+	if err := t.addFailure(now, accountThrottleKey(email), t.MaxAccountFailures); err != nil {
+		return err
+	}
+	return t.addFailure(now, ipThrottleKey(ip), t.MaxIPFailures)
+}
+
+func (t *LoginThrottle) addFailure(now time.Time, key string, max int) error {
+	if err := t.Store.AddFailure(key, now); err != nil {
+		return err
+	}
+	failures, err := t.Store.Failures(key, now.Add(-t.Window))
+	if err != nil {
+		return err
+	}
+	if max > 0 && len(failures) >= max {
+		return t.Store.SetLockout(key, now.Add(t.LockoutDuration))
+	}
+	return nil
+}
+
+func (t *LoginThrottle) Success(email string) error {
+	return t.Store.Reset(accountThrottleKey(email))
+}
+
+// tooManyRequestsResponse は Retry-After を付けて 429 を返す
+func tooManyRequestsResponse(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	errorResponse(w, r, ErrTooManyLoginAttempts)
+}
+
+func clientIP(r *http.Request) string {
+	if trustProxyHeaders {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			return strings.TrimSpace(strings.Split(xff, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// 設定からログイン試行の制限を設定する
+func configureLoginThrottle(db *sqlx.DB, cfg LoginThrottleConfig) {
+	if cfg.Store == "mysql" {
+		loginThrottle.Store = NewMySQLLoginAttemptStore(db)
+	}
+	trustProxyHeaders = appConfig.Features.TrustProxyHeaders
+
+	loginThrottle.Window = time.Duration(cfg.Window)
+	loginThrottle.MaxAccountFailures = cfg.MaxAccountFailures
+	loginThrottle.MaxIPFailures = cfg.MaxIPFailures
+	loginThrottle.LockoutDuration = time.Duration(cfg.Lockout)
+	loginThrottle.BaseDelay = time.Duration(cfg.BaseDelay)
+	loginThrottle.MaxDelay = time.Duration(cfg.MaxDelay)
+}
+
+// MySQLLoginAttemptStore は login_failures, login_lockouts テーブルに保存する
+type MySQLLoginAttemptStore struct {
+	db *sqlx.DB
+}
+
+func NewMySQLLoginAttemptStore(db *sqlx.DB) *MySQLLoginAttemptStore {
+	return &MySQLLoginAttemptStore{db: db}
+}
+
+func (s *MySQLLoginAttemptStore) AddFailure(key string, at time.Time) error {
+	_, err := s.db.Exec("INSERT INTO `login_failures` (`throttle_key`, `failed_at`) VALUES (?, ?)", key, at)
+	return err
+}
+
+func (s *MySQLLoginAttemptStore) Failures(key string, since time.Time) ([]time.Time, error) {
+	failures := []time.Time{}
+	err := s.db.Select(&failures, "SELECT `failed_at` FROM `login_failures` WHERE `throttle_key` = ? AND `failed_at` >= ? ORDER BY `failed_at`", key, since)
+	return failures, err
+}
+
+func (s *MySQLLoginAttemptStore) Reset(key string) error {
+	if _, err := s.db.Exec("DELETE FROM `login_failures` WHERE `throttle_key` = ?", key); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM `login_lockouts` WHERE `throttle_key` = ?", key)
+	return err
+}
+
+func (s *MySQLLoginAttemptStore) SetLockout(key string, until time.Time) error {
+	_, err := s.db.Exec(
+		"INSERT INTO `login_lockouts` (`throttle_key`, `locked_until`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `locked_until` = VALUES(`locked_until`)",
+		key, until,
+	)
+	return err
+}
+
+func (s *MySQLLoginAttemptStore) Lockout(key string) (time.Time, error) {
+	var until time.Time
+	err := s.db.Get(&until, "SELECT `locked_until` FROM `login_lockouts` WHERE `throttle_key` = ?", key)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return until, err
+}
+
+func (s *MySQLLoginAttemptStore) DeleteAll() error {
+	if _, err := s.db.Exec("TRUNCATE `login_failures`"); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("TRUNCATE `login_lockouts`")
+	return err
+}
+
+// MemoryLoginAttemptStore はプロセス内に保持する
+type MemoryLoginAttemptStore struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	lockouts map[string]time.Time
+}
+
+func NewMemoryLoginAttemptStore() *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{
+		failures: map[string][]time.Time{},
+		lockouts: map[string]time.Time{},
+	}
+}
+
+func (s *MemoryLoginAttemptStore) AddFailure(key string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[key] = append(s.failures[key], at)
+	return nil
+}
+
+func (s *MemoryLoginAttemptStore) Failures(key string, since time.Time) ([]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 窓から外れた失敗はここで捨てる
+	recent := []time.Time{}
+	for _, at := range s.failures[key] {
+		if !at.Before(since) {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) == 0 {
+		delete(s.failures, key)
+	} else {
+		s.failures[key] = recent
+	}
+	return append([]time.Time{}, recent...), nil
+}
+
+func (s *MemoryLoginAttemptStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.failures, key)
+	delete(s.lockouts, key)
+	return nil
+}
+
+func (s *MemoryLoginAttemptStore) SetLockout(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lockouts[key] = until
+	return nil
+}
+
+func (s *MemoryLoginAttemptStore) Lockout(key string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lockouts[key], nil
+}
+
+func (s *MemoryLoginAttemptStore) DeleteAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = map[string][]time.Time{}
+	s.lockouts = map[string]time.Time{}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestLoginThrottle() *LoginThrottle {
+	return &LoginThrottle{
+		Store:              NewMemoryLoginAttemptStore(),
+		Window:             15 * time.Minute,
+		MaxAccountFailures: 4,
+		MaxIPFailures:      6,
+		LockoutDuration:    10 * time.Minute,
+		BaseDelay:          time.Second,
+		MaxDelay:           3 * time.Second,
+	}
+}
+
+func TestLoginThrottleProgressiveDelay(t *testing.T) {
+	throttle := newTestLoginThrottle()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// 失敗ごとに 1s, 2s, 3s(上限) 待たせる
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		if err := throttle.Failure(now, "a@example.com", "192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+		wait, err := throttle.Wait(now, "a@example.com", "192.0.2.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != want {
+			t.Errorf("after %d failures: wait = %v, want %v", i+1, wait, want)
+		}
+		now = now.Add(wait)
+	}
+
+	// 別のアカウントには影響しない
+	if wait, _ := throttle.Wait(now, "b@example.com", "192.0.2.1"); wait != 0 {
+		t.Errorf("other account: wait = %v, want 0", wait)
+	}
+
+	// 上限に達したらロックし、成功してもIPのロックは残る
+	throttle.Failure(now, "a@example.com", "192.0.2.1")
+	if wait, _ := throttle.Wait(now, "a@example.com", "192.0.2.2"); wait != 10*time.Minute {
+		t.Errorf("locked account: wait = %v, want 10m", wait)
+	}
+	if err := throttle.Success("a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, _ := throttle.Wait(now, "a@example.com", "192.0.2.2"); wait != 0 {
+		t.Errorf("after success: wait = %v, want 0", wait)
+	}
+}
+
+func TestLoginThrottleIPLockout(t *testing.T) {
+	throttle := newTestLoginThrottle()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// アカウントを変えながら同じIPから失敗させる
+	for _, email := range []string{"a@x.jp", "b@x.jp", "c@x.jp", "d@x.jp", "e@x.jp", "f@x.jp"} {
+		throttle.Failure(now, email, "192.0.2.1")
+	}
+	if wait, _ := throttle.Wait(now, "g@x.jp", "192.0.2.1"); wait != 10*time.Minute {
+		t.Errorf("locked ip: wait = %v, want 10m", wait)
+	}
+	if wait, _ := throttle.Wait(now, "g@x.jp", "192.0.2.2"); wait != 0 {
+		t.Errorf("other ip: wait = %v, want 0", wait)
+	}
+
+	// 窓を過ぎれば数え直す
+	now = now.Add(16 * time.Minute)
+	if wait, _ := throttle.Wait(now, "g@x.jp", "192.0.2.1"); wait != 0 {
+		t.Errorf("after window: wait = %v, want 0", wait)
+	}
+}
+
+func TestTooManyRequestsResponse(t *testing.T) {
+	w := httptest.NewRecorder()
+	tooManyRequestsResponse(w, httptest.NewRequest("POST", "/api/auth/login", nil), 1500*time.Millisecond)
+	if w.Code != 429 {
+		t.Errorf("status = %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want \"2\"", got)
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"goji.io/pat"
+)
+
+/*
+	ポイント
+
+	支払いが完了した予約に、乗車距離 (station_master.distance の差) と座席クラスに応じたポイントを付与する
+		付与ポイント = floor(距離 × 座席クラスごとの倍率) × 人数
+	1ポイント = 1円として予約時に use_points で運賃の一部に充てられる (割引後の運賃を超える分は使わない)
+	予約をキャンセルすると付与したポイントを取り消し、予約に使ったポイントは戻す
+
+	point_ledger はポイントの増減をすべて記録する台帳
+		付与・返還・加算調整の行は remaining (未使用の残り) と expires_at を持ち、使うときは有効期限の近いものから減らす
+		有効期限を過ぎた残りは expirePoints で expire の行として台帳に記録する
+	ユーザごとの操作は users の行を FOR UPDATE でロックして直列化する
+	付与規定は設定 loyalty.policy_file (LOYALTY_POLICY_FILE) の JSON で変更できる。未設定なら defaultLoyaltyPolicy
+*/
+
+const (
+	PointEarn    = "earn"
+	PointRedeem  = "redeem"
+	PointReverse = "reverse"
+	PointRestore = "restore"
+	PointAdjust  = "adjust"
+	PointExpire  = "expire"
+)
+
+type LoyaltyPolicy struct {
+	// 座席クラスごとの 1km あたりのポイント
+	PointsPerKm map[string]float64 `json:"points_per_km"`
+	// 付与・返還したポイントの有効期間
+	ExpiryDays int `json:"expiry_days"`
+}
+
+type PointEntry struct {
+	ID            int64      `json:"id" db:"id"`
+	UserID        int64      `json:"-" db:"user_id"`
+	ReservationID *int64     `json:"reservation_id" db:"reservation_id"`
+	Kind          string     `json:"kind" db:"kind"`
+	Points        int        `json:"points" db:"points"`
+	Remaining     int        `json:"-" db:"remaining"`
+	ExpiresAt     *time.Time `json:"expires_at" db:"expires_at"`
+	Note          string     `json:"note" db:"note"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+}
+
+type PointExpiry struct {
+	Points    int       `json:"points" db:"points"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+}
+
+type PointsResponse struct {
+	Balance  int           `json:"balance"`
+	Expiring []PointExpiry `json:"expiring"`
+	History  []PointEntry  `json:"history"`
+}
+
+type PointAdjustmentRequest struct {
+	Points int    `json:"points" validate:"required"`
+	Note   string `json:"note" validate:"required,max=255"`
+}
+
+type PointAdjustmentResponse struct {
+	UserID  int64 `json:"user_id"`
+	Points  int   `json:"points"`
+	Balance int   `json:"balance"`
+}
+
+var defaultLoyaltyPolicy = LoyaltyPolicy{
+	PointsPerKm: map[string]float64{
+		"premium":      2,
+		"reserved":     1,
+		"non-reserved": 0.5,
+	},
+	ExpiryDays: 365,
+}
+
+var loyaltyPolicy = defaultLoyaltyPolicy
+
+const pointHistoryLimit = 50
+
+func (p LoyaltyPolicy) Validate() error {
+	if p.ExpiryDays <= 0 {
+		return fmt.Errorf("expiry_days must be positive")
+	}
+	for seatClass, rate := range p.PointsPerKm {
+		if _, ok := SeatClassLabels[seatClass]; !ok {
+			return fmt.Errorf("points_per_km: unknown seat class %q", seatClass)
+		}
+		if rate < 0 {
+			return fmt.Errorf("points_per_km.%s must not be negative", seatClass)
+		}
+	}
+	return nil
+}
+
+// Points は乗車距離 distance の予約に付与するポイント
+func (p LoyaltyPolicy) Points(distance float64, seatClass string, passengers int) int {
+	return int(math.Abs(distance)*p.PointsPerKm[seatClass]) * passengers
+}
+
+func (p LoyaltyPolicy) expiresAt(now time.Time) time.Time {
+	return now.AddDate(0, 0, p.ExpiryDays)
+}
+
+// lockPointAccount はユーザのポイント操作を直列化する
+func lockPointAccount(tx *sqlx.Tx, userID int64) error {
+	var id int64
+	return tx.Get(&id, "SELECT `id` FROM `users` WHERE `id` = ? FOR UPDATE", userID)
+}
+
+// expirePoints は有効期限を過ぎた残りを失効させる
+func expirePoints(tx *sqlx.Tx, userID int64, now time.Time) error {
+	lots := []PointEntry{}
+	err := tx.Select(&lots, "SELECT * FROM `point_ledger` WHERE `user_id` = ? AND `remaining` > 0 AND `expires_at` <= ? FOR UPDATE", userID, now)
+	if err != nil {
+		return err
+	}
+	for _, lot := range lots {
+		if _, err := tx.Exec("UPDATE `point_ledger` SET `remaining` = 0 WHERE `id` = ?", lot.ID); err != nil {
+			return err
+		}
+		if err := insertPointEntry(tx, userID, nil, PointExpire, -lot.Remaining, 0, nil, "", now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pointBalance(q sqlx.Queryer, userID int64, now time.Time) (int, error) {
+	var balance int
+	err := sqlx.Get(q, &balance,
+		"SELECT COALESCE(SUM(`remaining`), 0) FROM `point_ledger` WHERE `user_id` = ? AND `remaining` > 0 AND (`expires_at` IS NULL OR `expires_at` > ?)",
+		userID, now,
+	)
+	return balance, err
+}
+
+func insertPointEntry(tx *sqlx.Tx, userID int64, reservationID *int64, kind string, points, remaining int, expiresAt *time.Time, note string, now time.Time) error {
+	_, err := tx.Exec(
+		"INSERT INTO `point_ledger` (`user_id`, `reservation_id`, `kind`, `points`, `remaining`, `expires_at`, `note`, `created_at`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		userID, reservationID, kind, points, remaining, expiresAt, note, now,
+	)
+	return err
+}
+
+// grantPoints は有効期限つきのポイントを加える
+func grantPoints(tx *sqlx.Tx, userID int64, reservationID *int64, kind string, points int, note string, now time.Time) error {
+	expiresAt := loyaltyPolicy.expiresAt(now)
+	return insertPointEntry(tx, userID, reservationID, kind, points, points, &expiresAt, note, now)
+}
+
+// consumePoints は有効期限の近いものから最大 points だけ減らし、減らした量を返す
+// 台帳への記録は呼び出し側で行う
+func consumePoints(tx *sqlx.Tx, userID int64, points int, now time.Time) (int, error) {
+	lots := []PointEntry{}
+	err := tx.Select(&lots,
+		"SELECT * FROM `point_ledger` WHERE `user_id` = ? AND `remaining` > 0 AND (`expires_at` IS NULL OR `expires_at` > ?) ORDER BY `expires_at` IS NULL, `expires_at`, `id` FOR UPDATE",
+		userID, now,
+	)
+	if err != nil {
+		return 0, err
+	}
+	consumed := 0
+	for _, lot := range lots {
+		if consumed >= points {
+			break
+		}
+		n := lot.Remaining
+		if n > points-consumed {
+			n = points - consumed
+		}
+		if _, err := tx.Exec("UPDATE `point_ledger` SET `remaining` = `remaining` - ? WHERE `id` = ?", n, lot.ID); err != nil {
+			return consumed, err
+		}
+		consumed += n
+	}
+	return consumed, nil
+}
+
+// redeemPoints は予約に points を使う (ctx は repo.BeginTx で始めたトランザクション)
+func redeemPoints(ctx context.Context, userID, reservationID int64, points int, now time.Time) ErrorCode {
+	tx, ok := sqlTx(ctx)
+	if !ok {
+		// 台帳がなければ残高は0
+		return ErrInsufficientPoints
+	}
+	if err := lockPointAccount(tx, userID); err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return ErrDatabase
+	}
+	if err := expirePoints(tx, userID, now); err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return ErrDatabase
+	}
+	balance, err := pointBalance(tx, userID, now)
+	if err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return ErrDatabase
+	}
+	if balance < points {
+		return ErrInsufficientPoints
+	}
+	if _, err := consumePoints(tx, userID, points, now); err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return ErrDatabase
+	}
+	if err := insertPointEntry(tx, userID, &reservationID, PointRedeem, -points, 0, nil, "", now); err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return ErrDatabase
+	}
+	return ""
+}
+
+// earnPoints は支払いが完了した予約にポイントを付与する (ctx は repo.BeginTx で始めたトランザクション)
+func earnPoints(ctx context.Context, reservation Reservation, now time.Time) error {
+	tx, ok := sqlTx(ctx)
+	if !ok {
+		return nil
+	}
+	resp, err := makeReservationResponse(ctx, reservation)
+	if err != nil {
+		return err
+	}
+	from, err := repo.StationByName(ctx, reservation.Departure)
+	if err != nil {
+		return err
+	}
+	to, err := repo.StationByName(ctx, reservation.Arrival)
+	if err != nil {
+		return err
+	}
+
+	points := loyaltyPolicy.Points(to.Distance-from.Distance, resp.SeatClass, reservation.passengerCounts().Total())
+	if points <= 0 {
+		return nil
+	}
+	reservationID := int64(reservation.ReservationId)
+	return grantPoints(tx, int64(*reservation.UserId), &reservationID, PointEarn, points, "", now)
+}
+
+// reversePoints はキャンセルした予約で付与したポイントを取り消し、使ったポイントを戻す
+// 付与したポイントを既に使っている場合は残高から差し引く (残高を超える分は差し引かない)
+func reversePoints(ctx context.Context, reservation Reservation, now time.Time) error {
+	tx, ok := sqlTx(ctx)
+	if !ok {
+		return nil
+	}
+	userID := int64(*reservation.UserId)
+	reservationID := int64(reservation.ReservationId)
+	if err := lockPointAccount(tx, userID); err != nil {
+		return err
+	}
+	if err := expirePoints(tx, userID, now); err != nil {
+		return err
+	}
+
+	earned := PointEntry{}
+	err := tx.Get(&earned, "SELECT * FROM `point_ledger` WHERE `reservation_id` = ? AND `kind` = ? FOR UPDATE", reservationID, PointEarn)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		reversed := earned.Remaining
+		if _, err := tx.Exec("UPDATE `point_ledger` SET `remaining` = 0 WHERE `id` = ?", earned.ID); err != nil {
+			return err
+		}
+		consumed, err := consumePoints(tx, userID, earned.Points-reversed, now)
+		if err != nil {
+			return err
+		}
+		reversed += consumed
+		if reversed > 0 {
+			if err := insertPointEntry(tx, userID, &reservationID, PointReverse, -reversed, 0, nil, "", now); err != nil {
+				return err
+			}
+		}
+	}
+
+	if reservation.PointsUsed > 0 {
+		return grantPoints(tx, userID, &reservationID, PointRestore, reservation.PointsUsed, "", now)
+	}
+	return nil
+}
+
+func userPointsHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		ポイント残高・失効予定・履歴
+		GET /api/user/points
+	*/
+	user, errCode := getSessionUser(r)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
+		return
+	}
+
+	now := clock.Now()
+	tx, err := dbx.BeginTxx(r.Context(), nil)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if err := lockPointAccount(tx, user.ID); err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if err := expirePoints(tx, user.ID, now); err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	resp := PointsResponse{Expiring: []PointExpiry{}, History: []PointEntry{}}
+	balance, err := pointBalance(tx, user.ID, now)
+	if err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	resp.Balance = balance
+	err = tx.Select(&resp.Expiring,
+		"SELECT SUM(`remaining`) AS `points`, `expires_at` FROM `point_ledger` WHERE `user_id` = ? AND `remaining` > 0 AND `expires_at` IS NOT NULL GROUP BY `expires_at` ORDER BY `expires_at`",
+		user.ID,
+	)
+	if err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	err = tx.Select(&resp.History, "SELECT * FROM `point_ledger` WHERE `user_id` = ? ORDER BY `id` DESC LIMIT ?", user.ID, pointHistoryLimit)
+	if err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func adminAdjustPointsHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		ポイントの調整 (正の値で加算、負の値で減算)
+		POST /api/admin/users/:user_id/points
+	*/
+	userID, err := strconv.ParseInt(pat.Param(r, "user_id"), 10, 64)
+	if err != nil || userID <= 0 {
+		errorResponse(w, r, ErrInvalidRequest)
+		return
+	}
+	req := PointAdjustmentRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errorResponse(w, r, ErrInvalidRequest)
+		return
+	}
+	if verrs := validateStruct(req); len(verrs) > 0 {
+		validationErrorResponse(w, r, verrs)
+		return
+	}
+
+	now := clock.Now()
+	tx, err := dbx.BeginTxx(r.Context(), nil)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	err = lockPointAccount(tx, userID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		errorResponse(w, r, ErrTargetUserNotFound)
+		return
+	}
+	if err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if err := expirePoints(tx, userID, now); err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	if req.Points > 0 {
+		err = grantPoints(tx, userID, nil, PointAdjust, req.Points, req.Note, now)
+	} else {
+		balance, berr := pointBalance(tx, userID, now)
+		if berr != nil {
+			tx.Rollback()
+			loggerFromContext(r.Context()).Error(berr.Error())
+			errorResponse(w, r, ErrDatabase)
+			return
+		}
+		if balance < -req.Points {
+			tx.Rollback()
+			errorResponse(w, r, ErrInsufficientPoints)
+			return
+		}
+		if _, err := consumePoints(tx, userID, -req.Points, now); err != nil {
+			tx.Rollback()
+			loggerFromContext(r.Context()).Error(err.Error())
+			errorResponse(w, r, ErrDatabase)
+			return
+		}
+		err = insertPointEntry(tx, userID, nil, PointAdjust, req.Points, 0, nil, req.Note, now)
+	}
+	if err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	balance, err := pointBalance(tx, userID, now)
+	if err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(PointAdjustmentResponse{UserID: userID, Points: req.Points, Balance: balance})
+}
+
+// 設定のファイルからポイントの付与規定を設定する
+func configureLoyaltyPolicy(cfg LoyaltyConfig) error {
+	if cfg.PolicyFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(cfg.PolicyFile)
+	if err != nil {
+		return err
+	}
+	policy := LoyaltyPolicy{}
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return err
+	}
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	loyaltyPolicy = policy
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoyaltyPolicyPoints(t *testing.T) {
+	cases := []struct {
+		distance   float64
+		seatClass  string
+		passengers int
+		want       int
+	}{
+		{100.5, "reserved", 1, 100},
+		{-100.5, "reserved", 1, 100}, // 上りでも距離は正
+		{100.5, "premium", 2, 402},
+		{100.5, "non-reserved", 3, 150},
+		{100, "unknown", 1, 0},
+		{0, "premium", 1, 0},
+	}
+	for _, c := range cases {
+		if got := defaultLoyaltyPolicy.Points(c.distance, c.seatClass, c.passengers); got != c.want {
+			t.Errorf("Points(%v, %s, %d) = %d, want %d", c.distance, c.seatClass, c.passengers, got, c.want)
+		}
+	}
+}
+
+func TestLoyaltyPolicyValidate(t *testing.T) {
+	if err := defaultLoyaltyPolicy.Validate(); err != nil {
+		t.Fatalf("default policy is invalid: %v", err)
+	}
+	for _, p := range []LoyaltyPolicy{
+		{ExpiryDays: 0},
+		{ExpiryDays: 30, PointsPerKm: map[string]float64{"first": 1}},
+		{ExpiryDays: 30, PointsPerKm: map[string]float64{"premium": -1}},
+	} {
+		if err := p.Validate(); err == nil {
+			t.Errorf("%+v should be invalid", p)
+		}
+	}
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, jst)
+	if got := defaultLoyaltyPolicy.expiresAt(now); !got.Equal(time.Date(2020, 12, 31, 0, 0, 0, 0, jst)) {
+		t.Errorf("expiresAt = %v", got)
+	}
+}
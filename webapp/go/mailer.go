@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+	メール送信
+
+	設定 mail.mailer (MAILER) で送信方法を選ぶ
+		smtp  mail.smtp_addr (host:port) のサーバから mail.from で送る (mail.smtp_username があれば PLAIN 認証)
+		file  mail.dir に1通1ファイル (.eml) で書き出す (開発・テスト用)
+		log   宛先と件名だけをログに出力する (既定)。本文の確認用トークンは出さない
+*/
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(m Mail) error
+}
+
+var mailer Mailer = LogMailer{}
+
+// message は RFC 5322 形式のメールを組み立てる
+func (m Mail) message(from string, date time.Time) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.Replace(m.Body, "\n", "\r\n", -1))
+	return buf.Bytes()
+}
+
+type SMTPMailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (s SMTPMailer) Send(m Mail) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	// エンベロープには表示名を除いたアドレスを使う
+	envelopeFrom := s.From
+	if addr, err := mail.ParseAddress(s.From); err == nil {
+		envelopeFrom = addr.Address
+	}
+	return smtp.SendMail(s.Addr, auth, envelopeFrom, []string{m.To}, m.message(s.From, time.Now()))
+}
+
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (f FileMailer) Send(m Mail) error {
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s.eml", now.Format("20060102T150405.000000000"), secureRandomStr(4))
+	return ioutil.WriteFile(filepath.Join(f.Dir, name), m.message(f.From, now), 0644)
+}
+
+type LogMailer struct{}
+
+// 本文には確認用・再設定用のトークンが入るのでログに出さない
+func (LogMailer) Send(m Mail) error {
+	logger.Info("mail", "to", m.To, "subject", m.Subject)
+	return nil
+}
+
+// 設定からメール送信方法を設定する (値は loadConfig で検証済み)
+func configureMailer(cfg MailConfig) error {
+	switch cfg.Mailer {
+	case "log":
+		mailer = LogMailer{}
+	case "file":
+		if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+			return err
+		}
+		mailer = FileMailer{Dir: cfg.Dir, From: cfg.From}
+	case "smtp":
+		mailer = SMTPMailer{
+			Addr:     cfg.SMTPAddr,
+			From:     cfg.From,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+		}
+	default:
+		return fmt.Errorf("unknown mailer: %s", cfg.Mailer)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := FileMailer{Dir: dir, From: "noreply@isutrain.example.com"}
+	err = m.Send(Mail{To: "user@example.com", Subject: "[ISUTRAIN] メールアドレスの確認", Body: "line1\nline2\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("got %d files, want 1", len(files))
+	}
+	b, _ := ioutil.ReadFile(files[0])
+	msg := string(b)
+	for _, want := range []string{
+		"To: user@example.com\r\n",
+		"Subject: =?UTF-8?b?",
+		"Content-Type: text/plain; charset=UTF-8\r\n",
+		"\r\n\r\nline1\r\nline2\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message does not contain %q:\n%s", want, msg)
+		}
+	}
+}
+
+// 本文のトークンをログに残さない
+func TestLogMailerOmitsBody(t *testing.T) {
+	buf, restore := captureLogs("info")
+	defer restore()
+
+	err := LogMailer{}.Send(Mail{To: "user@example.com", Subject: "[ISUTRAIN] パスワードの再設定", Body: "https://isutrain.example.com/reset?token=secret-token\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := buf.String()
+	if !strings.Contains(logs, "user@example.com") {
+		t.Errorf("recipient not logged: %s", logs)
+	}
+	if strings.Contains(logs, "secret-token") {
+		t.Errorf("token leaked into logs: %s", logs)
+	}
+}
@@ -1,26 +1,28 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	crand "crypto/rand"
-	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"syscall"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	goji "goji.io"
 	"goji.io/pat"
-	"golang.org/x/crypto/pbkdf2"
 	// "sync"
 )
 
@@ -87,6 +89,12 @@ type Reservation struct {
 	Adult         int        `json:"adult" db:"adult"`
 	Child         int        `json:"child" db:"child"`
 	Amount        int        `json:"amount" db:"amount"`
+	Passengers    string     `json:"-" db:"passengers"`
+	PromotionID   *int64     `json:"-" db:"promotion_id"`
+	Discount      int        `json:"discount" db:"discount"`
+	PointsUsed    int        `json:"points_used" db:"points_used"`
+	CreatedAt     time.Time  `json:"-" db:"created_at"`
+	PaidAt        *time.Time `json:"-" db:"paid_at"`
 }
 
 type SeatReservation struct {
@@ -144,37 +152,45 @@ type User struct {
 	Password       string `json:"password"`
 	Salt           []byte `db:"salt"`
 	HashedPassword []byte `db:"super_secure_password"`
+
+	EmailVerifiedAt *time.Time `json:"-" db:"email_verified_at"`
 }
 
 type TrainReservationRequest struct {
-	Date          string        `json:"date"`
-	TrainName     string        `json:"train_name"`
-	TrainClass    string        `json:"train_class"`
-	CarNumber     int           `json:"car_number"`
-	IsSmokingSeat bool          `json:"is_smoking_seat"`
-	SeatClass     string        `json:"seat_class"`
-	Departure     string        `json:"departure"`
-	Arrival       string        `json:"arrival"`
-	Child         int           `json:"child"`
-	Adult         int           `json:"adult"`
-	Column        string        `json:"Column"`
-	Seats         []RequestSeat `json:"seats"`
+	Date          string `json:"date" validate:"required,rfc3339"`
+	TrainName     string `json:"train_name" validate:"required"`
+	TrainClass    string `json:"train_class" validate:"required,train_class"`
+	CarNumber     int    `json:"car_number" validate:"min=0,max=16"`
+	IsSmokingSeat bool   `json:"is_smoking_seat"`
+	SeatClass     string `json:"seat_class" validate:"required,seat_class"`
+	Departure     string `json:"departure" validate:"required"`
+	Arrival       string `json:"arrival" validate:"required"`
+	Child         int    `json:"child" validate:"min=0,max=10"`
+	Adult         int    `json:"adult" validate:"min=0,max=10"`
+	// 区分ごとの人数 (adult / child と併用できる)
+	Passengers PassengerCounts `json:"passengers" validate:"passengers"`
+	Column     string          `json:"Column"`
+	Seats      []RequestSeat   `json:"seats" validate:"max=10,dive"`
+	PromoCode  string          `json:"promo_code" validate:"max=32"`
+	UsePoints  int             `json:"use_points" validate:"min=0"`
 }
 
 type RequestSeat struct {
-	Row    int    `json:"row"`
-	Column string `json:"column"`
+	Row    int    `json:"row" validate:"min=1"`
+	Column string `json:"column" validate:"required"`
 }
 
 type TrainReservationResponse struct {
 	ReservationId int64 `json:"reservation_id"`
 	Amount        int   `json:"amount"`
+	Discount      int   `json:"discount"`
+	PointsUsed    int   `json:"points_used"`
 	IsOk          bool  `json:"is_ok"`
 }
 
 type ReservationPaymentRequest struct {
-	CardToken     string `json:"card_token"`
-	ReservationId int    `json:"reservation_id"`
+	CardToken     string `json:"card_token" validate:"required"`
+	ReservationId int    `json:"reservation_id" validate:"min=1"`
 }
 
 type ReservationPaymentResponse struct {
@@ -204,8 +220,11 @@ type ReservationResponse struct {
 	CarNumber     int               `json:"car_number"`
 	SeatClass     string            `json:"seat_class"`
 	Amount        int               `json:"amount"`
+	Discount      int               `json:"discount"`
+	PointsUsed    int               `json:"points_used"`
 	Adult         int               `json:"adult"`
 	Child         int               `json:"child"`
+	Passengers    PassengerCounts   `json:"passengers"`
 	Departure     string            `json:"departure"`
 	Arrival       string            `json:"arrival"`
 	DepartureTime string            `json:"departure_time"`
@@ -213,14 +232,6 @@ type ReservationResponse struct {
 	Seats         []SeatReservation `json:"seats"`
 }
 
-type CancelPaymentInformationRequest struct {
-	PaymentId string `json:"payment_id"`
-}
-
-type CancelPaymentInformationResponse struct {
-	IsOk bool `json:"is_ok"`
-}
-
 type Settings struct {
 	PaymentAPI string `json:"payment_api"`
 }
@@ -231,16 +242,15 @@ type InitializeResponse struct {
 }
 
 type AuthResponse struct {
-	Email string `json:"email"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	CSRFToken     string `json:"csrf_token"`
 }
 
 const (
-	sessionName   = "session_isutrain"
-	availableDays = 10
-)
+	sessionName = "session_isutrain"
 
-var (
-	store sessions.Store = sessions.NewCookieStore([]byte(secureRandomStr(20)))
+	mysqlErrDuplicateEntry = 1062
 )
 
 func handler(w http.ResponseWriter, r *http.Request) {
@@ -256,40 +266,48 @@ func messageResponse(w http.ResponseWriter, message string) {
 	w.Write(errResp)
 }
 
-func errorResponse(w http.ResponseWriter, errCode int, message string) {
-	e := map[string]interface{}{
-		"is_error": true,
-		"message":  message,
-	}
-	errResp, _ := json.Marshal(e)
-
-	w.WriteHeader(errCode)
-	w.Write(errResp)
-}
-
 func getSession(r *http.Request) *sessions.Session {
 	session, _ := store.Get(r, sessionName)
 
 	return session
 }
 
-func getUser(r *http.Request) (user User, errCode int, errMsg string) {
+// getUser はセッションまたは Bearer トークンからログイン中のユーザを返す
+// トークンの場合は scope が必要 (APIごとに呼び出し側で指定する)
+func getUser(r *http.Request, scope string) (user User, errCode ErrorCode) {
+	if token, ok := bearerToken(r); ok {
+		return getTokenUser(r, token, scope)
+	}
+	return getSessionUser(r)
+}
+
+// getSessionUser はセッションでログインしているユーザだけを返す
+// アカウントの管理に使うAPI用で、Bearer トークンが付いていればクッキーがあっても受け付けない
+func getSessionUser(r *http.Request) (user User, errCode ErrorCode) {
+	if _, ok := bearerToken(r); ok {
+		return user, ErrAPITokenNotAllowed
+	}
 	session := getSession(r)
 	userID, ok := session.Values["user_id"]
 	if !ok {
-		return user, http.StatusUnauthorized, "no session"
+		return user, ErrNoSession
 	}
 
-	err := dbx.Get(&user, "SELECT * FROM `users` WHERE `id` = ?", userID)
+	id, ok := userID.(int64)
+	if !ok {
+		return user, ErrUserNotFound
+	}
+	user, err := repo.User(r.Context(), id)
 	if err == sql.ErrNoRows {
-		return user, http.StatusUnauthorized, "user not found"
+		return user, ErrUserNotFound
 	}
 	if err != nil {
-		log.Print(err)
-		return user, http.StatusInternalServerError, "db error"
+		loggerFromContext(r.Context()).Error(err.Error())
+		return user, ErrDatabase
 	}
+	setLogField(r.Context(), "user_id", user.ID)
 
-	return user, http.StatusOK, ""
+	return user, ""
 }
 
 func secureRandomStr(b int) string {
@@ -302,12 +320,10 @@ func secureRandomStr(b int) string {
 
 func distanceFareHandler(w http.ResponseWriter, r *http.Request) {
 
-	distanceFareList := []DistanceFare{}
-
-	query := "SELECT * FROM distance_fare_master"
-	err := dbx.Select(&distanceFareList, query)
+	distanceFareList, err := repo.ListDistanceFares(r.Context())
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
 		return
 	}
 
@@ -319,12 +335,9 @@ func distanceFareHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(distanceFareList)
 }
 
-func getDistanceFare(origToDestDistance float64) (int, error) {
+func getDistanceFare(ctx context.Context, origToDestDistance float64) (int, error) {
 
-	distanceFareList := []DistanceFare{}
-
-	query := "SELECT distance,fare FROM distance_fare_master ORDER BY distance"
-	err := dbx.Select(&distanceFareList, query)
+	distanceFareList, err := repo.ListDistanceFares(ctx)
 	if err != nil {
 		return 0, err
 	}
@@ -332,30 +345,24 @@ func getDistanceFare(origToDestDistance float64) (int, error) {
 	lastDistance := 0.0
 	lastFare := 0
 	for _, distanceFare := range distanceFareList {
-
-		fmt.Println(origToDestDistance, distanceFare.Distance, distanceFare.Fare)
 		if float64(lastDistance) < origToDestDistance && origToDestDistance < float64(distanceFare.Distance) {
 			break
 		}
 		lastDistance = distanceFare.Distance
 		lastFare = distanceFare.Fare
 	}
+	loggerFromContext(ctx).Debug("distance fare", "distance", origToDestDistance, "fare", lastFare)
 
 	return lastFare, nil
 }
 
-func fareCalc(date time.Time, depStation int, destStation int, trainClass, seatClass string) (int, error) {
+func fareCalc(ctx context.Context, date time.Time, depStation int, destStation int, trainClass, seatClass string) (int, error) {
 	//
 	// 料金計算メモ
 	// 距離運賃(円) * 期間倍率(繁忙期なら2倍等) * 車両クラス倍率(急行・各停等) * 座席クラス倍率(プレミアム・指定席・自由席)
 	//
-	var err error
-	var fromStation, toStation Station
-
-	query := "SELECT * FROM station_master WHERE id=?"
-
 	// From
-	err = dbx.Get(&fromStation, query, depStation)
+	fromStation, err := repo.StationByID(ctx, depStation)
 	if err == sql.ErrNoRows {
 		return 0, err
 	}
@@ -364,26 +371,22 @@ func fareCalc(date time.Time, depStation int, destStation int, trainClass, seatC
 	}
 
 	// To
-	err = dbx.Get(&toStation, query, destStation)
+	toStation, err := repo.StationByID(ctx, destStation)
 	if err == sql.ErrNoRows {
 		return 0, err
 	}
 	if err != nil {
-		log.Print(err)
+		loggerFromContext(ctx).Error(err.Error())
 		return 0, err
 	}
 
-	fmt.Println("distance", math.Abs(toStation.Distance-fromStation.Distance))
-	distFare, err := getDistanceFare(math.Abs(toStation.Distance - fromStation.Distance))
+	distFare, err := getDistanceFare(ctx, math.Abs(toStation.Distance-fromStation.Distance))
 	if err != nil {
 		return 0, err
 	}
-	fmt.Println("distFare", distFare)
 
 	// 期間・車両・座席クラス倍率
-	fareList := []Fare{}
-	query = "SELECT * FROM fare_master WHERE train_class=? AND seat_class=? ORDER BY start_date"
-	err = dbx.Select(&fareList, query, trainClass, seatClass)
+	fareList, err := repo.ListFares(ctx, trainClass, seatClass)
 	if err != nil {
 		return 0, err
 	}
@@ -396,12 +399,10 @@ func fareCalc(date time.Time, depStation int, destStation int, trainClass, seatC
 	date = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
 	for _, fare := range fareList {
 		if !date.Before(fare.StartDate) {
-			fmt.Println(fare.StartDate, fare.FareMultiplier)
 			selectedFare = fare
 		}
 	}
-
-	fmt.Println("%%%%%%%%%%%%%%%%%%%")
+	loggerFromContext(ctx).Debug("fare multiplier", "train_class", trainClass, "seat_class", seatClass, "start_date", selectedFare.StartDate, "multiplier", selectedFare.FareMultiplier)
 
 	return int(float64(distFare) * selectedFare.FareMultiplier), nil
 }
@@ -414,12 +415,10 @@ func getStationsHandler(w http.ResponseWriter, r *http.Request) {
 		return []Station{}
 	*/
 
-	stations := []Station{}
-
-	query := "SELECT * FROM station_master ORDER BY id"
-	err := dbx.Select(&stations, query)
+	stations, err := repo.ListStations(r.Context())
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
 		return
 	}
 
@@ -439,51 +438,56 @@ func trainSearchHandler(w http.ResponseWriter, r *http.Request) {
 
 	*/
 
-	jst := time.FixedZone("JST", 9*60*60)
-	date, err := time.Parse(time.RFC3339, r.URL.Query().Get("use_at"))
+	searchQuery, verrs := parseTrainSearchQuery(r)
+	if len(verrs) > 0 {
+		validationErrorResponse(w, r, verrs)
+		return
+	}
+
+	date, err := time.Parse(time.RFC3339, searchQuery.UseAt)
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		errorResponse(w, r, ErrInvalidDate)
 		return
 	}
 	date = date.In(jst)
 
-	if !checkAvailableDate(date) {
-		errorResponse(w, http.StatusNotFound, "予約可能期間外です")
+	if errCode := checkAvailableDate(date); errCode != "" {
+		errorResponse(w, r, errCode)
 		return
 	}
 
-	trainClass := r.URL.Query().Get("train_class")
-	fromName := r.URL.Query().Get("from")
-	toName := r.URL.Query().Get("to")
+	trainClass := searchQuery.TrainClass
+	fromName := searchQuery.From
+	toName := searchQuery.To
 
-	adult, _ := strconv.Atoi(r.URL.Query().Get("adult"))
-	child, _ := strconv.Atoi(r.URL.Query().Get("child"))
+	passengers := searchQuery.passengerCounts()
 
+	// 駅名のほか別名や駅IDでも指定できる
 	var fromStation, toStation Station
-	query := "SELECT * FROM station_master WHERE name=?"
 
 	// From
-	err = dbx.Get(&fromStation, query, fromName)
+	fromStation, err = resolveStation(r.Context(), fromName)
 	if err == sql.ErrNoRows {
-		log.Print("fromStation: no rows")
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Debug("station not found", "station", fromName)
+		errorResponse(w, r, ErrStationNotFound, fromName)
 		return
 	}
 	if err != nil {
-		errorResponse(w, http.StatusInternalServerError, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
 		return
 	}
 
 	// To
-	err = dbx.Get(&toStation, query, toName)
+	toStation, err = resolveStation(r.Context(), toName)
 	if err == sql.ErrNoRows {
-		log.Print("toStation: no rows")
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Debug("station not found", "station", toName)
+		errorResponse(w, r, ErrStationNotFound, toName)
 		return
 	}
 	if err != nil {
-		log.Print(err)
-		errorResponse(w, http.StatusInternalServerError, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
 		return
 	}
 
@@ -492,47 +496,43 @@ func trainSearchHandler(w http.ResponseWriter, r *http.Request) {
 		isNobori = true
 	}
 
-	query = "SELECT * FROM station_master ORDER BY distance"
-	if isNobori {
-		// 上りだったら駅リストを逆にする
-		query += " DESC"
-	}
-
 	usableTrainClassList := getUsableTrainClassList(fromStation, toStation)
-
-	var inQuery string
-	var inArgs []interface{}
-
-	if trainClass == "" {
-		query := "SELECT * FROM train_master WHERE date=? AND train_class IN (?) AND is_nobori=?"
-		inQuery, inArgs, err = sqlx.In(query, date.Format("2006/01/02"), usableTrainClassList, isNobori)
-	} else {
-		query := "SELECT * FROM train_master WHERE date=? AND train_class IN (?) AND is_nobori=? AND train_class=?"
-		inQuery, inArgs, err = sqlx.In(query, date.Format("2006/01/02"), usableTrainClassList, isNobori, trainClass)
-	}
-	if err != nil {
-		errorResponse(w, http.StatusBadRequest, err.Error())
-		return
+	if trainClass != "" {
+		// 種別の指定があればその種別だけ (停車しない種別なら空)
+		classes := []string{}
+		for _, c := range usableTrainClassList {
+			if c == trainClass {
+				classes = append(classes, c)
+			}
+		}
+		usableTrainClassList = classes
 	}
 
-	trainList := []Train{}
-	err = dbx.Select(&trainList, inQuery, inArgs...)
+	trainList, err := repo.SearchTrains(r.Context(), date, usableTrainClassList, isNobori)
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
 		return
 	}
 
-	stations := []Station{}
-	err = dbx.Select(&stations, query)
+	stations, err := repo.ListStations(r.Context())
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
 		return
 	}
+	// 距離の順 (上りだったら駅リストを逆にする)
+	sort.SliceStable(stations, func(i, j int) bool {
+		if isNobori {
+			return stations[i].Distance > stations[j].Distance
+		}
+		return stations[i].Distance < stations[j].Distance
+	})
 
-	fmt.Println("From", fromStation)
-	fmt.Println("To", toStation)
+	loggerFromContext(r.Context()).Debug("search trains", "from", fromStation.Name, "to", toStation.Name, "trains", len(trainList))
 
 	trainSearchResponseList := []TrainSearchResponse{}
+	window, now := currentReservationWindow(), clock.Now()
 
 	for _, train := range trainList {
 		isSeekedToFirstStation := false
@@ -563,7 +563,7 @@ func trainSearchHandler(w http.ResponseWriter, r *http.Request) {
 					break
 				} else {
 					// 出発駅より先に終点が見つかったとき
-					fmt.Println("なんかおかしい")
+					loggerFromContext(r.Context()).Debug("destination comes before origin", "train_class", train.TrainClass, "train_name", train.TrainName)
 					break
 				}
 			}
@@ -580,15 +580,18 @@ func trainSearchHandler(w http.ResponseWriter, r *http.Request) {
 			// 所要時間
 			var departure, arrival string
 
-			err = dbx.Get(&departure, "SELECT departure FROM train_timetable_master WHERE date=? AND train_class=? AND train_name=? AND station=?", date.Format("2006/01/02"), train.TrainClass, train.TrainName, fromStation.Name)
+			fromStop, err := repo.TrainStop(r.Context(), date, train.TrainClass, train.TrainName, fromStation.Name)
 			if err != nil {
-				errorResponse(w, http.StatusInternalServerError, err.Error())
+				loggerFromContext(r.Context()).Error(err.Error())
+				errorResponse(w, r, ErrDatabase)
 				return
 			}
+			departure = fromStop.Departure
 
-			departureDate, err := time.Parse("2006/01/02 15:04:05 -07:00 MST", fmt.Sprintf("%s %s +09:00 JST", date.Format("2006/01/02"), departure))
+			departureDate, err := time.ParseInLocation("2006/01/02 15:04:05", date.Format("2006/01/02")+" "+departure, jst)
 			if err != nil {
-				errorResponse(w, http.StatusInternalServerError, err.Error())
+				loggerFromContext(r.Context()).Error(err.Error())
+				errorResponse(w, r, ErrInternal)
 				return
 			}
 
@@ -596,32 +599,42 @@ func trainSearchHandler(w http.ResponseWriter, r *http.Request) {
 				// 乗りたい時刻より出発時刻が前なので除外
 				continue
 			}
+			if window.SalesClosed(departureDate, now) {
+				// 販売を締め切った列車は除外
+				continue
+			}
 
-			err = dbx.Get(&arrival, "SELECT arrival FROM train_timetable_master WHERE date=? AND train_class=? AND train_name=? AND station=?", date.Format("2006/01/02"), train.TrainClass, train.TrainName, toStation.Name)
+			toStop, err := repo.TrainStop(r.Context(), date, train.TrainClass, train.TrainName, toStation.Name)
 			if err != nil {
-				errorResponse(w, http.StatusInternalServerError, err.Error())
+				loggerFromContext(r.Context()).Error(err.Error())
+				errorResponse(w, r, ErrDatabase)
 				return
 			}
+			arrival = toStop.Arrival
 
-			premium_avail_seats, err := train.getAvailableSeats(fromStation, toStation, "premium", false)
+			premium_avail_seats, err := train.getAvailableSeats(r.Context(), fromStation, toStation, "premium", false)
 			if err != nil {
-				errorResponse(w, http.StatusBadRequest, err.Error())
+				loggerFromContext(r.Context()).Error(err.Error())
+				errorResponse(w, r, ErrDatabase)
 				return
 			}
-			premium_smoke_avail_seats, err := train.getAvailableSeats(fromStation, toStation, "premium", true)
+			premium_smoke_avail_seats, err := train.getAvailableSeats(r.Context(), fromStation, toStation, "premium", true)
 			if err != nil {
-				errorResponse(w, http.StatusBadRequest, err.Error())
+				loggerFromContext(r.Context()).Error(err.Error())
+				errorResponse(w, r, ErrDatabase)
 				return
 			}
 
-			reserved_avail_seats, err := train.getAvailableSeats(fromStation, toStation, "reserved", false)
+			reserved_avail_seats, err := train.getAvailableSeats(r.Context(), fromStation, toStation, "reserved", false)
 			if err != nil {
-				errorResponse(w, http.StatusBadRequest, err.Error())
+				loggerFromContext(r.Context()).Error(err.Error())
+				errorResponse(w, r, ErrDatabase)
 				return
 			}
-			reserved_smoke_avail_seats, err := train.getAvailableSeats(fromStation, toStation, "reserved", true)
+			reserved_smoke_avail_seats, err := train.getAvailableSeats(r.Context(), fromStation, toStation, "reserved", true)
 			if err != nil {
-				errorResponse(w, http.StatusBadRequest, err.Error())
+				loggerFromContext(r.Context()).Error(err.Error())
+				errorResponse(w, r, ErrDatabase)
 				return
 			}
 
@@ -663,26 +676,29 @@ func trainSearchHandler(w http.ResponseWriter, r *http.Request) {
 			}
 
 			// 料金計算
-			premiumFare, err := fareCalc(date, fromStation.ID, toStation.ID, train.TrainClass, "premium")
+			premiumFare, err := fareCalc(r.Context(), date, fromStation.ID, toStation.ID, train.TrainClass, "premium")
 			if err != nil {
-				errorResponse(w, http.StatusBadRequest, err.Error())
+				loggerFromContext(r.Context()).Error(err.Error())
+				errorResponse(w, r, ErrInternal)
 				return
 			}
-			premiumFare = premiumFare*adult + premiumFare/2*child
+			premiumFare = passengerFare(premiumFare, passengers)
 
-			reservedFare, err := fareCalc(date, fromStation.ID, toStation.ID, train.TrainClass, "reserved")
+			reservedFare, err := fareCalc(r.Context(), date, fromStation.ID, toStation.ID, train.TrainClass, "reserved")
 			if err != nil {
-				errorResponse(w, http.StatusBadRequest, err.Error())
+				loggerFromContext(r.Context()).Error(err.Error())
+				errorResponse(w, r, ErrInternal)
 				return
 			}
-			reservedFare = reservedFare*adult + reservedFare/2*child
+			reservedFare = passengerFare(reservedFare, passengers)
 
-			nonReservedFare, err := fareCalc(date, fromStation.ID, toStation.ID, train.TrainClass, "non-reserved")
+			nonReservedFare, err := fareCalc(r.Context(), date, fromStation.ID, toStation.ID, train.TrainClass, "non-reserved")
 			if err != nil {
-				errorResponse(w, http.StatusBadRequest, err.Error())
+				loggerFromContext(r.Context()).Error(err.Error())
+				errorResponse(w, r, ErrInternal)
 				return
 			}
-			nonReservedFare = nonReservedFare*adult + nonReservedFare/2*child
+			nonReservedFare = passengerFare(nonReservedFare, passengers)
 
 			fareInformation := map[string]int{
 				"premium":        premiumFare,
@@ -704,7 +720,8 @@ func trainSearchHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	resp, err := json.Marshal(trainSearchResponseList)
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrInternal)
 		return
 	}
 	w.Write(resp)
@@ -717,16 +734,15 @@ func trainSeatsHandler(w http.ResponseWriter, r *http.Request) {
 		GET /train/seats?date=2020-03-01&train_class=のぞみ&train_name=96号&car_number=2&from=大阪&to=東京
 	*/
 
-	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
 	date, err := time.Parse(time.RFC3339, r.URL.Query().Get("date"))
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		errorResponse(w, r, ErrInvalidDate)
 		return
 	}
 	date = date.In(jst)
 
-	if !checkAvailableDate(date) {
-		errorResponse(w, http.StatusNotFound, "予約可能期間外です")
+	if errCode := checkAvailableDate(date); errCode != "" {
+		errorResponse(w, r, errCode)
 		return
 	}
 
@@ -737,42 +753,43 @@ func trainSeatsHandler(w http.ResponseWriter, r *http.Request) {
 	toName := r.URL.Query().Get("to")
 
 	// 対象列車の取得
-	var train Train
-	query := "SELECT * FROM train_master WHERE date=? AND train_class=? AND train_name=?"
-	err = dbx.Get(&train, query, date.Format("2006/01/02"), trainClass, trainName)
+	train, err := repo.Train(r.Context(), date, trainClass, trainName)
 	if err == sql.ErrNoRows {
-		errorResponse(w, http.StatusNotFound, "列車が存在しません")
+		errorResponse(w, r, ErrTrainNotFound)
+		return
 	}
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
 		return
 	}
 
+	// 駅名のほか別名や駅IDでも指定できる
 	var fromStation, toStation Station
-	query = "SELECT * FROM station_master WHERE name=?"
 
 	// From
-	err = dbx.Get(&fromStation, query, fromName)
+	fromStation, err = resolveStation(r.Context(), fromName)
 	if err == sql.ErrNoRows {
-		log.Print("fromStation: no rows")
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Debug("station not found", "station", fromName)
+		errorResponse(w, r, ErrStationNotFound, fromName)
 		return
 	}
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
 		return
 	}
 
 	// To
-	err = dbx.Get(&toStation, query, toName)
+	toStation, err = resolveStation(r.Context(), toName)
 	if err == sql.ErrNoRows {
-		log.Print("toStation: no rows")
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Debug("station not found", "station", toName)
+		errorResponse(w, r, ErrStationNotFound, toName)
 		return
 	}
 	if err != nil {
-		log.Print(err)
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
 		return
 	}
 
@@ -785,38 +802,35 @@ func trainSeatsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	if !usable {
 		err = fmt.Errorf("invalid train_class")
-		log.Print(err)
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrStationNotServed, train.TrainClass)
 		return
 	}
 
-	seatList := []Seat{}
-
-	query = "SELECT * FROM seat_master WHERE train_class=? AND car_number=? ORDER BY seat_row, seat_column"
-	err = dbx.Select(&seatList, query, trainClass, carNumber)
+	// 全号車の座席 (号車・列・席の順)
+	trainSeats, err := repo.ListSeats(r.Context(), SeatFilter{TrainClass: trainClass})
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
 		return
 	}
 
+	seatList := []Seat{}
+	for _, seat := range trainSeats {
+		if seat.CarNumber == carNumber {
+			seatList = append(seatList, seat)
+		}
+	}
+
 	var seatInformationList []SeatInformation
 
 	for _, seat := range seatList {
 
 		s := SeatInformation{seat.SeatRow, seat.SeatColumn, seat.SeatClass, seat.IsSmokingSeat, false}
 
-		seatReservationList := []SeatReservation{}
-
-		query := `
-SELECT s.*
-FROM seat_reservations s, reservations r
-WHERE
-	r.date=? AND r.train_class=? AND r.train_name=? AND car_number=? AND seat_row=? AND seat_column=?
-`
-
-		err = dbx.Select(
-			&seatReservationList, query,
-			date.Format("2006/01/02"),
+		seatReservationList, err := repo.ListSeatReservationsAt(
+			r.Context(),
+			date,
 			seat.TrainClass,
 			trainName,
 			seat.CarNumber,
@@ -824,30 +838,30 @@ WHERE
 			seat.SeatColumn,
 		)
 		if err != nil {
-			errorResponse(w, http.StatusBadRequest, err.Error())
+			loggerFromContext(r.Context()).Error(err.Error())
+			errorResponse(w, r, ErrDatabase)
 			return
 		}
 
-		fmt.Println(seatReservationList)
-
 		for _, seatReservation := range seatReservationList {
-			reservation := Reservation{}
-			query = "SELECT * FROM reservations WHERE reservation_id=?"
-			err = dbx.Get(&reservation, query, seatReservation.ReservationId)
+			reservation, err := repo.Reservation(r.Context(), int64(seatReservation.ReservationId))
 			if err != nil {
-				panic(err)
+				loggerFromContext(r.Context()).Error(err.Error())
+				errorResponse(w, r, ErrDatabase)
+				return
 			}
 
-			var departureStation, arrivalStation Station
-			query = "SELECT * FROM station_master WHERE name=?"
-
-			err = dbx.Get(&departureStation, query, reservation.Departure)
+			departureStation, err := repo.StationByName(r.Context(), reservation.Departure)
 			if err != nil {
-				panic(err)
+				loggerFromContext(r.Context()).Error(err.Error())
+				errorResponse(w, r, ErrDatabase)
+				return
 			}
-			err = dbx.Get(&arrivalStation, query, reservation.Arrival)
+			arrivalStation, err := repo.StationByName(r.Context(), reservation.Arrival)
 			if err != nil {
-				panic(err)
+				loggerFromContext(r.Context()).Error(err.Error())
+				errorResponse(w, r, ErrDatabase)
+				return
 			}
 
 			if train.IsNobori {
@@ -874,19 +888,20 @@ WHERE
 			}
 		}
 
-		fmt.Println(s.IsOccupied)
+		loggerFromContext(r.Context()).Debug("seat occupancy", "car_number", seat.CarNumber, "seat_row", seat.SeatRow, "seat_column", seat.SeatColumn, "reservations", len(seatReservationList), "occupied", s.IsOccupied)
 		seatInformationList = append(seatInformationList, s)
 	}
 
 	// 各号車の情報
 
+	// 1号車から順に、号車の先頭の座席の座席クラスを使う (号車が途切れたら終わり)
 	simpleCarInformationList := []SimpleCarInformation{}
-	seat := Seat{}
-	query = "SELECT * FROM seat_master WHERE train_class=? AND car_number=? ORDER BY seat_row, seat_column LIMIT 1"
 	i := 1
-	for {
-		err = dbx.Get(&seat, query, trainClass, i)
-		if err != nil {
+	for _, seat := range trainSeats {
+		if seat.CarNumber < i {
+			continue
+		}
+		if seat.CarNumber > i {
 			break
 		}
 		simpleCarInformationList = append(simpleCarInformationList, SimpleCarInformation{i, seat.SeatClass})
@@ -896,7 +911,8 @@ WHERE
 	c := CarInformation{date.Format("2006/01/02"), trainClass, trainName, carNumber, seatInformationList, simpleCarInformationList}
 	resp, err := json.Marshal(c)
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrInternal)
 		return
 	}
 	w.Write(resp)
@@ -937,139 +953,142 @@ func trainReservationHandler(w http.ResponseWriter, r *http.Request) {
 	req := new(TrainReservationRequest)
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		errorResponse(w, http.StatusInternalServerError, "JSON parseに失敗しました")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrInvalidRequest)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
+	if verrs := validateStruct(req); len(verrs) > 0 {
+		validationErrorResponse(w, r, verrs)
+		return
+	}
+	passengers := req.passengerCounts()
+	partySize := passengers.Total()
 
 	// 乗車日の日付表記統一
-	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
 	date, err := time.Parse(time.RFC3339, req.Date)
 	if err != nil {
-		errorResponse(w, http.StatusInternalServerError, "時刻のparseに失敗しました")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrInvalidDate)
+		loggerFromContext(r.Context()).Error(err.Error())
+		return
 	}
 	date = date.In(jst)
 
-	if !checkAvailableDate(date) {
-		errorResponse(w, http.StatusNotFound, "予約可能期間外です")
+	if errCode := checkAvailableDate(date); errCode != "" {
+		errorResponse(w, r, errCode)
 		return
 	}
 
-	tx := dbx.MustBegin()
+	ctx, tx, err := repo.BeginTx(r.Context())
+	if err != nil {
+		errorResponse(w, r, ErrDatabase)
+		loggerFromContext(r.Context()).Error(err.Error())
+		return
+	}
 	// 止まらない駅の予約を取ろうとしていないかチェックする
 	// 列車データを取得
-	tmas := Train{}
-	query := "SELECT * FROM train_master WHERE date=? AND train_class=? AND train_name=?"
-	err = tx.Get(
-		&tmas, query,
-		date.Format("2006/01/02"),
-		req.TrainClass,
-		req.TrainName,
-	)
+	tmas, err := repo.Train(ctx, date, req.TrainClass, req.TrainName)
 	if err == sql.ErrNoRows {
 		tx.Rollback()
-		errorResponse(w, http.StatusNotFound, "列車データがみつかりません")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrTrainNotFound)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "列車データの取得に失敗しました")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 
 	// 列車自体の駅IDを求める
-	var departureStation, arrivalStation Station
-	query = "SELECT * FROM station_master WHERE name=?"
 	// Departure
-	err = tx.Get(&departureStation, query, tmas.StartStation)
+	departureStation, err := repo.StationByName(ctx, tmas.StartStation)
 	if err == sql.ErrNoRows {
 		tx.Rollback()
-		errorResponse(w, http.StatusNotFound, "リクエストされた列車の始発駅データがみつかりません")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrStationNotFound, tmas.StartStation)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "リクエストされた列車の始発駅データの取得に失敗しました")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 
 	// Arrive
-	err = tx.Get(&arrivalStation, query, tmas.LastStation)
+	arrivalStation, err := repo.StationByName(ctx, tmas.LastStation)
 	if err == sql.ErrNoRows {
 		tx.Rollback()
-		errorResponse(w, http.StatusNotFound, "リクエストされた列車の終着駅データがみつかりません")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrStationNotFound, tmas.LastStation)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "リクエストされた列車の終着駅データの取得に失敗しました")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 
-	// リクエストされた乗車区間の駅IDを求める
+	// リクエストされた乗車区間の駅IDを求める (駅名のほか別名や駅IDでも指定できる)
 	var fromStation, toStation Station
-	query = "SELECT * FROM station_master WHERE name=?"
 
 	// From
-	err = tx.Get(&fromStation, query, req.Departure)
+	fromStation, err = resolveStation(r.Context(), req.Departure)
 	if err == sql.ErrNoRows {
 		tx.Rollback()
-		errorResponse(w, http.StatusNotFound, fmt.Sprintf("乗車駅データがみつかりません %s", req.Departure))
-		log.Println(err.Error())
+		errorResponse(w, r, ErrStationNotFound, req.Departure)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "乗車駅データの取得に失敗しました")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 
 	// To
-	err = tx.Get(&toStation, query, req.Arrival)
+	toStation, err = resolveStation(r.Context(), req.Arrival)
 	if err == sql.ErrNoRows {
 		tx.Rollback()
-		errorResponse(w, http.StatusNotFound, fmt.Sprintf("降車駅データがみつかりません %s", req.Arrival))
-		log.Println(err.Error())
+		errorResponse(w, r, ErrStationNotFound, req.Arrival)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "降車駅データの取得に失敗しました")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
+	// 予約には駅名で保存する
+	req.Departure = fromStation.Name
+	req.Arrival = toStation.Name
 
 	switch req.TrainClass {
 	case "最速":
 		if !fromStation.IsStopExpress || !toStation.IsStopExpress {
 			tx.Rollback()
-			errorResponse(w, http.StatusBadRequest, "最速の止まらない駅です")
+			errorResponse(w, r, ErrStationNotServed, req.TrainClass)
 			return
 		}
 	case "中間":
 		if !fromStation.IsStopSemiExpress || !toStation.IsStopSemiExpress {
 			tx.Rollback()
-			errorResponse(w, http.StatusBadRequest, "中間の止まらない駅です")
+			errorResponse(w, r, ErrStationNotServed, req.TrainClass)
 			return
 		}
 	case "遅いやつ":
 		if !fromStation.IsStopLocal || !toStation.IsStopLocal {
 			tx.Rollback()
-			errorResponse(w, http.StatusBadRequest, "遅いやつの止まらない駅です")
+			errorResponse(w, r, ErrStationNotServed, req.TrainClass)
 			return
 		}
 	default:
 		tx.Rollback()
-		errorResponse(w, http.StatusBadRequest, "リクエストされた列車クラスが不明です")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrUnknownTrainClass)
 		return
 	}
 
@@ -1077,27 +1096,34 @@ func trainReservationHandler(w http.ResponseWriter, r *http.Request) {
 	if tmas.IsNobori {
 		if fromStation.ID > departureStation.ID || toStation.ID > departureStation.ID {
 			tx.Rollback()
-			errorResponse(w, http.StatusBadRequest, "リクエストされた区間に列車が運行していない区間が含まれています")
+			errorResponse(w, r, ErrSectionNotServed)
 			return
 		}
 		if arrivalStation.ID >= fromStation.ID || arrivalStation.ID > toStation.ID {
 			tx.Rollback()
-			errorResponse(w, http.StatusBadRequest, "リクエストされた区間に列車が運行していない区間が含まれています")
+			errorResponse(w, r, ErrSectionNotServed)
 			return
 		}
 	} else {
 		if fromStation.ID < departureStation.ID || toStation.ID < departureStation.ID {
 			tx.Rollback()
-			errorResponse(w, http.StatusBadRequest, "リクエストされた区間に列車が運行していない区間が含まれています")
+			errorResponse(w, r, ErrSectionNotServed)
 			return
 		}
 		if arrivalStation.ID <= fromStation.ID || arrivalStation.ID < toStation.ID {
 			tx.Rollback()
-			errorResponse(w, http.StatusBadRequest, "リクエストされた区間に列車が運行していない区間が含まれています")
+			errorResponse(w, r, ErrSectionNotServed)
 			return
 		}
 	}
 
+	// 出発直前の販売締め切り
+	if errCode := checkSalesCutoff(ctx, date, req.TrainClass, req.TrainName, fromStation.Name); errCode != "" {
+		tx.Rollback()
+		errorResponse(w, r, errCode)
+		return
+	}
+
 	/*
 		あいまい座席検索
 		seatsが空白の時に発動する
@@ -1108,15 +1134,11 @@ func trainReservationHandler(w http.ResponseWriter, r *http.Request) {
 			break // non-reservedはそもそもあいまい検索もせずダミーのRow/Columnで予約を確定させる。
 		}
 		//当該列車・号車中の空き座席検索
-		var train Train
-		query := "SELECT * FROM train_master WHERE date=? AND train_class=? AND train_name=?"
-		err = dbx.Get(&train, query, date.Format("2006/01/02"), req.TrainClass, req.TrainName)
-		if err == sql.ErrNoRows {
-			panic(err)
-		}
+		train, err := repo.Train(ctx, date, req.TrainClass, req.TrainName)
 		if err != nil {
 			tx.Rollback()
-			errorResponse(w, http.StatusBadRequest, err.Error())
+			loggerFromContext(r.Context()).Error(err.Error())
+			errorResponse(w, r, ErrDatabase)
 			return
 		}
 
@@ -1129,31 +1151,35 @@ func trainReservationHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		if !usable {
 			err = fmt.Errorf("invalid train_class")
-			log.Print(err)
+			loggerFromContext(r.Context()).Error(err.Error())
 			tx.Rollback()
-			errorResponse(w, http.StatusBadRequest, err.Error())
+			errorResponse(w, r, ErrStationNotServed, train.TrainClass)
 			return
 		}
 
 		req.Seats = []RequestSeat{} // 座席リクエスト情報は空に
 		for carnum := 1; carnum <= 16; carnum++ {
-			seatList := []Seat{}
-			query = "SELECT * FROM seat_master WHERE train_class=? AND car_number=? AND seat_class=? AND is_smoking_seat=? ORDER BY seat_row, seat_column"
-			err = dbx.Select(&seatList, query, req.TrainClass, carnum, req.SeatClass, req.IsSmokingSeat)
+			seatList, err := repo.ListSeats(ctx, SeatFilter{
+				TrainClass:    req.TrainClass,
+				CarNumber:     carnum,
+				SeatClass:     req.SeatClass,
+				IsSmokingSeat: &req.IsSmokingSeat,
+			})
 			if err != nil {
 				tx.Rollback()
-				errorResponse(w, http.StatusBadRequest, err.Error())
+				loggerFromContext(r.Context()).Error(err.Error())
+				errorResponse(w, r, ErrDatabase)
 				return
 			}
 
 			var seatInformationList []SeatInformation
 			for _, seat := range seatList {
 				s := SeatInformation{seat.SeatRow, seat.SeatColumn, seat.SeatClass, seat.IsSmokingSeat, false}
-				seatReservationList := []SeatReservation{}
-				query = "SELECT s.* FROM seat_reservations s, reservations r WHERE r.date=? AND r.train_class=? AND r.train_name=? AND car_number=? AND seat_row=? AND seat_column=? FOR UPDATE"
-				err = dbx.Select(
-					&seatReservationList, query,
-					date.Format("2006/01/02"),
+				// 空席の候補を探すだけなので、トランザクションの外で読んでほかの列車の予約をロックしない
+				// (重複の確認は後で当該列車の予約をロックして行う)
+				seatReservationList, err := repo.ListSeatReservationsAt(
+					r.Context(),
+					date,
 					seat.TrainClass,
 					req.TrainName,
 					seat.CarNumber,
@@ -1162,30 +1188,33 @@ func trainReservationHandler(w http.ResponseWriter, r *http.Request) {
 				)
 				if err != nil {
 					tx.Rollback()
-					errorResponse(w, http.StatusBadRequest, err.Error())
+					loggerFromContext(r.Context()).Error(err.Error())
+					errorResponse(w, r, ErrDatabase)
 					return
 				}
 
 				for _, seatReservation := range seatReservationList {
-					reservation := Reservation{}
-					query = "SELECT * FROM reservations WHERE reservation_id=? FOR UPDATE"
-					err = dbx.Get(&reservation, query, seatReservation.ReservationId)
+					reservation, err := repo.Reservation(r.Context(), int64(seatReservation.ReservationId))
 					if err != nil {
-						panic(err)
+						tx.Rollback()
+						loggerFromContext(r.Context()).Error(err.Error())
+						errorResponse(w, r, ErrDatabase)
+						return
 					}
 
-					var departureStation, arrivalStation Station
-					query = "SELECT * FROM station_master WHERE name=?"
-
-					err = dbx.Get(&departureStation, query, reservation.Departure)
+					departureStation, err := repo.StationByName(ctx, reservation.Departure)
 					if err != nil {
 						tx.Rollback()
-						panic(err)
+						loggerFromContext(r.Context()).Error(err.Error())
+						errorResponse(w, r, ErrDatabase)
+						return
 					}
-					err = dbx.Get(&arrivalStation, query, reservation.Arrival)
+					arrivalStation, err := repo.StationByName(ctx, reservation.Arrival)
 					if err != nil {
 						tx.Rollback()
-						panic(err)
+						loggerFromContext(r.Context()).Error(err.Error())
+						errorResponse(w, r, ErrDatabase)
+						return
 					}
 
 					if train.IsNobori {
@@ -1219,11 +1248,11 @@ func trainReservationHandler(w http.ResponseWriter, r *http.Request) {
 			var VagueSeat RequestSeat // あいまい指定席保存用
 			reserved = false
 			vargue = true
-			seatnum = (req.Adult + req.Child - 1) // 全体の人数からあいまい指定席分を引いておく
-			if req.Column == "" {                 // A/B/C/D/Eを指定しなければ、空いている適当な指定席を取るあいまいモード
-				seatnum = (req.Adult + req.Child) // あいまい指定せず大人＋小人分の座席を取る
-				reserved = true                   // dummy
-				vargue = false                    // dummy
+			seatnum = (partySize - 1) // 全体の人数からあいまい指定席分を引いておく
+			if req.Column == "" {     // A/B/C/D/Eを指定しなければ、空いている適当な指定席を取るあいまいモード
+				seatnum = partySize // あいまい指定せず全員分の座席を取る
+				reserved = true     // dummy
+				vargue = false      // dummy
 			}
 			var CandidateSeat RequestSeat
 			CandidateSeats := []RequestSeat{}
@@ -1250,50 +1279,41 @@ func trainReservationHandler(w http.ResponseWriter, r *http.Request) {
 				req.Seats = append(req.Seats, CandidateSeats...) // 予約候補席追加
 			}
 
-			if len(req.Seats) < req.Adult+req.Child {
+			if len(req.Seats) < partySize {
 				// リクエストに対して席数が足りてない
 				// 次の号車にうつしたい
-				fmt.Println("-----------------")
-				fmt.Printf("現在検索中の車両: %d号車, リクエスト座席数: %d, 予約できそうな座席数: %d, 不足数: %d\n", carnum, req.Adult+req.Child, len(req.Seats), req.Adult+req.Child-len(req.Seats))
-				fmt.Println("リクエストに対して座席数が不足しているため、次の車両を検索します。")
+				loggerFromContext(r.Context()).Debug("not enough seats in car", "car_number", carnum, "party_size", partySize, "available", len(req.Seats))
 				req.Seats = []RequestSeat{}
 				if carnum == 16 {
-					fmt.Println("この新幹線にまとめて予約できる席数がなかったから検索をやめるよ")
+					loggerFromContext(r.Context()).Debug("no car can seat the whole party", "party_size", partySize)
 					req.Seats = []RequestSeat{}
 					break
 				}
 			}
-			fmt.Printf("空き実績: %d号車 シート:%v 席数:%d\n", carnum, req.Seats, len(req.Seats))
-			if len(req.Seats) >= req.Adult+req.Child {
-				fmt.Println("予約情報に追加したよ")
-				req.Seats = req.Seats[:req.Adult+req.Child]
+			if len(req.Seats) >= partySize {
+				loggerFromContext(r.Context()).Debug("seats found", "car_number", carnum, "seats", req.Seats[:partySize])
+				req.Seats = req.Seats[:partySize]
 				req.CarNumber = carnum
 				break
 			}
 		}
 		if len(req.Seats) == 0 {
-			errorResponse(w, http.StatusNotFound, "あいまい座席予約ができませんでした。指定した席、もしくは1車両内に希望の席数をご用意できませんでした。")
+			errorResponse(w, r, ErrNoAvailableSeats)
 			tx.Rollback()
 			return
 		}
 	default:
 		// 座席情報のValidate
-		seatList := Seat{}
 		for _, z := range req.Seats {
-			fmt.Println("XXXX", z)
-			query = "SELECT * FROM seat_master WHERE train_class=? AND car_number=? AND seat_column=? AND seat_row=? AND seat_class=?"
-			err = dbx.Get(
-				&seatList, query,
-				req.TrainClass,
-				req.CarNumber,
-				z.Column,
-				z.Row,
-				req.SeatClass,
-			)
+			loggerFromContext(r.Context()).Debug("validate seat", "car_number", req.CarNumber, "seat_row", z.Row, "seat_column", z.Column)
+			seat, err := repo.Seat(ctx, req.TrainClass, req.CarNumber, z.Row, z.Column)
+			if err == nil && seat.SeatClass != req.SeatClass {
+				err = sql.ErrNoRows
+			}
 			if err != nil {
 				tx.Rollback()
-				errorResponse(w, http.StatusNotFound, "リクエストされた座席情報は存在しません。号車・喫煙席・座席クラスなど組み合わせを見直してください")
-				log.Println(err.Error())
+				errorResponse(w, r, ErrSeatNotFound)
+				loggerFromContext(r.Context()).Error(err.Error())
 				return
 			}
 		}
@@ -1301,18 +1321,11 @@ func trainReservationHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 当該列車・列車名の予約一覧取得
-	reservations := []Reservation{}
-	query = "SELECT * FROM reservations WHERE date=? AND train_class=? AND train_name=? FOR UPDATE"
-	err = tx.Select(
-		&reservations, query,
-		date.Format("2006/01/02"),
-		req.TrainClass,
-		req.TrainName,
-	)
+	reservations, err := repo.ListTrainReservations(ctx, date, req.TrainClass, req.TrainName)
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "列車予約情報の取得に失敗しました")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 
@@ -1321,58 +1334,48 @@ func trainReservationHandler(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 		// train_masterから列車情報を取得(上り・下りが分かる)
-		tmas = Train{}
-		query = "SELECT * FROM train_master WHERE date=? AND train_class=? AND train_name=?"
-		err = tx.Get(
-			&tmas, query,
-			date.Format("2006/01/02"),
-			req.TrainClass,
-			req.TrainName,
-		)
+		tmas, err = repo.Train(ctx, date, req.TrainClass, req.TrainName)
 		if err == sql.ErrNoRows {
 			tx.Rollback()
-			errorResponse(w, http.StatusNotFound, "列車データがみつかりません")
-			log.Println(err.Error())
+			errorResponse(w, r, ErrTrainNotFound)
+			loggerFromContext(r.Context()).Error(err.Error())
 			return
 		}
 		if err != nil {
 			tx.Rollback()
-			errorResponse(w, http.StatusInternalServerError, "列車データの取得に失敗しました")
-			log.Println(err.Error())
+			errorResponse(w, r, ErrDatabase)
+			loggerFromContext(r.Context()).Error(err.Error())
 			return
 		}
 
 		// 予約情報の乗車区間の駅IDを求める
-		var reservedfromStation, reservedtoStation Station
-		query = "SELECT * FROM station_master WHERE name=?"
-
 		// From
-		err = tx.Get(&reservedfromStation, query, reservation.Departure)
+		reservedfromStation, err := repo.StationByName(ctx, reservation.Departure)
 		if err == sql.ErrNoRows {
 			tx.Rollback()
-			errorResponse(w, http.StatusNotFound, "予約情報に記載された列車の乗車駅データがみつかりません")
-			log.Println(err.Error())
+			errorResponse(w, r, ErrStationNotFound, reservation.Departure)
+			loggerFromContext(r.Context()).Error(err.Error())
 			return
 		}
 		if err != nil {
 			tx.Rollback()
-			errorResponse(w, http.StatusInternalServerError, "予約情報に記載された列車の乗車駅データの取得に失敗しました")
-			log.Println(err.Error())
+			errorResponse(w, r, ErrDatabase)
+			loggerFromContext(r.Context()).Error(err.Error())
 			return
 		}
 
 		// To
-		err = tx.Get(&reservedtoStation, query, reservation.Arrival)
+		reservedtoStation, err := repo.StationByName(ctx, reservation.Arrival)
 		if err == sql.ErrNoRows {
 			tx.Rollback()
-			errorResponse(w, http.StatusNotFound, "予約情報に記載された列車の降車駅データがみつかりません")
-			log.Println(err.Error())
+			errorResponse(w, r, ErrStationNotFound, reservation.Arrival)
+			loggerFromContext(r.Context()).Error(err.Error())
 			return
 		}
 		if err != nil {
 			tx.Rollback()
-			errorResponse(w, http.StatusInternalServerError, "予約情報に記載された列車の降車駅データの取得に失敗しました")
-			log.Println(err.Error())
+			errorResponse(w, r, ErrDatabase)
+			loggerFromContext(r.Context()).Error(err.Error())
 			return
 		}
 
@@ -1401,16 +1404,11 @@ func trainReservationHandler(w http.ResponseWriter, r *http.Request) {
 		if secdup {
 
 			// 区間重複の場合は更に座席の重複をチェックする
-			SeatReservations := []SeatReservation{}
-			query := "SELECT * FROM seat_reservations WHERE reservation_id=? FOR UPDATE"
-			err = tx.Select(
-				&SeatReservations, query,
-				reservation.ReservationId,
-			)
+			SeatReservations, err := repo.ListSeatReservations(ctx, int64(reservation.ReservationId))
 			if err != nil {
 				tx.Rollback()
-				errorResponse(w, http.StatusInternalServerError, "座席予約情報の取得に失敗しました")
-				log.Println(err.Error())
+				errorResponse(w, r, ErrDatabase)
+				loggerFromContext(r.Context()).Error(err.Error())
 				return
 			}
 
@@ -1418,8 +1416,8 @@ func trainReservationHandler(w http.ResponseWriter, r *http.Request) {
 				for _, seat := range req.Seats {
 					if v.CarNumber == req.CarNumber && v.SeatRow == seat.Row && v.SeatColumn == seat.Column {
 						tx.Rollback()
-						fmt.Println("Duplicated ", reservation)
-						errorResponse(w, http.StatusBadRequest, "リクエストに既に予約された席が含まれています")
+						loggerFromContext(r.Context()).Debug("seat already reserved", "conflicting_reservation_id", reservation.ReservationId, "car_number", v.CarNumber, "seat_row", v.SeatRow, "seat_column", v.SeatColumn)
+						errorResponse(w, r, ErrSeatTaken)
 						return
 					}
 				}
@@ -1433,7 +1431,7 @@ func trainReservationHandler(w http.ResponseWriter, r *http.Request) {
 		req.Seats = []RequestSeat{}
 		dummySeat := RequestSeat{}
 		req.CarNumber = 0
-		for num := 0; num < req.Adult+req.Child; num++ {
+		for num := 0; num < partySize; num++ {
 			dummySeat.Row = 0
 			dummySeat.Column = ""
 			req.Seats = append(req.Seats, dummySeat)
@@ -1444,109 +1442,156 @@ func trainReservationHandler(w http.ResponseWriter, r *http.Request) {
 	var fare int
 	switch req.SeatClass {
 	case "premium":
-		fare, err = fareCalc(date, fromStation.ID, toStation.ID, req.TrainClass, "premium")
+		fare, err = fareCalc(r.Context(), date, fromStation.ID, toStation.ID, req.TrainClass, "premium")
 		if err != nil {
 			tx.Rollback()
-			errorResponse(w, http.StatusBadRequest, err.Error())
-			log.Println("fareCalc " + err.Error())
+			errorResponse(w, r, ErrInternal)
+			loggerFromContext(r.Context()).Error("fareCalc: " + err.Error())
 			return
 		}
 	case "reserved":
-		fare, err = fareCalc(date, fromStation.ID, toStation.ID, req.TrainClass, "reserved")
+		fare, err = fareCalc(r.Context(), date, fromStation.ID, toStation.ID, req.TrainClass, "reserved")
 		if err != nil {
 			tx.Rollback()
-			errorResponse(w, http.StatusBadRequest, err.Error())
-			log.Println("fareCalc " + err.Error())
+			errorResponse(w, r, ErrInternal)
+			loggerFromContext(r.Context()).Error("fareCalc: " + err.Error())
 			return
 		}
 	case "non-reserved":
-		fare, err = fareCalc(date, fromStation.ID, toStation.ID, req.TrainClass, "non-reserved")
+		fare, err = fareCalc(r.Context(), date, fromStation.ID, toStation.ID, req.TrainClass, "non-reserved")
 		if err != nil {
 			tx.Rollback()
-			errorResponse(w, http.StatusBadRequest, err.Error())
-			log.Println("fareCalc " + err.Error())
+			errorResponse(w, r, ErrInternal)
+			loggerFromContext(r.Context()).Error("fareCalc: " + err.Error())
 			return
 		}
 	default:
 		tx.Rollback()
-		errorResponse(w, http.StatusBadRequest, "リクエストされた座席クラスが不明です")
+		errorResponse(w, r, ErrUnknownSeatClass)
 		return
 	}
-	sumFare := (req.Adult * fare) + (req.Child*fare)/2
-	fmt.Println("SUMFARE")
+	sumFare := passengerFare(fare, passengers)
+	loggerFromContext(r.Context()).Debug("fare", "fare", fare, "passengers", passengers.String(), "sum_fare", sumFare)
 
 	// userID取得。ログインしてないと怒られる。
-	user, errCode, errMsg := getUser(r)
-	if errCode != http.StatusOK {
+	user, errCode := getUser(r, ScopeWriteReservations)
+	if errCode != "" {
 		tx.Rollback()
-		errorResponse(w, errCode, errMsg)
-		log.Printf("%s", errMsg)
+		errorResponse(w, r, errCode)
+		loggerFromContext(r.Context()).Info(string(errCode))
 		return
 	}
 
+	now := clock.Now()
+
+	// プロモーションコードの適用
+	var promotion *Promotion
+	discount := 0
+	if req.PromoCode != "" {
+		target := promotionTarget{
+			TrainClass: req.TrainClass,
+			SeatClass:  req.SeatClass,
+			Departure:  req.Departure,
+			Arrival:    req.Arrival,
+			Date:       date,
+		}
+		p, d, errCode := applyPromotion(ctx, req.PromoCode, user.ID, target, sumFare, now)
+		if errCode != "" {
+			tx.Rollback()
+			errorResponse(w, r, errCode)
+			return
+		}
+		promotion, discount = &p, d
+	}
+	var promotionID *int64
+	if promotion != nil {
+		promotionID = &promotion.ID
+	}
+
+	// ポイントは割引後の運賃を超えない分だけ使う
+	pointsUsed := req.UsePoints
+	if pointsUsed > sumFare-discount {
+		pointsUsed = sumFare - discount
+	}
+
 	//予約ID発行と予約情報登録
-	query = "INSERT INTO `reservations` (`user_id`, `date`, `train_class`, `train_name`, `departure`, `arrival`, `status`, `payment_id`, `adult`, `child`, `amount`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
-	result, err := tx.Exec(
-		query,
-		user.ID,
-		date.Format("2006/01/02"),
-		req.TrainClass,
-		req.TrainName,
-		req.Departure,
-		req.Arrival,
-		"requesting",
-		"a",
-		req.Adult,
-		req.Child,
-		sumFare,
-	)
+	userID := int(user.ID)
+	reservation := Reservation{
+		UserId:      &userID,
+		Date:        &date,
+		TrainClass:  req.TrainClass,
+		TrainName:   req.TrainName,
+		Departure:   req.Departure,
+		Arrival:     req.Arrival,
+		Status:      "requesting",
+		PaymentId:   "a",
+		Adult:       passengers["adult"],
+		Child:       passengers["child"],
+		Passengers:  passengers.String(),
+		Amount:      sumFare - discount - pointsUsed,
+		PromotionID: promotionID,
+		Discount:    discount,
+		PointsUsed:  pointsUsed,
+	}
+	err = repo.CreateReservation(ctx, &reservation)
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusBadRequest, "予約の保存に失敗しました。"+err.Error())
-		log.Println(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
+	id := int64(reservation.ReservationId) //予約ID
+	setLogField(r.Context(), "reservation_id", id)
 
-	id, err := result.LastInsertId() //予約ID
-	if err != nil {
-		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "予約IDの取得に失敗しました")
-		log.Println(err.Error())
-		return
+	if pointsUsed > 0 {
+		if errCode := redeemPoints(ctx, user.ID, id, pointsUsed, now); errCode != "" {
+			tx.Rollback()
+			errorResponse(w, r, errCode)
+			return
+		}
+	}
+	if promotion != nil {
+		if err := redeemPromotion(ctx, promotion.ID, user.ID, id, discount, now); err != nil {
+			tx.Rollback()
+			errorResponse(w, r, ErrDatabase)
+			loggerFromContext(r.Context()).Error(err.Error())
+			return
+		}
 	}
 
 	//席の予約情報登録
 	//reservationsレコード1に対してseat_reservationstが1以上登録される
-	query = "INSERT INTO `seat_reservations` (`reservation_id`, `car_number`, `seat_row`, `seat_column`) VALUES (?, ?, ?, ?)"
 	for _, v := range req.Seats {
-		_, err = tx.Exec(
-			query,
-			id,
-			req.CarNumber,
-			v.Row,
-			v.Column,
-		)
+		err = repo.CreateSeatReservation(ctx, SeatReservation{
+			ReservationId: reservation.ReservationId,
+			CarNumber:     req.CarNumber,
+			SeatRow:       v.Row,
+			SeatColumn:    v.Column,
+		})
 		if err != nil {
 			tx.Rollback()
-			errorResponse(w, http.StatusInternalServerError, "座席予約の登録に失敗しました")
-			log.Println(err.Error())
+			errorResponse(w, r, ErrDatabase)
+			loggerFromContext(r.Context()).Error(err.Error())
 			return
 		}
 	}
 
 	rr := TrainReservationResponse{
 		ReservationId: id,
-		Amount:        sumFare,
+		Amount:        sumFare - discount - pointsUsed,
+		Discount:      discount,
+		PointsUsed:    pointsUsed,
 		IsOk:          true,
 	}
 	response, err := json.Marshal(rr)
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "レスポンスの生成に失敗しました")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrInternal)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 	tx.Commit()
+	recordReservationTransition("none", "requesting")
 	w.Write(response)
 }
 
@@ -1567,45 +1612,49 @@ func reservationPaymentHandler(w http.ResponseWriter, r *http.Request) {
 	req := new(ReservationPaymentRequest)
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		errorResponse(w, http.StatusInternalServerError, "JSON parseに失敗しました")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrInvalidRequest)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
+	if verrs := validateStruct(req); len(verrs) > 0 {
+		validationErrorResponse(w, r, verrs)
+		return
+	}
+	setLogField(r.Context(), "reservation_id", req.ReservationId)
 
-	tx := dbx.MustBegin()
+	ctx, tx, err := repo.BeginTx(r.Context())
+	if err != nil {
+		errorResponse(w, r, ErrDatabase)
+		loggerFromContext(r.Context()).Error(err.Error())
+		return
+	}
 
 	// 予約IDで検索
-	reservation := Reservation{}
-	query := "SELECT * FROM reservations WHERE reservation_id=?"
-	err = tx.Get(
-		&reservation, query,
-		req.ReservationId,
-	)
+	reservation, err := repo.Reservation(ctx, int64(req.ReservationId))
 	if err == sql.ErrNoRows {
 		tx.Rollback()
-		errorResponse(w, http.StatusNotFound, "予約情報がみつかりません")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrReservationNotFound)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "予約情報の取得に失敗しました")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 
 	// 支払い前のユーザチェック。本人以外のユーザの予約を支払ったりキャンセルできてはいけない。
-	user, errCode, errMsg := getUser(r)
-	if errCode != http.StatusOK {
+	user, errCode := getUser(r, ScopeWriteReservations)
+	if errCode != "" {
 		tx.Rollback()
-		errorResponse(w, errCode, errMsg)
-		log.Printf("%s", errMsg)
+		errorResponse(w, r, errCode)
+		loggerFromContext(r.Context()).Info(string(errCode))
 		return
 	}
 	if int64(*reservation.UserId) != user.ID {
 		tx.Rollback()
-		errorResponse(w, http.StatusForbidden, "他のユーザIDの支払いはできません")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrReservationForbidden)
 		return
 	}
 
@@ -1613,7 +1662,7 @@ func reservationPaymentHandler(w http.ResponseWriter, r *http.Request) {
 	switch reservation.Status {
 	case "done":
 		tx.Rollback()
-		errorResponse(w, http.StatusForbidden, "既に支払いが完了している予約IDです")
+		errorResponse(w, r, ErrReservationPaid)
 		return
 	default:
 		break
@@ -1624,37 +1673,32 @@ func reservationPaymentHandler(w http.ResponseWriter, r *http.Request) {
 	j, err := json.Marshal(PaymentInformation{PayInfo: payInfo})
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "JSON Marshalに失敗しました")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrInternal)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 
-	payment_api := os.Getenv("PAYMENT_API")
-	if payment_api == "" {
-		payment_api = "http://payment:5000"
-	}
-
-	resp, err := http.Post(payment_api+"/payment", "application/json", bytes.NewBuffer(j))
+	resp, err := postPayment(r.Context(), appConfig.Payment.URL+"/payment", j)
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, resp.StatusCode, "HTTP POSTに失敗しました")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrPaymentUnavailable)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "レスポンスの読み込みに失敗しました")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrPaymentUnavailable)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 
 	// リクエスト失敗
 	if resp.StatusCode != http.StatusOK {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "決済に失敗しました。カードトークンや支払いIDが間違っている可能性があります")
-		log.Println(resp.StatusCode)
+		errorResponse(w, r, ErrPaymentDeclined)
+		loggerFromContext(r.Context()).Warn("payment declined", "status", resp.StatusCode)
 		return
 	}
 
@@ -1662,23 +1706,26 @@ func reservationPaymentHandler(w http.ResponseWriter, r *http.Request) {
 	output := PaymentResponse{}
 	err = json.Unmarshal(body, &output)
 	if err != nil {
-		errorResponse(w, http.StatusInternalServerError, "JSON parseに失敗しました")
-		log.Println(err.Error())
+		tx.Rollback()
+		errorResponse(w, r, ErrPaymentUnavailable)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 
 	// 予約情報の更新
-	query = "UPDATE reservations SET status=?, payment_id=? WHERE reservation_id=?"
-	_, err = tx.Exec(
-		query,
-		"done",
-		output.PaymentId,
-		req.ReservationId,
-	)
+	err = repo.MarkReservationPaid(ctx, int64(req.ReservationId), output.PaymentId, clock.Now())
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "予約情報の更新に失敗しました")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		loggerFromContext(r.Context()).Error(err.Error())
+		return
+	}
+
+	// ポイント付与
+	if err := earnPoints(ctx, reservation, clock.Now()); err != nil {
+		tx.Rollback()
+		errorResponse(w, r, ErrDatabase)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 
@@ -1688,25 +1735,38 @@ func reservationPaymentHandler(w http.ResponseWriter, r *http.Request) {
 	response, err := json.Marshal(rr)
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "レスポンスの生成に失敗しました")
-		log.Println(err.Error())
+		errorResponse(w, r, ErrInternal)
+		loggerFromContext(r.Context()).Error(err.Error())
 		return
 	}
 	tx.Commit()
+	recordReservationTransition("requesting", "done")
 	w.Write(response)
 }
 
 func getAuthHandler(w http.ResponseWriter, r *http.Request) {
 
 	// userID取得
-	user, errCode, errMsg := getUser(r)
-	if errCode != http.StatusOK {
-		errorResponse(w, errCode, errMsg)
-		log.Printf("%s", errMsg)
+	user, errCode := getUser(r, ScopeReadReservations)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
+		loggerFromContext(r.Context()).Info(string(errCode))
 		return
 	}
 
-	resp := AuthResponse{user.Email}
+	// トークンでのアクセスにはCSRFトークンは不要
+	csrfToken := ""
+	if _, ok := bearerToken(r); !ok {
+		var err error
+		csrfToken, err = issueCSRFToken(w, r)
+		if err != nil {
+			loggerFromContext(r.Context()).Error(err.Error())
+			errorResponse(w, r, ErrSession)
+			return
+		}
+	}
+
+	resp := AuthResponse{user.Email, user.EmailVerifiedAt != nil, csrfToken}
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	json.NewEncoder(w).Encode(resp)
 }
@@ -1718,31 +1778,61 @@ func signUpHandler(w http.ResponseWriter, r *http.Request) {
 	*/
 
 	defer r.Body.Close()
-	buf, _ := ioutil.ReadAll(r.Body)
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		errorResponse(w, r, ErrInvalidRequest)
+		return
+	}
 
 	user := User{}
-	json.Unmarshal(buf, &user)
+	if err := json.Unmarshal(buf, &user); err != nil {
+		errorResponse(w, r, ErrInvalidRequest)
+		return
+	}
+
+	verrs := ValidationErrors{}
+	email, ok := normalizeEmail(user.Email)
+	if !ok {
+		verrs = append(verrs, FieldError{"email", "email", ""})
+	}
+	verrs = append(verrs, passwordPolicy.Check(email, user.Password)...)
+	if len(verrs) > 0 {
+		validationErrorResponse(w, r, verrs)
+		return
+	}
+	user.Email = email
 
-	// TODO: validation
+	_, err = repo.UserByEmail(r.Context(), user.Email)
+	if err == nil {
+		errorResponse(w, r, ErrEmailTaken)
+		return
+	}
+	if err != sql.ErrNoRows {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
 
-	salt := make([]byte, 1024)
-	_, err := crand.Read(salt)
+	superSecurePassword, err := hashPassword(user.Password)
 	if err != nil {
-		errorResponse(w, http.StatusInternalServerError, "salt generator error")
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrInternal)
 		return
 	}
-	superSecurePassword := pbkdf2.Key([]byte(user.Password), salt, 100, 256, sha256.New)
 
-	_, err = dbx.Exec(
-		"INSERT INTO `users` (`email`, `salt`, `super_secure_password`) VALUES (?, ?, ?)",
-		user.Email,
-		salt,
-		superSecurePassword,
-	)
+	// メールアドレスは未確認の状態で登録し、確認メールを送る
+	user.HashedPassword = superSecurePassword
+	err = repo.CreateUser(r.Context(), &user)
+	if err == errEmailTaken {
+		errorResponse(w, r, ErrEmailTaken)
+		return
+	}
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, "user registration failed")
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrRegistrationFailed)
 		return
 	}
+	sendVerificationMail(r.Context(), user.ID, user.Email)
 
 	messageResponse(w, "registration complete")
 }
@@ -1758,37 +1848,94 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 
 	postUser := User{}
 	json.Unmarshal(buf, &postUser)
+	if email, ok := normalizeEmail(postUser.Email); ok {
+		postUser.Email = email
+	}
 
-	user := User{}
-	query := "SELECT * FROM users WHERE email=?"
-	err := dbx.Get(&user, query, postUser.Email)
+	// 総当たり対策 (パスワードの照合より前に判定する)
+	now := time.Now()
+	ip := clientIP(r)
+	wait, err := loginThrottle.Wait(now, postUser.Email, ip)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if wait > 0 {
+		tooManyRequestsResponse(w, r, wait)
+		return
+	}
+
+	user, err := repo.UserByEmail(r.Context(), postUser.Email)
 	if err == sql.ErrNoRows {
-		errorResponse(w, http.StatusForbidden, "authentication failed")
+		if err := loginThrottle.Failure(now, postUser.Email, ip); err != nil {
+			loggerFromContext(r.Context()).Error(err.Error())
+		}
+		errorResponse(w, r, ErrAuthenticationFailed)
 		return
 	}
 	if err != nil {
-		errorResponse(w, http.StatusInternalServerError, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
 		return
 	}
 
-	challengePassword := pbkdf2.Key([]byte(postUser.Password), user.Salt, 100, 256, sha256.New)
-
-	if !bytes.Equal(user.HashedPassword, challengePassword) {
-		errorResponse(w, http.StatusForbidden, "authentication failed")
+	ok, needsRehash, err := verifyPassword(user, postUser.Password)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrInternal)
 		return
 	}
+	if !ok {
+		if err := loginThrottle.Failure(now, postUser.Email, ip); err != nil {
+			loggerFromContext(r.Context()).Error(err.Error())
+		}
+		errorResponse(w, r, ErrAuthenticationFailed)
+		return
+	}
+	if err := loginThrottle.Success(postUser.Email); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+	}
+	if requireEmailVerification && user.EmailVerifiedAt == nil {
+		errorResponse(w, r, ErrEmailNotVerified)
+		return
+	}
+	if needsRehash {
+		rehashPassword(r.Context(), user, postUser.Password)
+	}
 
 	session := getSession(r)
 
+	// セッション固定攻撃を防ぐためログインのたびにIDを振り直す
+	if err = renewSession(session); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrSession)
+		return
+	}
 	session.Values["user_id"] = user.ID
+	setLogField(r.Context(), "user_id", user.ID)
 	if err = session.Save(r, w); err != nil {
-		log.Print(err)
-		errorResponse(w, http.StatusInternalServerError, "session error")
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrSession)
 		return
 	}
 	messageResponse(w, "autheticated")
 }
 
+// rehashPassword は保存済みのハッシュを現在の既定アルゴリズムで置き換える
+// 失敗してもログイン自体は成功させ、次回のログインで再試行する
+func rehashPassword(ctx context.Context, user User, password string) {
+	hashed, err := hashPassword(password)
+	if err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return
+	}
+	err = repo.UpdatePasswordHash(ctx, user.ID, user.HashedPassword, hashed)
+	if err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+	}
+}
+
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	/*
 		ログアウト
@@ -1797,33 +1944,52 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 
 	session := getSession(r)
 
-	session.Values["user_id"] = 0
+	session.Options.MaxAge = -1
 	if err := session.Save(r, w); err != nil {
-		log.Print(err)
-		errorResponse(w, http.StatusInternalServerError, "session error")
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrSession)
 		return
 	}
 	messageResponse(w, "logged out")
 }
 
-func makeReservationResponse(reservation Reservation) (ReservationResponse, error) {
+func logoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		全端末からログアウト
+		POST /auth/logout/all
+	*/
+
+	user, errCode := getSessionUser(r)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
+		return
+	}
+
+	if err := sessionStore.DeleteByUser(user.ID); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrSession)
+		return
+	}
+
+	session := getSession(r)
+	session.Options.MaxAge = -1
+	if err := session.Save(r, w); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrSession)
+		return
+	}
+	messageResponse(w, "logged out from all devices")
+}
+
+func makeReservationResponse(ctx context.Context, reservation Reservation) (ReservationResponse, error) {
 
 	reservationResponse := ReservationResponse{}
 
-	var departure, arrival string
-	err := dbx.Get(
-		&departure,
-		"SELECT departure FROM train_timetable_master WHERE date=? AND train_class=? AND train_name=? AND station=?",
-		reservation.Date.Format("2006/01/02"), reservation.TrainClass, reservation.TrainName, reservation.Departure,
-	)
+	departure, err := repo.TrainStop(ctx, *reservation.Date, reservation.TrainClass, reservation.TrainName, reservation.Departure)
 	if err != nil {
 		return reservationResponse, err
 	}
-	err = dbx.Get(
-		&arrival,
-		"SELECT arrival FROM train_timetable_master WHERE date=? AND train_class=? AND train_name=? AND station=?",
-		reservation.Date.Format("2006/01/02"), reservation.TrainClass, reservation.TrainName, reservation.Arrival,
-	)
+	arrival, err := repo.TrainStop(ctx, *reservation.Date, reservation.TrainClass, reservation.TrainName, reservation.Arrival)
 	if err != nil {
 		return reservationResponse, err
 	}
@@ -1831,17 +1997,19 @@ func makeReservationResponse(reservation Reservation) (ReservationResponse, erro
 	reservationResponse.ReservationId = reservation.ReservationId
 	reservationResponse.Date = reservation.Date.Format("2006/01/02")
 	reservationResponse.Amount = reservation.Amount
+	reservationResponse.Discount = reservation.Discount
+	reservationResponse.PointsUsed = reservation.PointsUsed
 	reservationResponse.Adult = reservation.Adult
 	reservationResponse.Child = reservation.Child
+	reservationResponse.Passengers = reservation.passengerCounts()
 	reservationResponse.Departure = reservation.Departure
 	reservationResponse.Arrival = reservation.Arrival
 	reservationResponse.TrainClass = reservation.TrainClass
 	reservationResponse.TrainName = reservation.TrainName
-	reservationResponse.DepartureTime = departure
-	reservationResponse.ArrivalTime = arrival
+	reservationResponse.DepartureTime = departure.Departure
+	reservationResponse.ArrivalTime = arrival.Arrival
 
-	query := "SELECT * FROM seat_reservations WHERE reservation_id=?"
-	err = dbx.Select(&reservationResponse.Seats, query, reservation.ReservationId)
+	reservationResponse.Seats, err = repo.ListSeatReservations(ctx, int64(reservation.ReservationId))
 
 	// 1つの予約内で車両番号は全席同じ
 	reservationResponse.CarNumber = reservationResponse.Seats[0].CarNumber
@@ -1850,12 +2018,10 @@ func makeReservationResponse(reservation Reservation) (ReservationResponse, erro
 		reservationResponse.SeatClass = "non-reserved"
 	} else {
 		// 座席種別を取得
-		seat := Seat{}
-		query = "SELECT * FROM seat_master WHERE train_class=? AND car_number=? AND seat_column=? AND seat_row=?"
-		err = dbx.Get(
-			&seat, query,
+		seat, err := repo.Seat(
+			ctx,
 			reservation.TrainClass, reservationResponse.CarNumber,
-			reservationResponse.Seats[0].SeatColumn, reservationResponse.Seats[0].SeatRow,
+			reservationResponse.Seats[0].SeatRow, reservationResponse.Seats[0].SeatColumn,
 		)
 		if err == sql.ErrNoRows {
 			return reservationResponse, err
@@ -1880,27 +2046,25 @@ func userReservationsHandler(w http.ResponseWriter, r *http.Request) {
 		ログイン
 		POST /auth/login
 	*/
-	user, errCode, errMsg := getUser(r)
-	if errCode != http.StatusOK {
-		errorResponse(w, errCode, errMsg)
+	user, errCode := getUser(r, ScopeReadReservations)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
 		return
 	}
-	reservationList := []Reservation{}
-
-	query := "SELECT * FROM reservations WHERE user_id=?"
-	err := dbx.Select(&reservationList, query, user.ID)
+	reservationList, err := repo.ListUserReservations(r.Context(), user.ID)
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
 		return
 	}
 
 	reservationResponseList := []ReservationResponse{}
 
-	for _, r := range reservationList {
-		res, err := makeReservationResponse(r)
+	for _, reservation := range reservationList {
+		res, err := makeReservationResponse(r.Context(), reservation)
 		if err != nil {
-			errorResponse(w, http.StatusBadRequest, err.Error())
-			log.Println("makeReservationResponse()", err)
+			errorResponse(w, r, ErrDatabase)
+			loggerFromContext(r.Context()).Error("makeReservationResponse: " + err.Error())
 			return
 		}
 		reservationResponseList = append(reservationResponseList, res)
@@ -1915,35 +2079,35 @@ func userReservationResponseHandler(w http.ResponseWriter, r *http.Request) {
 		ログイン
 		POST /auth/login
 	*/
-	user, errCode, errMsg := getUser(r)
-	if errCode != http.StatusOK {
-		errorResponse(w, errCode, errMsg)
+	user, errCode := getUser(r, ScopeReadReservations)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
 		return
 	}
 	itemIDStr := pat.Param(r, "item_id")
 	itemID, err := strconv.ParseInt(itemIDStr, 10, 64)
 	if err != nil || itemID <= 0 {
-		errorResponse(w, http.StatusBadRequest, "incorrect item id")
+		errorResponse(w, r, ErrInvalidItemID)
 		return
 	}
+	setLogField(r.Context(), "reservation_id", itemID)
 
-	reservation := Reservation{}
-	query := "SELECT * FROM reservations WHERE reservation_id=? AND user_id=?"
-	err = dbx.Get(&reservation, query, itemID, user.ID)
+	reservation, err := repo.UserReservation(r.Context(), itemID, user.ID)
 	if err == sql.ErrNoRows {
-		errorResponse(w, http.StatusNotFound, "Reservation not found")
+		errorResponse(w, r, ErrReservationNotFound)
 		return
 	}
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
 		return
 	}
 
-	reservationResponse, err := makeReservationResponse(reservation)
+	reservationResponse, err := makeReservationResponse(r.Context(), reservation)
 
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, err.Error())
-		log.Println("makeReservationResponse() ", err)
+		errorResponse(w, r, ErrDatabase)
+		loggerFromContext(r.Context()).Error("makeReservationResponse: " + err.Error())
 		return
 	}
 
@@ -1952,125 +2116,128 @@ func userReservationResponseHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func userReservationCancelHandler(w http.ResponseWriter, r *http.Request) {
-	user, errCode, errMsg := getUser(r)
-	if errCode != http.StatusOK {
-		errorResponse(w, errCode, errMsg)
+	user, errCode := getUser(r, ScopeWriteReservations)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
 		return
 	}
 	itemIDStr := pat.Param(r, "item_id")
 	itemID, err := strconv.ParseInt(itemIDStr, 10, 64)
 	if err != nil || itemID <= 0 {
-		errorResponse(w, http.StatusBadRequest, "incorrect item id")
+		errorResponse(w, r, ErrInvalidItemID)
+		return
+	}
+	setLogField(r.Context(), "reservation_id", itemID)
+
+	// 本文は省略できる
+	req := CancelReservationRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		errorResponse(w, r, ErrInvalidRequest)
 		return
 	}
 
-	tx := dbx.MustBegin()
+	ctx, tx, err := repo.BeginTx(r.Context())
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
 
-	reservation := Reservation{}
-	query := "SELECT * FROM reservations WHERE reservation_id=? AND user_id=?"
-	err = tx.Get(&reservation, query, itemID, user.ID)
-	fmt.Println("CANCEL", reservation, itemID, user.ID)
+	reservation, err := repo.UserReservation(ctx, itemID, user.ID)
 	if err == sql.ErrNoRows {
 		tx.Rollback()
-		errorResponse(w, http.StatusBadRequest, "reservations naiyo")
+		errorResponse(w, r, ErrReservationNotFound)
 		return
 	}
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "予約情報の検索に失敗しました")
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
 	}
+	loggerFromContext(r.Context()).Debug("cancel reservation", "status", reservation.Status)
 
+	now := clock.Now()
+	quote := RefundQuote{}
 	switch reservation.Status {
 	case "rejected":
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "何らかの理由により予約はRejected状態です")
+		errorResponse(w, r, ErrReservationRejected)
 		return
 	case "done":
-		// 支払いをキャンセルする
-		payInfo := CancelPaymentInformationRequest{reservation.PaymentId}
-		j, err := json.Marshal(payInfo)
+		// 手数料を差し引いて払い戻す
+		quote, err = quoteRefund(ctx, reservation, now)
 		if err != nil {
 			tx.Rollback()
-			errorResponse(w, http.StatusInternalServerError, "JSON Marshalに失敗しました")
-			log.Println(err.Error())
+			loggerFromContext(r.Context()).Error(err.Error())
+			errorResponse(w, r, ErrDatabase)
 			return
 		}
-
-		payment_api := os.Getenv("PAYMENT_API")
-		if payment_api == "" {
-			payment_api = "http://payment:5000"
-		}
-
-		client := &http.Client{Timeout: time.Duration(10) * time.Second}
-		req, err := http.NewRequest("DELETE", payment_api+"/payment/"+reservation.PaymentId, bytes.NewBuffer(j))
-		if err != nil {
+		if req.RefundAmount != nil && *req.RefundAmount != quote.RefundAmount {
 			tx.Rollback()
-			errorResponse(w, http.StatusInternalServerError, "HTTPリクエストの作成に失敗しました")
-			log.Println(err.Error())
+			errorResponse(w, r, ErrRefundQuoteChanged)
 			return
 		}
-		resp, err := client.Do(req)
-		if err != nil {
-			tx.Rollback()
-			errorResponse(w, resp.StatusCode, "HTTP DELETEに失敗しました")
-			log.Println(err.Error())
-			return
-		}
-		defer resp.Body.Close()
-
-		// リクエスト失敗
-		if resp.StatusCode != http.StatusOK {
-			tx.Rollback()
-			errorResponse(w, http.StatusInternalServerError, "決済のキャンセルに失敗しました")
-			log.Println(resp.StatusCode)
-			return
-		}
-
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			tx.Rollback()
-			errorResponse(w, http.StatusInternalServerError, "レスポンスの読み込みに失敗しました")
-			log.Println(err.Error())
-			return
-		}
-
-		// リクエスト取り出し
-		output := CancelPaymentInformationResponse{}
-		err = json.Unmarshal(body, &output)
-		if err != nil {
-			errorResponse(w, http.StatusInternalServerError, "JSON parseに失敗しました")
-			log.Println(err.Error())
-			return
-		}
-		fmt.Println(output)
 	default:
 		// pass(requesting状態のものはpayment_id無いので叩かない)
 	}
 
-	query = "DELETE FROM reservations WHERE reservation_id=? AND user_id=?"
-	_, err = tx.Exec(query, itemID, user.ID)
+	err = repo.DeleteReservation(ctx, itemID)
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
 		return
 	}
 
-	query = "DELETE FROM seat_reservations WHERE reservation_id=?"
-	_, err = tx.Exec(query, itemID)
-	if err == sql.ErrNoRows {
+	// プロモーションコードの利用回数を戻す
+	if err := releasePromotion(ctx, reservation); err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, "seat naiyo")
-		// errorResponse(w, http.Status, "authentication failed")
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
 		return
 	}
+
+	// 付与したポイントの取り消しと使ったポイントの返還
+	if err := reversePoints(ctx, reservation, now); err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	err = repo.DeleteSeatReservations(ctx, itemID)
 	if err != nil {
 		tx.Rollback()
-		errorResponse(w, http.StatusInternalServerError, err.Error())
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
 		return
 	}
 
-	tx.Commit()
-	messageResponse(w, "cancell complete")
+	// 返金はDBの更新がすべて済んでから最後に行う
+	// コミットに失敗しても、決済サービスは同じ金額での返金のやり直しを受け付ける
+	if reservation.Status == "done" {
+		if errCode := refundPayment(r.Context(), reservation.PaymentId, quote.RefundAmount); errCode != "" {
+			tx.Rollback()
+			errorResponse(w, r, errCode)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	recordReservationTransition(reservation.Status, "canceled")
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(CancelReservationResponse{
+		IsError:      false,
+		Message:      "cancell complete",
+		CancelFee:    quote.CancelFee,
+		RefundAmount: quote.RefundAmount,
+	})
 }
 
 func initializeHandler(w http.ResponseWriter, r *http.Request) {
@@ -2078,12 +2245,41 @@ func initializeHandler(w http.ResponseWriter, r *http.Request) {
 		initialize
 	*/
 
-	dbx.Exec("TRUNCATE seat_reservations")
-	dbx.Exec("TRUNCATE reservations")
-	dbx.Exec("TRUNCATE users")
+	for _, reset := range []func(context.Context) error{
+		repo.DeleteAllReservations,
+		repo.DeleteAllUsers,
+		repo.DeleteAllAPITokens,
+		repo.DeleteAllCalendarTokens,
+		repo.DeleteAllTicketUsages,
+	} {
+		if err := reset(r.Context()); err != nil {
+			loggerFromContext(r.Context()).Error(err.Error())
+			errorResponse(w, r, ErrDatabase)
+			return
+		}
+	}
+	// リポジトリの対象外のテーブル
+	for _, query := range []string{
+		"TRUNCATE email_tokens",
+		"TRUNCATE promotion_redemptions",
+		"UPDATE promotions SET redemption_count = 0",
+		"TRUNCATE point_ledger",
+	} {
+		if _, err := dbx.ExecContext(r.Context(), query); err != nil {
+			loggerFromContext(r.Context()).Error(err.Error())
+			errorResponse(w, r, ErrDatabase)
+			return
+		}
+	}
+	if err := sessionStore.DeleteAll(); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+	}
+	if err := loginThrottle.Store.DeleteAll(); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+	}
 
 	resp := InitializeResponse{
-		availableDays,
+		currentReservationWindow().DaysAhead,
 		"golang",
 	}
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
@@ -2091,13 +2287,8 @@ func initializeHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func settingsHandler(w http.ResponseWriter, r *http.Request) {
-	payment_api := os.Getenv("PAYMENT_API")
-	if payment_api == "" {
-		payment_api = "http://localhost:5000"
-	}
-
 	settings := Settings{
-		PaymentAPI: payment_api,
+		PaymentAPI: appConfig.Payment.PublicURL,
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
@@ -2108,59 +2299,26 @@ func dummyHandler(w http.ResponseWriter, r *http.Request) {
 	messageResponse(w, "ok")
 }
 
-func main() {
-	// MySQL関連のお膳立て
-	var err error
-
-	host := os.Getenv("MYSQL_HOSTNAME")
-	if host == "" {
-		host = "127.0.0.1"
-	}
-	port := os.Getenv("MYSQL_PORT")
-	if port == "" {
-		port = "3306"
-	}
-	_, err = strconv.Atoi(port)
-	if err != nil {
-		port = "3306"
-	}
-	user := os.Getenv("MYSQL_USER")
-	if user == "" {
-		user = "isutrain"
-	}
-	dbname := os.Getenv("MYSQL_DATABASE")
-	if dbname == "" {
-		dbname = "isutrain"
-	}
-	password := os.Getenv("MYSQL_PASSWORD")
-	if password == "" {
-		password = "isutrain"
-	}
-
-	dsn := fmt.Sprintf(
-		"%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=true&loc=Local",
-		user,
-		password,
-		host,
-		port,
-		dbname,
-	)
-
-	dbx, err = sqlx.Open("mysql", dsn)
-	if err != nil {
-		log.Fatalf("failed to connect to DB: %s.", err.Error())
-	}
-	defer dbx.Close()
-
-	// HTTP
-
+// newMux はミドルウェアとルーティングを設定したハンドラを返す
+func newMux() *goji.Mux {
 	mux := goji.NewMux()
+	mux.Use(tracingMiddleware)
+	mux.Use(requestIDMiddleware)
+	mux.Use(metricsMiddleware)
+	mux.Use(csrfProtect)
+
+	// 死活監視
+	mux.HandleFunc(pat.Get("/healthz"), healthzHandler)
+	mux.HandleFunc(pat.Get("/readyz"), readyzHandler)
+	mux.Handle(pat.Get("/metrics"), metricsHandler())
 
 	mux.HandleFunc(pat.Post("/initialize"), initializeHandler)
 	mux.HandleFunc(pat.Get("/api/settings"), settingsHandler)
 
 	// 予約関係
 	mux.HandleFunc(pat.Get("/api/stations"), getStationsHandler)
+	mux.HandleFunc(pat.Get("/api/stations/search"), stationSearchHandler)
+	mux.HandleFunc(pat.Get("/api/passenger_categories"), passengerCategoriesHandler)
 	mux.HandleFunc(pat.Get("/api/train/search"), trainSearchHandler)
 	mux.HandleFunc(pat.Get("/api/train/seats"), trainSeatsHandler)
 	mux.HandleFunc(pat.Post("/api/train/reserve"), trainReservationHandler)
@@ -2171,12 +2329,132 @@ func main() {
 	mux.HandleFunc(pat.Post("/api/auth/signup"), signUpHandler)
 	mux.HandleFunc(pat.Post("/api/auth/login"), loginHandler)
 	mux.HandleFunc(pat.Post("/api/auth/logout"), logoutHandler)
+	mux.HandleFunc(pat.Post("/api/auth/logout/all"), logoutAllHandler)
+	mux.HandleFunc(pat.Post("/api/auth/verify"), verifyEmailHandler)
+	mux.HandleFunc(pat.Post("/api/auth/verify/resend"), resendVerificationHandler)
+	mux.HandleFunc(pat.Post("/api/auth/password/forgot"), forgotPasswordHandler)
+	mux.HandleFunc(pat.Post("/api/auth/password/reset"), resetPasswordHandler)
 	mux.HandleFunc(pat.Get("/api/user/reservations"), userReservationsHandler)
+	mux.HandleFunc(pat.Get("/api/user/reservations.ics"), userReservationsCalendarHandler)
 	mux.HandleFunc(pat.Get("/api/user/reservations/:item_id"), userReservationResponseHandler)
+	mux.HandleFunc(pat.Get("/api/user/reservations/:item_id/cancel/quote"), userReservationCancelQuoteHandler)
 	mux.HandleFunc(pat.Post("/api/user/reservations/:item_id/cancel"), userReservationCancelHandler)
+	mux.HandleFunc(pat.Get("/api/user/reservations/:item_id/receipt"), userReservationReceiptHandler)
+	mux.HandleFunc(pat.Get("/api/user/reservations/:item_id/ticket"), userReservationTicketHandler)
+	mux.HandleFunc(pat.Post("/api/user/calendar/token"), createCalendarTokenHandler)
+	mux.HandleFunc(pat.Delete("/api/user/calendar/token"), deleteCalendarTokenHandler)
+	mux.HandleFunc(pat.Get("/api/user/points"), userPointsHandler)
+
+	// パーソナルアクセストークン
+	mux.HandleFunc(pat.Post("/api/user/tokens"), createAPITokenHandler)
+	mux.HandleFunc(pat.Get("/api/user/tokens"), listAPITokensHandler)
+	mux.HandleFunc(pat.Delete("/api/user/tokens/:token_id"), revokeAPITokenHandler)
+	mux.HandleFunc(pat.Get("/api/user/tokens/:token_id/usages"), apiTokenUsagesHandler)
+
+	// 改札
+	mux.HandleFunc(pat.Post("/api/gate/verify"), requireGate(gateVerifyHandler))
+
+	// 管理用
+	mux.HandleFunc(pat.Delete("/api/admin/users/:user_id/sessions"), requireAdmin(adminRevokeSessionsHandler))
+	mux.HandleFunc(pat.Post("/api/admin/users/:user_id/points"), requireAdmin(adminAdjustPointsHandler))
+	mux.HandleFunc(pat.Post("/api/admin/promotions"), requireAdmin(adminCreatePromotionHandler))
+	mux.HandleFunc(pat.Get("/api/admin/promotions"), requireAdmin(adminListPromotionsHandler))
+	mux.HandleFunc(pat.Delete("/api/admin/promotions/:promotion_id"), requireAdmin(adminEndPromotionHandler))
+	mux.HandleFunc(pat.Get("/api/admin/reservation_window"), requireAdmin(adminGetReservationWindowHandler))
+	mux.HandleFunc(pat.Put("/api/admin/reservation_window"), requireAdmin(adminUpdateReservationWindowHandler))
+	mux.HandleFunc(pat.Delete("/api/admin/reservation_window"), requireAdmin(adminResetReservationWindowHandler))
+	mux.HandleFunc(pat.Put("/api/admin/reservation_window/closed_dates/:date"), requireAdmin(adminCloseDateHandler))
+	mux.HandleFunc(pat.Delete("/api/admin/reservation_window/closed_dates/:date"), requireAdmin(adminReopenDateHandler))
+	mux.HandleFunc(pat.Get("/api/admin/config"), requireAdmin(adminConfigHandler))
+	mux.HandleFunc(pat.Get("/api/admin/clock"), requireAdmin(adminGetClockHandler))
+	if appConfig.Features.TimeTravel {
+		mux.HandleFunc(pat.Put("/api/admin/clock"), requireAdmin(adminSetClockHandler))
+		mux.HandleFunc(pat.Post("/api/admin/clock/advance"), requireAdmin(adminAdvanceClockHandler))
+		mux.HandleFunc(pat.Delete("/api/admin/clock"), requireAdmin(adminResetClockHandler))
+	}
+
+	return mux
+}
 
-	fmt.Println(banner)
-	err = http.ListenAndServe(":8000", mux)
+func main() {
+	var err error
+
+	appConfig, err = loadConfig(os.Getenv("CONFIG_FILE"), os.Getenv)
+	if err != nil {
+		log.Fatalf("failed to load config: %s.", err.Error())
+	}
+
+	if err := configureLogging(appConfig.Log); err != nil {
+		log.Fatalf("failed to configure logging: %s.", err.Error())
+	}
+
+	// MySQL関連のお膳立て
+	dbx, err = openObservedDB(appConfig.DB.DSN())
+	if err != nil {
+		log.Fatalf("failed to connect to DB: %s.", err.Error())
+	}
+	defer dbx.Close()
+	dbx.SetMaxOpenConns(appConfig.DB.MaxOpenConns)
+	dbx.SetMaxIdleConns(appConfig.DB.MaxIdleConns)
+	dbx.SetConnMaxLifetime(time.Duration(appConfig.DB.ConnMaxLifetime))
+	repo = NewMySQLRepository(dbx)
 
-	log.Fatal(err)
+	if err := configureTracing(appConfig.Tracing); err != nil {
+		log.Fatalf("failed to configure tracing: %s.", err.Error())
+	}
+	if err := configureClock(appConfig.Features.TimeTravel, appConfig.Clock); err != nil {
+		log.Fatalf("failed to configure clock: %s.", err.Error())
+	}
+	if err := configurePasswordPolicy(appConfig.Password); err != nil {
+		log.Fatalf("failed to configure password policy: %s.", err.Error())
+	}
+	if err := setDefaultPasswordHasher(appConfig.Password.Hasher); err != nil {
+		log.Fatalf("failed to configure password hasher: %s.", err.Error())
+	}
+	if err := configureSessionStore(dbx, appConfig.Session); err != nil {
+		log.Fatalf("failed to configure session store: %s.", err.Error())
+	}
+	configureCSRF(appConfig.CSRF)
+	if err := configureMailer(appConfig.Mail); err != nil {
+		log.Fatalf("failed to configure mailer: %s.", err.Error())
+	}
+	configureAccountRecovery(appConfig)
+	configureTicketSigning(appConfig.Ticket)
+	if err := configureRefundPolicy(appConfig.Refund); err != nil {
+		log.Fatalf("failed to configure refund policy: %s.", err.Error())
+	}
+	if err := configurePassengerCategories(appConfig.Passenger); err != nil {
+		log.Fatalf("failed to configure passenger categories: %s.", err.Error())
+	}
+	if err := configureLoyaltyPolicy(appConfig.Loyalty); err != nil {
+		log.Fatalf("failed to configure loyalty policy: %s.", err.Error())
+	}
+	if err := configureReservationWindow(dbx, appConfig.ReservationWindow); err != nil {
+		log.Fatalf("failed to configure reservation window: %s.", err.Error())
+	}
+	configureLoginThrottle(dbx, appConfig.LoginThrottle)
+
+	// HTTP
+	mux := newMux()
+
+	ln, err := net.Listen("tcp", appConfig.Listen)
+	if err != nil {
+		log.Fatalf("failed to listen: %s.", err.Error())
+	}
+	// 最初のリクエストを待たずにキャッシュを温める
+	go loadStationIndex(context.Background())
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	fmt.Println(banner)
+	srv := &http.Server{Handler: mux}
+	if err := serve(srv, ln, stop, time.Duration(appConfig.ShutdownDelay), time.Duration(appConfig.ShutdownTimeout)); err != nil {
+		logger.Error(err.Error())
+		tracer.flush()
+		dbx.Close()
+		os.Exit(1)
+	}
+	tracer.flush()
+	logger.Info("shutdown complete")
 }
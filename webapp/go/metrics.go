@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"goji.io/middleware"
+)
+
+/*
+	Prometheus のメトリクス
+
+	GET /metrics で Prometheus のテキスト形式で返す (nginx からは公開しない)
+		isutrain_http_requests_total / isutrain_http_request_duration_seconds: goji のルート (パターン) ごとのリクエスト数と処理時間
+		isutrain_db_query_duration_seconds / isutrain_db_query_errors_total: クエリの名前 (select train_master など) ごとの実行時間とエラー数
+		isutrain_payment_requests_total / isutrain_payment_request_duration_seconds: 決済APIの呼び出し (pay, refund) ごとの結果と所要時間
+		isutrain_reservation_transitions_total: 予約の状態遷移 (none→requesting, requesting→done, requesting/done→canceled)
+		isutrain_seats_total / isutrain_seat_reservations: 予約受付期間内の日付・列車種別ごとの座席数と予約済みの座席数 (取得のたびに DB を集計する)
+*/
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "isutrain_http_requests_total",
+		Help: "Number of HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "isutrain_http_request_duration_seconds",
+		Help:    "HTTP request latency by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "isutrain_db_query_duration_seconds",
+		Help:    "Database query latency by statement.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"statement"})
+	dbQueryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "isutrain_db_query_errors_total",
+		Help: "Number of failed database queries by statement.",
+	}, []string{"statement"})
+
+	paymentRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "isutrain_payment_requests_total",
+		Help: "Number of payment API calls by operation and outcome (ok, declined, failed, error).",
+	}, []string{"operation", "outcome"})
+	paymentRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "isutrain_payment_request_duration_seconds",
+		Help:    "Payment API latency by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	reservationTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "isutrain_reservation_transitions_total",
+		Help: "Number of reservation state transitions.",
+	}, []string{"from", "to"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		httpRequestsTotal,
+		httpRequestDuration,
+		dbQueryDuration,
+		dbQueryErrors,
+		paymentRequestsTotal,
+		paymentRequestDuration,
+		reservationTransitions,
+		seatInventoryCollector{},
+	)
+	queryObservers = append(queryObservers, recordQueryMetrics)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// statusRecorder はハンドラが返したステータスコードを覚えておく
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// routeName はリクエストにマッチした goji のパターン (どれにもマッチしなければ unmatched)
+func routeName(ctx context.Context) string {
+	if p, ok := middleware.Pattern(ctx).(interface{ String() string }); ok {
+		return p.String()
+	}
+	return "unmatched"
+}
+
+// metricsMiddleware はルートごとのリクエスト数と処理時間を記録する
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		route := routeName(r.Context())
+		httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+func recordQueryMetrics(ctx context.Context, ev QueryEvent) {
+	dbQueryDuration.WithLabelValues(ev.Statement).Observe(ev.Duration.Seconds())
+	if ev.Err != nil {
+		dbQueryErrors.WithLabelValues(ev.Statement).Inc()
+	}
+}
+
+// paymentOperation は決済APIのリクエストの種類
+func paymentOperation(r *http.Request) string {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodPost && path == "/payment":
+		return "pay"
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/payment/") && strings.HasSuffix(path, "/refund"):
+		return "refund"
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "/payment/"):
+		return "cancel"
+	}
+	return "other"
+}
+
+// paymentOutcome は決済APIの応答を ok (2xx), declined (4xx), failed (5xx), error (通信エラー) に分ける
+func paymentOutcome(resp *http.Response, err error) string {
+	switch {
+	case err != nil:
+		return "error"
+	case resp.StatusCode < 300:
+		return "ok"
+	case resp.StatusCode < 500:
+		return "declined"
+	}
+	return "failed"
+}
+
+// paymentTransport は決済APIの呼び出しを記録し、トレースの子スパンを作って traceparent を付ける
+type paymentTransport struct {
+	next http.RoundTripper
+}
+
+func (t paymentTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	op := paymentOperation(r)
+	ctx, span := startSpan(r.Context(), "payment "+op, spanKindClient)
+	if span != nil {
+		// RoundTripper はリクエストを書き換えてはいけないのでヘッダを複製する
+		header := make(http.Header, len(r.Header)+1)
+		for k, v := range r.Header {
+			header[k] = v
+		}
+		header.Set("traceparent", span.sc.traceparent())
+		r = r.WithContext(ctx)
+		r.Header = header
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.url", r.URL.String())
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	paymentRequestsTotal.WithLabelValues(op, paymentOutcome(resp, err)).Inc()
+	paymentRequestDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+
+	if err == nil {
+		span.SetAttribute("http.status_code", resp.StatusCode)
+	}
+	span.SetError(err)
+	span.End()
+	return resp, err
+}
+
+// paymentClient は決済APIを呼ぶときに使う
+var paymentClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: paymentTransport{http.DefaultTransport},
+}
+
+// postPayment は決済APIに JSON を POST する
+// ctx のスパンは引き継ぐが、クライアントが切断しても決済APIの呼び出しは中断しない
+func postPayment(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return paymentClient.Do(req.WithContext(detachedSpanContext(ctx)))
+}
+
+// recordReservationTransition は予約の状態遷移を数える (トランザクションをコミットしてから呼ぶ)
+func recordReservationTransition(from, to string) {
+	reservationTransitions.WithLabelValues(from, to).Inc()
+}
+
+var (
+	seatsTotalDesc = prometheus.NewDesc(
+		"isutrain_seats_total",
+		"Number of seats on trains running on the date, by train class.",
+		[]string{"date", "train_class"}, nil,
+	)
+	seatReservationsDesc = prometheus.NewDesc(
+		"isutrain_seat_reservations",
+		"Number of reserved seats (requesting or done) on the date, by train class.",
+		[]string{"date", "train_class"}, nil,
+	)
+)
+
+// seatInventoryCollector は予約受付期間内の座席数と予約済みの座席数を取得のたびに集計する
+type seatInventoryCollector struct{}
+
+func (seatInventoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- seatsTotalDesc
+	ch <- seatReservationsDesc
+}
+
+func (seatInventoryCollector) Collect(ch chan<- prometheus.Metric) {
+	if dbx == nil {
+		return
+	}
+	from, to := currentReservationWindow().Range(clock.Now())
+
+	type count struct {
+		Date       time.Time `db:"date"`
+		TrainClass string    `db:"train_class"`
+		Count      int       `db:"count"`
+	}
+
+	// 列車種別ごとの1編成あたりの座席数
+	seatsPerTrain := []count{}
+	err := dbx.Select(&seatsPerTrain, "SELECT train_class, COUNT(*) AS count FROM seat_master GROUP BY train_class")
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(seatsTotalDesc, err)
+		return
+	}
+	seats := map[string]int{}
+	for _, c := range seatsPerTrain {
+		seats[c.TrainClass] = c.Count
+	}
+
+	trains := []count{}
+	err = dbx.Select(
+		&trains,
+		"SELECT date, train_class, COUNT(*) AS count FROM train_master WHERE date >= ? AND date < ? GROUP BY date, train_class",
+		from.Format("2006-01-02"),
+		to.Format("2006-01-02"),
+	)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(seatsTotalDesc, err)
+		return
+	}
+	for _, c := range trains {
+		ch <- prometheus.MustNewConstMetric(
+			seatsTotalDesc, prometheus.GaugeValue,
+			float64(c.Count*seats[c.TrainClass]),
+			c.Date.Format("2006-01-02"), c.TrainClass,
+		)
+	}
+
+	reserved := []count{}
+	err = dbx.Select(
+		&reserved,
+		"SELECT DATE(r.date) AS date, r.train_class, COUNT(*) AS count FROM seat_reservations s JOIN reservations r ON r.reservation_id = s.reservation_id WHERE r.status IN ('requesting', 'done') AND r.date >= ? AND r.date < ? GROUP BY DATE(r.date), r.train_class",
+		from.Format("2006-01-02"),
+		to.Format("2006-01-02"),
+	)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(seatReservationsDesc, err)
+		return
+	}
+	for _, c := range reserved {
+		ch <- prometheus.MustNewConstMetric(
+			seatReservationsDesc, prometheus.GaugeValue,
+			float64(c.Count),
+			c.Date.Format("2006-01-02"), c.TrainClass,
+		)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	goji "goji.io"
+	"goji.io/pat"
+)
+
+func TestStatementName(t *testing.T) {
+	cases := map[string]string{
+		"SELECT * FROM train_master WHERE date=?":                            "select train_master",
+		"\n\t\tSELECT COUNT(*) FROM `users` WHERE `email`=?":                 "select users",
+		"SELECT s.* FROM seat_reservations s, reservations r WHERE r.date=?": "select seat_reservations",
+		"INSERT INTO `reservations` (`user_id`, `date`) VALUES (?, ?)":       "insert reservations",
+		"INSERT IGNORE INTO `login_failures` (`email`) VALUES (?)":           "insert login_failures",
+		"UPDATE `point_ledger` SET `remaining` = ? WHERE `id` = ?":           "update point_ledger",
+		"DELETE FROM reservations WHERE reservation_id=? AND user_id=?":      "delete reservations",
+		"TRUNCATE `sessions`": "truncate sessions",
+		"SELECT 1":            "select",
+		"SET NAMES utf8mb4":   "other",
+		"":                    "other",
+	}
+	for query, want := range cases {
+		if got := statementName(query); got != want {
+			t.Errorf("statementName(%q) = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestMetricsMiddlewareLabelsRoutes(t *testing.T) {
+	mux := goji.NewMux()
+	mux.Use(metricsMiddleware)
+	mux.HandleFunc(pat.Get("/api/user/reservations/:item_id"), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	mux.HandleFunc(pat.Get("/api/settings"), func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	})
+
+	route := "/api/user/reservations/:item_id"
+	before := testutil.ToFloat64(httpRequestsTotal.WithLabelValues(route, "GET", "404"))
+	for _, id := range []string{"1", "2"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/user/reservations/"+id, nil))
+	}
+	if got := testutil.ToFloat64(httpRequestsTotal.WithLabelValues(route, "GET", "404")) - before; got != 2 {
+		t.Errorf("requests for %s = %v, want 2", route, got)
+	}
+
+	before = testutil.ToFloat64(httpRequestsTotal.WithLabelValues("/api/settings", "GET", "200"))
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/settings", nil))
+	if got := testutil.ToFloat64(httpRequestsTotal.WithLabelValues("/api/settings", "GET", "200")) - before; got != 1 {
+		t.Errorf("requests for /api/settings = %v, want 1", got)
+	}
+
+	before = testutil.ToFloat64(httpRequestsTotal.WithLabelValues("unmatched", "GET", "404"))
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nowhere", nil))
+	if got := testutil.ToFloat64(httpRequestsTotal.WithLabelValues("unmatched", "GET", "404")) - before; got != 1 {
+		t.Errorf("unmatched requests = %v, want 1", got)
+	}
+}
+
+func TestPaymentClientMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/payment":
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	declined := paymentRequestsTotal.WithLabelValues("pay", "declined")
+	failed := paymentRequestsTotal.WithLabelValues("refund", "failed")
+	unreachable := paymentRequestsTotal.WithLabelValues("pay", "error")
+	before := []float64{testutil.ToFloat64(declined), testutil.ToFloat64(failed), testutil.ToFloat64(unreachable)}
+
+	resp, err := paymentClient.Post(ts.URL+"/payment", "application/json", bytes.NewBufferString("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = paymentClient.Post(ts.URL+"/payment/abc/refund", "application/json", bytes.NewBufferString("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, err := paymentClient.Post("http://127.0.0.1:1/payment", "application/json", bytes.NewBufferString("{}")); err == nil {
+		t.Fatal("expected connection error")
+	}
+
+	after := []float64{testutil.ToFloat64(declined), testutil.ToFloat64(failed), testutil.ToFloat64(unreachable)}
+	for i := range before {
+		if after[i]-before[i] != 1 {
+			t.Errorf("counter %d: %v -> %v", i, before[i], after[i])
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	recordReservationTransition("requesting", "done")
+
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`isutrain_reservation_transitions_total{from="requesting",to="done"}`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+	旅客区分
+
+	区分ごとに運賃に掛ける倍率を持つ (小計 = 運賃 × 人数 × 倍率、1円未満切り捨て)
+	倍率は 0.001 単位で扱うので、子供 (0.5) は従来どおり (運賃 × 人数) / 2 になる
+	区分は設定 passenger.categories_file (PASSENGER_CATEGORIES_FILE) の JSON で変更できる。未設定なら defaultPassengerCategories
+	大人・子供は従来の adult / child フィールドでも指定でき、reservations の adult / child にも保存する
+*/
+
+type PassengerCategory struct {
+	Name       string  `json:"name"`
+	Label      string  `json:"label"`
+	Multiplier float64 `json:"multiplier"`
+	// 年齢や必要な証明書などの適用条件 (表示用)
+	Notes string `json:"notes"`
+}
+
+// PassengerCounts は区分名ごとの人数
+type PassengerCounts map[string]int
+
+var defaultPassengerCategories = []PassengerCategory{
+	{Name: "adult", Label: "大人", Multiplier: 1, Notes: "12歳以上"},
+	{Name: "child", Label: "子供", Multiplier: 0.5, Notes: "6歳以上12歳未満"},
+	{Name: "infant", Label: "幼児", Multiplier: 0, Notes: "6歳未満。座席を使用する場合のみ指定してください"},
+	{Name: "senior", Label: "シニア", Multiplier: 0.7, Notes: "65歳以上。年齢を確認できる証明書が必要です"},
+	{Name: "student", Label: "学生", Multiplier: 0.8, Notes: "学生証が必要です"},
+	{Name: "disability", Label: "障害者割引", Multiplier: 0.5, Notes: "障害者手帳が必要です"},
+}
+
+var passengerCategories = defaultPassengerCategories
+
+func findPassengerCategory(name string) (PassengerCategory, bool) {
+	for _, c := range passengerCategories {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return PassengerCategory{}, false
+}
+
+// Fare は count 人分の運賃
+func (c PassengerCategory) Fare(fare, count int) int {
+	return fare * count * int(math.Round(c.Multiplier*1000)) / 1000
+}
+
+func (counts PassengerCounts) Total() int {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return total
+}
+
+// passengerFare は1人あたりの運賃 fare から区分ごとの人数に応じた合計を求める
+func passengerFare(fare int, counts PassengerCounts) int {
+	sum := 0
+	for _, c := range passengerCategories {
+		sum += c.Fare(fare, counts[c.Name])
+	}
+	return sum
+}
+
+// String は "adult:1,child:2" の形式にする (reservations.passengers に保存する)
+func (counts PassengerCounts) String() string {
+	list := []string{}
+	for _, c := range passengerCategories {
+		if n := counts[c.Name]; n > 0 {
+			list = append(list, c.Name+":"+strconv.Itoa(n))
+		}
+	}
+	return strings.Join(list, ",")
+}
+
+func parsePassengerCounts(s string) PassengerCounts {
+	counts := PassengerCounts{}
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil {
+			continue
+		}
+		counts[kv[0]] = n
+	}
+	return counts
+}
+
+// Label は "大人1名 子供2名" の形式にする
+func (counts PassengerCounts) Label() string {
+	list := []string{}
+	for _, c := range passengerCategories {
+		if n := counts[c.Name]; n > 0 {
+			list = append(list, fmt.Sprintf("%s%d名", c.Label, n))
+		}
+	}
+	return strings.Join(list, " ")
+}
+
+// mergeLegacyCounts は adult / child フィールドの人数を passengers に足す
+// 同じ区分を両方で指定した場合は passengers を優先する (食い違いは検証でエラーにする)
+func mergeLegacyCounts(passengers PassengerCounts, adult, child int) PassengerCounts {
+	counts := PassengerCounts{}
+	for name, n := range passengers {
+		if n > 0 {
+			counts[name] = n
+		}
+	}
+	if _, ok := counts["adult"]; !ok && adult > 0 {
+		counts["adult"] = adult
+	}
+	if _, ok := counts["child"]; !ok && child > 0 {
+		counts["child"] = child
+	}
+	return counts
+}
+
+// legacyCountErrors は adult / child フィールドと passengers の食い違いを検出する
+func legacyCountErrors(passengers PassengerCounts, adult, child int) ValidationErrors {
+	errs := ValidationErrors{}
+	if n, ok := passengers["adult"]; ok && adult != 0 && adult != n {
+		errs = append(errs, FieldError{"adult", "passengers_conflict", ""})
+	}
+	if n, ok := passengers["child"]; ok && child != 0 && child != n {
+		errs = append(errs, FieldError{"child", "passengers_conflict", ""})
+	}
+	return errs
+}
+
+// passengerCounts は予約の区分ごとの人数 (passengers 導入前の予約は adult / child から求める)
+func (reservation Reservation) passengerCounts() PassengerCounts {
+	if reservation.Passengers == "" {
+		return mergeLegacyCounts(nil, reservation.Adult, reservation.Child)
+	}
+	return parsePassengerCounts(reservation.Passengers)
+}
+
+func validatePassengerCategories(categories []PassengerCategory) error {
+	seen := map[string]bool{}
+	for _, c := range categories {
+		if c.Name == "" || c.Label == "" {
+			return fmt.Errorf("name and label are required")
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("duplicate category %q", c.Name)
+		}
+		if c.Multiplier < 0 {
+			return fmt.Errorf("%s: multiplier must not be negative", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	// adult / child フィールドとの互換のため
+	for _, name := range []string{"adult", "child"} {
+		if !seen[name] {
+			return fmt.Errorf("category %q is required", name)
+		}
+	}
+	return nil
+}
+
+func passengerCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		旅客区分の一覧
+		GET /api/passenger_categories
+	*/
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(passengerCategories)
+}
+
+// 設定のファイルから旅客区分を設定する
+func configurePassengerCategories(cfg PassengerConfig) error {
+	if cfg.CategoriesFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(cfg.CategoriesFile)
+	if err != nil {
+		return err
+	}
+	categories := []PassengerCategory{}
+	if err := json.Unmarshal(b, &categories); err != nil {
+		return err
+	}
+	if err := validatePassengerCategories(categories); err != nil {
+		return err
+	}
+	passengerCategories = categories
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPassengerFare(t *testing.T) {
+	cases := []struct {
+		fare   int
+		counts PassengerCounts
+		want   int
+	}{
+		{3001, PassengerCounts{"adult": 2, "child": 1}, 6002 + 1500},
+		{3001, PassengerCounts{"child": 3}, 4501}, // 従来どおり (運賃 × 人数) / 2
+		{1000, PassengerCounts{"infant": 2}, 0},
+		{1000, PassengerCounts{"senior": 1, "student": 1, "disability": 1}, 700 + 800 + 500},
+		{999, PassengerCounts{"senior": 1}, 699},
+		{1000, PassengerCounts{}, 0},
+	}
+	for _, c := range cases {
+		if got := passengerFare(c.fare, c.counts); got != c.want {
+			t.Errorf("passengerFare(%d, %v) = %d, want %d", c.fare, c.counts, got, c.want)
+		}
+	}
+}
+
+func TestPassengerCountsString(t *testing.T) {
+	counts := PassengerCounts{"senior": 2, "adult": 1, "child": 0}
+	s := counts.String()
+	if s != "adult:1,senior:2" {
+		t.Fatalf("String() = %q", s)
+	}
+	if got := parsePassengerCounts(s); !reflect.DeepEqual(got, PassengerCounts{"adult": 1, "senior": 2}) {
+		t.Errorf("parsePassengerCounts(%q) = %v", s, got)
+	}
+	if got := counts.Label(); got != "大人1名 シニア2名" {
+		t.Errorf("Label() = %q", got)
+	}
+
+	// passengers 導入前の予約は adult / child から求める
+	legacy := Reservation{Adult: 2, Child: 1}
+	if got := legacy.passengerCounts(); !reflect.DeepEqual(got, PassengerCounts{"adult": 2, "child": 1}) {
+		t.Errorf("legacy reservation: got %v", got)
+	}
+}
+
+func TestMergeLegacyCounts(t *testing.T) {
+	got := mergeLegacyCounts(PassengerCounts{"senior": 1, "student": 0}, 2, 1)
+	want := PassengerCounts{"adult": 2, "child": 1, "senior": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := mergeLegacyCounts(PassengerCounts{"adult": 3}, 3, 0); got["adult"] != 3 {
+		t.Errorf("adult counted twice: %v", got)
+	}
+}
+
+func TestValidatePassengerCategories(t *testing.T) {
+	if err := validatePassengerCategories(defaultPassengerCategories); err != nil {
+		t.Fatalf("default categories are invalid: %v", err)
+	}
+	adult := PassengerCategory{Name: "adult", Label: "大人", Multiplier: 1}
+	child := PassengerCategory{Name: "child", Label: "子供", Multiplier: 0.5}
+	for _, categories := range [][]PassengerCategory{
+		{adult},
+		{adult, child, adult},
+		{adult, child, {Name: "senior", Label: "シニア", Multiplier: -0.1}},
+		{adult, child, {Name: "senior"}},
+	} {
+		if err := validatePassengerCategories(categories); err == nil {
+			t.Errorf("%+v should be invalid", categories)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+/*
+	パスワードハッシュ
+
+	users.super_secure_password には "$<アルゴリズム>$<パラメータ>$..." 形式の文字列を保存する
+	(bcrypt は "$2a$<cost>$..." の標準形式をそのまま使う)
+	この形式として解釈できないものは users.salt を使った旧形式の pbkdf2 (100回) で、ログイン成功時に再ハッシュする
+*/
+
+type PasswordHasher interface {
+	// ID は保存形式の先頭に付くアルゴリズム名
+	ID() string
+	Hash(password string) (string, error)
+	Verify(password, encoded string) (bool, error)
+	// NeedsRehash は現在のパラメータより弱い設定でハッシュされていれば true を返す
+	NeedsRehash(encoded string) bool
+}
+
+var (
+	passwordHashers = map[string]PasswordHasher{}
+
+	defaultPasswordHasher PasswordHasher
+)
+
+func registerPasswordHasher(h PasswordHasher, ids ...string) {
+	passwordHashers[h.ID()] = h
+	for _, id := range ids {
+		passwordHashers[id] = h
+	}
+}
+
+func init() {
+	argon2id := &Argon2idHasher{Time: 2, Memory: 19 * 1024, Threads: 1, KeyLen: 32, SaltLen: 16}
+	registerPasswordHasher(argon2id)
+	registerPasswordHasher(&BcryptHasher{Cost: 10}, "2b", "2y")
+	registerPasswordHasher(&PBKDF2Hasher{Iterations: 600000, KeyLen: 32, SaltLen: 16})
+
+	defaultPasswordHasher = argon2id
+}
+
+// setDefaultPasswordHasher は新規ハッシュと再ハッシュに使うアルゴリズムを切り替える
+func setDefaultPasswordHasher(id string) error {
+	h, ok := passwordHashers[id]
+	if !ok {
+		return fmt.Errorf("unknown password hasher: %s", id)
+	}
+	defaultPasswordHasher = h
+	return nil
+}
+
+func hashPassword(password string) ([]byte, error) {
+	encoded, err := defaultPasswordHasher.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(encoded), nil
+}
+
+// verifyPassword はパスワードを照合し、保存形式を更新すべきかどうかもあわせて返す
+func verifyPassword(user User, password string) (ok bool, needsRehash bool, err error) {
+	h, encoded, ok := parsePasswordHash(user.HashedPassword)
+	if !ok {
+		challenge := pbkdf2.Key([]byte(password), user.Salt, 100, legacyPasswordHashLen, sha256.New)
+		return subtle.ConstantTimeCompare(user.HashedPassword, challenge) == 1, true, nil
+	}
+
+	ok, err = h.Verify(password, encoded)
+	if err != nil || !ok {
+		return false, false, err
+	}
+	return true, h != defaultPasswordHasher || h.NeedsRehash(encoded), nil
+}
+
+// 旧形式は pbkdf2 の出力そのままの256バイトで、先頭が偶然 "$" になることもある
+const legacyPasswordHashLen = 256
+
+// parsePasswordHash は登録済みアルゴリズムの "$<アルゴリズム>$..." 形式なら対応する PasswordHasher を返す
+// 形式は ASCII のみなので、ASCII 以外を含むものや未知のアルゴリズムは旧形式として扱う
+func parsePasswordHash(hashed []byte) (PasswordHasher, string, bool) {
+	if !bytes.HasPrefix(hashed, []byte("$")) {
+		return nil, "", false
+	}
+	for _, c := range hashed {
+		if c < 0x20 || c > 0x7e {
+			return nil, "", false
+		}
+	}
+	encoded := string(hashed)
+	h, ok := passwordHashers[hasherID(encoded)]
+	return h, encoded, ok
+}
+
+func hasherID(encoded string) string {
+	parts := strings.SplitN(encoded, "$", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+var b64 = base64.RawStdEncoding
+
+// Argon2idHasher: $argon2id$v=19$m=<KiB>,t=<回数>,p=<並列数>$<salt>$<hash>
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen int
+}
+
+func (h *Argon2idHasher) ID() string { return "argon2id" }
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt, err := randomBytes(h.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Time, h.Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h *Argon2idHasher) decode(encoded string) (version int, memory, time uint32, threads uint8, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != h.ID() {
+		err = fmt.Errorf("malformed argon2id hash")
+		return
+	}
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return
+	}
+	if salt, err = b64.DecodeString(parts[4]); err != nil {
+		return
+	}
+	key, err = b64.DecodeString(parts[5])
+	return
+}
+
+func (h *Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	version, memory, time, threads, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	if version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version: %d", version)
+	}
+	challenge := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, challenge) == 1, nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	_, memory, time, threads, _, key, err := h.decode(encoded)
+	if err != nil {
+		return true
+	}
+	return memory < h.Memory || time < h.Time || threads < h.Threads || uint32(len(key)) < h.KeyLen
+}
+
+// BcryptHasher: bcrypt 標準形式 ($2a$<cost>$...)
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h *BcryptHasher) ID() string { return "2a" }
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hashed), err
+}
+
+func (h *BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < h.Cost
+}
+
+// PBKDF2Hasher: $pbkdf2-sha256$i=<回数>$<salt>$<hash>
+type PBKDF2Hasher struct {
+	Iterations int
+	KeyLen     int
+	SaltLen    int
+}
+
+func (h *PBKDF2Hasher) ID() string { return "pbkdf2-sha256" }
+
+func (h *PBKDF2Hasher) Hash(password string) (string, error) {
+	salt, err := randomBytes(h.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(password), salt, h.Iterations, h.KeyLen, sha256.New)
+	return fmt.Sprintf("$%s$i=%d$%s$%s", h.ID(), h.Iterations, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h *PBKDF2Hasher) decode(encoded string) (iterations int, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[1] != h.ID() {
+		err = fmt.Errorf("malformed pbkdf2 hash")
+		return
+	}
+	if _, err = fmt.Sscanf(parts[2], "i=%d", &iterations); err != nil {
+		return
+	}
+	if salt, err = b64.DecodeString(parts[3]); err != nil {
+		return
+	}
+	key, err = b64.DecodeString(parts[4])
+	return
+}
+
+func (h *PBKDF2Hasher) Verify(password, encoded string) (bool, error) {
+	iterations, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	challenge := pbkdf2.Key([]byte(password), salt, iterations, len(key), sha256.New)
+	return subtle.ConstantTimeCompare(key, challenge) == 1, nil
+}
+
+func (h *PBKDF2Hasher) NeedsRehash(encoded string) bool {
+	iterations, _, key, err := h.decode(encoded)
+	return err != nil || iterations < h.Iterations || len(key) < h.KeyLen
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := crand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
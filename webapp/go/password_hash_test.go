@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ログイン1回あたりのパスワード照合にかけてよい時間
+const loginHashBudget = 250 * time.Millisecond
+
+func TestPasswordHashersRoundTrip(t *testing.T) {
+	hashers := []PasswordHasher{
+		&Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLen: 32, SaltLen: 16},
+		&BcryptHasher{Cost: 4},
+		&PBKDF2Hasher{Iterations: 1000, KeyLen: 32, SaltLen: 16},
+	}
+	for _, h := range hashers {
+		encoded, err := h.Hash("correct horse")
+		if err != nil {
+			t.Fatalf("%s: %v", h.ID(), err)
+		}
+		if id := hasherID(encoded); passwordHashers[id] == nil {
+			t.Errorf("%s: encoded hash %q has unregistered prefix %q", h.ID(), encoded, id)
+		}
+		if ok, err := h.Verify("correct horse", encoded); !ok || err != nil {
+			t.Errorf("%s: Verify(correct) = %v, %v", h.ID(), ok, err)
+		}
+		if ok, err := h.Verify("wrong horse", encoded); ok || err != nil {
+			t.Errorf("%s: Verify(wrong) = %v, %v", h.ID(), ok, err)
+		}
+		if h.NeedsRehash(encoded) {
+			t.Errorf("%s: fresh hash should not need rehash", h.ID())
+		}
+	}
+}
+
+func TestVerifyPasswordLegacy(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	user := User{
+		Salt:           salt,
+		HashedPassword: pbkdf2.Key([]byte("legacy"), salt, 100, 256, sha256.New),
+	}
+
+	ok, needsRehash, err := verifyPassword(user, "legacy")
+	if !ok || !needsRehash || err != nil {
+		t.Fatalf("verifyPassword(legacy) = %v, %v, %v", ok, needsRehash, err)
+	}
+	if ok, _, _ := verifyPassword(user, "wrong"); ok {
+		t.Fatal("wrong password accepted")
+	}
+}
+
+// 旧形式のハッシュは256通りに1つほど先頭が "$" になる
+func TestVerifyPasswordLegacyWithDollarPrefix(t *testing.T) {
+	var user User
+	for i := 0; ; i++ {
+		salt := []byte(fmt.Sprintf("salt-%d", i))
+		hashed := pbkdf2.Key([]byte("legacy"), salt, 100, 256, sha256.New)
+		if hashed[0] == '$' {
+			user = User{Salt: salt, HashedPassword: hashed}
+			break
+		}
+	}
+
+	ok, needsRehash, err := verifyPassword(user, "legacy")
+	if !ok || !needsRehash || err != nil {
+		t.Fatalf("verifyPassword(legacy) = %v, %v, %v", ok, needsRehash, err)
+	}
+	if ok, _, err := verifyPassword(user, "wrong"); ok || err != nil {
+		t.Fatalf("verifyPassword(wrong) = %v, %v", ok, err)
+	}
+}
+
+func TestVerifyPasswordRehashOnAlgorithmChange(t *testing.T) {
+	weak := &BcryptHasher{Cost: 4}
+	encoded, err := weak.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, needsRehash, err := verifyPassword(User{HashedPassword: []byte(encoded)}, "secret")
+	if !ok || !needsRehash || err != nil {
+		t.Fatalf("verifyPassword(bcrypt) = %v, %v, %v", ok, needsRehash, err)
+	}
+
+	hashed, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, needsRehash, err = verifyPassword(User{HashedPassword: hashed}, "secret")
+	if !ok || needsRehash || err != nil {
+		t.Fatalf("verifyPassword(default) = %v, %v, %v", ok, needsRehash, err)
+	}
+}
+
+func TestLoginHashCostWithinBudget(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping timing test in short mode")
+	}
+	hashed, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := User{HashedPassword: hashed}
+
+	durations := make([]time.Duration, 5)
+	for i := range durations {
+		start := time.Now()
+		if ok, _, err := verifyPassword(user, "correct horse"); !ok || err != nil {
+			t.Fatalf("verifyPassword = %v, %v", ok, err)
+		}
+		durations[i] = time.Since(start)
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	if median := durations[len(durations)/2]; median > loginHashBudget {
+		t.Fatalf("%s verify took %s, budget is %s", defaultPasswordHasher.ID(), median, loginHashBudget)
+	}
+}
+
+func BenchmarkVerifyPassword(b *testing.B) {
+	for _, id := range []string{"argon2id", "2a", "pbkdf2-sha256"} {
+		h := passwordHashers[id]
+		encoded, err := h.Hash("correct horse")
+		if err != nil {
+			b.Fatal(err)
+		}
+		user := User{HashedPassword: []byte(encoded)}
+		b.Run(h.ID(), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				verifyPassword(user, "correct horse")
+			}
+		})
+	}
+}
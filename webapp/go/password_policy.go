@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const maxEmailLength = 300 // users.email の桁数
+
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+
+	denylist map[string]struct{}
+}
+
+var passwordPolicy = NewPasswordPolicy(4, 128)
+
+func NewPasswordPolicy(minLength, maxLength int) *PasswordPolicy {
+	return &PasswordPolicy{
+		MinLength: minLength,
+		MaxLength: maxLength,
+		denylist:  map[string]struct{}{},
+	}
+}
+
+// LoadDenylist は漏洩パスワードのリストを読み込む
+// 1行1パスワード、空行と # で始まる行は無視し、大文字小文字は区別しない
+func (p *PasswordPolicy) LoadDenylist(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	denylist := map[string]struct{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		denylist[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	p.denylist = denylist
+	return nil
+}
+
+func (p *PasswordPolicy) Check(email, password string) ValidationErrors {
+	errs := ValidationErrors{}
+	length := len([]rune(password))
+	if length < p.MinLength {
+		errs = append(errs, FieldError{"password", "password_min_length", strconv.Itoa(p.MinLength)})
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		errs = append(errs, FieldError{"password", "password_max_length", strconv.Itoa(p.MaxLength)})
+	}
+	if _, ok := p.denylist[strings.ToLower(password)]; ok {
+		errs = append(errs, FieldError{"password", "password_denylisted", ""})
+	}
+	if email != "" && strings.EqualFold(password, email) {
+		errs = append(errs, FieldError{"password", "password_same_as_email", ""})
+	}
+	return errs
+}
+
+// normalizeEmail はメールアドレスを比較・保存用の形式にそろえる
+// 表示名付きの形式 ("Name <a@example.com>") は受け付けない
+func normalizeEmail(email string) (string, bool) {
+	email = strings.TrimSpace(email)
+	if email == "" || len(email) > maxEmailLength {
+		return "", false
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", false
+	}
+	return strings.ToLower(addr.Address), true
+}
+
+// 設定からパスワードポリシーを設定する
+func configurePasswordPolicy(cfg PasswordConfig) error {
+	passwordPolicy.MinLength = cfg.MinLength
+	passwordPolicy.MaxLength = cfg.MaxLength
+	if cfg.DenylistFile != "" {
+		return passwordPolicy.LoadDenylist(cfg.DenylistFile)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"user@example.com", "user@example.com", true},
+		{"  User@Example.COM ", "user@example.com", true},
+		{"", "", false},
+		{"user", "", false},
+		{"User <user@example.com>", "", false},
+		{"user@@example.com", "", false},
+	}
+	for _, c := range cases {
+		got, ok := normalizeEmail(c.in)
+		if got != c.want || ok != c.ok {
+			t.Errorf("normalizeEmail(%q) = %q, %v; want %q, %v", c.in, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	f, err := ioutil.TempFile("", "denylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\n\nPassword1\nqwerty\n")
+	f.Close()
+
+	p := NewPasswordPolicy(8, 16)
+	if err := p.LoadDenylist(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	if errs := p.Check("user@example.com", "correct horse"); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	got := p.Check("user@example.com", "qwerty")
+	want := ValidationErrors{
+		{"password", "password_min_length", "8"},
+		{"password", "password_denylisted", ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	got = p.Check("a@example.com", "PASSWORD1")
+	if len(got) != 1 || got[0].Rule != "password_denylisted" {
+		t.Fatalf("denylist should be case-insensitive: %v", got)
+	}
+
+	got = p.Check("a@example.com", "A@EXAMPLE.COM")
+	if len(got) != 1 || got[0].Rule != "password_same_as_email" {
+		t.Fatalf("got %v", got)
+	}
+
+	got = p.Check("a@example.com", "12345678901234567")
+	if len(got) != 1 || got[0].Rule != "password_max_length" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+// 既定のポリシーはベンチマーカーが登録に使う認証情報を受け付ける
+func TestDefaultPasswordPolicyAcceptsBenchmarkCredentials(t *testing.T) {
+	cases := []struct{ email, password string }{
+		{"hoge@example.com", "hoge"},
+		{"puser1@example.com", "puser1"},
+		{"0123456789abcdefghij@example.com", "0123456789abcdefghij"},
+		{"bgtester@example.com", "Clacvuwobfonsakchayraill"},
+	}
+	for _, c := range cases {
+		if errs := passwordPolicy.Check(c.email, c.password); len(errs) != 0 {
+			t.Errorf("Check(%q, %q) = %v", c.email, c.password, errs)
+		}
+	}
+}
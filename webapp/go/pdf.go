@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf16"
+)
+
+/*
+	最小限のPDF生成
+
+	1ページにテキストと罫線を置くだけのもの (領収書用)
+	日本語は Adobe-Japan1 の標準フォント HeiseiKakuGo-W5 (埋め込みなし、UniJIS-UCS2-H) で出力する
+	座標はポイント単位で、原点はページの左下
+*/
+
+const (
+	pdfPageWidth  = 595 // A4
+	pdfPageHeight = 842
+)
+
+type pdfDocument struct {
+	content bytes.Buffer
+}
+
+func newPDFDocument() *pdfDocument {
+	return &pdfDocument{}
+}
+
+// Text は (x, y) を左下として文字列を置く
+func (d *pdfDocument) Text(x, y, size float64, s string) {
+	fmt.Fprintf(&d.content, "BT /F1 %.1f Tf %.2f %.2f Td <%s> Tj ET\n", size, x, y, pdfUTF16Hex(s))
+}
+
+// TextRight は x を右端として文字列を置く
+func (d *pdfDocument) TextRight(x, y, size float64, s string) {
+	d.Text(x-pdfTextWidth(s, size), y, size, s)
+}
+
+func (d *pdfDocument) Line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(&d.content, "%.2f %.2f m %.2f %.2f l S\n", x1, y1, x2, y2)
+}
+
+// pdfTextWidth は /W の指定どおり ASCII を半角、それ以外を全角として幅を求める
+func pdfTextWidth(s string, size float64) float64 {
+	w := 0.0
+	for _, c := range s {
+		if c < 0x80 {
+			w += 0.5
+		} else {
+			w += 1
+		}
+	}
+	return w * size
+}
+
+// UCS-2 の範囲外の文字は "?" に置き換える
+func pdfUTF16Hex(s string) string {
+	runes := []rune(s)
+	for i, c := range runes {
+		if c > 0xFFFF {
+			runes[i] = '?'
+		}
+	}
+	return fmt.Sprintf("%X", pdfUint16Bytes(utf16.Encode(runes)))
+}
+
+func pdfUint16Bytes(u []uint16) []byte {
+	b := make([]byte, 0, len(u)*2)
+	for _, v := range u {
+		b = append(b, byte(v>>8), byte(v))
+	}
+	return b
+}
+
+func (d *pdfDocument) Bytes() []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 5 0 R >> >> /Contents 4 0 R >>", pdfPageWidth, pdfPageHeight),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", d.content.Len(), d.content.String()),
+		"<< /Type /Font /Subtype /Type0 /BaseFont /HeiseiKakuGo-W5 /Encoding /UniJIS-UCS2-H /DescendantFonts [6 0 R] >>",
+		"<< /Type /Font /Subtype /CIDFontType0 /BaseFont /HeiseiKakuGo-W5 " +
+			"/CIDSystemInfo << /Registry (Adobe) /Ordering (Japan1) /Supplement 2 >> " +
+			"/FontDescriptor 7 0 R /DW 1000 /W [1 95 500 231 389 500 631 631 500] >>",
+		"<< /Type /FontDescriptor /FontName /HeiseiKakuGo-W5 /Flags 4 /FontBBox [-92 -250 1010 922] " +
+			"/ItalicAngle 0 /Ascent 752 /Descent -221 /CapHeight 737 /StemV 114 >>",
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"goji.io/pat"
+)
+
+/*
+	プロモーションコード
+
+	予約時に promo_code を指定すると運賃を割り引く (割引後の額を reservations.amount に、割引額を discount に保存する)
+		percent: 運賃の discount_value% を割り引く (1円未満切り捨て)
+		fixed:   discount_value 円を割り引く (運賃を超えない)
+	コードごとに有効期間、全体と1ユーザあたりの利用回数の上限、対象 (列車クラス・座席クラス・区間・乗車日) を設定できる
+	利用回数は予約と同じトランザクションでコードの行をロックして数える。予約をキャンセルすると1回分戻す
+	コードの登録・一覧・終了は管理用API
+*/
+
+const (
+	PromotionDiscountPercent = "percent"
+	PromotionDiscountFixed   = "fixed"
+)
+
+var promoCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+type Promotion struct {
+	ID            int64  `db:"id"`
+	Code          string `db:"code"`
+	Description   string `db:"description"`
+	DiscountType  string `db:"discount_type"`
+	DiscountValue int    `db:"discount_value"`
+	// 有効期間 (NULL は制限なし、EndsAt は含まない)
+	StartsAt *time.Time `db:"starts_at"`
+	EndsAt   *time.Time `db:"ends_at"`
+	// 0 は無制限
+	MaxRedemptions        int `db:"max_redemptions"`
+	MaxRedemptionsPerUser int `db:"max_redemptions_per_user"`
+	RedemptionCount       int `db:"redemption_count"`
+	// 対象 (空なら制限なし、クラスはカンマ区切り)
+	TrainClasses     string     `db:"train_classes"`
+	SeatClasses      string     `db:"seat_classes"`
+	DepartureStation string     `db:"departure_station"`
+	ArrivalStation   string     `db:"arrival_station"`
+	TravelDateFrom   *time.Time `db:"travel_date_from"`
+	TravelDateTo     *time.Time `db:"travel_date_to"`
+	CreatedAt        time.Time  `db:"created_at"`
+}
+
+type PromotionRequest struct {
+	Code                  string   `json:"code" validate:"required,promo_code"`
+	Description           string   `json:"description" validate:"max=255"`
+	DiscountType          string   `json:"discount_type" validate:"required,oneof=percent fixed"`
+	DiscountValue         int      `json:"discount_value" validate:"min=1"`
+	StartsAt              string   `json:"starts_at" validate:"rfc3339"`
+	EndsAt                string   `json:"ends_at" validate:"rfc3339"`
+	MaxRedemptions        int      `json:"max_redemptions" validate:"min=0"`
+	MaxRedemptionsPerUser int      `json:"max_redemptions_per_user" validate:"min=0"`
+	TrainClasses          []string `json:"train_classes" validate:"train_classes"`
+	SeatClasses           []string `json:"seat_classes" validate:"seat_classes"`
+	DepartureStation      string   `json:"departure_station" validate:"max=100"`
+	ArrivalStation        string   `json:"arrival_station" validate:"max=100"`
+	TravelDateFrom        string   `json:"travel_date_from" validate:"date"`
+	TravelDateTo          string   `json:"travel_date_to" validate:"date"`
+}
+
+type PromotionResponse struct {
+	ID                    int64      `json:"id"`
+	Code                  string     `json:"code"`
+	Description           string     `json:"description"`
+	DiscountType          string     `json:"discount_type"`
+	DiscountValue         int        `json:"discount_value"`
+	StartsAt              *time.Time `json:"starts_at"`
+	EndsAt                *time.Time `json:"ends_at"`
+	MaxRedemptions        int        `json:"max_redemptions"`
+	MaxRedemptionsPerUser int        `json:"max_redemptions_per_user"`
+	RedemptionCount       int        `json:"redemption_count"`
+	TrainClasses          []string   `json:"train_classes"`
+	SeatClasses           []string   `json:"seat_classes"`
+	DepartureStation      string     `json:"departure_station"`
+	ArrivalStation        string     `json:"arrival_station"`
+	TravelDateFrom        string     `json:"travel_date_from"`
+	TravelDateTo          string     `json:"travel_date_to"`
+	CreatedAt             time.Time  `json:"created_at"`
+}
+
+// promotionTarget は割引の対象かどうかを判定する予約の内容
+type promotionTarget struct {
+	TrainClass string
+	SeatClass  string
+	Departure  string
+	Arrival    string
+	Date       time.Time
+}
+
+func normalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// PromotionRequest のフィールドをまたぐ検証
+func (req PromotionRequest) Validate() ValidationErrors {
+	errs := ValidationErrors{}
+	if req.DiscountType == PromotionDiscountPercent && req.DiscountValue > 100 {
+		errs = append(errs, FieldError{"discount_value", "max", "100"})
+	}
+	if req.StartsAt != "" && req.EndsAt != "" {
+		starts, err1 := time.Parse(time.RFC3339, req.StartsAt)
+		ends, err2 := time.Parse(time.RFC3339, req.EndsAt)
+		if err1 == nil && err2 == nil && !ends.After(starts) {
+			errs = append(errs, FieldError{"ends_at", "after", "starts_at"})
+		}
+	}
+	if req.TravelDateFrom != "" && req.TravelDateTo != "" && req.TravelDateTo < req.TravelDateFrom {
+		errs = append(errs, FieldError{"travel_date_to", "after", "travel_date_from"})
+	}
+	return errs
+}
+
+// promotion は検証済みのリクエストから Promotion を作る
+func (req PromotionRequest) promotion(now time.Time) Promotion {
+	p := Promotion{
+		Code:                  normalizePromoCode(req.Code),
+		Description:           req.Description,
+		DiscountType:          req.DiscountType,
+		DiscountValue:         req.DiscountValue,
+		MaxRedemptions:        req.MaxRedemptions,
+		MaxRedemptionsPerUser: req.MaxRedemptionsPerUser,
+		TrainClasses:          strings.Join(req.TrainClasses, ","),
+		SeatClasses:           strings.Join(req.SeatClasses, ","),
+		DepartureStation:      req.DepartureStation,
+		ArrivalStation:        req.ArrivalStation,
+		CreatedAt:             now,
+	}
+	parseTime := func(s, layout string) *time.Time {
+		if s == "" {
+			return nil
+		}
+		t, _ := time.ParseInLocation(layout, s, jst)
+		return &t
+	}
+	p.StartsAt = parseTime(req.StartsAt, time.RFC3339)
+	p.EndsAt = parseTime(req.EndsAt, time.RFC3339)
+	p.TravelDateFrom = parseTime(req.TravelDateFrom, "2006-01-02")
+	p.TravelDateTo = parseTime(req.TravelDateTo, "2006-01-02")
+	return p
+}
+
+func (p Promotion) response() PromotionResponse {
+	formatDate := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format("2006-01-02")
+	}
+	return PromotionResponse{
+		ID:                    p.ID,
+		Code:                  p.Code,
+		Description:           p.Description,
+		DiscountType:          p.DiscountType,
+		DiscountValue:         p.DiscountValue,
+		StartsAt:              p.StartsAt,
+		EndsAt:                p.EndsAt,
+		MaxRedemptions:        p.MaxRedemptions,
+		MaxRedemptionsPerUser: p.MaxRedemptionsPerUser,
+		RedemptionCount:       p.RedemptionCount,
+		TrainClasses:          splitList(p.TrainClasses),
+		SeatClasses:           splitList(p.SeatClasses),
+		DepartureStation:      p.DepartureStation,
+		ArrivalStation:        p.ArrivalStation,
+		TravelDateFrom:        formatDate(p.TravelDateFrom),
+		TravelDateTo:          formatDate(p.TravelDateTo),
+		CreatedAt:             p.CreatedAt,
+	}
+}
+
+// Active は now が有効期間内かどうか
+func (p Promotion) Active(now time.Time) bool {
+	if p.StartsAt != nil && now.Before(*p.StartsAt) {
+		return false
+	}
+	if p.EndsAt != nil && !now.Before(*p.EndsAt) {
+		return false
+	}
+	return true
+}
+
+// Applicable は予約が割引の対象かどうか
+func (p Promotion) Applicable(target promotionTarget) bool {
+	if p.TrainClasses != "" && !containsString(splitList(p.TrainClasses), target.TrainClass) {
+		return false
+	}
+	if p.SeatClasses != "" && !containsString(splitList(p.SeatClasses), target.SeatClass) {
+		return false
+	}
+	if p.DepartureStation != "" && p.DepartureStation != target.Departure {
+		return false
+	}
+	if p.ArrivalStation != "" && p.ArrivalStation != target.Arrival {
+		return false
+	}
+	date := target.Date.Format("2006-01-02")
+	if p.TravelDateFrom != nil && date < p.TravelDateFrom.Format("2006-01-02") {
+		return false
+	}
+	if p.TravelDateTo != nil && date > p.TravelDateTo.Format("2006-01-02") {
+		return false
+	}
+	return true
+}
+
+// Discount は運賃 amount に対する割引額
+func (p Promotion) Discount(amount int) int {
+	discount := p.DiscountValue
+	if p.DiscountType == PromotionDiscountPercent {
+		discount = amount * p.DiscountValue / 100
+	}
+	if discount > amount {
+		discount = amount
+	}
+	return discount
+}
+
+// applyPromotion はコードを検証して割引額を返す
+// コードの行を FOR UPDATE でロックするので、redeemPromotion まで同じトランザクション (ctx) で行うこと
+func applyPromotion(ctx context.Context, code string, userID int64, target promotionTarget, amount int, now time.Time) (Promotion, int, ErrorCode) {
+	p := Promotion{}
+	tx, ok := sqlTx(ctx)
+	if !ok {
+		// コードの有無を判定できないので「見つからない」ではなくDBエラーにする
+		loggerFromContext(ctx).Error(errNoSQLTx.Error())
+		return p, 0, ErrDatabase
+	}
+	err := tx.Get(&p, "SELECT * FROM `promotions` WHERE `code` = ? FOR UPDATE", normalizePromoCode(code))
+	if err == sql.ErrNoRows {
+		return p, 0, ErrPromoCodeNotFound
+	}
+	if err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return p, 0, ErrDatabase
+	}
+
+	if !p.Active(now) {
+		return p, 0, ErrPromoCodeNotActive
+	}
+	if !p.Applicable(target) {
+		return p, 0, ErrPromoCodeNotApplicable
+	}
+	if p.MaxRedemptions > 0 && p.RedemptionCount >= p.MaxRedemptions {
+		return p, 0, ErrPromoCodeExhausted
+	}
+	if p.MaxRedemptionsPerUser > 0 {
+		var used int
+		err := tx.Get(&used, "SELECT COUNT(*) FROM `promotion_redemptions` WHERE `promotion_id` = ? AND `user_id` = ?", p.ID, userID)
+		if err != nil {
+			loggerFromContext(ctx).Error(err.Error())
+			return p, 0, ErrDatabase
+		}
+		if used >= p.MaxRedemptionsPerUser {
+			return p, 0, ErrPromoCodeExhausted
+		}
+	}
+	return p, p.Discount(amount), ""
+}
+
+// redeemPromotion は予約に対するコードの利用を記録する
+func redeemPromotion(ctx context.Context, promotionID, userID, reservationID int64, discount int, now time.Time) error {
+	tx, ok := sqlTx(ctx)
+	if !ok {
+		return errNoSQLTx
+	}
+	_, err := tx.Exec(
+		"INSERT INTO `promotion_redemptions` (`promotion_id`, `user_id`, `reservation_id`, `discount`, `created_at`) VALUES (?, ?, ?, ?, ?)",
+		promotionID, userID, reservationID, discount, now,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE `promotions` SET `redemption_count` = `redemption_count` + 1 WHERE `id` = ?", promotionID)
+	return err
+}
+
+// releasePromotion はキャンセルした予約のコード利用を取り消す
+func releasePromotion(ctx context.Context, reservation Reservation) error {
+	tx, ok := sqlTx(ctx)
+	if reservation.PromotionID == nil || !ok {
+		return nil
+	}
+	_, err := tx.Exec("DELETE FROM `promotion_redemptions` WHERE `reservation_id` = ?", reservation.ReservationId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"UPDATE `promotions` SET `redemption_count` = `redemption_count` - 1 WHERE `id` = ? AND `redemption_count` > 0",
+		*reservation.PromotionID,
+	)
+	return err
+}
+
+func adminCreatePromotionHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		プロモーションコードの登録
+		POST /api/admin/promotions
+	*/
+	req := PromotionRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errorResponse(w, r, ErrInvalidRequest)
+		return
+	}
+	req.Code = normalizePromoCode(req.Code)
+	if verrs := validateStruct(req); len(verrs) > 0 {
+		validationErrorResponse(w, r, verrs)
+		return
+	}
+
+	p := req.promotion(clock.Now())
+	result, err := dbx.NamedExecContext(
+		r.Context(),
+		"INSERT INTO `promotions` (`code`, `description`, `discount_type`, `discount_value`, `starts_at`, `ends_at`, "+
+			"`max_redemptions`, `max_redemptions_per_user`, `train_classes`, `seat_classes`, `departure_station`, `arrival_station`, "+
+			"`travel_date_from`, `travel_date_to`, `created_at`) VALUES (:code, :description, :discount_type, :discount_value, "+
+			":starts_at, :ends_at, :max_redemptions, :max_redemptions_per_user, :train_classes, :seat_classes, "+
+			":departure_station, :arrival_station, :travel_date_from, :travel_date_to, :created_at)",
+		p,
+	)
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == mysqlErrDuplicateEntry {
+		errorResponse(w, r, ErrPromoCodeTaken)
+		return
+	}
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	p.ID, err = result.LastInsertId()
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p.response())
+}
+
+func adminListPromotionsHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		プロモーションコードの一覧 (利用回数を含む)
+		GET /api/admin/promotions
+	*/
+	promotions := []Promotion{}
+	if err := dbx.SelectContext(r.Context(), &promotions, "SELECT * FROM `promotions` ORDER BY `id` DESC"); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	resp := make([]PromotionResponse, 0, len(promotions))
+	for _, p := range promotions {
+		resp = append(resp, p.response())
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func adminEndPromotionHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		プロモーションコードをただちに終了する (利用履歴は残す)
+		DELETE /api/admin/promotions/:promotion_id
+	*/
+	promotionID, err := strconv.ParseInt(pat.Param(r, "promotion_id"), 10, 64)
+	if err != nil || promotionID <= 0 {
+		errorResponse(w, r, ErrInvalidRequest)
+		return
+	}
+
+	now := clock.Now()
+	result, err := dbx.ExecContext(
+		r.Context(),
+		"UPDATE `promotions` SET `ends_at` = ? WHERE `id` = ? AND (`ends_at` IS NULL OR `ends_at` > ?)",
+		now, promotionID, now,
+	)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		var exists int
+		if err := dbx.GetContext(r.Context(), &exists, "SELECT COUNT(*) FROM `promotions` WHERE `id` = ?", promotionID); err != nil {
+			loggerFromContext(r.Context()).Error(err.Error())
+			errorResponse(w, r, ErrDatabase)
+			return
+		}
+		if exists == 0 {
+			errorResponse(w, r, ErrPromoCodeNotFound)
+			return
+		}
+	}
+	messageResponse(w, "promotion ended")
+}
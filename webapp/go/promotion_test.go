@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPromotionDiscount(t *testing.T) {
+	cases := []struct {
+		discountType string
+		value        int
+		amount       int
+		want         int
+	}{
+		{PromotionDiscountPercent, 10, 10000, 1000},
+		{PromotionDiscountPercent, 15, 999, 149}, // 1円未満切り捨て
+		{PromotionDiscountPercent, 100, 5000, 5000},
+		{PromotionDiscountFixed, 500, 10000, 500},
+		{PromotionDiscountFixed, 500, 300, 300}, // 運賃を超えない
+	}
+	for _, c := range cases {
+		p := Promotion{DiscountType: c.discountType, DiscountValue: c.value}
+		if got := p.Discount(c.amount); got != c.want {
+			t.Errorf("%s %d of %d = %d, want %d", c.discountType, c.value, c.amount, got, c.want)
+		}
+	}
+}
+
+func TestPromotionActive(t *testing.T) {
+	starts := time.Date(2020, 1, 1, 0, 0, 0, 0, jst)
+	ends := time.Date(2020, 2, 1, 0, 0, 0, 0, jst)
+	p := Promotion{StartsAt: &starts, EndsAt: &ends}
+	for _, tc := range []struct {
+		now  time.Time
+		want bool
+	}{
+		{starts.Add(-time.Second), false},
+		{starts, true},
+		{ends.Add(-time.Second), true},
+		{ends, false},
+	} {
+		if got := p.Active(tc.now); got != tc.want {
+			t.Errorf("Active(%v) = %v, want %v", tc.now, got, tc.want)
+		}
+	}
+	if !(Promotion{}).Active(time.Now()) {
+		t.Error("promotion without a window should always be active")
+	}
+}
+
+func TestPromotionApplicable(t *testing.T) {
+	from := time.Date(2020, 1, 10, 0, 0, 0, 0, jst)
+	to := time.Date(2020, 1, 20, 0, 0, 0, 0, jst)
+	p := Promotion{
+		TrainClasses:     "最速,中間",
+		SeatClasses:      "reserved",
+		DepartureStation: "東京",
+		TravelDateFrom:   &from,
+		TravelDateTo:     &to,
+	}
+	base := promotionTarget{
+		TrainClass: "最速",
+		SeatClass:  "reserved",
+		Departure:  "東京",
+		Arrival:    "大阪",
+		Date:       time.Date(2020, 1, 20, 18, 0, 0, 0, jst),
+	}
+	if !p.Applicable(base) {
+		t.Fatalf("%+v should apply to %+v", p, base)
+	}
+
+	mutations := []func(*promotionTarget){
+		func(target *promotionTarget) { target.TrainClass = "遅いやつ" },
+		func(target *promotionTarget) { target.SeatClass = "premium" },
+		func(target *promotionTarget) { target.Departure = "大阪" },
+		func(target *promotionTarget) { target.Date = to.AddDate(0, 0, 1) },
+		func(target *promotionTarget) { target.Date = from.AddDate(0, 0, -1) },
+	}
+	for i, mutate := range mutations {
+		target := base
+		mutate(&target)
+		if p.Applicable(target) {
+			t.Errorf("case %d: %+v should not apply", i, target)
+		}
+	}
+}
+
+func TestPromotionRequestValidate(t *testing.T) {
+	valid := PromotionRequest{
+		Code:          "SPRING2020",
+		DiscountType:  PromotionDiscountPercent,
+		DiscountValue: 20,
+		StartsAt:      "2020-03-01T00:00:00+09:00",
+		EndsAt:        "2020-04-01T00:00:00+09:00",
+		TrainClasses:  []string{"最速"},
+		SeatClasses:   []string{"premium"},
+	}
+	if errs := validateStruct(valid); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	invalid := []func(*PromotionRequest){
+		func(req *PromotionRequest) { req.Code = "spring 2020" },
+		func(req *PromotionRequest) { req.DiscountValue = 120 },
+		func(req *PromotionRequest) { req.DiscountType = "bogo" },
+		func(req *PromotionRequest) { req.EndsAt = req.StartsAt },
+		func(req *PromotionRequest) { req.TrainClasses = []string{"express"} },
+		func(req *PromotionRequest) { req.SeatClasses = []string{"first"} },
+		func(req *PromotionRequest) { req.TravelDateFrom = "2020/03/01" },
+		func(req *PromotionRequest) { req.TravelDateFrom, req.TravelDateTo = "2020-03-02", "2020-03-01" },
+	}
+	for i, mutate := range invalid {
+		req := valid
+		mutate(&req)
+		if errs := validateStruct(req); len(errs) == 0 {
+			t.Errorf("case %d: %+v should be invalid", i, req)
+		}
+	}
+}
+
+func TestApplyPromotionWithoutSQLTx(t *testing.T) {
+	// MySQL のトランザクションがなければコードの有無を調べられないので DB エラーにする
+	_, discount, errCode := applyPromotion(context.Background(), "SPRING2020", 1, promotionTarget{}, 10000, time.Now())
+	if errCode != ErrDatabase || discount != 0 {
+		t.Errorf("got (%d, %q), want (0, %q)", discount, errCode, ErrDatabase)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"goji.io/pat"
+)
+
+/*
+	領収書
+
+	支払い済み (status=done) の予約について HTML または PDF の領収書を返す
+	?format=pdf か Accept: application/pdf なら PDF、それ以外は HTML
+*/
+
+var SeatClassLabels = map[string]string{
+	"premium":      "プレミアム",
+	"reserved":     "指定席",
+	"non-reserved": "自由席",
+}
+
+type ReceiptLine struct {
+	Label     string
+	UnitPrice int
+	Quantity  int
+	Subtotal  int
+}
+
+type Receipt struct {
+	ReservationID int
+	PaymentID     string
+	IssuedAt      time.Time
+	ReservedAt    time.Time
+	PaidAt        *time.Time
+
+	Date          string
+	TrainClass    string
+	TrainName     string
+	Departure     string
+	Arrival       string
+	DepartureTime string
+	ArrivalTime   string
+	CarNumber     int
+	SeatClass     string
+	Seats         []string
+
+	Passengers string
+	Lines      []ReceiptLine
+	Total      int
+}
+
+func buildReceipt(ctx context.Context, reservation Reservation) (Receipt, error) {
+	reservationResponse, err := makeReservationResponse(ctx, reservation)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	receipt := Receipt{
+		ReservationID: reservation.ReservationId,
+		PaymentID:     reservation.PaymentId,
+		IssuedAt:      clock.Now(),
+		ReservedAt:    reservation.CreatedAt,
+		PaidAt:        reservation.PaidAt,
+		Date:          reservationResponse.Date,
+		TrainClass:    TrainClassMap[reservation.TrainClass],
+		TrainName:     reservation.TrainName,
+		Departure:     reservation.Departure,
+		Arrival:       reservation.Arrival,
+		DepartureTime: reservationResponse.DepartureTime,
+		ArrivalTime:   reservationResponse.ArrivalTime,
+		CarNumber:     reservationResponse.CarNumber,
+		SeatClass:     SeatClassLabels[reservationResponse.SeatClass],
+		Passengers:    reservation.passengerCounts().Label(),
+		Total:         reservation.Amount,
+	}
+	for _, seat := range reservationResponse.Seats {
+		receipt.Seats = append(receipt.Seats, fmt.Sprintf("%d%s", seat.SeatRow, seat.SeatColumn))
+	}
+
+	// 内訳は予約時と同じ計算で求め直す (旅客区分ごとの運賃は passengerCategories の倍率による)
+	fromStation, err := repo.StationByName(ctx, reservation.Departure)
+	if err != nil {
+		return receipt, err
+	}
+	toStation, err := repo.StationByName(ctx, reservation.Arrival)
+	if err != nil {
+		return receipt, err
+	}
+	fare, err := fareCalc(ctx, *reservation.Date, fromStation.ID, toStation.ID, reservation.TrainClass, reservationResponse.SeatClass)
+	if err != nil {
+		return receipt, err
+	}
+	receipt.Lines = append(receiptLines(fare, reservation.passengerCounts()), deductionLines(reservation)...)
+	return receipt, nil
+}
+
+// deductionLines は割引とポイント利用の行 (内訳の合計が支払額になるように負の金額で書く)
+func deductionLines(reservation Reservation) []ReceiptLine {
+	lines := []ReceiptLine{}
+	if reservation.Discount > 0 {
+		lines = append(lines, ReceiptLine{"割引", -reservation.Discount, 1, -reservation.Discount})
+	}
+	if reservation.PointsUsed > 0 {
+		lines = append(lines, ReceiptLine{"ポイント利用", -reservation.PointsUsed, 1, -reservation.PointsUsed})
+	}
+	return lines
+}
+
+func receiptLines(fare int, counts PassengerCounts) []ReceiptLine {
+	lines := []ReceiptLine{}
+	for _, c := range passengerCategories {
+		if n := counts[c.Name]; n > 0 {
+			lines = append(lines, ReceiptLine{c.Label, c.Fare(fare, 1), n, c.Fare(fare, n)})
+		}
+	}
+	return lines
+}
+
+// formatYen は 12345 を "12,345円" にする
+func formatYen(n int) string {
+	s := strconv.Itoa(n)
+	sign := ""
+	if n < 0 {
+		sign, s = "-", s[1:]
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return sign + s + "円"
+}
+
+func formatReceiptTime(t time.Time) string {
+	return t.Format("2006/01/02 15:04")
+}
+
+var receiptTemplate = template.Must(template.New("receipt").Funcs(template.FuncMap{
+	"yen":  formatYen,
+	"time": formatReceiptTime,
+	"join": strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html lang="ja">
+<head>
+<meta charset="utf-8">
+<title>領収書 予約番号{{.ReservationID}}</title>
+<style>
+body { font-family: sans-serif; max-width: 640px; margin: 2em auto; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1.5em; }
+th, td { border-bottom: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+td.num, th.num { text-align: right; }
+.total { font-size: 1.4em; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>領収書</h1>
+<p>ISUTRAIN</p>
+<table>
+<tr><th>予約番号</th><td>{{.ReservationID}}</td></tr>
+<tr><th>決済ID</th><td>{{.PaymentID}}</td></tr>
+<tr><th>予約日時</th><td>{{time .ReservedAt}}</td></tr>
+{{- if .PaidAt}}
+<tr><th>支払日時</th><td>{{time .PaidAt}}</td></tr>
+{{- end}}
+<tr><th>発行日時</th><td>{{time .IssuedAt}}</td></tr>
+</table>
+<h2>乗車内容</h2>
+<table>
+<tr><th>乗車日</th><td>{{.Date}}</td></tr>
+<tr><th>列車</th><td>{{.TrainClass}} {{.TrainName}}号</td></tr>
+<tr><th>区間</th><td>{{.Departure}} {{.DepartureTime}} → {{.Arrival}} {{.ArrivalTime}}</td></tr>
+<tr><th>座席</th><td>{{.SeatClass}}{{if .CarNumber}} {{.CarNumber}}号車 {{join .Seats ", "}}{{end}}</td></tr>
+<tr><th>人数</th><td>{{.Passengers}}</td></tr>
+</table>
+<h2>料金内訳</h2>
+<table>
+<tr><th></th><th class="num">単価</th><th class="num">人数</th><th class="num">小計</th></tr>
+{{- range .Lines}}
+<tr><td>{{.Label}}</td><td class="num">{{yen .UnitPrice}}</td><td class="num">{{.Quantity}}</td><td class="num">{{yen .Subtotal}}</td></tr>
+{{- end}}
+<tr><td class="total">合計</td><td></td><td></td><td class="num total">{{yen .Total}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+func renderReceiptPDF(receipt Receipt) []byte {
+	d := newPDFDocument()
+	const left, right = 60.0, 535.0
+	y := 770.0
+
+	d.Text(left, y, 24, "領収書")
+	d.TextRight(right, y, 10, "ISUTRAIN")
+	y -= 20
+	d.Line(left, y, right, y)
+
+	row := func(label, value string) {
+		y -= 20
+		d.Text(left, y, 10, label)
+		d.Text(left+90, y, 10, value)
+	}
+
+	row("予約番号", strconv.Itoa(receipt.ReservationID))
+	row("決済ID", receipt.PaymentID)
+	row("予約日時", formatReceiptTime(receipt.ReservedAt))
+	if receipt.PaidAt != nil {
+		row("支払日時", formatReceiptTime(*receipt.PaidAt))
+	}
+	row("発行日時", formatReceiptTime(receipt.IssuedAt))
+
+	y -= 30
+	d.Text(left, y, 14, "乗車内容")
+	y -= 6
+	d.Line(left, y, right, y)
+	row("乗車日", receipt.Date)
+	row("列車", receipt.TrainClass+" "+receipt.TrainName+"号")
+	row("区間", fmt.Sprintf("%s %s → %s %s", receipt.Departure, receipt.DepartureTime, receipt.Arrival, receipt.ArrivalTime))
+	seats := receipt.SeatClass
+	if receipt.CarNumber != 0 {
+		seats += fmt.Sprintf(" %d号車 %s", receipt.CarNumber, strings.Join(receipt.Seats, ", "))
+	}
+	row("座席", seats)
+	row("人数", receipt.Passengers)
+
+	y -= 30
+	d.Text(left, y, 14, "料金内訳")
+	y -= 6
+	d.Line(left, y, right, y)
+	y -= 20
+	d.TextRight(340, y, 10, "単価")
+	d.TextRight(420, y, 10, "人数")
+	d.TextRight(right, y, 10, "小計")
+	for _, line := range receipt.Lines {
+		y -= 20
+		d.Text(left, y, 10, line.Label)
+		d.TextRight(340, y, 10, formatYen(line.UnitPrice))
+		d.TextRight(420, y, 10, strconv.Itoa(line.Quantity))
+		d.TextRight(right, y, 10, formatYen(line.Subtotal))
+	}
+	y -= 10
+	d.Line(left, y, right, y)
+	y -= 24
+	d.Text(left, y, 14, "合計")
+	d.TextRight(right, y, 14, formatYen(receipt.Total))
+
+	return d.Bytes()
+}
+
+func wantsPDF(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "pdf":
+		return true
+	case "html":
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/pdf")
+}
+
+func userReservationReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		領収書
+		GET /api/user/reservations/:item_id/receipt
+	*/
+	user, errCode := getSessionUser(r)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
+		return
+	}
+	itemID, err := strconv.ParseInt(pat.Param(r, "item_id"), 10, 64)
+	if err != nil || itemID <= 0 {
+		errorResponse(w, r, ErrInvalidItemID)
+		return
+	}
+	setLogField(r.Context(), "reservation_id", itemID)
+
+	reservation, err := repo.UserReservation(r.Context(), itemID, user.ID)
+	if err == sql.ErrNoRows {
+		errorResponse(w, r, ErrReservationNotFound)
+		return
+	}
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if reservation.Status != "done" {
+		errorResponse(w, r, ErrReservationNotPaid)
+		return
+	}
+
+	receipt, err := buildReceipt(r.Context(), reservation)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	filename := fmt.Sprintf("receipt-%d", receipt.ReservationID)
+	if wantsPDF(r) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s.pdf"`, filename))
+		w.Write(renderReceiptPDF(receipt))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	if err := receiptTemplate.Execute(w, receipt); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatYen(t *testing.T) {
+	for n, want := range map[int]string{0: "0円", 999: "999円", 1000: "1,000円", 1234567: "1,234,567円", -5000: "-5,000円"} {
+		if got := formatYen(n); got != want {
+			t.Errorf("formatYen(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestReceiptLines(t *testing.T) {
+	lines := receiptLines(3001, PassengerCounts{"adult": 2, "child": 1})
+	if len(lines) != 2 || lines[0].Subtotal != 6002 || lines[1].UnitPrice != 1500 || lines[1].Subtotal != 1500 {
+		t.Errorf("unexpected lines: %+v", lines)
+	}
+	if lines := receiptLines(1000, PassengerCounts{"adult": 1, "child": 0}); len(lines) != 1 {
+		t.Errorf("child line should be omitted: %+v", lines)
+	}
+}
+
+func TestDeductionLinesSumToTotal(t *testing.T) {
+	// 運賃 10000 + 5000 から割引 1500 とポイント 2000 を引いた額を支払った予約
+	reservation := Reservation{Amount: 11500, Discount: 1500, PointsUsed: 2000}
+	lines := append(receiptLines(10000, PassengerCounts{"adult": 1, "child": 1}), deductionLines(reservation)...)
+
+	sum := 0
+	for _, line := range lines {
+		sum += line.Subtotal
+	}
+	if sum != reservation.Amount {
+		t.Errorf("lines sum to %d, want %d: %+v", sum, reservation.Amount, lines)
+	}
+	if last := lines[len(lines)-1]; last.Label != "ポイント利用" || last.Subtotal != -2000 {
+		t.Errorf("points line = %+v", last)
+	}
+	if lines := deductionLines(Reservation{Amount: 15000}); len(lines) != 0 {
+		t.Errorf("no deductions expected: %+v", lines)
+	}
+}
+
+func testReceipt() Receipt {
+	paidAt := time.Date(2020, 1, 1, 10, 5, 0, 0, time.Local)
+	return Receipt{
+		ReservationID: 42,
+		PaymentID:     "01DXYZ",
+		IssuedAt:      time.Date(2020, 1, 2, 9, 0, 0, 0, time.Local),
+		ReservedAt:    time.Date(2020, 1, 1, 10, 0, 0, 0, time.Local),
+		PaidAt:        &paidAt,
+		Date:          "2020/01/10",
+		TrainClass:    "最速",
+		TrainName:     "1",
+		Departure:     "東京",
+		Arrival:       "大阪",
+		DepartureTime: "06:00:00",
+		ArrivalTime:   "08:30:00",
+		CarNumber:     3,
+		SeatClass:     "指定席",
+		Seats:         []string{"1A", "1B"},
+		Passengers:    "大人1名 子供1名",
+		Lines:         receiptLines(10000, PassengerCounts{"adult": 1, "child": 1}),
+		Total:         15000,
+	}
+}
+
+func TestReceiptHTML(t *testing.T) {
+	var buf bytes.Buffer
+	if err := receiptTemplate.Execute(&buf, testReceipt()); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	for _, want := range []string{"予約番号", "01DXYZ", "2020/01/01 10:05", "3号車 1A, 1B", "15,000円", "5,000円"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("receipt does not contain %q", want)
+		}
+	}
+}
+
+func TestReceiptPDF(t *testing.T) {
+	pdf := renderReceiptPDF(testReceipt())
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatal("not a PDF")
+	}
+
+	// startxref と xref の各オフセットが実際の位置を指していること
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(pdf)
+	if m == nil {
+		t.Fatal("startxref not found")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(pdf[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d does not point to xref", xref)
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(pdf[xref:], -1)
+	for i, e := range entries {
+		offset, _ := strconv.Atoi(string(e[1]))
+		if !bytes.HasPrefix(pdf[offset:], []byte(fmt.Sprintf("%d 0 obj\n", i+1))) {
+			t.Errorf("xref entry %d points to offset %d which is not the object", i+1, offset)
+		}
+	}
+
+	// "合計" は UTF-16BE で書かれる
+	if !bytes.Contains(pdf, []byte("<54088A08>")) {
+		t.Error("total label not found")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"goji.io/pat"
+)
+
+/*
+	払い戻し
+
+	支払い済みの予約をキャンセルすると、出発までの残り時間と座席クラスに応じた手数料を差し引いて払い戻す
+		手数料 = max(運賃 × 料率, 最低手数料) (運賃を超えない)
+	料率は出発までの残り時間で段階的に決まり、どの段階にも当てはまらない (出発後など) 場合は払い戻さない
+	規定は設定 refund.policy_file (REFUND_POLICY_FILE) の JSON で変更できる。未設定なら defaultRefundPolicy
+*/
+
+type RefundTier struct {
+	// 出発までの残り時間がこれ以上なら適用する (負の値なら出発後も払い戻す)
+	HoursBefore float64 `json:"hours_before"`
+	FeeRate     float64 `json:"fee_rate"`
+}
+
+type RefundPolicy struct {
+	MinFee int          `json:"min_fee"`
+	Tiers  []RefundTier `json:"tiers"`
+	// 座席クラスごとの段階 (指定がなければ Tiers を使う)
+	SeatClassTiers map[string][]RefundTier `json:"seat_class_tiers"`
+}
+
+type RefundQuote struct {
+	ReservationID int       `json:"reservation_id"`
+	Status        string    `json:"status"`
+	SeatClass     string    `json:"seat_class"`
+	DepartureAt   time.Time `json:"departure_at"`
+	Amount        int       `json:"amount"`
+	FeeRate       float64   `json:"fee_rate"`
+	CancelFee     int       `json:"cancel_fee"`
+	RefundAmount  int       `json:"refund_amount"`
+}
+
+type CancelReservationRequest struct {
+	// 見積もりで確認した払い戻し額 (指定した場合、キャンセル時の額と違えば REFUND_QUOTE_CHANGED)
+	RefundAmount *int `json:"refund_amount"`
+}
+
+type CancelReservationResponse struct {
+	IsError      bool   `json:"is_error"`
+	Message      string `json:"message"`
+	CancelFee    int    `json:"cancel_fee"`
+	RefundAmount int    `json:"refund_amount"`
+}
+
+type RefundPaymentRequest struct {
+	Amount int `json:"amount"`
+}
+
+type RefundPaymentResponse struct {
+	IsOk           bool `json:"is_ok"`
+	RefundedAmount int  `json:"refunded_amount"`
+}
+
+// 2日前までは最低手数料のみ、それ以降は30% (プレミアムは1週間前から段階的に上がる)
+var defaultRefundPolicy = RefundPolicy{
+	MinFee: 340,
+	Tiers: []RefundTier{
+		{HoursBefore: 48, FeeRate: 0},
+		{HoursBefore: 0, FeeRate: 0.3},
+	},
+	SeatClassTiers: map[string][]RefundTier{
+		"premium": {
+			{HoursBefore: 168, FeeRate: 0},
+			{HoursBefore: 48, FeeRate: 0.1},
+			{HoursBefore: 0, FeeRate: 0.5},
+		},
+	},
+}
+
+var refundPolicy = defaultRefundPolicy
+
+func (p RefundPolicy) Validate() error {
+	if p.MinFee < 0 {
+		return fmt.Errorf("min_fee must not be negative")
+	}
+	check := func(name string, tiers []RefundTier) error {
+		for _, tier := range tiers {
+			if tier.FeeRate < 0 || tier.FeeRate > 1 {
+				return fmt.Errorf("%s: fee_rate must be between 0 and 1", name)
+			}
+		}
+		return nil
+	}
+	if err := check("tiers", p.Tiers); err != nil {
+		return err
+	}
+	for seatClass, tiers := range p.SeatClassTiers {
+		if _, ok := SeatClassLabels[seatClass]; !ok {
+			return fmt.Errorf("seat_class_tiers: unknown seat class %q", seatClass)
+		}
+		if err := check("seat_class_tiers."+seatClass, tiers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fee は手数料と適用した料率を返す。当てはまる段階がなければ全額を手数料とする
+func (p RefundPolicy) Fee(amount int, seatClass string, departure, now time.Time) (int, float64) {
+	tiers, ok := p.SeatClassTiers[seatClass]
+	if !ok {
+		tiers = p.Tiers
+	}
+	sorted := make([]RefundTier, len(tiers))
+	copy(sorted, tiers)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].HoursBefore > sorted[j].HoursBefore })
+
+	remaining := departure.Sub(now).Hours()
+	for _, tier := range sorted {
+		if remaining < tier.HoursBefore {
+			continue
+		}
+		fee := int(float64(amount) * tier.FeeRate)
+		if fee < p.MinFee {
+			fee = p.MinFee
+		}
+		if fee > amount {
+			fee = amount
+		}
+		return fee, tier.FeeRate
+	}
+	return amount, 1
+}
+
+// quoteRefund は予約をいまキャンセルした場合の払い戻し額を求める
+// 未払い (requesting) の予約は決済がないので手数料も払い戻しもない
+func quoteRefund(ctx context.Context, reservation Reservation, now time.Time) (RefundQuote, error) {
+	resp, err := makeReservationResponse(ctx, reservation)
+	if err != nil {
+		return RefundQuote{}, err
+	}
+	departure, _, err := reservationTimes(*reservation.Date, resp.DepartureTime, resp.ArrivalTime)
+	if err != nil {
+		return RefundQuote{}, err
+	}
+
+	quote := RefundQuote{
+		ReservationID: reservation.ReservationId,
+		Status:        reservation.Status,
+		SeatClass:     resp.SeatClass,
+		DepartureAt:   departure,
+		Amount:        reservation.Amount,
+	}
+	if reservation.Status != "done" {
+		return quote, nil
+	}
+	quote.CancelFee, quote.FeeRate = refundPolicy.Fee(reservation.Amount, resp.SeatClass, departure, now)
+	quote.RefundAmount = reservation.Amount - quote.CancelFee
+	return quote, nil
+}
+
+// refundPayment は決済をキャンセルし、amount だけ払い戻す
+func refundPayment(ctx context.Context, paymentID string, amount int) ErrorCode {
+	j, err := json.Marshal(RefundPaymentRequest{Amount: amount})
+	if err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return ErrInternal
+	}
+
+	resp, err := postPayment(ctx, appConfig.Payment.URL+"/payment/"+paymentID+"/refund", j)
+	if err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return ErrPaymentUnavailable
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		loggerFromContext(ctx).Warn("refund declined", "status", resp.StatusCode)
+		return ErrPaymentCancelFailed
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return ErrPaymentUnavailable
+	}
+	output := RefundPaymentResponse{}
+	if err := json.Unmarshal(body, &output); err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return ErrPaymentUnavailable
+	}
+	if !output.IsOk || output.RefundedAmount != amount {
+		loggerFromContext(ctx).Error("unexpected refund result", "result", output, "requested", amount)
+		return ErrPaymentCancelFailed
+	}
+	return ""
+}
+
+func userReservationCancelQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		キャンセルした場合の払い戻し額の見積もり
+		GET /api/user/reservations/:item_id/cancel/quote
+	*/
+	user, errCode := getUser(r, ScopeReadReservations)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
+		return
+	}
+	itemID, err := strconv.ParseInt(pat.Param(r, "item_id"), 10, 64)
+	if err != nil || itemID <= 0 {
+		errorResponse(w, r, ErrInvalidItemID)
+		return
+	}
+	setLogField(r.Context(), "reservation_id", itemID)
+
+	reservation, err := repo.UserReservation(r.Context(), itemID, user.ID)
+	if err == sql.ErrNoRows {
+		errorResponse(w, r, ErrReservationNotFound)
+		return
+	}
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if reservation.Status == "rejected" {
+		errorResponse(w, r, ErrReservationRejected)
+		return
+	}
+
+	quote, err := quoteRefund(r.Context(), reservation, clock.Now())
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(quote)
+}
+
+// 設定から払い戻し規定を設定する
+func configureRefundPolicy(cfg RefundConfig) error {
+	path := cfg.PolicyFile
+	if path == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	policy := RefundPolicy{}
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return err
+	}
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	refundPolicy = policy
+	return nil
+}
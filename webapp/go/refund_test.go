@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefundPolicyFee(t *testing.T) {
+	departure := time.Date(2020, 1, 10, 9, 0, 0, 0, jst)
+	cases := []struct {
+		amount    int
+		seatClass string
+		before    time.Duration
+		fee       int
+		rate      float64
+	}{
+		{10000, "reserved", 72 * time.Hour, 340, 0},    // 最低手数料のみ
+		{10000, "reserved", 48 * time.Hour, 340, 0},    // 境界は前の段階
+		{10000, "reserved", 47 * time.Hour, 3000, 0.3}, // 2日前を過ぎると30%
+		{1000, "reserved", 1 * time.Hour, 340, 0.3},    // 30%が最低手数料を下回る
+		{200, "reserved", 72 * time.Hour, 200, 0},      // 運賃を超えない
+		{10000, "reserved", -1 * time.Minute, 10000, 1},
+		{10000, "premium", 100 * time.Hour, 1000, 0.1},
+		{10000, "premium", 10 * time.Hour, 5000, 0.5},
+		{10000, "non-reserved", 1 * time.Hour, 3000, 0.3},
+	}
+	for _, c := range cases {
+		fee, rate := defaultRefundPolicy.Fee(c.amount, c.seatClass, departure, departure.Add(-c.before))
+		if fee != c.fee || rate != c.rate {
+			t.Errorf("Fee(%d, %s, %v before) = %d, %v; want %d, %v", c.amount, c.seatClass, c.before, fee, rate, c.fee, c.rate)
+		}
+	}
+}
+
+func TestRefundPolicyValidate(t *testing.T) {
+	if err := defaultRefundPolicy.Validate(); err != nil {
+		t.Fatalf("default policy is invalid: %v", err)
+	}
+
+	invalid := []RefundPolicy{
+		{MinFee: -1},
+		{Tiers: []RefundTier{{HoursBefore: 0, FeeRate: 1.5}}},
+		{SeatClassTiers: map[string][]RefundTier{"first": {{HoursBefore: 0, FeeRate: 0.1}}}},
+		{SeatClassTiers: map[string][]RefundTier{"premium": {{HoursBefore: 0, FeeRate: -0.1}}}},
+	}
+	for _, p := range invalid {
+		if err := p.Validate(); err == nil {
+			t.Errorf("%+v should be invalid", p)
+		}
+	}
+}
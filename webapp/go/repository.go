@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+	リポジトリ
+
+	駅・運賃・列車・時刻表・座席・予約・ユーザ・APIトークン・カレンダーの購読用トークン・改札の記録の読み書きは repo (Repository) を通して行う
+		MySQLRepository: 各マスタと上のテーブルに読み書きする
+		MemoryRepository: プロセス内に保持する (テスト用。マスタデータは LoadMasterData で入れる)
+	見つからない場合は sql.ErrNoRows を返す
+
+	トランザクションは BeginTx が返すコンテキストで表し、そのコンテキストを渡した読み書きはトランザクションの中で行う
+		MySQLRepository はトランザクションの中で読んだ予約と座席予約の行を FOR UPDATE でロックする
+		MemoryRepository はトランザクションを1つずつ順に実行し、Rollback でそのトランザクションの書き込みを取り消す
+	ポイントとプロモーションコードのテーブルはリポジトリを通さないので、sqlTx で MySQL のトランザクションを取り出して読み書きする
+	(MemoryRepository ではポイントの台帳とプロモーションコードは空として扱う)
+	メールの確認・再設定用トークン、予約受付期間の設定、メトリクスの集計もリポジトリの対象外で、dbx で直接読み書きする
+*/
+
+type StationRepository interface {
+	// ListStations は駅IDの順
+	ListStations(ctx context.Context) ([]Station, error)
+	ListStationAliases(ctx context.Context) ([]StationAlias, error)
+	StationByID(ctx context.Context, id int) (Station, error)
+	StationByName(ctx context.Context, name string) (Station, error)
+}
+
+type FareRepository interface {
+	// ListDistanceFares は距離の順
+	ListDistanceFares(ctx context.Context) ([]DistanceFare, error)
+	// ListFares は適用開始日の順
+	ListFares(ctx context.Context, trainClass, seatClass string) ([]Fare, error)
+}
+
+type TrainRepository interface {
+	Train(ctx context.Context, date time.Time, trainClass, trainName string) (Train, error)
+	// SearchTrains は date に走る trainClasses の列車のうち、上りか下りかが isNobori と同じもの
+	SearchTrains(ctx context.Context, date time.Time, trainClasses []string, isNobori bool) ([]Train, error)
+}
+
+type TimetableRepository interface {
+	// TrainStop は列車の station での発着時刻
+	TrainStop(ctx context.Context, date time.Time, trainClass, trainName, station string) (TrainTimetable, error)
+}
+
+type SeatRepository interface {
+	// ListSeats は号車・列・席の順
+	ListSeats(ctx context.Context, filter SeatFilter) ([]Seat, error)
+	Seat(ctx context.Context, trainClass string, carNumber, row int, column string) (Seat, error)
+}
+
+type ReservationRepository interface {
+	Reservation(ctx context.Context, id int64) (Reservation, error)
+	// UserReservation は userID の予約だけを返す (ほかのユーザの予約なら sql.ErrNoRows)
+	UserReservation(ctx context.Context, id, userID int64) (Reservation, error)
+	// ListUserReservations・ListTrainReservations は予約IDの順
+	ListUserReservations(ctx context.Context, userID int64) ([]Reservation, error)
+	ListTrainReservations(ctx context.Context, date time.Time, trainClass, trainName string) ([]Reservation, error)
+	// CreateReservation は予約を登録して ReservationId を設定する (date は日付だけを保存する)
+	CreateReservation(ctx context.Context, reservation *Reservation) error
+	// MarkReservationPaid は予約を支払い済み (done) にする
+	MarkReservationPaid(ctx context.Context, id int64, paymentID string, paidAt time.Time) error
+	DeleteReservation(ctx context.Context, id int64) error
+	DeleteAllReservations(ctx context.Context) error
+
+	ListSeatReservations(ctx context.Context, reservationID int64) ([]SeatReservation, error)
+	// ListSeatReservationsAt は date・trainClass・trainName の列車に予約があれば、
+	// 号車・列・席が同じ座席予約を予約した列車によらずすべて返す
+	ListSeatReservationsAt(ctx context.Context, date time.Time, trainClass, trainName string, carNumber, row int, column string) ([]SeatReservation, error)
+	// ListSeatReservationsInSection は乗車区間が from から to と重なる予約の座席予約を、列車と日付によらずすべて返す (自由席を除く)
+	ListSeatReservationsInSection(ctx context.Context, isNobori bool, from, to Station) ([]SeatReservation, error)
+	CreateSeatReservation(ctx context.Context, seat SeatReservation) error
+	DeleteSeatReservations(ctx context.Context, reservationID int64) error
+}
+
+type UserRepository interface {
+	User(ctx context.Context, id int64) (User, error)
+	UserByEmail(ctx context.Context, email string) (User, error)
+	// CreateUser はユーザを登録して ID を設定する。メールアドレスが登録済みなら errEmailTaken
+	CreateUser(ctx context.Context, user *User) error
+	// UpdatePasswordHash はパスワードのハッシュが oldHash のままなら newHash に置き換える (salt は空にする)
+	UpdatePasswordHash(ctx context.Context, id int64, oldHash, newHash []byte) error
+	DeleteAllUsers(ctx context.Context) error
+}
+
+type APITokenRepository interface {
+	APITokenByHash(ctx context.Context, tokenHash string) (APIToken, error)
+	// UserAPIToken は userID のトークンだけを返す (ほかのユーザのトークンなら sql.ErrNoRows)
+	UserAPIToken(ctx context.Context, id, userID int64) (APIToken, error)
+	// ListUserAPITokens はIDの順
+	ListUserAPITokens(ctx context.Context, userID int64) ([]APIToken, error)
+	// CreateAPIToken はトークンを登録して ID を設定する
+	CreateAPIToken(ctx context.Context, token *APIToken) error
+	// RevokeAPIToken は失効していなければ revokedAt で失効させる
+	RevokeAPIToken(ctx context.Context, id int64, revokedAt time.Time) error
+	// RecordAPITokenUsage は利用履歴を追加してトークンの last_used_at を更新する
+	RecordAPITokenUsage(ctx context.Context, usage APITokenUsage) error
+	// ListAPITokenUsages は新しい順に limit 件
+	ListAPITokenUsages(ctx context.Context, tokenID int64, limit int) ([]APITokenUsage, error)
+	// DeleteAllAPITokens はトークンと利用履歴をすべて消す
+	DeleteAllAPITokens(ctx context.Context) error
+}
+
+type CalendarTokenRepository interface {
+	// CalendarTokenUser は購読用トークンのハッシュが tokenHash のユーザ
+	CalendarTokenUser(ctx context.Context, tokenHash string) (User, error)
+	// PutCalendarToken はユーザの購読用トークンを登録する (登録済みなら置き換える)
+	PutCalendarToken(ctx context.Context, userID int64, tokenHash string, createdAt time.Time) error
+	DeleteCalendarToken(ctx context.Context, userID int64) error
+	DeleteAllCalendarTokens(ctx context.Context) error
+}
+
+type TicketUsageRepository interface {
+	TicketUsage(ctx context.Context, reservationID int64) (TicketUsage, error)
+	// RecordTicketEntry は入場を記録する
+	RecordTicketEntry(ctx context.Context, reservationID int64, station string, at time.Time) error
+	// RecordTicketExit は入場済みの記録に出場を記録する
+	RecordTicketExit(ctx context.Context, reservationID int64, station string, at time.Time) error
+	DeleteAllTicketUsages(ctx context.Context) error
+}
+
+type Repository interface {
+	StationRepository
+	FareRepository
+	TrainRepository
+	TimetableRepository
+	SeatRepository
+	ReservationRepository
+	UserRepository
+	APITokenRepository
+	CalendarTokenRepository
+	TicketUsageRepository
+
+	// BeginTx はトランザクションを始め、その中で読み書きするためのコンテキストを返す
+	BeginTx(ctx context.Context) (context.Context, Tx, error)
+}
+
+// Tx はリポジトリのトランザクション (Commit の後の Rollback は何もしない)
+type Tx interface {
+	Commit() error
+	Rollback() error
+}
+
+type TrainTimetable struct {
+	Date       time.Time `db:"date"`
+	TrainClass string    `db:"train_class"`
+	TrainName  string    `db:"train_name"`
+	Station    string    `db:"station"`
+	// "15:04:05"
+	Departure string `db:"departure"`
+	Arrival   string `db:"arrival"`
+}
+
+// SeatFilter は ListSeats の条件 (ゼロ値の項目では絞り込まない)
+type SeatFilter struct {
+	TrainClass    string
+	CarNumber     int
+	SeatClass     string
+	IsSmokingSeat *bool
+}
+
+var (
+	errEmailTaken = errors.New("email already registered")
+	errNoSQLTx    = errors.New("not in a MySQL transaction")
+)
+
+var repo Repository = NewMemoryRepository()
+
+type sqlTxContextKey struct{}
+
+// sqlTx はコンテキストの MySQL のトランザクションを返す (MySQLRepository の BeginTx の中でなければ ok は false)
+func sqlTx(ctx context.Context) (*sqlx.Tx, bool) {
+	tx, ok := ctx.Value(sqlTxContextKey{}).(*sqlx.Tx)
+	return tx, ok
+}
+
+// sameDate は2つの日時の日付 (それぞれのタイムゾーンでの) が同じかどうか
+func sameDate(a, b time.Time) bool {
+	return a.Format("2006/01/02") == b.Format("2006/01/02")
+}
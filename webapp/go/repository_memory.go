@@ -0,0 +1,868 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryRepository はマスタデータと予約・ユーザ・トークン・改札の記録をプロセス内に保持する
+type MemoryRepository struct {
+	mu sync.Mutex
+	// txMu はトランザクションの間ずっと持つ
+	txMu sync.Mutex
+
+	stations      []Station
+	aliases       []StationAlias
+	distanceFares []DistanceFare
+	fares         []Fare
+	trains        []Train
+	timetables    []TrainTimetable
+	seats         []Seat
+
+	// 予約IDとユーザIDの順
+	reservations     []Reservation
+	seatReservations []SeatReservation
+	users            []User
+
+	// IDの順
+	apiTokens      []APIToken
+	apiTokenUsages []APITokenUsage
+	calendarTokens []memoryCalendarToken
+	ticketUsages   []TicketUsage
+
+	lastReservationID   int
+	lastUserID          int64
+	lastAPITokenID      int64
+	lastAPITokenUsageID int64
+}
+
+type memoryCalendarToken struct {
+	userID    int64
+	tokenHash string
+	createdAt time.Time
+}
+
+// MasterData は MemoryRepository に入れるマスタデータ
+type MasterData struct {
+	Stations       []Station
+	StationAliases []StationAlias
+	DistanceFares  []DistanceFare
+	Fares          []Fare
+	Trains         []Train
+	Timetables     []TrainTimetable
+	Seats          []Seat
+}
+
+type memoryTx struct {
+	repo *MemoryRepository
+	// 書き込みを取り消す関数 (書き込んだ順)
+	undo []func()
+	done bool
+}
+
+type memoryTxContextKey struct{}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{}
+}
+
+// LoadMasterData はマスタデータを入れ替える
+func (m *MemoryRepository) LoadMasterData(data MasterData) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stations = append([]Station{}, data.Stations...)
+	sort.SliceStable(m.stations, func(i, j int) bool { return m.stations[i].ID < m.stations[j].ID })
+	m.aliases = append([]StationAlias{}, data.StationAliases...)
+	sort.SliceStable(m.aliases, func(i, j int) bool {
+		if m.aliases[i].StationID != m.aliases[j].StationID {
+			return m.aliases[i].StationID < m.aliases[j].StationID
+		}
+		return m.aliases[i].Kind < m.aliases[j].Kind
+	})
+	m.distanceFares = append([]DistanceFare{}, data.DistanceFares...)
+	sort.SliceStable(m.distanceFares, func(i, j int) bool { return m.distanceFares[i].Distance < m.distanceFares[j].Distance })
+	m.fares = append([]Fare{}, data.Fares...)
+	sort.SliceStable(m.fares, func(i, j int) bool { return m.fares[i].StartDate.Before(m.fares[j].StartDate) })
+	m.trains = append([]Train{}, data.Trains...)
+	m.timetables = append([]TrainTimetable{}, data.Timetables...)
+	m.seats = append([]Seat{}, data.Seats...)
+	sort.SliceStable(m.seats, func(i, j int) bool {
+		a, b := m.seats[i], m.seats[j]
+		if a.CarNumber != b.CarNumber {
+			return a.CarNumber < b.CarNumber
+		}
+		if a.SeatRow != b.SeatRow {
+			return a.SeatRow < b.SeatRow
+		}
+		return a.SeatColumn < b.SeatColumn
+	})
+}
+
+func (m *MemoryRepository) BeginTx(ctx context.Context) (context.Context, Tx, error) {
+	m.txMu.Lock()
+	tx := &memoryTx{repo: m}
+	return context.WithValue(ctx, memoryTxContextKey{}, tx), tx, nil
+}
+
+func (tx *memoryTx) Commit() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+	tx.repo.txMu.Unlock()
+	return nil
+}
+
+func (tx *memoryTx) Rollback() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+	tx.repo.mu.Lock()
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.repo.mu.Unlock()
+	tx.repo.txMu.Unlock()
+	return nil
+}
+
+// onRollback はトランザクションの中の書き込みなら、取り消す関数を記録する (m.mu を持って呼ぶ)
+func (m *MemoryRepository) onRollback(ctx context.Context, undo func()) {
+	if tx, ok := ctx.Value(memoryTxContextKey{}).(*memoryTx); ok && tx.repo == m {
+		tx.undo = append(tx.undo, undo)
+	}
+}
+
+func (m *MemoryRepository) ListStations(ctx context.Context) ([]Station, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Station{}, m.stations...), nil
+}
+
+func (m *MemoryRepository) ListStationAliases(ctx context.Context) ([]StationAlias, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]StationAlias{}, m.aliases...), nil
+}
+
+func (m *MemoryRepository) StationByID(ctx context.Context, id int) (Station, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, station := range m.stations {
+		if station.ID == id {
+			return station, nil
+		}
+	}
+	return Station{}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) StationByName(ctx context.Context, name string) (Station, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stationByName(name)
+}
+
+func (m *MemoryRepository) stationByName(name string) (Station, error) {
+	for _, station := range m.stations {
+		if station.Name == name {
+			return station, nil
+		}
+	}
+	return Station{}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) ListDistanceFares(ctx context.Context) ([]DistanceFare, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]DistanceFare{}, m.distanceFares...), nil
+}
+
+func (m *MemoryRepository) ListFares(ctx context.Context, trainClass, seatClass string) ([]Fare, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fares := []Fare{}
+	for _, fare := range m.fares {
+		if fare.TrainClass == trainClass && fare.SeatClass == seatClass {
+			fares = append(fares, fare)
+		}
+	}
+	return fares, nil
+}
+
+func (m *MemoryRepository) Train(ctx context.Context, date time.Time, trainClass, trainName string) (Train, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, train := range m.trains {
+		if sameDate(train.Date, date) && train.TrainClass == trainClass && train.TrainName == trainName {
+			return train, nil
+		}
+	}
+	return Train{}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) SearchTrains(ctx context.Context, date time.Time, trainClasses []string, isNobori bool) ([]Train, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	classes := map[string]bool{}
+	for _, c := range trainClasses {
+		classes[c] = true
+	}
+	trains := []Train{}
+	for _, train := range m.trains {
+		if sameDate(train.Date, date) && classes[train.TrainClass] && train.IsNobori == isNobori {
+			trains = append(trains, train)
+		}
+	}
+	return trains, nil
+}
+
+func (m *MemoryRepository) TrainStop(ctx context.Context, date time.Time, trainClass, trainName, station string) (TrainTimetable, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, stop := range m.timetables {
+		if sameDate(stop.Date, date) && stop.TrainClass == trainClass && stop.TrainName == trainName && stop.Station == station {
+			return stop, nil
+		}
+	}
+	return TrainTimetable{}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) ListSeats(ctx context.Context, filter SeatFilter) ([]Seat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seats := []Seat{}
+	for _, seat := range m.seats {
+		if seat.TrainClass != filter.TrainClass ||
+			(filter.CarNumber != 0 && seat.CarNumber != filter.CarNumber) ||
+			(filter.SeatClass != "" && seat.SeatClass != filter.SeatClass) ||
+			(filter.IsSmokingSeat != nil && seat.IsSmokingSeat != *filter.IsSmokingSeat) {
+			continue
+		}
+		seats = append(seats, seat)
+	}
+	return seats, nil
+}
+
+func (m *MemoryRepository) Seat(ctx context.Context, trainClass string, carNumber, row int, column string) (Seat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.seat(trainClass, carNumber, row, column)
+}
+
+func (m *MemoryRepository) seat(trainClass string, carNumber, row int, column string) (Seat, error) {
+	for _, seat := range m.seats {
+		if seat.TrainClass == trainClass && seat.CarNumber == carNumber && seat.SeatRow == row && seat.SeatColumn == column {
+			return seat, nil
+		}
+	}
+	return Seat{}, sql.ErrNoRows
+}
+
+// copyReservation は呼び出し側が書き換えても保持している予約が変わらないようにする
+func copyReservation(reservation Reservation) Reservation {
+	if reservation.UserId != nil {
+		userID := *reservation.UserId
+		reservation.UserId = &userID
+	}
+	if reservation.Date != nil {
+		date := *reservation.Date
+		reservation.Date = &date
+	}
+	if reservation.PromotionID != nil {
+		promotionID := *reservation.PromotionID
+		reservation.PromotionID = &promotionID
+	}
+	if reservation.PaidAt != nil {
+		paidAt := *reservation.PaidAt
+		reservation.PaidAt = &paidAt
+	}
+	return reservation
+}
+
+func (m *MemoryRepository) reservationIndex(id int64) int {
+	for i, reservation := range m.reservations {
+		if int64(reservation.ReservationId) == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// putReservation は予約IDの順を保って予約を入れる
+func (m *MemoryRepository) putReservation(reservation Reservation) {
+	i := sort.Search(len(m.reservations), func(i int) bool {
+		return m.reservations[i].ReservationId >= reservation.ReservationId
+	})
+	m.reservations = append(m.reservations, Reservation{})
+	copy(m.reservations[i+1:], m.reservations[i:])
+	m.reservations[i] = reservation
+}
+
+func (m *MemoryRepository) Reservation(ctx context.Context, id int64) (Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := m.reservationIndex(id); i >= 0 {
+		return copyReservation(m.reservations[i]), nil
+	}
+	return Reservation{}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) UserReservation(ctx context.Context, id, userID int64) (Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := m.reservationIndex(id); i >= 0 {
+		reservation := m.reservations[i]
+		if reservation.UserId != nil && int64(*reservation.UserId) == userID {
+			return copyReservation(reservation), nil
+		}
+	}
+	return Reservation{}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) ListUserReservations(ctx context.Context, userID int64) ([]Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reservations := []Reservation{}
+	for _, reservation := range m.reservations {
+		if reservation.UserId != nil && int64(*reservation.UserId) == userID {
+			reservations = append(reservations, copyReservation(reservation))
+		}
+	}
+	return reservations, nil
+}
+
+func (m *MemoryRepository) ListTrainReservations(ctx context.Context, date time.Time, trainClass, trainName string) ([]Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reservations := []Reservation{}
+	for _, reservation := range m.reservations {
+		if m.isTrainReservation(reservation, date, trainClass, trainName) {
+			reservations = append(reservations, copyReservation(reservation))
+		}
+	}
+	return reservations, nil
+}
+
+func (m *MemoryRepository) isTrainReservation(reservation Reservation, date time.Time, trainClass, trainName string) bool {
+	return reservation.Date != nil && sameDate(*reservation.Date, date) &&
+		reservation.TrainClass == trainClass && reservation.TrainName == trainName
+}
+
+func (m *MemoryRepository) CreateReservation(ctx context.Context, reservation *Reservation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastReservationID++
+	reservation.ReservationId = m.lastReservationID
+	stored := copyReservation(*reservation)
+	if stored.Date != nil {
+		d := *stored.Date
+		date := time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, d.Location())
+		stored.Date = &date
+	}
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = clock.Now()
+	}
+	m.putReservation(stored)
+
+	id := int64(stored.ReservationId)
+	m.onRollback(ctx, func() {
+		if i := m.reservationIndex(id); i >= 0 {
+			m.reservations = append(m.reservations[:i], m.reservations[i+1:]...)
+		}
+	})
+	return nil
+}
+
+func (m *MemoryRepository) MarkReservationPaid(ctx context.Context, id int64, paymentID string, paidAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.reservationIndex(id)
+	if i < 0 {
+		return nil
+	}
+	prev := m.reservations[i]
+	reservation := copyReservation(prev)
+	reservation.Status = "done"
+	reservation.PaymentId = paymentID
+	reservation.PaidAt = &paidAt
+	m.reservations[i] = reservation
+
+	m.onRollback(ctx, func() {
+		if i := m.reservationIndex(id); i >= 0 {
+			m.reservations[i] = prev
+		}
+	})
+	return nil
+}
+
+func (m *MemoryRepository) DeleteReservation(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.reservationIndex(id)
+	if i < 0 {
+		return nil
+	}
+	prev := m.reservations[i]
+	m.reservations = append(m.reservations[:i], m.reservations[i+1:]...)
+
+	m.onRollback(ctx, func() { m.putReservation(prev) })
+	return nil
+}
+
+func (m *MemoryRepository) DeleteAllReservations(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reservations, seats, lastID := m.reservations, m.seatReservations, m.lastReservationID
+	m.reservations, m.seatReservations, m.lastReservationID = nil, nil, 0
+
+	m.onRollback(ctx, func() { m.reservations, m.seatReservations, m.lastReservationID = reservations, seats, lastID })
+	return nil
+}
+
+func (m *MemoryRepository) ListSeatReservations(ctx context.Context, reservationID int64) ([]SeatReservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seats := []SeatReservation{}
+	for _, seat := range m.seatReservations {
+		if int64(seat.ReservationId) == reservationID {
+			seats = append(seats, seat)
+		}
+	}
+	return seats, nil
+}
+
+func (m *MemoryRepository) ListSeatReservationsAt(ctx context.Context, date time.Time, trainClass, trainName string, carNumber, row int, column string) ([]SeatReservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seats := []SeatReservation{}
+	found := false
+	for _, reservation := range m.reservations {
+		if m.isTrainReservation(reservation, date, trainClass, trainName) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return seats, nil
+	}
+	for _, seat := range m.seatReservations {
+		if seat.CarNumber == carNumber && seat.SeatRow == row && seat.SeatColumn == column {
+			seats = append(seats, seat)
+		}
+	}
+	return seats, nil
+}
+
+func (m *MemoryRepository) ListSeatReservationsInSection(ctx context.Context, isNobori bool, from, to Station) ([]SeatReservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seats := []SeatReservation{}
+	for _, seat := range m.seatReservations {
+		i := m.reservationIndex(int64(seat.ReservationId))
+		if i < 0 {
+			continue
+		}
+		reservation := m.reservations[i]
+		if _, err := m.seat(reservation.TrainClass, seat.CarNumber, seat.SeatRow, seat.SeatColumn); err != nil {
+			continue
+		}
+		dep, err := m.stationByName(reservation.Departure)
+		if err != nil {
+			continue
+		}
+		arr, err := m.stationByName(reservation.Arrival)
+		if err != nil {
+			continue
+		}
+
+		var overlaps bool
+		if isNobori {
+			overlaps = (arr.ID < from.ID && from.ID <= dep.ID) ||
+				(arr.ID < to.ID && to.ID <= dep.ID) ||
+				(from.ID < arr.ID && dep.ID < to.ID)
+		} else {
+			overlaps = (dep.ID <= from.ID && from.ID < arr.ID) ||
+				(dep.ID <= to.ID && to.ID < arr.ID) ||
+				(arr.ID < from.ID && to.ID < dep.ID)
+		}
+		if overlaps {
+			seats = append(seats, seat)
+		}
+	}
+	return seats, nil
+}
+
+func (m *MemoryRepository) CreateSeatReservation(ctx context.Context, seat SeatReservation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seatReservations = append(m.seatReservations, seat)
+	m.onRollback(ctx, func() {
+		for i := len(m.seatReservations) - 1; i >= 0; i-- {
+			if m.seatReservations[i] == seat {
+				m.seatReservations = append(m.seatReservations[:i], m.seatReservations[i+1:]...)
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (m *MemoryRepository) DeleteSeatReservations(ctx context.Context, reservationID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept, deleted := []SeatReservation{}, []SeatReservation{}
+	for _, seat := range m.seatReservations {
+		if int64(seat.ReservationId) == reservationID {
+			deleted = append(deleted, seat)
+		} else {
+			kept = append(kept, seat)
+		}
+	}
+	m.seatReservations = kept
+
+	m.onRollback(ctx, func() { m.seatReservations = append(m.seatReservations, deleted...) })
+	return nil
+}
+
+func (m *MemoryRepository) userIndex(id int64) int {
+	for i, user := range m.users {
+		if user.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *MemoryRepository) User(ctx context.Context, id int64) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := m.userIndex(id); i >= 0 {
+		return m.users[i], nil
+	}
+	return User{}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) UserByEmail(ctx context.Context, email string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, user := range m.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return User{}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) CreateUser(ctx context.Context, user *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.Email == user.Email {
+			return errEmailTaken
+		}
+	}
+	m.lastUserID++
+	user.ID = m.lastUserID
+	user.Salt = []byte{}
+	stored := *user
+	stored.Password = ""
+	m.users = append(m.users, stored)
+
+	id := user.ID
+	m.onRollback(ctx, func() {
+		if i := m.userIndex(id); i >= 0 {
+			m.users = append(m.users[:i], m.users[i+1:]...)
+		}
+	})
+	return nil
+}
+
+func (m *MemoryRepository) UpdatePasswordHash(ctx context.Context, id int64, oldHash, newHash []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.userIndex(id)
+	if i < 0 || string(m.users[i].HashedPassword) != string(oldHash) {
+		return nil
+	}
+	prev := m.users[i]
+	m.users[i].Salt = []byte{}
+	m.users[i].HashedPassword = append([]byte{}, newHash...)
+
+	m.onRollback(ctx, func() {
+		if i := m.userIndex(id); i >= 0 {
+			m.users[i] = prev
+		}
+	})
+	return nil
+}
+
+func (m *MemoryRepository) DeleteAllUsers(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	users, lastID := m.users, m.lastUserID
+	m.users, m.lastUserID = nil, 0
+	m.onRollback(ctx, func() { m.users, m.lastUserID = users, lastID })
+	return nil
+}
+
+func (m *MemoryRepository) apiTokenIndex(id int64) int {
+	for i, token := range m.apiTokens {
+		if token.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *MemoryRepository) APITokenByHash(ctx context.Context, tokenHash string) (APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, token := range m.apiTokens {
+		if token.TokenHash == tokenHash {
+			return token, nil
+		}
+	}
+	return APIToken{}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) UserAPIToken(ctx context.Context, id, userID int64) (APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := m.apiTokenIndex(id); i >= 0 && m.apiTokens[i].UserID == userID {
+		return m.apiTokens[i], nil
+	}
+	return APIToken{}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) ListUserAPITokens(ctx context.Context, userID int64) ([]APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tokens := []APIToken{}
+	for _, token := range m.apiTokens {
+		if token.UserID == userID {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+func (m *MemoryRepository) CreateAPIToken(ctx context.Context, token *APIToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastAPITokenID++
+	token.ID = m.lastAPITokenID
+	m.apiTokens = append(m.apiTokens, *token)
+
+	id := token.ID
+	m.onRollback(ctx, func() {
+		if i := m.apiTokenIndex(id); i >= 0 {
+			m.apiTokens = append(m.apiTokens[:i], m.apiTokens[i+1:]...)
+		}
+	})
+	return nil
+}
+
+func (m *MemoryRepository) RevokeAPIToken(ctx context.Context, id int64, revokedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.apiTokenIndex(id)
+	if i < 0 || m.apiTokens[i].RevokedAt != nil {
+		return nil
+	}
+	m.apiTokens[i].RevokedAt = &revokedAt
+
+	m.onRollback(ctx, func() {
+		if i := m.apiTokenIndex(id); i >= 0 {
+			m.apiTokens[i].RevokedAt = nil
+		}
+	})
+	return nil
+}
+
+func (m *MemoryRepository) RecordAPITokenUsage(ctx context.Context, usage APITokenUsage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastAPITokenUsageID++
+	usage.ID = m.lastAPITokenUsageID
+	m.apiTokenUsages = append(m.apiTokenUsages, usage)
+	var prev *time.Time
+	if i := m.apiTokenIndex(usage.TokenID); i >= 0 {
+		prev = m.apiTokens[i].LastUsedAt
+		usedAt := usage.UsedAt
+		m.apiTokens[i].LastUsedAt = &usedAt
+	}
+
+	m.onRollback(ctx, func() {
+		m.apiTokenUsages = m.apiTokenUsages[:len(m.apiTokenUsages)-1]
+		if i := m.apiTokenIndex(usage.TokenID); i >= 0 {
+			m.apiTokens[i].LastUsedAt = prev
+		}
+	})
+	return nil
+}
+
+func (m *MemoryRepository) ListAPITokenUsages(ctx context.Context, tokenID int64, limit int) ([]APITokenUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usages := []APITokenUsage{}
+	for i := len(m.apiTokenUsages) - 1; i >= 0 && len(usages) < limit; i-- {
+		if m.apiTokenUsages[i].TokenID == tokenID {
+			usages = append(usages, m.apiTokenUsages[i])
+		}
+	}
+	return usages, nil
+}
+
+func (m *MemoryRepository) DeleteAllAPITokens(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tokens, usages, lastID, lastUsageID := m.apiTokens, m.apiTokenUsages, m.lastAPITokenID, m.lastAPITokenUsageID
+	m.apiTokens, m.apiTokenUsages, m.lastAPITokenID, m.lastAPITokenUsageID = nil, nil, 0, 0
+	m.onRollback(ctx, func() {
+		m.apiTokens, m.apiTokenUsages, m.lastAPITokenID, m.lastAPITokenUsageID = tokens, usages, lastID, lastUsageID
+	})
+	return nil
+}
+
+func (m *MemoryRepository) CalendarTokenUser(ctx context.Context, tokenHash string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, token := range m.calendarTokens {
+		if token.tokenHash != tokenHash {
+			continue
+		}
+		if i := m.userIndex(token.userID); i >= 0 {
+			return m.users[i], nil
+		}
+	}
+	return User{}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) PutCalendarToken(ctx context.Context, userID int64, tokenHash string, createdAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := m.calendarTokens
+	m.calendarTokens = []memoryCalendarToken{}
+	for _, token := range prev {
+		if token.userID != userID {
+			m.calendarTokens = append(m.calendarTokens, token)
+		}
+	}
+	m.calendarTokens = append(m.calendarTokens, memoryCalendarToken{userID, tokenHash, createdAt})
+
+	m.onRollback(ctx, func() { m.calendarTokens = prev })
+	return nil
+}
+
+func (m *MemoryRepository) DeleteCalendarToken(ctx context.Context, userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := m.calendarTokens
+	m.calendarTokens = []memoryCalendarToken{}
+	for _, token := range prev {
+		if token.userID != userID {
+			m.calendarTokens = append(m.calendarTokens, token)
+		}
+	}
+
+	m.onRollback(ctx, func() { m.calendarTokens = prev })
+	return nil
+}
+
+func (m *MemoryRepository) DeleteAllCalendarTokens(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := m.calendarTokens
+	m.calendarTokens = nil
+	m.onRollback(ctx, func() { m.calendarTokens = prev })
+	return nil
+}
+
+func (m *MemoryRepository) ticketUsageIndex(reservationID int64) int {
+	for i, usage := range m.ticketUsages {
+		if int64(usage.ReservationID) == reservationID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *MemoryRepository) TicketUsage(ctx context.Context, reservationID int64) (TicketUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := m.ticketUsageIndex(reservationID); i >= 0 {
+		return m.ticketUsages[i], nil
+	}
+	return TicketUsage{}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) RecordTicketEntry(ctx context.Context, reservationID int64, station string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ticketUsages = append(m.ticketUsages, TicketUsage{
+		ReservationID: int(reservationID),
+		EntryStation:  station,
+		EnteredAt:     at,
+	})
+
+	m.onRollback(ctx, func() {
+		if i := m.ticketUsageIndex(reservationID); i >= 0 {
+			m.ticketUsages = append(m.ticketUsages[:i], m.ticketUsages[i+1:]...)
+		}
+	})
+	return nil
+}
+
+func (m *MemoryRepository) RecordTicketExit(ctx context.Context, reservationID int64, station string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.ticketUsageIndex(reservationID)
+	if i < 0 {
+		return nil
+	}
+	prev := m.ticketUsages[i]
+	m.ticketUsages[i].ExitStation = &station
+	m.ticketUsages[i].ExitedAt = &at
+
+	m.onRollback(ctx, func() {
+		if i := m.ticketUsageIndex(reservationID); i >= 0 {
+			m.ticketUsages[i] = prev
+		}
+	})
+	return nil
+}
+
+func (m *MemoryRepository) DeleteAllTicketUsages(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := m.ticketUsages
+	m.ticketUsages = nil
+	m.onRollback(ctx, func() { m.ticketUsages = prev })
+	return nil
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// MySQLRepository は各マスタと予約・ユーザを MySQL に読み書きする
+type MySQLRepository struct {
+	db *sqlx.DB
+}
+
+func NewMySQLRepository(db *sqlx.DB) *MySQLRepository {
+	return &MySQLRepository{db: db}
+}
+
+// ext はトランザクションの中ならそのトランザクションを返す
+func (m *MySQLRepository) ext(ctx context.Context) sqlx.ExtContext {
+	if tx, ok := sqlTx(ctx); ok {
+		return tx
+	}
+	return m.db
+}
+
+// forUpdate はトランザクションの中なら読んだ行をロックする
+func forUpdate(ctx context.Context) string {
+	if _, ok := sqlTx(ctx); ok {
+		return " FOR UPDATE"
+	}
+	return ""
+}
+
+func (m *MySQLRepository) BeginTx(ctx context.Context) (context.Context, Tx, error) {
+	tx, err := m.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return context.WithValue(ctx, sqlTxContextKey{}, tx), tx, nil
+}
+
+func (m *MySQLRepository) ListStations(ctx context.Context) ([]Station, error) {
+	stations := []Station{}
+	err := sqlx.SelectContext(ctx, m.ext(ctx), &stations, "SELECT * FROM station_master ORDER BY id")
+	return stations, err
+}
+
+func (m *MySQLRepository) ListStationAliases(ctx context.Context) ([]StationAlias, error) {
+	aliases := []StationAlias{}
+	err := sqlx.SelectContext(ctx, m.ext(ctx), &aliases, "SELECT `station_id`, `kind`, `alias` FROM `station_aliases` ORDER BY `station_id`, `kind`")
+	return aliases, err
+}
+
+func (m *MySQLRepository) StationByID(ctx context.Context, id int) (Station, error) {
+	station := Station{}
+	err := sqlx.GetContext(ctx, m.ext(ctx), &station, "SELECT * FROM station_master WHERE id=?", id)
+	return station, err
+}
+
+func (m *MySQLRepository) StationByName(ctx context.Context, name string) (Station, error) {
+	station := Station{}
+	err := sqlx.GetContext(ctx, m.ext(ctx), &station, "SELECT * FROM station_master WHERE name=?", name)
+	return station, err
+}
+
+func (m *MySQLRepository) ListDistanceFares(ctx context.Context) ([]DistanceFare, error) {
+	distanceFares := []DistanceFare{}
+	err := sqlx.SelectContext(ctx, m.ext(ctx), &distanceFares, "SELECT distance,fare FROM distance_fare_master ORDER BY distance")
+	return distanceFares, err
+}
+
+func (m *MySQLRepository) ListFares(ctx context.Context, trainClass, seatClass string) ([]Fare, error) {
+	fares := []Fare{}
+	err := sqlx.SelectContext(
+		ctx, m.ext(ctx), &fares,
+		"SELECT * FROM fare_master WHERE train_class=? AND seat_class=? ORDER BY start_date",
+		trainClass, seatClass,
+	)
+	return fares, err
+}
+
+func (m *MySQLRepository) Train(ctx context.Context, date time.Time, trainClass, trainName string) (Train, error) {
+	train := Train{}
+	err := sqlx.GetContext(
+		ctx, m.ext(ctx), &train,
+		"SELECT * FROM train_master WHERE date=? AND train_class=? AND train_name=?",
+		date.Format("2006/01/02"), trainClass, trainName,
+	)
+	return train, err
+}
+
+func (m *MySQLRepository) SearchTrains(ctx context.Context, date time.Time, trainClasses []string, isNobori bool) ([]Train, error) {
+	trains := []Train{}
+	if len(trainClasses) == 0 {
+		return trains, nil
+	}
+	query, args, err := sqlx.In(
+		"SELECT * FROM train_master WHERE date=? AND train_class IN (?) AND is_nobori=?",
+		date.Format("2006/01/02"), trainClasses, isNobori,
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = sqlx.SelectContext(ctx, m.ext(ctx), &trains, query, args...)
+	return trains, err
+}
+
+func (m *MySQLRepository) TrainStop(ctx context.Context, date time.Time, trainClass, trainName, station string) (TrainTimetable, error) {
+	stop := TrainTimetable{}
+	err := sqlx.GetContext(
+		ctx, m.ext(ctx), &stop,
+		"SELECT * FROM train_timetable_master WHERE date=? AND train_class=? AND train_name=? AND station=?",
+		date.Format("2006/01/02"), trainClass, trainName, station,
+	)
+	return stop, err
+}
+
+func (m *MySQLRepository) ListSeats(ctx context.Context, filter SeatFilter) ([]Seat, error) {
+	query := "SELECT * FROM seat_master WHERE train_class=?"
+	args := []interface{}{filter.TrainClass}
+	if filter.CarNumber != 0 {
+		query += " AND car_number=?"
+		args = append(args, filter.CarNumber)
+	}
+	if filter.SeatClass != "" {
+		query += " AND seat_class=?"
+		args = append(args, filter.SeatClass)
+	}
+	if filter.IsSmokingSeat != nil {
+		query += " AND is_smoking_seat=?"
+		args = append(args, *filter.IsSmokingSeat)
+	}
+	query += " ORDER BY car_number, seat_row, seat_column"
+
+	seats := []Seat{}
+	err := sqlx.SelectContext(ctx, m.ext(ctx), &seats, query, args...)
+	return seats, err
+}
+
+func (m *MySQLRepository) Seat(ctx context.Context, trainClass string, carNumber, row int, column string) (Seat, error) {
+	seat := Seat{}
+	err := sqlx.GetContext(
+		ctx, m.ext(ctx), &seat,
+		"SELECT * FROM seat_master WHERE train_class=? AND car_number=? AND seat_column=? AND seat_row=?",
+		trainClass, carNumber, column, row,
+	)
+	return seat, err
+}
+
+func (m *MySQLRepository) Reservation(ctx context.Context, id int64) (Reservation, error) {
+	reservation := Reservation{}
+	err := sqlx.GetContext(ctx, m.ext(ctx), &reservation, "SELECT * FROM reservations WHERE reservation_id=?"+forUpdate(ctx), id)
+	return reservation, err
+}
+
+func (m *MySQLRepository) UserReservation(ctx context.Context, id, userID int64) (Reservation, error) {
+	reservation := Reservation{}
+	err := sqlx.GetContext(
+		ctx, m.ext(ctx), &reservation,
+		"SELECT * FROM reservations WHERE reservation_id=? AND user_id=?"+forUpdate(ctx),
+		id, userID,
+	)
+	return reservation, err
+}
+
+func (m *MySQLRepository) ListUserReservations(ctx context.Context, userID int64) ([]Reservation, error) {
+	reservations := []Reservation{}
+	err := sqlx.SelectContext(ctx, m.ext(ctx), &reservations, "SELECT * FROM reservations WHERE user_id=? ORDER BY reservation_id", userID)
+	return reservations, err
+}
+
+func (m *MySQLRepository) ListTrainReservations(ctx context.Context, date time.Time, trainClass, trainName string) ([]Reservation, error) {
+	reservations := []Reservation{}
+	err := sqlx.SelectContext(
+		ctx, m.ext(ctx), &reservations,
+		"SELECT * FROM reservations WHERE date=? AND train_class=? AND train_name=? ORDER BY reservation_id"+forUpdate(ctx),
+		date.Format("2006/01/02"), trainClass, trainName,
+	)
+	return reservations, err
+}
+
+func (m *MySQLRepository) CreateReservation(ctx context.Context, reservation *Reservation) error {
+	result, err := m.ext(ctx).ExecContext(
+		ctx,
+		"INSERT INTO `reservations` (`user_id`, `date`, `train_class`, `train_name`, `departure`, `arrival`, `status`, `payment_id`, `adult`, `child`, `passengers`, `amount`, `promotion_id`, `discount`, `points_used`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		reservation.UserId,
+		reservation.Date.Format("2006/01/02"),
+		reservation.TrainClass,
+		reservation.TrainName,
+		reservation.Departure,
+		reservation.Arrival,
+		reservation.Status,
+		reservation.PaymentId,
+		reservation.Adult,
+		reservation.Child,
+		reservation.Passengers,
+		reservation.Amount,
+		reservation.PromotionID,
+		reservation.Discount,
+		reservation.PointsUsed,
+	)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	reservation.ReservationId = int(id)
+	return nil
+}
+
+func (m *MySQLRepository) MarkReservationPaid(ctx context.Context, id int64, paymentID string, paidAt time.Time) error {
+	_, err := m.ext(ctx).ExecContext(
+		ctx,
+		"UPDATE reservations SET status=?, payment_id=?, paid_at=? WHERE reservation_id=?",
+		"done", paymentID, paidAt, id,
+	)
+	return err
+}
+
+func (m *MySQLRepository) DeleteReservation(ctx context.Context, id int64) error {
+	_, err := m.ext(ctx).ExecContext(ctx, "DELETE FROM reservations WHERE reservation_id=?", id)
+	return err
+}
+
+func (m *MySQLRepository) DeleteAllReservations(ctx context.Context) error {
+	if _, err := m.ext(ctx).ExecContext(ctx, "TRUNCATE seat_reservations"); err != nil {
+		return err
+	}
+	_, err := m.ext(ctx).ExecContext(ctx, "TRUNCATE reservations")
+	return err
+}
+
+func (m *MySQLRepository) ListSeatReservations(ctx context.Context, reservationID int64) ([]SeatReservation, error) {
+	seats := []SeatReservation{}
+	err := sqlx.SelectContext(ctx, m.ext(ctx), &seats, "SELECT * FROM seat_reservations WHERE reservation_id=?"+forUpdate(ctx), reservationID)
+	return seats, err
+}
+
+func (m *MySQLRepository) ListSeatReservationsAt(ctx context.Context, date time.Time, trainClass, trainName string, carNumber, row int, column string) ([]SeatReservation, error) {
+	query := `
+SELECT s.*
+FROM seat_reservations s, reservations r
+WHERE
+	r.date=? AND r.train_class=? AND r.train_name=? AND car_number=? AND seat_row=? AND seat_column=?
+`
+	seats := []SeatReservation{}
+	err := sqlx.SelectContext(
+		ctx, m.ext(ctx), &seats, query,
+		date.Format("2006/01/02"), trainClass, trainName, carNumber, row, column,
+	)
+	return seats, err
+}
+
+func (m *MySQLRepository) ListSeatReservationsInSection(ctx context.Context, isNobori bool, from, to Station) ([]SeatReservation, error) {
+	query := `
+	SELECT sr.reservation_id, sr.car_number, sr.seat_row, sr.seat_column
+	FROM seat_reservations sr, reservations r, seat_master s, station_master std, station_master sta
+	WHERE
+		r.reservation_id=sr.reservation_id AND
+		s.train_class=r.train_class AND
+		s.car_number=sr.car_number AND
+		s.seat_column=sr.seat_column AND
+		s.seat_row=sr.seat_row AND
+		std.name=r.departure AND
+		sta.name=r.arrival
+	`
+	if isNobori {
+		query += "AND ((sta.id < ? AND ? <= std.id) OR (sta.id < ? AND ? <= std.id) OR (? < sta.id AND std.id < ?))"
+	} else {
+		query += "AND ((std.id <= ? AND ? < sta.id) OR (std.id <= ? AND ? < sta.id) OR (sta.id < ? AND ? < std.id))"
+	}
+
+	seats := []SeatReservation{}
+	err := sqlx.SelectContext(ctx, m.ext(ctx), &seats, query, from.ID, from.ID, to.ID, to.ID, from.ID, to.ID)
+	return seats, err
+}
+
+func (m *MySQLRepository) CreateSeatReservation(ctx context.Context, seat SeatReservation) error {
+	_, err := m.ext(ctx).ExecContext(
+		ctx,
+		"INSERT INTO `seat_reservations` (`reservation_id`, `car_number`, `seat_row`, `seat_column`) VALUES (?, ?, ?, ?)",
+		seat.ReservationId, seat.CarNumber, seat.SeatRow, seat.SeatColumn,
+	)
+	return err
+}
+
+func (m *MySQLRepository) DeleteSeatReservations(ctx context.Context, reservationID int64) error {
+	_, err := m.ext(ctx).ExecContext(ctx, "DELETE FROM seat_reservations WHERE reservation_id=?", reservationID)
+	return err
+}
+
+func (m *MySQLRepository) User(ctx context.Context, id int64) (User, error) {
+	user := User{}
+	err := sqlx.GetContext(ctx, m.ext(ctx), &user, "SELECT * FROM `users` WHERE `id` = ?", id)
+	return user, err
+}
+
+func (m *MySQLRepository) UserByEmail(ctx context.Context, email string) (User, error) {
+	user := User{}
+	err := sqlx.GetContext(ctx, m.ext(ctx), &user, "SELECT * FROM `users` WHERE `email` = ?", email)
+	return user, err
+}
+
+func (m *MySQLRepository) CreateUser(ctx context.Context, user *User) error {
+	// saltは旧形式のpbkdf2でのみ使う。新形式はハッシュ文字列に含まれる
+	result, err := m.ext(ctx).ExecContext(
+		ctx,
+		"INSERT INTO `users` (`email`, `salt`, `super_secure_password`) VALUES (?, ?, ?)",
+		user.Email, []byte{}, user.HashedPassword,
+	)
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == mysqlErrDuplicateEntry {
+		return errEmailTaken
+	}
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	user.ID = id
+	user.Salt = []byte{}
+	return nil
+}
+
+func (m *MySQLRepository) UpdatePasswordHash(ctx context.Context, id int64, oldHash, newHash []byte) error {
+	_, err := m.ext(ctx).ExecContext(
+		ctx,
+		"UPDATE `users` SET `salt` = ?, `super_secure_password` = ? WHERE `id` = ? AND `super_secure_password` = ?",
+		[]byte{}, newHash, id, oldHash,
+	)
+	return err
+}
+
+func (m *MySQLRepository) DeleteAllUsers(ctx context.Context) error {
+	_, err := m.ext(ctx).ExecContext(ctx, "TRUNCATE users")
+	return err
+}
+
+func (m *MySQLRepository) APITokenByHash(ctx context.Context, tokenHash string) (APIToken, error) {
+	token := APIToken{}
+	err := sqlx.GetContext(ctx, m.ext(ctx), &token, "SELECT * FROM `api_tokens` WHERE `token_hash` = ?", tokenHash)
+	return token, err
+}
+
+func (m *MySQLRepository) UserAPIToken(ctx context.Context, id, userID int64) (APIToken, error) {
+	token := APIToken{}
+	err := sqlx.GetContext(ctx, m.ext(ctx), &token, "SELECT * FROM `api_tokens` WHERE `id` = ? AND `user_id` = ?", id, userID)
+	return token, err
+}
+
+func (m *MySQLRepository) ListUserAPITokens(ctx context.Context, userID int64) ([]APIToken, error) {
+	tokens := []APIToken{}
+	err := sqlx.SelectContext(ctx, m.ext(ctx), &tokens, "SELECT * FROM `api_tokens` WHERE `user_id` = ? ORDER BY `id`", userID)
+	return tokens, err
+}
+
+func (m *MySQLRepository) CreateAPIToken(ctx context.Context, token *APIToken) error {
+	result, err := m.ext(ctx).ExecContext(
+		ctx,
+		"INSERT INTO `api_tokens` (`user_id`, `name`, `token_hash`, `prefix`, `scopes`, `created_at`, `expires_at`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		token.UserID, token.Name, token.TokenHash, token.Prefix, token.Scopes, token.CreatedAt, token.ExpiresAt,
+	)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	token.ID = id
+	return nil
+}
+
+func (m *MySQLRepository) RevokeAPIToken(ctx context.Context, id int64, revokedAt time.Time) error {
+	_, err := m.ext(ctx).ExecContext(ctx, "UPDATE `api_tokens` SET `revoked_at` = ? WHERE `id` = ? AND `revoked_at` IS NULL", revokedAt, id)
+	return err
+}
+
+func (m *MySQLRepository) RecordAPITokenUsage(ctx context.Context, usage APITokenUsage) error {
+	_, err := m.ext(ctx).ExecContext(
+		ctx,
+		"INSERT INTO `api_token_usages` (`token_id`, `used_at`, `method`, `path`, `remote_ip`) VALUES (?, ?, ?, ?, ?)",
+		usage.TokenID, usage.UsedAt, usage.Method, usage.Path, usage.RemoteIP,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = m.ext(ctx).ExecContext(ctx, "UPDATE `api_tokens` SET `last_used_at` = ? WHERE `id` = ?", usage.UsedAt, usage.TokenID)
+	return err
+}
+
+func (m *MySQLRepository) ListAPITokenUsages(ctx context.Context, tokenID int64, limit int) ([]APITokenUsage, error) {
+	usages := []APITokenUsage{}
+	err := sqlx.SelectContext(ctx, m.ext(ctx), &usages, "SELECT * FROM `api_token_usages` WHERE `token_id` = ? ORDER BY `id` DESC LIMIT ?", tokenID, limit)
+	return usages, err
+}
+
+func (m *MySQLRepository) DeleteAllAPITokens(ctx context.Context) error {
+	if _, err := m.ext(ctx).ExecContext(ctx, "TRUNCATE api_token_usages"); err != nil {
+		return err
+	}
+	_, err := m.ext(ctx).ExecContext(ctx, "TRUNCATE api_tokens")
+	return err
+}
+
+func (m *MySQLRepository) CalendarTokenUser(ctx context.Context, tokenHash string) (User, error) {
+	user := User{}
+	err := sqlx.GetContext(
+		ctx, m.ext(ctx), &user,
+		"SELECT u.* FROM `users` u JOIN `calendar_tokens` c ON c.`user_id` = u.`id` WHERE c.`token_hash` = ?",
+		tokenHash,
+	)
+	return user, err
+}
+
+func (m *MySQLRepository) PutCalendarToken(ctx context.Context, userID int64, tokenHash string, createdAt time.Time) error {
+	_, err := m.ext(ctx).ExecContext(
+		ctx,
+		"INSERT INTO `calendar_tokens` (`user_id`, `token_hash`, `created_at`) VALUES (?, ?, ?) "+
+			"ON DUPLICATE KEY UPDATE `token_hash` = VALUES(`token_hash`), `created_at` = VALUES(`created_at`)",
+		userID, tokenHash, createdAt,
+	)
+	return err
+}
+
+func (m *MySQLRepository) DeleteCalendarToken(ctx context.Context, userID int64) error {
+	_, err := m.ext(ctx).ExecContext(ctx, "DELETE FROM `calendar_tokens` WHERE `user_id` = ?", userID)
+	return err
+}
+
+func (m *MySQLRepository) DeleteAllCalendarTokens(ctx context.Context) error {
+	_, err := m.ext(ctx).ExecContext(ctx, "TRUNCATE calendar_tokens")
+	return err
+}
+
+func (m *MySQLRepository) TicketUsage(ctx context.Context, reservationID int64) (TicketUsage, error) {
+	usage := TicketUsage{}
+	err := sqlx.GetContext(ctx, m.ext(ctx), &usage, "SELECT * FROM ticket_usages WHERE reservation_id=?", reservationID)
+	return usage, err
+}
+
+func (m *MySQLRepository) RecordTicketEntry(ctx context.Context, reservationID int64, station string, at time.Time) error {
+	_, err := m.ext(ctx).ExecContext(
+		ctx,
+		"INSERT INTO ticket_usages (reservation_id, entry_station, entered_at) VALUES (?, ?, ?)",
+		reservationID, station, at,
+	)
+	return err
+}
+
+func (m *MySQLRepository) RecordTicketExit(ctx context.Context, reservationID int64, station string, at time.Time) error {
+	_, err := m.ext(ctx).ExecContext(
+		ctx,
+		"UPDATE ticket_usages SET exit_station=?, exited_at=? WHERE reservation_id=?",
+		station, at, reservationID,
+	)
+	return err
+}
+
+func (m *MySQLRepository) DeleteAllTicketUsages(ctx context.Context) error {
+	_, err := m.ext(ctx).ExecContext(ctx, "TRUNCATE ticket_usages")
+	return err
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// testMasterData は東京・名古屋・大阪を結ぶ 2020-01-01 の下り最速1本のマスタ
+// (1号車はプレミアム、2号車は指定席で、それぞれ2列×A/B)
+func testMasterData() MasterData {
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, jst)
+	data := MasterData{
+		Stations: []Station{
+			{ID: 1, Name: "東京", Distance: 0, IsStopExpress: true, IsStopSemiExpress: true, IsStopLocal: true},
+			{ID: 2, Name: "名古屋", Distance: 366, IsStopExpress: true, IsStopSemiExpress: true, IsStopLocal: true},
+			{ID: 3, Name: "大阪", Distance: 552, IsStopExpress: true, IsStopSemiExpress: true, IsStopLocal: true},
+		},
+		StationAliases: []StationAlias{
+			{1, StationAliasRomaji, "toukyou"},
+			{3, StationAliasRomaji, "oosaka"},
+		},
+		DistanceFares: []DistanceFare{{0, 2500}, {50, 3000}, {1000, 10000}},
+		Trains: []Train{
+			{Date: date, DepartureAt: "06:00:00", TrainClass: "最速", TrainName: "1", StartStation: "東京", LastStation: "大阪"},
+		},
+		Timetables: []TrainTimetable{
+			{date, "最速", "1", "東京", "06:00:00", "06:00:00"},
+			{date, "最速", "1", "名古屋", "07:32:00", "07:30:00"},
+			{date, "最速", "1", "大阪", "08:30:00", "08:30:00"},
+		},
+	}
+	for seatClass, multiplier := range map[string]float64{"premium": 2, "reserved": 1.5, "non-reserved": 1} {
+		data.Fares = append(data.Fares, Fare{"最速", seatClass, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), multiplier})
+	}
+	for car, seatClass := range map[int]string{1: "premium", 2: "reserved"} {
+		for row := 1; row <= 2; row++ {
+			for _, column := range []string{"B", "A"} {
+				data.Seats = append(data.Seats, Seat{"最速", car, column, row, seatClass, false})
+			}
+		}
+	}
+	return data
+}
+
+func newTestRepository() *MemoryRepository {
+	m := NewMemoryRepository()
+	m.LoadMasterData(testMasterData())
+	return m
+}
+
+// createTestReservation は列車1の予約と座席予約を登録する
+func createTestReservation(t *testing.T, m *MemoryRepository, ctx context.Context, userID int, departure, arrival string, seats ...SeatReservation) Reservation {
+	t.Helper()
+	date := time.Date(2020, 1, 1, 5, 0, 0, 0, jst)
+	reservation := Reservation{
+		UserId: &userID, Date: &date, TrainClass: "最速", TrainName: "1",
+		Departure: departure, Arrival: arrival, Status: "requesting", PaymentId: "a", Adult: len(seats),
+	}
+	if err := m.CreateReservation(ctx, &reservation); err != nil {
+		t.Fatal(err)
+	}
+	for _, seat := range seats {
+		seat.ReservationId = reservation.ReservationId
+		if err := m.CreateSeatReservation(ctx, seat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return reservation
+}
+
+func TestMemoryRepositoryMasterData(t *testing.T) {
+	m := newTestRepository()
+	ctx := context.Background()
+	date := time.Date(2020, 1, 1, 5, 0, 0, 0, jst)
+
+	if _, err := m.StationByName(ctx, "京都"); err != sql.ErrNoRows {
+		t.Errorf("StationByName(京都) err = %v", err)
+	}
+	if station, err := m.StationByID(ctx, 2); err != nil || station.Name != "名古屋" {
+		t.Errorf("StationByID(2) = %v, %v", station, err)
+	}
+	if _, err := m.Train(ctx, date.AddDate(0, 0, 1), "最速", "1"); err != sql.ErrNoRows {
+		t.Errorf("Train(next day) err = %v", err)
+	}
+	if trains, _ := m.SearchTrains(ctx, date, []string{"最速", "中間"}, false); len(trains) != 1 {
+		t.Errorf("SearchTrains = %v", trains)
+	}
+	if trains, _ := m.SearchTrains(ctx, date, []string{"最速"}, true); len(trains) != 0 {
+		t.Errorf("SearchTrains(nobori) = %v", trains)
+	}
+	if stop, err := m.TrainStop(ctx, date, "最速", "1", "名古屋"); err != nil || stop.Departure != "07:32:00" {
+		t.Errorf("TrainStop = %v, %v", stop, err)
+	}
+
+	// 号車・列・席の順
+	seats, _ := m.ListSeats(ctx, SeatFilter{TrainClass: "最速", CarNumber: 2})
+	if len(seats) != 4 || seats[0].SeatRow != 1 || seats[0].SeatColumn != "A" || seats[3].SeatRow != 2 || seats[3].SeatColumn != "B" {
+		t.Errorf("ListSeats(car 2) = %v", seats)
+	}
+	smoking := false
+	if seats, _ := m.ListSeats(ctx, SeatFilter{TrainClass: "最速", SeatClass: "premium", IsSmokingSeat: &smoking}); len(seats) != 4 || seats[0].CarNumber != 1 {
+		t.Errorf("ListSeats(premium) = %v", seats)
+	}
+	if _, err := m.Seat(ctx, "最速", 3, 1, "A"); err != sql.ErrNoRows {
+		t.Errorf("Seat(car 3) err = %v", err)
+	}
+}
+
+func TestMemoryRepositoryReservations(t *testing.T) {
+	m := newTestRepository()
+	ctx := context.Background()
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, jst)
+
+	r1 := createTestReservation(t, m, ctx, 7, "東京", "名古屋", SeatReservation{CarNumber: 2, SeatRow: 1, SeatColumn: "A"})
+	r2 := createTestReservation(t, m, ctx, 8, "名古屋", "大阪", SeatReservation{CarNumber: 2, SeatRow: 1, SeatColumn: "A"})
+	if r1.ReservationId != 1 || r2.ReservationId != 2 {
+		t.Fatalf("reservation ids = %d, %d", r1.ReservationId, r2.ReservationId)
+	}
+
+	if _, err := m.UserReservation(ctx, int64(r1.ReservationId), 8); err != sql.ErrNoRows {
+		t.Errorf("UserReservation(other user) err = %v", err)
+	}
+	if list, _ := m.ListUserReservations(ctx, 7); len(list) != 1 || list[0].ReservationId != r1.ReservationId {
+		t.Errorf("ListUserReservations = %v", list)
+	}
+	if list, _ := m.ListTrainReservations(ctx, date, "最速", "1"); len(list) != 2 {
+		t.Errorf("ListTrainReservations = %v", list)
+	}
+
+	// 返した予約を書き換えても保持している予約は変わらない
+	got, _ := m.Reservation(ctx, int64(r1.ReservationId))
+	*got.UserId = 99
+	if got, _ := m.Reservation(ctx, int64(r1.ReservationId)); *got.UserId != 7 || got.CreatedAt.IsZero() {
+		t.Errorf("stored reservation = %v", got)
+	}
+
+	paidAt := time.Date(2019, 12, 20, 10, 0, 0, 0, jst)
+	if err := m.MarkReservationPaid(ctx, int64(r1.ReservationId), "p1", paidAt); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := m.Reservation(ctx, int64(r1.ReservationId)); got.Status != "done" || got.PaymentId != "p1" || !got.PaidAt.Equal(paidAt) {
+		t.Errorf("paid reservation = %v", got)
+	}
+
+	// 重なりの判定は MySQL の条件と同じ (境界の駅の扱いも含めて)
+	tokyo, _ := m.StationByName(ctx, "東京")
+	nagoya, _ := m.StationByName(ctx, "名古屋")
+	osaka, _ := m.StationByName(ctx, "大阪")
+	for _, c := range []struct {
+		from, to Station
+		want     []int
+	}{
+		{tokyo, nagoya, []int{r1.ReservationId, r2.ReservationId}},
+		{nagoya, osaka, []int{r2.ReservationId}},
+		{tokyo, osaka, []int{r1.ReservationId}},
+	} {
+		seats, _ := m.ListSeatReservationsInSection(ctx, false, c.from, c.to)
+		ids := []int{}
+		for _, s := range seats {
+			ids = append(ids, s.ReservationId)
+		}
+		if len(ids) != len(c.want) || (len(ids) > 0 && ids[0] != c.want[0]) {
+			t.Errorf("%s-%s: reservations = %v, want %v", c.from.Name, c.to.Name, ids, c.want)
+		}
+	}
+
+	if seats, _ := m.ListSeatReservationsAt(ctx, date, "最速", "1", 2, 1, "A"); len(seats) != 2 {
+		t.Errorf("ListSeatReservationsAt = %v", seats)
+	}
+	if seats, _ := m.ListSeatReservationsAt(ctx, date.AddDate(0, 0, 1), "最速", "1", 2, 1, "A"); len(seats) != 0 {
+		t.Errorf("ListSeatReservationsAt(next day) = %v", seats)
+	}
+
+	if err := m.DeleteSeatReservations(ctx, int64(r1.ReservationId)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeleteReservation(ctx, int64(r1.ReservationId)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Reservation(ctx, int64(r1.ReservationId)); err != sql.ErrNoRows {
+		t.Errorf("deleted reservation err = %v", err)
+	}
+	if seats, _ := m.ListSeatReservations(ctx, int64(r1.ReservationId)); len(seats) != 0 {
+		t.Errorf("deleted seats = %v", seats)
+	}
+
+	// 初期化すると予約IDは1から振り直す
+	m.DeleteAllReservations(ctx)
+	if r := createTestReservation(t, m, ctx, 7, "東京", "大阪"); r.ReservationId != 1 {
+		t.Errorf("reservation id after reset = %d", r.ReservationId)
+	}
+}
+
+func TestMemoryRepositoryRollback(t *testing.T) {
+	m := newTestRepository()
+	base := context.Background()
+	kept := createTestReservation(t, m, base, 7, "東京", "大阪", SeatReservation{CarNumber: 1, SeatRow: 1, SeatColumn: "A"})
+
+	ctx, tx, err := m.BeginTx(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestReservation(t, m, ctx, 7, "東京", "名古屋", SeatReservation{CarNumber: 2, SeatRow: 2, SeatColumn: "B"})
+	m.MarkReservationPaid(ctx, int64(kept.ReservationId), "p1", time.Now())
+	m.DeleteSeatReservations(ctx, int64(kept.ReservationId))
+	m.DeleteReservation(ctx, int64(kept.ReservationId))
+	user := User{Email: "new@example.com"}
+	m.CreateUser(ctx, &user)
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != sql.ErrTxDone {
+		t.Errorf("Commit after Rollback err = %v", err)
+	}
+
+	list, _ := m.ListUserReservations(base, 7)
+	if len(list) != 1 || list[0].ReservationId != kept.ReservationId || list[0].Status != "requesting" {
+		t.Errorf("reservations after rollback = %v", list)
+	}
+	if seats, _ := m.ListSeatReservations(base, int64(kept.ReservationId)); len(seats) != 1 {
+		t.Errorf("seats after rollback = %v", seats)
+	}
+	if _, err := m.UserByEmail(base, "new@example.com"); err != sql.ErrNoRows {
+		t.Errorf("user after rollback err = %v", err)
+	}
+
+	// コミットした書き込みは残り、次のトランザクションを始められる
+	ctx, tx, _ = m.BeginTx(base)
+	m.DeleteReservation(ctx, int64(kept.ReservationId))
+	tx.Commit()
+	if err := tx.Rollback(); err != sql.ErrTxDone {
+		t.Errorf("Rollback after Commit err = %v", err)
+	}
+	if _, err := m.Reservation(base, int64(kept.ReservationId)); err != sql.ErrNoRows {
+		t.Errorf("committed delete err = %v", err)
+	}
+	_, tx, _ = m.BeginTx(base)
+	tx.Rollback()
+}
+
+func TestMemoryRepositoryUsers(t *testing.T) {
+	m := newTestRepository()
+	ctx := context.Background()
+
+	user := User{Email: "isutrain@example.com", Password: "plain", HashedPassword: []byte("old")}
+	if err := m.CreateUser(ctx, &user); err != nil || user.ID != 1 {
+		t.Fatalf("CreateUser = %d, %v", user.ID, err)
+	}
+	if err := m.CreateUser(ctx, &User{Email: "isutrain@example.com"}); err != errEmailTaken {
+		t.Errorf("duplicate email err = %v", err)
+	}
+
+	// ハッシュが変わっていれば置き換えない
+	m.UpdatePasswordHash(ctx, user.ID, []byte("other"), []byte("new"))
+	if got, _ := m.User(ctx, user.ID); string(got.HashedPassword) != "old" || got.Password != "" {
+		t.Errorf("user = %+v", got)
+	}
+	m.UpdatePasswordHash(ctx, user.ID, []byte("old"), []byte("new"))
+	if got, _ := m.UserByEmail(ctx, "isutrain@example.com"); string(got.HashedPassword) != "new" {
+		t.Errorf("rehashed user = %+v", got)
+	}
+
+	m.DeleteAllUsers(ctx)
+	if _, err := m.User(ctx, user.ID); err != sql.ErrNoRows {
+		t.Errorf("User after DeleteAllUsers err = %v", err)
+	}
+}
+
+func TestMemoryRepositoryAPITokens(t *testing.T) {
+	m := newTestRepository()
+	ctx := context.Background()
+
+	mine := APIToken{UserID: 1, Name: "script", TokenHash: "h1", Scopes: ScopeReadReservations}
+	other := APIToken{UserID: 2, Name: "other", TokenHash: "h2", Scopes: ScopeReadReservations}
+	m.CreateAPIToken(ctx, &mine)
+	m.CreateAPIToken(ctx, &other)
+	if mine.ID != 1 || other.ID != 2 {
+		t.Fatalf("token ids = %d, %d", mine.ID, other.ID)
+	}
+	if got, err := m.APITokenByHash(ctx, "h2"); err != nil || got.ID != other.ID {
+		t.Errorf("APITokenByHash = %+v, %v", got, err)
+	}
+	if _, err := m.UserAPIToken(ctx, other.ID, 1); err != sql.ErrNoRows {
+		t.Errorf("other user's token err = %v", err)
+	}
+	if tokens, _ := m.ListUserAPITokens(ctx, 1); len(tokens) != 1 || tokens[0].ID != mine.ID {
+		t.Errorf("ListUserAPITokens = %+v", tokens)
+	}
+
+	used := time.Date(2020, 1, 1, 9, 0, 0, 0, jst)
+	for i := 0; i < 3; i++ {
+		m.RecordAPITokenUsage(ctx, APITokenUsage{TokenID: mine.ID, UsedAt: used.Add(time.Duration(i) * time.Minute), Method: "GET"})
+	}
+	usages, _ := m.ListAPITokenUsages(ctx, mine.ID, 2)
+	if len(usages) != 2 || !usages[0].UsedAt.Equal(used.Add(2*time.Minute)) {
+		t.Errorf("ListAPITokenUsages = %+v", usages)
+	}
+	if got, _ := m.UserAPIToken(ctx, mine.ID, 1); got.LastUsedAt == nil || !got.LastUsedAt.Equal(used.Add(2*time.Minute)) {
+		t.Errorf("last_used_at = %v", got.LastUsedAt)
+	}
+
+	// 失効は最初の1回だけ記録する
+	m.RevokeAPIToken(ctx, mine.ID, used)
+	m.RevokeAPIToken(ctx, mine.ID, used.Add(time.Hour))
+	if got, _ := m.APITokenByHash(ctx, "h1"); got.RevokedAt == nil || !got.RevokedAt.Equal(used) {
+		t.Errorf("revoked_at = %v", got.RevokedAt)
+	}
+
+	m.DeleteAllAPITokens(ctx)
+	if _, err := m.APITokenByHash(ctx, "h1"); err != sql.ErrNoRows {
+		t.Errorf("token after DeleteAllAPITokens err = %v", err)
+	}
+	if usages, _ := m.ListAPITokenUsages(ctx, mine.ID, 100); len(usages) != 0 {
+		t.Errorf("usages after DeleteAllAPITokens = %+v", usages)
+	}
+}
+
+func TestMemoryRepositoryCalendarTokens(t *testing.T) {
+	m := newTestRepository()
+	ctx := context.Background()
+
+	user := User{Email: "isutrain@example.com"}
+	m.CreateUser(ctx, &user)
+	m.PutCalendarToken(ctx, user.ID, "old", time.Now())
+	m.PutCalendarToken(ctx, user.ID, "new", time.Now())
+
+	// 発行し直すと古いトークンは使えない
+	if _, err := m.CalendarTokenUser(ctx, "old"); err != sql.ErrNoRows {
+		t.Errorf("old token err = %v", err)
+	}
+	if got, err := m.CalendarTokenUser(ctx, "new"); err != nil || got.ID != user.ID {
+		t.Errorf("CalendarTokenUser = %+v, %v", got, err)
+	}
+
+	m.DeleteCalendarToken(ctx, user.ID)
+	if _, err := m.CalendarTokenUser(ctx, "new"); err != sql.ErrNoRows {
+		t.Errorf("deleted token err = %v", err)
+	}
+}
+
+func TestMemoryRepositoryTicketUsages(t *testing.T) {
+	m := newTestRepository()
+	base := context.Background()
+	entered := time.Date(2020, 1, 1, 6, 0, 0, 0, jst)
+
+	if _, err := m.TicketUsage(base, 1); err != sql.ErrNoRows {
+		t.Errorf("unused ticket err = %v", err)
+	}
+	m.RecordTicketEntry(base, 1, "東京", entered)
+
+	// ロールバックした出場は残らない
+	ctx, tx, _ := m.BeginTx(base)
+	m.RecordTicketExit(ctx, 1, "大阪", entered.Add(time.Hour))
+	tx.Rollback()
+	if usage, _ := m.TicketUsage(base, 1); usage.EntryStation != "東京" || usage.ExitedAt != nil {
+		t.Errorf("usage after rollback = %+v", usage)
+	}
+
+	m.RecordTicketExit(base, 1, "大阪", entered.Add(time.Hour))
+	if usage, _ := m.TicketUsage(base, 1); usage.ExitStation == nil || *usage.ExitStation != "大阪" {
+		t.Errorf("usage after exit = %+v", usage)
+	}
+
+	m.DeleteAllTicketUsages(base)
+	if _, err := m.TicketUsage(base, 1); err != sql.ErrNoRows {
+		t.Errorf("usage after DeleteAllTicketUsages err = %v", err)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"goji.io/pat"
+)
+
+/*
+	予約受付期間と営業日カレンダー
+
+	列車検索・座席列挙・予約は、乗車日が受付期間 [初日, 初日 + days_ahead 日) にある場合のみ受け付ける
+		open_date を指定すればその日が初日、空なら現在日 (clock) が初日になる (毎日1日ずつ進む)
+		sales_cutoff_minutes を指定すると、乗車駅の出発時刻のその分前で予約を締め切る (null なら締め切らない)
+	reservation_closed_dates に登録した日は受付期間内でも受け付けない (点検日など)
+	設定は reservation_window テーブル (id = 1 の1行) にあればそれを使い、なければ
+	reservation_window.file (RESERVATION_WINDOW_FILE) の JSON、それもなければ defaultReservationWindow (2020-01-01 から10日間)
+	管理用APIでの変更はテーブルに保存し、このプロセスにはただちに反映する (他のプロセスは再起動で反映)
+*/
+
+const reservationWindowDateLayout = "2006-01-02"
+
+type ReservationWindow struct {
+	OpenDate  string `json:"open_date" db:"open_date" validate:"date"`
+	DaysAhead int    `json:"days_ahead" db:"days_ahead" validate:"min=1,max=366"`
+	// 出発の何分前で予約を締め切るか
+	SalesCutoffMinutes *int `json:"sales_cutoff_minutes" db:"sales_cutoff_minutes"`
+}
+
+type ClosedDate struct {
+	Date string `json:"date" db:"date"`
+	Note string `json:"note" db:"note"`
+}
+
+type ClosedDateRequest struct {
+	Note string `json:"note" validate:"max=255"`
+}
+
+type ReservationWindowResponse struct {
+	ReservationWindow
+	// database (管理用APIで変更済み) または config
+	Source string `json:"source"`
+	// 現在の受付期間 (to は含まない)
+	From        string       `json:"from"`
+	To          string       `json:"to"`
+	ClosedDates []ClosedDate `json:"closed_dates"`
+}
+
+var defaultReservationWindow = ReservationWindow{
+	OpenDate:  "2020-01-01",
+	DaysAhead: 10,
+}
+
+var reservationWindow = struct {
+	sync.RWMutex
+	// reservation_window.file または既定値
+	config ReservationWindow
+	// reservation_window テーブルの設定 (なければ nil)
+	override    *ReservationWindow
+	closedDates map[string]string
+}{
+	config:      defaultReservationWindow,
+	closedDates: map[string]string{},
+}
+
+func (w ReservationWindow) Validate() ValidationErrors {
+	if w.SalesCutoffMinutes != nil && *w.SalesCutoffMinutes < 0 {
+		return ValidationErrors{{"sales_cutoff_minutes", "min", "0"}}
+	}
+	return nil
+}
+
+// Range は now の時点の受付期間 [from, to) を返す
+func (w ReservationWindow) Range(now time.Time) (time.Time, time.Time) {
+	now = now.In(jst)
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, jst)
+	if w.OpenDate != "" {
+		if t, err := time.ParseInLocation(reservationWindowDateLayout, w.OpenDate, jst); err == nil {
+			from = t
+		}
+	}
+	return from, from.AddDate(0, 0, w.DaysAhead)
+}
+
+// SalesClosed は出発時刻 departure の列車の予約を締め切ったかどうか
+func (w ReservationWindow) SalesClosed(departure, now time.Time) bool {
+	if w.SalesCutoffMinutes == nil {
+		return false
+	}
+	return !now.Before(departure.Add(-time.Duration(*w.SalesCutoffMinutes) * time.Minute))
+}
+
+func currentReservationWindow() ReservationWindow {
+	reservationWindow.RLock()
+	defer reservationWindow.RUnlock()
+	if reservationWindow.override != nil {
+		return *reservationWindow.override
+	}
+	return reservationWindow.config
+}
+
+// checkAvailableDate は乗車日 date の予約を受け付けるかどうか (受け付けるなら "")
+func checkAvailableDate(date time.Time) ErrorCode {
+	from, to := currentReservationWindow().Range(clock.Now())
+	if date.Before(from) || !date.Before(to) {
+		return ErrOutOfReservationWindow
+	}
+
+	reservationWindow.RLock()
+	_, closed := reservationWindow.closedDates[date.In(jst).Format(reservationWindowDateLayout)]
+	reservationWindow.RUnlock()
+	if closed {
+		return ErrDateClosed
+	}
+	return ""
+}
+
+// checkSalesCutoff は列車の乗車駅 station の出発時刻が締め切りを過ぎていないか調べる
+func checkSalesCutoff(ctx context.Context, date time.Time, trainClass, trainName, station string) ErrorCode {
+	window := currentReservationWindow()
+	if window.SalesCutoffMinutes == nil {
+		return ""
+	}
+
+	stop, err := repo.TrainStop(ctx, date, trainClass, trainName, station)
+	if err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return ErrDatabase
+	}
+	departure, _, err := reservationTimes(date, stop.Departure, stop.Departure)
+	if err != nil {
+		loggerFromContext(ctx).Error(err.Error())
+		return ErrInternal
+	}
+	if window.SalesClosed(departure, clock.Now()) {
+		return ErrSalesClosed
+	}
+	return ""
+}
+
+// loadReservationWindow はテーブルの設定と受付しない日を読み込み直す
+func loadReservationWindow(db *sqlx.DB) error {
+	var override *ReservationWindow
+	w := ReservationWindow{}
+	err := db.Get(&w, "SELECT `open_date`, `days_ahead`, `sales_cutoff_minutes` FROM `reservation_window` WHERE `id` = 1")
+	switch {
+	case err == nil:
+		override = &w
+	case err != sql.ErrNoRows:
+		return err
+	}
+
+	dates := []ClosedDate{}
+	if err := db.Select(&dates, "SELECT `date`, `note` FROM `reservation_closed_dates`"); err != nil {
+		return err
+	}
+	closedDates := map[string]string{}
+	for _, d := range dates {
+		closedDates[d.Date] = d.Note
+	}
+
+	reservationWindow.Lock()
+	reservationWindow.override = override
+	reservationWindow.closedDates = closedDates
+	reservationWindow.Unlock()
+	return nil
+}
+
+func reservationWindowResponse() ReservationWindowResponse {
+	reservationWindow.RLock()
+	defer reservationWindow.RUnlock()
+
+	resp := ReservationWindowResponse{
+		ReservationWindow: reservationWindow.config,
+		Source:            "config",
+		ClosedDates:       []ClosedDate{},
+	}
+	if reservationWindow.override != nil {
+		resp.ReservationWindow = *reservationWindow.override
+		resp.Source = "database"
+	}
+	from, to := resp.ReservationWindow.Range(clock.Now())
+	resp.From = from.Format(reservationWindowDateLayout)
+	resp.To = to.Format(reservationWindowDateLayout)
+	for date, note := range reservationWindow.closedDates {
+		resp.ClosedDates = append(resp.ClosedDates, ClosedDate{date, note})
+	}
+	sort.Slice(resp.ClosedDates, func(i, j int) bool {
+		return resp.ClosedDates[i].Date < resp.ClosedDates[j].Date
+	})
+	return resp
+}
+
+func writeReservationWindow(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(reservationWindowResponse())
+}
+
+func adminGetReservationWindowHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		予約受付期間と受付しない日
+		GET /api/admin/reservation_window
+	*/
+	writeReservationWindow(w)
+}
+
+func adminUpdateReservationWindowHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		予約受付期間の変更
+		PUT /api/admin/reservation_window
+	*/
+	req := ReservationWindow{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errorResponse(w, r, ErrInvalidRequest)
+		return
+	}
+	if verrs := validateStruct(req); len(verrs) > 0 {
+		validationErrorResponse(w, r, verrs)
+		return
+	}
+
+	_, err := dbx.ExecContext(
+		r.Context(),
+		"REPLACE INTO `reservation_window` (`id`, `open_date`, `days_ahead`, `sales_cutoff_minutes`, `updated_at`) VALUES (1, ?, ?, ?, ?)",
+		req.OpenDate, req.DaysAhead, req.SalesCutoffMinutes, time.Now(),
+	)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if err := loadReservationWindow(dbx); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	writeReservationWindow(w)
+}
+
+func adminResetReservationWindowHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		予約受付期間を設定ファイル (既定値) に戻す
+		DELETE /api/admin/reservation_window
+	*/
+	if _, err := dbx.ExecContext(r.Context(), "DELETE FROM `reservation_window` WHERE `id` = 1"); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if err := loadReservationWindow(dbx); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	writeReservationWindow(w)
+}
+
+func adminCloseDateHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		受付しない日の登録
+		PUT /api/admin/reservation_window/closed_dates/:date
+	*/
+	date := pat.Param(r, "date")
+	if _, err := time.Parse(reservationWindowDateLayout, date); err != nil {
+		errorResponse(w, r, ErrInvalidDate)
+		return
+	}
+	req := ClosedDateRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errorResponse(w, r, ErrInvalidRequest)
+		return
+	}
+	if verrs := validateStruct(req); len(verrs) > 0 {
+		validationErrorResponse(w, r, verrs)
+		return
+	}
+
+	_, err := dbx.ExecContext(
+		r.Context(),
+		"INSERT INTO `reservation_closed_dates` (`date`, `note`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `note` = VALUES(`note`)",
+		date, req.Note,
+	)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if err := loadReservationWindow(dbx); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	writeReservationWindow(w)
+}
+
+func adminReopenDateHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		受付しない日の解除
+		DELETE /api/admin/reservation_window/closed_dates/:date
+	*/
+	date := pat.Param(r, "date")
+	if _, err := dbx.ExecContext(r.Context(), "DELETE FROM `reservation_closed_dates` WHERE `date` = ?", date); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if err := loadReservationWindow(dbx); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	writeReservationWindow(w)
+}
+
+// 設定のファイルとDBから予約受付期間を設定する
+func configureReservationWindow(db *sqlx.DB, cfg ReservationWindowConfig) error {
+	if cfg.File != "" {
+		b, err := ioutil.ReadFile(cfg.File)
+		if err != nil {
+			return err
+		}
+		window := ReservationWindow{}
+		if err := json.Unmarshal(b, &window); err != nil {
+			return err
+		}
+		if verrs := validateStruct(window); len(verrs) > 0 {
+			return verrs
+		}
+		reservationWindow.Lock()
+		reservationWindow.config = window
+		reservationWindow.Unlock()
+	}
+	return loadReservationWindow(db)
+}
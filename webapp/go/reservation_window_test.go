@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// setReservationWindow は設定と時刻を差し替え、元に戻す関数を返す
+func setReservationWindow(window ReservationWindow, closedDates map[string]string, now time.Time) func() {
+	saved := reservationWindow.config
+	savedClosed := reservationWindow.closedDates
+	savedClock := clock
+	reservationWindow.config = window
+	reservationWindow.closedDates = closedDates
+	clock = fixedClock(now)
+	return func() {
+		reservationWindow.config = saved
+		reservationWindow.closedDates = savedClosed
+		clock = savedClock
+	}
+}
+
+func TestCheckAvailableDate(t *testing.T) {
+	defer setReservationWindow(defaultReservationWindow, map[string]string{"2020-01-05": "点検"}, time.Date(2026, 10, 18, 12, 0, 0, 0, jst))()
+
+	cases := []struct {
+		date time.Time
+		want ErrorCode
+	}{
+		{time.Date(2020, 1, 1, 0, 0, 0, 0, jst), ""},
+		{time.Date(2019, 12, 31, 23, 59, 0, 0, jst), ErrOutOfReservationWindow},
+		{time.Date(2020, 1, 10, 23, 59, 0, 0, jst), ""},
+		{time.Date(2020, 1, 11, 0, 0, 0, 0, jst), ErrOutOfReservationWindow},
+		{time.Date(2020, 1, 5, 8, 0, 0, 0, jst), ErrDateClosed},
+		// 2020-01-01T00:00:00Z は JST で 1/1 9:00
+		{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), ""},
+	}
+	for _, c := range cases {
+		if got := checkAvailableDate(c.date); got != c.want {
+			t.Errorf("checkAvailableDate(%s) = %q, want %q", c.date, got, c.want)
+		}
+	}
+}
+
+func TestReservationWindowRolling(t *testing.T) {
+	// open_date が空なら現在日から
+	defer setReservationWindow(ReservationWindow{DaysAhead: 30}, map[string]string{}, time.Date(2020, 3, 1, 23, 30, 0, 0, jst))()
+
+	from, to := currentReservationWindow().Range(clock.Now())
+	if want := time.Date(2020, 3, 1, 0, 0, 0, 0, jst); !from.Equal(want) {
+		t.Errorf("from = %s, want %s", from, want)
+	}
+	if want := time.Date(2020, 3, 31, 0, 0, 0, 0, jst); !to.Equal(want) {
+		t.Errorf("to = %s, want %s", to, want)
+	}
+	if got := checkAvailableDate(time.Date(2020, 2, 29, 12, 0, 0, 0, jst)); got != ErrOutOfReservationWindow {
+		t.Errorf("yesterday: got %q", got)
+	}
+
+	clock = fixedClock(time.Date(2020, 3, 2, 0, 0, 0, 0, jst))
+	if got := checkAvailableDate(time.Date(2020, 3, 31, 12, 0, 0, 0, jst)); got != "" {
+		t.Errorf("next day: got %q", got)
+	}
+}
+
+func TestReservationWindowSalesClosed(t *testing.T) {
+	departure := time.Date(2020, 1, 1, 9, 0, 0, 0, jst)
+
+	w := ReservationWindow{DaysAhead: 10}
+	if w.SalesClosed(departure, departure.Add(time.Hour)) {
+		t.Error("no cutoff should never close")
+	}
+
+	cutoff := 30
+	w.SalesCutoffMinutes = &cutoff
+	if w.SalesClosed(departure, departure.Add(-31*time.Minute)) {
+		t.Error("31 minutes before departure should be open")
+	}
+	if !w.SalesClosed(departure, departure.Add(-30*time.Minute)) {
+		t.Error("30 minutes before departure should be closed")
+	}
+}
+
+func TestReservationWindowValidate(t *testing.T) {
+	negative := -1
+	cases := []struct {
+		window ReservationWindow
+		rule   string
+	}{
+		{ReservationWindow{OpenDate: "2020-01-01", DaysAhead: 10}, ""},
+		{ReservationWindow{DaysAhead: 366}, ""},
+		{ReservationWindow{DaysAhead: 0}, "min"},
+		{ReservationWindow{DaysAhead: 367}, "max"},
+		{ReservationWindow{OpenDate: "2020/01/01", DaysAhead: 10}, "date"},
+		{ReservationWindow{DaysAhead: 10, SalesCutoffMinutes: &negative}, "min"},
+	}
+	for _, c := range cases {
+		errs := validateStruct(c.window)
+		got := ""
+		if len(errs) > 0 {
+			got = errs[0].Rule
+		}
+		if got != c.rule {
+			t.Errorf("validate(%+v) = %v, want rule %q", c.window, errs, c.rule)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+	サーバサイドセッション
+
+	クッキーには署名付きのセッションIDだけを入れ、中身は SessionStore に保存する
+	gorilla/sessions の Store として振る舞うので、ハンドラからは従来どおり getSession で扱える
+*/
+
+type SessionRecord struct {
+	ID         string    `db:"id"`
+	UserID     int64     `db:"user_id"`
+	Data       []byte    `db:"data"`
+	CreatedAt  time.Time `db:"created_at"`
+	LastSeenAt time.Time `db:"last_seen_at"`
+}
+
+type SessionStore interface {
+	// Load は見つからない場合 nil, nil を返す
+	Load(id string) (*SessionRecord, error)
+	Save(rec *SessionRecord) error
+	Touch(id string, at time.Time) error
+	Delete(id string) error
+	DeleteByUser(userID int64) error
+	DeleteExpired(idleBefore, createdBefore time.Time) error
+	DeleteAll() error
+}
+
+const (
+	defaultSessionIdleTimeout     = 30 * time.Minute
+	defaultSessionAbsoluteTimeout = 24 * time.Hour
+
+	// last_seen_at の更新はこの間隔より細かくは行わない
+	sessionTouchInterval = time.Minute
+)
+
+var (
+	sessionStore SessionStore = NewMemorySessionStore()
+
+	store sessions.Store = newServerSessionStore(sessionStore, []byte(secureRandomStr(20)), defaultSessionIdleTimeout, defaultSessionAbsoluteTimeout)
+)
+
+type serverSessionStore struct {
+	backend         SessionStore
+	codec           securecookie.Codec
+	serializer      securecookie.GobEncoder
+	idleTimeout     time.Duration
+	absoluteTimeout time.Duration
+	options         sessions.Options
+}
+
+func newServerSessionStore(backend SessionStore, secret []byte, idleTimeout, absoluteTimeout time.Duration) *serverSessionStore {
+	hashKey := sha256.Sum256(secret)
+	codec := securecookie.New(hashKey[:], nil)
+	codec.MaxAge(int(absoluteTimeout.Seconds()))
+
+	return &serverSessionStore{
+		backend:         backend,
+		codec:           codec,
+		idleTimeout:     idleTimeout,
+		absoluteTimeout: absoluteTimeout,
+		options: sessions.Options{
+			Path:     "/",
+			MaxAge:   int(absoluteTimeout.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+	}
+}
+
+func (s *serverSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *serverSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var id string
+	if err := s.codec.Decode(name, c.Value, &id); err != nil {
+		return session, nil
+	}
+
+	rec, err := s.backend.Load(id)
+	if err != nil {
+		return session, err
+	}
+	if rec == nil {
+		return session, nil
+	}
+
+	now := time.Now()
+	if now.Sub(rec.LastSeenAt) > s.idleTimeout || now.Sub(rec.CreatedAt) > s.absoluteTimeout {
+		if err := s.backend.Delete(id); err != nil {
+			loggerFromContext(r.Context()).Error(err.Error())
+		}
+		return session, nil
+	}
+	if err := s.serializer.Deserialize(rec.Data, &session.Values); err != nil {
+		return session, err
+	}
+	if now.Sub(rec.LastSeenAt) > sessionTouchInterval {
+		if err := s.backend.Touch(id, now); err != nil {
+			loggerFromContext(r.Context()).Error(err.Error())
+		}
+	}
+
+	session.ID = id
+	session.IsNew = false
+	return session, nil
+}
+
+func (s *serverSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.Delete(session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	now := time.Now()
+	rec := &SessionRecord{ID: session.ID, CreatedAt: now, LastSeenAt: now}
+	if session.ID == "" {
+		rec.ID = secureRandomStr(32)
+	} else if old, err := s.backend.Load(session.ID); err != nil {
+		return err
+	} else if old != nil {
+		rec.CreatedAt = old.CreatedAt
+	}
+	if userID, ok := session.Values["user_id"].(int64); ok {
+		rec.UserID = userID
+	}
+
+	data, err := s.serializer.Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+	rec.Data = data
+	if err := s.backend.Save(rec); err != nil {
+		return err
+	}
+	session.ID = rec.ID
+
+	encoded, err := s.codec.Encode(session.Name(), session.ID)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// renewSession はログイン時にセッションIDを振り直す (セッション固定攻撃対策)
+func renewSession(session *sessions.Session) error {
+	if session.ID != "" {
+		if err := sessionStore.Delete(session.ID); err != nil {
+			return err
+		}
+	}
+	session.ID = ""
+	// ログイン前に発行された CSRF トークンは引き継がない
+	delete(session.Values, csrfSessionKey)
+	return nil
+}
+
+// 設定からセッションストアを設定する
+func configureSessionStore(db *sqlx.DB, cfg SessionConfig) error {
+	switch cfg.Store {
+	case "memory":
+		sessionStore = NewMemorySessionStore()
+	default:
+		sessionStore = NewMySQLSessionStore(db)
+	}
+
+	secret := cfg.Secret
+	if secret == "" {
+		logger.Warn("SESSION_SECRET is not set; sessions will not survive a restart")
+		secret = secureRandomStr(20)
+	}
+
+	idleTimeout := time.Duration(cfg.IdleTimeout)
+	absoluteTimeout := time.Duration(cfg.AbsoluteTimeout)
+
+	s := newServerSessionStore(sessionStore, []byte(secret), idleTimeout, absoluteTimeout)
+	switch cfg.CookieSameSite {
+	case "", "lax":
+		s.options.SameSite = http.SameSiteLaxMode
+	case "strict":
+		s.options.SameSite = http.SameSiteStrictMode
+	default:
+		return fmt.Errorf("unknown session.cookie_samesite: %s", cfg.CookieSameSite)
+	}
+
+	store = s
+	go expireSessions(sessionStore, idleTimeout, absoluteTimeout)
+	return nil
+}
+
+func expireSessions(backend SessionStore, idleTimeout, absoluteTimeout time.Duration) {
+	for range time.Tick(10 * time.Minute) {
+		now := time.Now()
+		if err := backend.DeleteExpired(now.Add(-idleTimeout), now.Add(-absoluteTimeout)); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+}
+
+// MySQLSessionStore は sessions テーブルにセッションを保存する
+type MySQLSessionStore struct {
+	db *sqlx.DB
+}
+
+func NewMySQLSessionStore(db *sqlx.DB) *MySQLSessionStore {
+	return &MySQLSessionStore{db: db}
+}
+
+func (s *MySQLSessionStore) Load(id string) (*SessionRecord, error) {
+	rec := SessionRecord{}
+	err := s.db.Get(&rec, "SELECT * FROM `sessions` WHERE `id` = ?", id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s *MySQLSessionStore) Save(rec *SessionRecord) error {
+	_, err := s.db.Exec(
+		"INSERT INTO `sessions` (`id`, `user_id`, `data`, `created_at`, `last_seen_at`) VALUES (?, ?, ?, ?, ?) "+
+			"ON DUPLICATE KEY UPDATE `user_id` = VALUES(`user_id`), `data` = VALUES(`data`), `last_seen_at` = VALUES(`last_seen_at`)",
+		rec.ID, rec.UserID, rec.Data, rec.CreatedAt, rec.LastSeenAt,
+	)
+	return err
+}
+
+func (s *MySQLSessionStore) Touch(id string, at time.Time) error {
+	_, err := s.db.Exec("UPDATE `sessions` SET `last_seen_at` = ? WHERE `id` = ?", at, id)
+	return err
+}
+
+func (s *MySQLSessionStore) Delete(id string) error {
+	_, err := s.db.Exec("DELETE FROM `sessions` WHERE `id` = ?", id)
+	return err
+}
+
+func (s *MySQLSessionStore) DeleteByUser(userID int64) error {
+	_, err := s.db.Exec("DELETE FROM `sessions` WHERE `user_id` = ?", userID)
+	return err
+}
+
+func (s *MySQLSessionStore) DeleteExpired(idleBefore, createdBefore time.Time) error {
+	_, err := s.db.Exec("DELETE FROM `sessions` WHERE `last_seen_at` < ? OR `created_at` < ?", idleBefore, createdBefore)
+	return err
+}
+
+func (s *MySQLSessionStore) DeleteAll() error {
+	_, err := s.db.Exec("TRUNCATE `sessions`")
+	return err
+}
+
+// MemorySessionStore はプロセス内にセッションを保持する (開発・テスト用)
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]SessionRecord
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: map[string]SessionRecord{}}
+}
+
+func (s *MemorySessionStore) Load(id string) (*SessionRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	return &rec, nil
+}
+
+func (s *MemorySessionStore) Save(rec *SessionRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.sessions[rec.ID]; ok {
+		rec.CreatedAt = old.CreatedAt
+	}
+	s.sessions[rec.ID] = *rec
+	return nil
+}
+
+func (s *MemorySessionStore) Touch(id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.sessions[id]; ok {
+		rec.LastSeenAt = at
+		s.sessions[id] = rec
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteByUser(userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, rec := range s.sessions {
+		if rec.UserID == userID {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteExpired(idleBefore, createdBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, rec := range s.sessions {
+		if rec.LastSeenAt.Before(idleBefore) || rec.CreatedAt.Before(createdBefore) {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = map[string]SessionRecord{}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// saveSession はセッションを保存し、そのクッキーを付けた次のリクエストを返す
+func saveSession(t *testing.T, s *serverSessionStore, values map[interface{}]interface{}) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := s.New(r, sessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	w := httptest.NewRecorder()
+	if err := s.Save(r, w, session); err != nil {
+		t.Fatal(err)
+	}
+
+	next := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		next.AddCookie(c)
+	}
+	return next
+}
+
+func TestServerSessionStoreRoundTrip(t *testing.T) {
+	backend := NewMemorySessionStore()
+	s := newServerSessionStore(backend, []byte("secret"), time.Hour, 24*time.Hour)
+
+	r := saveSession(t, s, map[interface{}]interface{}{"user_id": int64(42)})
+	session, err := s.New(r, sessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.IsNew || session.Values["user_id"] != int64(42) {
+		t.Fatalf("session was not restored: %#v", session.Values)
+	}
+
+	// 別の鍵で署名されたクッキーは受け付けない
+	other := newServerSessionStore(backend, []byte("other"), time.Hour, 24*time.Hour)
+	if session, _ := other.New(r, sessionName); !session.IsNew {
+		t.Fatal("cookie signed with another secret was accepted")
+	}
+}
+
+func TestServerSessionStoreTimeouts(t *testing.T) {
+	backend := NewMemorySessionStore()
+	s := newServerSessionStore(backend, []byte("secret"), time.Hour, 24*time.Hour)
+
+	tests := []struct {
+		name     string
+		created  time.Duration
+		lastSeen time.Duration
+		expired  bool
+	}{
+		{"active", -2 * time.Hour, -time.Minute, false},
+		{"idle", -2 * time.Hour, -61 * time.Minute, true},
+		{"absolute", -25 * time.Hour, -time.Minute, true},
+	}
+	for _, tt := range tests {
+		r := saveSession(t, s, map[interface{}]interface{}{"user_id": int64(1)})
+		for id, rec := range backend.sessions {
+			rec.CreatedAt = time.Now().Add(tt.created)
+			rec.LastSeenAt = time.Now().Add(tt.lastSeen)
+			backend.sessions[id] = rec
+		}
+
+		session, err := s.New(r, sessionName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.IsNew != tt.expired {
+			t.Errorf("%s: IsNew = %v, want %v", tt.name, session.IsNew, tt.expired)
+		}
+		backend.DeleteAll()
+	}
+}
+
+func TestMemorySessionStoreDeleteByUser(t *testing.T) {
+	backend := NewMemorySessionStore()
+	s := newServerSessionStore(backend, []byte("secret"), time.Hour, 24*time.Hour)
+
+	first := saveSession(t, s, map[interface{}]interface{}{"user_id": int64(1)})
+	second := saveSession(t, s, map[interface{}]interface{}{"user_id": int64(1)})
+	other := saveSession(t, s, map[interface{}]interface{}{"user_id": int64(2)})
+
+	if err := backend.DeleteByUser(1); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*http.Request{first, second} {
+		if session, _ := s.New(r, sessionName); !session.IsNew {
+			t.Error("revoked session is still valid")
+		}
+	}
+	if session, _ := s.New(other, sessionName); session.IsNew {
+		t.Error("another user's session was revoked")
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+/*
+	駅の別名と駅検索
+
+	station_aliases に駅名の読み (kana)・ローマ字 (romaji)・英語表記 (english) を登録する
+	列車検索・座席列挙・予約の駅指定は、駅名のほか別名と駅IDでも受け付ける (resolveStation)
+	GET /api/stations/search?q= は駅名と別名を前方一致・部分一致・編集距離であいまいに検索する
+	照合はカタカナをひらがなに、全角英数を半角にし、大文字小文字・空白・記号を無視して行う
+	駅マスタと別名は起動後に変わらないので、初回に読み込んで stationIndex に保持する
+*/
+
+const (
+	StationAliasKana    = "kana"
+	StationAliasRomaji  = "romaji"
+	StationAliasEnglish = "english"
+
+	stationSearchLimit = 10
+)
+
+type StationAlias struct {
+	StationID int    `json:"-" db:"station_id"`
+	Kind      string `json:"kind" db:"kind"`
+	Alias     string `json:"alias" db:"alias"`
+}
+
+type StationSearchResult struct {
+	Station
+	Aliases []StationAlias `json:"aliases"`
+	// 一致した駅名または別名と一致の種類 (exact, prefix, partial, fuzzy)
+	Matched string `json:"matched"`
+	Match   string `json:"match"`
+}
+
+type stationIndexEntry struct {
+	station Station
+	aliases []StationAlias
+	// 正規化した駅名と別名 (keys[0] が駅名)
+	keys []string
+}
+
+var stationIndex struct {
+	sync.Mutex
+	entries []stationIndexEntry
+}
+
+// normalizeStationKey は照合用に表記ゆれをなくす
+func normalizeStationKey(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 'ァ' && r <= 'ヶ':
+			r -= 'ァ' - 'ぁ'
+		case r >= '！' && r <= '～':
+			r -= '！' - '!'
+		}
+		if unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			continue
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+func loadStationIndex(ctx context.Context) ([]stationIndexEntry, error) {
+	stationIndex.Lock()
+	defer stationIndex.Unlock()
+	if stationIndex.entries != nil {
+		return stationIndex.entries, nil
+	}
+
+	stations, err := repo.ListStations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := repo.ListStationAliases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stationIndex.entries = buildStationIndex(stations, aliases)
+	return stationIndex.entries, nil
+}
+
+func buildStationIndex(stations []Station, aliases []StationAlias) []stationIndexEntry {
+	byStation := map[int][]StationAlias{}
+	for _, a := range aliases {
+		byStation[a.StationID] = append(byStation[a.StationID], a)
+	}
+	entries := make([]stationIndexEntry, 0, len(stations))
+	for _, station := range stations {
+		entry := stationIndexEntry{
+			station: station,
+			aliases: byStation[station.ID],
+			keys:    []string{normalizeStationKey(station.Name)},
+		}
+		if entry.aliases == nil {
+			entry.aliases = []StationAlias{}
+		}
+		for _, a := range entry.aliases {
+			entry.keys = append(entry.keys, normalizeStationKey(a.Alias))
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// lookupStation は駅名・駅ID・別名のいずれかに完全に一致する駅を探す
+func lookupStation(entries []stationIndexEntry, name string) (Station, bool) {
+	for _, e := range entries {
+		if e.station.Name == name {
+			return e.station, true
+		}
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		for _, e := range entries {
+			if e.station.ID == id {
+				return e.station, true
+			}
+		}
+		return Station{}, false
+	}
+	key := normalizeStationKey(name)
+	if key == "" {
+		return Station{}, false
+	}
+	for _, e := range entries {
+		for _, k := range e.keys {
+			if k == key {
+				return e.station, true
+			}
+		}
+	}
+	return Station{}, false
+}
+
+// resolveStation はリクエストで指定された駅を求める。みつからなければ sql.ErrNoRows
+func resolveStation(ctx context.Context, name string) (Station, error) {
+	entries, err := loadStationIndex(ctx)
+	if err != nil {
+		return Station{}, err
+	}
+	station, ok := lookupStation(entries, name)
+	if !ok {
+		return Station{}, sql.ErrNoRows
+	}
+	return station, nil
+}
+
+// searchStations は q に近い順に駅を返す
+func searchStations(entries []stationIndexEntry, q string, limit int) []StationSearchResult {
+	query := normalizeStationKey(q)
+	if query == "" {
+		return []StationSearchResult{}
+	}
+
+	type scored struct {
+		result StationSearchResult
+		rank   int
+		order  int
+	}
+	list := []scored{}
+	for i, e := range entries {
+		best := scored{rank: -1}
+		for j, key := range e.keys {
+			matched := e.station.Name
+			if j > 0 {
+				matched = e.aliases[j-1].Alias
+			}
+			rank, match := stationMatchRank(query, key)
+			if rank < 0 || (best.rank >= 0 && rank >= best.rank) {
+				continue
+			}
+			best = scored{StationSearchResult{e.station, e.aliases, matched, match}, rank, i}
+		}
+		if best.rank >= 0 {
+			list = append(list, best)
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].rank != list[j].rank {
+			return list[i].rank < list[j].rank
+		}
+		return list[i].order < list[j].order
+	})
+	results := []StationSearchResult{}
+	for _, s := range list {
+		if len(results) >= limit {
+			break
+		}
+		results = append(results, s.result)
+	}
+	return results
+}
+
+// stationMatchRank は一致の度合い (小さいほど近い、一致しなければ -1)
+func stationMatchRank(query, key string) (int, string) {
+	switch {
+	case key == query:
+		return 0, "exact"
+	case strings.HasPrefix(key, query):
+		return 1, "prefix"
+	case strings.Contains(key, query):
+		return 2, "partial"
+	}
+
+	// 入力途中の typo も拾えるよう、同じ長さの先頭部分との距離も見る
+	q, k := []rune(query), []rune(key)
+	d := editDistance(q, k)
+	if len(k) > len(q) {
+		if dp := editDistance(q, k[:len(q)]); dp < d {
+			d = dp
+		}
+	}
+	if d <= fuzzyThreshold(len(q)) {
+		return 2 + d, "fuzzy"
+	}
+	return -1, ""
+}
+
+func fuzzyThreshold(n int) int {
+	switch {
+	case n < 3:
+		return 0
+	case n < 6:
+		return 1
+	}
+	return 2
+}
+
+func editDistance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func stationSearchHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		駅検索 (駅名・読み・ローマ字・英語表記)
+		GET /api/stations/search?q=toukyou
+	*/
+	q := r.URL.Query().Get("q")
+	if strings.TrimSpace(q) == "" {
+		validationErrorResponse(w, r, ValidationErrors{{"q", "required", ""}})
+		return
+	}
+
+	entries, err := loadStationIndex(r.Context())
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(searchStations(entries, q, stationSearchLimit))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func testStationIndex() []stationIndexEntry {
+	stations := []Station{
+		{ID: 1, Name: "東京"},
+		{ID: 2, Name: "古岡"},
+		{ID: 42, Name: "名古屋"},
+		{ID: 53, Name: "鳩平ヶ丘"},
+		{ID: 82, Name: "大阪"},
+	}
+	aliases := []StationAlias{
+		{1, StationAliasKana, "とうきょう"}, {1, StationAliasRomaji, "toukyou"}, {1, StationAliasEnglish, "Tokyo"},
+		{2, StationAliasKana, "ふるおか"}, {2, StationAliasRomaji, "furuoka"}, {2, StationAliasEnglish, "Furuoka"},
+		{42, StationAliasKana, "なごや"}, {42, StationAliasRomaji, "nagoya"}, {42, StationAliasEnglish, "Nagoya"},
+		{53, StationAliasKana, "はとひらがおか"}, {53, StationAliasRomaji, "hatohiragaoka"}, {53, StationAliasEnglish, "Hatohiragaoka"},
+		{82, StationAliasKana, "おおさか"}, {82, StationAliasRomaji, "oosaka"}, {82, StationAliasEnglish, "Osaka"},
+	}
+	return buildStationIndex(stations, aliases)
+}
+
+func TestNormalizeStationKey(t *testing.T) {
+	for in, want := range map[string]string{
+		"トウキョウ":     "とうきょう",
+		"ＴＯＫＹＯ":     "tokyo",
+		" Nagoya ":  "nagoya",
+		"hato-hira": "hatohira",
+	} {
+		if got := normalizeStationKey(in); got != want {
+			t.Errorf("normalizeStationKey(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestLookupStation(t *testing.T) {
+	entries := testStationIndex()
+	for _, name := range []string{"東京", "1", "とうきょう", "トウキョウ", "toukyou", "TOKYO"} {
+		station, ok := lookupStation(entries, name)
+		if !ok || station.Name != "東京" {
+			t.Errorf("lookupStation(%q) = %+v, %v", name, station, ok)
+		}
+	}
+	for _, name := range []string{"", "999", "とう", "tokio"} {
+		if station, ok := lookupStation(entries, name); ok {
+			t.Errorf("lookupStation(%q) should not match, got %+v", name, station)
+		}
+	}
+}
+
+func TestSearchStations(t *testing.T) {
+	entries := testStationIndex()
+	cases := []struct {
+		q     string
+		first string
+		match string
+	}{
+		{"osaka", "大阪", "exact"},
+		{"naGO", "名古屋", "prefix"},
+		{"ひらが", "鳩平ヶ丘", "partial"},
+		{"tokio", "東京", "fuzzy"},
+		{"furuko", "古岡", "fuzzy"},
+	}
+	for _, c := range cases {
+		results := searchStations(entries, c.q, stationSearchLimit)
+		if len(results) == 0 || results[0].Name != c.first || results[0].Match != c.match {
+			t.Errorf("searchStations(%q) = %+v, want %s (%s) first", c.q, results, c.first, c.match)
+		}
+	}
+
+	if results := searchStations(entries, "xyzw", stationSearchLimit); len(results) != 0 {
+		t.Errorf("unexpected results: %+v", results)
+	}
+	if results := searchStations(entries, "o", 2); len(results) != 2 {
+		t.Errorf("limit is not applied: %+v", results)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+	"goji.io/pat"
+)
+
+/*
+	電子チケット
+
+	支払い済みの予約について、署名付きのチケット (QRコードのPNG) を発行する
+	チケットは base64url(JSON) + "." + base64url(HMAC-SHA256) の文字列で、鍵は設定 ticket.signing_key (TICKET_SIGNING_KEY)
+	改札機は POST /api/gate/verify で検証し、入場・出場を記録する (X-Gate-Token が ticket.gate_token (GATE_TOKEN) と一致する必要がある)
+		- 入場・出場どちらも駅がチケットの区間内であること
+		- 入場は1回だけ、出場は入場後に1回だけ
+*/
+
+const (
+	gateTokenHeader = "X-Gate-Token"
+
+	// 到着予定からこの時間が過ぎたチケットは無効
+	ticketGracePeriod = 3 * time.Hour
+
+	ticketQRCodeSize = 320
+)
+
+var ticketSigningKey = []byte(secureRandomStr(32))
+
+type TicketPayload struct {
+	ReservationID int      `json:"rid"`
+	TrainClass    string   `json:"tc"`
+	TrainName     string   `json:"tn"`
+	Date          string   `json:"d"`
+	Departure     string   `json:"from"`
+	Arrival       string   `json:"to"`
+	CarNumber     int      `json:"car"`
+	Seats         []string `json:"seats"`
+	ExpiresAt     int64    `json:"exp"`
+}
+
+type GateVerifyRequest struct {
+	Ticket    string `json:"ticket" validate:"required"`
+	Station   string `json:"station" validate:"required"`
+	Direction string `json:"direction" validate:"required,oneof=entry exit"`
+}
+
+type GateVerifyResponse struct {
+	IsOk          bool     `json:"is_ok"`
+	ReservationID int      `json:"reservation_id"`
+	Direction     string   `json:"direction"`
+	Station       string   `json:"station"`
+	TrainClass    string   `json:"train_class"`
+	TrainName     string   `json:"train_name"`
+	CarNumber     int      `json:"car_number"`
+	Seats         []string `json:"seats"`
+}
+
+type TicketUsage struct {
+	ReservationID int        `db:"reservation_id"`
+	EntryStation  string     `db:"entry_station"`
+	EnteredAt     time.Time  `db:"entered_at"`
+	ExitStation   *string    `db:"exit_station"`
+	ExitedAt      *time.Time `db:"exited_at"`
+}
+
+var ticketEncoding = base64.RawURLEncoding
+
+func signTicket(payload TicketPayload, key []byte) (string, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	body := ticketEncoding.EncodeToString(b)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(body))
+	return body + "." + ticketEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// parseTicket は署名と有効期限を検証してチケットの内容を返す
+func parseTicket(ticket string, key []byte, now time.Time) (TicketPayload, ErrorCode) {
+	payload := TicketPayload{}
+
+	parts := strings.Split(ticket, ".")
+	if len(parts) != 2 {
+		return payload, ErrInvalidTicket
+	}
+	sig, err := ticketEncoding.DecodeString(parts[1])
+	if err != nil {
+		return payload, ErrInvalidTicket
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return payload, ErrInvalidTicket
+	}
+
+	b, err := ticketEncoding.DecodeString(parts[0])
+	if err != nil {
+		return payload, ErrInvalidTicket
+	}
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return payload, ErrInvalidTicket
+	}
+	if now.Unix() > payload.ExpiresAt {
+		return payload, ErrTicketExpired
+	}
+	return payload, ""
+}
+
+func makeTicketPayload(reservation Reservation, resp ReservationResponse) (TicketPayload, error) {
+	_, arrival, err := reservationTimes(*reservation.Date, resp.DepartureTime, resp.ArrivalTime)
+	if err != nil {
+		return TicketPayload{}, err
+	}
+
+	payload := TicketPayload{
+		ReservationID: reservation.ReservationId,
+		TrainClass:    reservation.TrainClass,
+		TrainName:     reservation.TrainName,
+		Date:          reservation.Date.Format("2006-01-02"),
+		Departure:     reservation.Departure,
+		Arrival:       reservation.Arrival,
+		CarNumber:     resp.CarNumber,
+		Seats:         []string{},
+		ExpiresAt:     arrival.Add(ticketGracePeriod).Unix(),
+	}
+	if resp.CarNumber != 0 {
+		for _, seat := range resp.Seats {
+			payload.Seats = append(payload.Seats, fmt.Sprintf("%d%s", seat.SeatRow, seat.SeatColumn))
+		}
+	}
+	return payload, nil
+}
+
+// stationWithinSection は station が from と to の間 (両端を含む) にあるかどうか
+func stationWithinSection(station, from, to Station) bool {
+	lower := math.Min(from.Distance, to.Distance)
+	upper := math.Max(from.Distance, to.Distance)
+	return station.Distance >= lower && station.Distance <= upper
+}
+
+func userReservationTicketHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		電子チケット (QRコードのPNG)
+		GET /api/user/reservations/:item_id/ticket
+	*/
+	user, errCode := getUser(r, ScopeReadReservations)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
+		return
+	}
+	itemID, err := strconv.ParseInt(pat.Param(r, "item_id"), 10, 64)
+	if err != nil || itemID <= 0 {
+		errorResponse(w, r, ErrInvalidItemID)
+		return
+	}
+	setLogField(r.Context(), "reservation_id", itemID)
+
+	reservation, err := repo.UserReservation(r.Context(), itemID, user.ID)
+	if err == sql.ErrNoRows {
+		errorResponse(w, r, ErrReservationNotFound)
+		return
+	}
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if reservation.Status != "done" {
+		errorResponse(w, r, ErrReservationNotPaid)
+		return
+	}
+
+	resp, err := makeReservationResponse(r.Context(), reservation)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	payload, err := makeTicketPayload(reservation, resp)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrInternal)
+		return
+	}
+	ticket, err := signTicket(payload, ticketSigningKey)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrInternal)
+		return
+	}
+	png, err := qrcode.Encode(ticket, qrcode.Medium, ticketQRCodeSize)
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write(png)
+}
+
+func gateVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	/*
+		改札でのチケット検証
+		POST /api/gate/verify
+	*/
+	req := GateVerifyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errorResponse(w, r, ErrInvalidRequest)
+		return
+	}
+	if verrs := validateStruct(req); len(verrs) > 0 {
+		validationErrorResponse(w, r, verrs)
+		return
+	}
+
+	now := clock.Now()
+	payload, errCode := parseTicket(req.Ticket, ticketSigningKey, now)
+	if errCode != "" {
+		errorResponse(w, r, errCode)
+		return
+	}
+
+	var station, from, to Station
+	for _, s := range []struct {
+		dest *Station
+		name string
+	}{{&station, req.Station}, {&from, payload.Departure}, {&to, payload.Arrival}} {
+		var err error
+		*s.dest, err = repo.StationByName(r.Context(), s.name)
+		if err == sql.ErrNoRows {
+			errorResponse(w, r, ErrStationNotFound, s.name)
+			return
+		}
+		if err != nil {
+			loggerFromContext(r.Context()).Error(err.Error())
+			errorResponse(w, r, ErrDatabase)
+			return
+		}
+	}
+	if !stationWithinSection(station, from, to) {
+		errorResponse(w, r, ErrStationOutsideSection)
+		return
+	}
+
+	setLogField(r.Context(), "reservation_id", payload.ReservationID)
+
+	ctx, tx, err := repo.BeginTx(r.Context())
+	if err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	// キャンセル済みのチケットは使えない
+	reservationID := int64(payload.ReservationID)
+	reservation, err := repo.Reservation(ctx, reservationID)
+	if err == sql.ErrNoRows || (err == nil && reservation.Status != "done") {
+		tx.Rollback()
+		errorResponse(w, r, ErrInvalidTicket)
+		return
+	}
+	if err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	usage, err := repo.TicketUsage(ctx, reservationID)
+	entered := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	switch req.Direction {
+	case "entry":
+		if entered {
+			tx.Rollback()
+			errorResponse(w, r, ErrTicketAlreadyUsed)
+			return
+		}
+		err = repo.RecordTicketEntry(ctx, reservationID, station.Name, now)
+	case "exit":
+		if !entered {
+			tx.Rollback()
+			errorResponse(w, r, ErrTicketNotEntered)
+			return
+		}
+		if usage.ExitedAt != nil {
+			tx.Rollback()
+			errorResponse(w, r, ErrTicketAlreadyUsed)
+			return
+		}
+		err = repo.RecordTicketExit(ctx, reservationID, station.Name, now)
+	}
+	if err != nil {
+		tx.Rollback()
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		loggerFromContext(r.Context()).Error(err.Error())
+		errorResponse(w, r, ErrDatabase)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(GateVerifyResponse{
+		IsOk:          true,
+		ReservationID: payload.ReservationID,
+		Direction:     req.Direction,
+		Station:       station.Name,
+		TrainClass:    payload.TrainClass,
+		TrainName:     payload.TrainName,
+		CarNumber:     payload.CarNumber,
+		Seats:         payload.Seats,
+	})
+}
+
+func requireGate(h http.HandlerFunc) http.HandlerFunc {
+	return requireSharedToken(func() string { return appConfig.Ticket.GateToken }, gateTokenHeader, ErrGateForbidden, h)
+}
+
+// 設定からチケットの署名鍵を設定する
+func configureTicketSigning(cfg TicketConfig) {
+	if cfg.SigningKey != "" {
+		ticketSigningKey = []byte(cfg.SigningKey)
+		return
+	}
+	logger.Warn("ticket.signing_key is not set; tickets will not survive a restart")
+}
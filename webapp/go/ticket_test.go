@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTicketRoundTrip(t *testing.T) {
+	key := []byte("test-key")
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, jst)
+	payload := TicketPayload{
+		ReservationID: 42,
+		TrainClass:    "最速",
+		TrainName:     "1",
+		Date:          "2020-01-01",
+		Departure:     "東京",
+		Arrival:       "大阪",
+		CarNumber:     3,
+		Seats:         []string{"1A", "1B"},
+		ExpiresAt:     now.Add(time.Hour).Unix(),
+	}
+
+	ticket, err := signTicket(payload, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, errCode := parseTicket(ticket, key, now)
+	if errCode != "" {
+		t.Fatalf("parseTicket returned %s", errCode)
+	}
+	if got.ReservationID != 42 || got.Arrival != "大阪" || strings.Join(got.Seats, ",") != "1A,1B" {
+		t.Errorf("unexpected payload: %+v", got)
+	}
+
+	if _, errCode := parseTicket(ticket, []byte("other-key"), now); errCode != ErrInvalidTicket {
+		t.Errorf("ticket signed with another key: got %q", errCode)
+	}
+	if _, errCode := parseTicket(ticket, key, now.Add(2*time.Hour)); errCode != ErrTicketExpired {
+		t.Errorf("expired ticket: got %q", errCode)
+	}
+}
+
+func TestTicketTampered(t *testing.T) {
+	key := []byte("test-key")
+	now := time.Now()
+	ticket, err := signTicket(TicketPayload{ReservationID: 1, ExpiresAt: now.Add(time.Hour).Unix()}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := signTicket(TicketPayload{ReservationID: 2, ExpiresAt: now.Add(time.Hour).Unix()}, []byte("forged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		"",
+		"no-signature",
+		ticket + ".extra",
+		strings.Split(forged, ".")[0] + "." + strings.Split(ticket, ".")[1],
+	} {
+		if _, errCode := parseTicket(s, key, now); errCode != ErrInvalidTicket {
+			t.Errorf("parseTicket(%q) = %q, want %q", s, errCode, ErrInvalidTicket)
+		}
+	}
+}
+
+func TestStationWithinSection(t *testing.T) {
+	from := Station{Name: "A", Distance: 10}
+	to := Station{Name: "C", Distance: 50}
+	for _, tc := range []struct {
+		distance float64
+		want     bool
+	}{
+		{10, true},
+		{30, true},
+		{50, true},
+		{5, false},
+		{60, false},
+	} {
+		station := Station{Distance: tc.distance}
+		if got := stationWithinSection(station, from, to); got != tc.want {
+			t.Errorf("distance %v: got %v, want %v", tc.distance, got, tc.want)
+		}
+		// 上り方向でも同じ結果になる
+		if got := stationWithinSection(station, to, from); got != tc.want {
+			t.Errorf("distance %v (reverse): got %v, want %v", tc.distance, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	分散トレーシング
+
+	OpenTelemetry と同じ形式 (W3C Trace Context の traceparent ヘッダ、OTLP/JSON) でスパンを記録する
+		HTTPリクエストごとにサーバスパンを作り、その中のクエリ (db_observer) と決済APIの呼び出しを子スパンにする
+		リクエストに traceparent があればその続きとして記録する
+		決済APIは traceparent を付けて呼ぶので、決済API (grpc-gateway と gRPC) のスパンも同じトレースに入る
+	クエリのスパンは、コンテキスト (r.Context() または BeginTx に渡したコンテキスト) にスパンがあるときだけ記録する
+
+	tracing.exporter (TRACING_EXPORTER)
+		none: 記録しない (既定)
+		file: tracing.file に OTLP/JSON (ExportTraceServiceRequest) を1行ずつ追記する (collector の otlpjsonfile receiver で読める)
+		otlp: tracing.endpoint の /v1/traces に OTLP/HTTP (JSON) で送る
+	終わったスパンはまとめて1秒ごとに書き出し、終了時に残りを書き出す
+*/
+
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+
+	spanStatusError = 2
+
+	traceExportInterval = time.Second
+	traceBatchSize      = 512
+)
+
+type traceID [16]byte
+type spanID [8]byte
+
+// spanContext はプロセスをまたいで引き継ぐスパンの識別子
+type spanContext struct {
+	TraceID traceID
+	SpanID  spanID
+}
+
+func (sc spanContext) isValid() bool {
+	return sc.TraceID != traceID{} && sc.SpanID != spanID{}
+}
+
+// traceparent は W3C Trace Context の traceparent ヘッダの値
+func (sc spanContext) traceparent() string {
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-01"
+}
+
+// parseTraceparent は traceparent ヘッダを読む (不正な値なら ok は false)
+func parseTraceparent(s string) (spanContext, bool) {
+	sc := spanContext{}
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.DecodeString(parts[3]); err != nil {
+		return sc, false
+	}
+	return sc, sc.isValid()
+}
+
+type Span struct {
+	mu         sync.Mutex
+	sc         spanContext
+	parent     spanID
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        string
+}
+
+// SetAttribute はスパンに属性を付ける (スパンが nil なら何もしない)
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError はスパンを失敗にする
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End はスパンを終えて書き出しに回す
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	tracer.enqueue(s)
+}
+
+type spanContextKey struct{}
+
+func spanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanContextKey{}).(*Span)
+	return s
+}
+
+func contextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, s)
+}
+
+func newTraceID() traceID {
+	id := traceID{}
+	crand.Read(id[:])
+	return id
+}
+
+func newSpanID() spanID {
+	id := spanID{}
+	crand.Read(id[:])
+	return id
+}
+
+func newSpan(parent spanContext, name string, kind int, start time.Time) *Span {
+	s := &Span{name: name, kind: kind, start: start, attributes: map[string]interface{}{}}
+	s.sc.SpanID = newSpanID()
+	if parent.isValid() {
+		s.sc.TraceID, s.parent = parent.TraceID, parent.SpanID
+	} else {
+		s.sc.TraceID = newTraceID()
+	}
+	return s
+}
+
+// startSpan は ctx のスパンの子スパンを始める (トレーシングが無効なら nil を返す)
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if !tracer.enabled() {
+		return ctx, nil
+	}
+	parent := spanContext{}
+	if p := spanFromContext(ctx); p != nil {
+		parent = p.sc
+	}
+	s := newSpan(parent, name, kind, time.Now())
+	return contextWithSpan(ctx, s), s
+}
+
+// detachedSpanContext は ctx のスパンだけを引き継いだ、キャンセルされないコンテキスト
+// (決済APIの呼び出しをクライアントの切断で中断させないために使う)
+func detachedSpanContext(ctx context.Context) context.Context {
+	if s := spanFromContext(ctx); s != nil {
+		return contextWithSpan(context.Background(), s)
+	}
+	return context.Background()
+}
+
+// tracingMiddleware はリクエストごとにサーバスパンを作る
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tracer.enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route := routeName(r.Context())
+		parent, _ := parseTraceparent(r.Header.Get("traceparent"))
+		s := newSpan(parent, r.Method+" "+route, spanKindServer, time.Now())
+		s.SetAttribute("http.method", r.Method)
+		s.SetAttribute("http.route", route)
+		s.SetAttribute("http.target", r.URL.RequestURI())
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(contextWithSpan(r.Context(), s)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.SetAttribute("http.status_code", rec.status)
+		if rec.status >= 500 {
+			s.SetError(fmt.Errorf("%d %s", rec.status, http.StatusText(rec.status)))
+		}
+		s.End()
+	})
+}
+
+// recordQuerySpan はクエリの子スパンを記録する
+func recordQuerySpan(ctx context.Context, ev QueryEvent) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return
+	}
+	s := newSpan(parent.sc, ev.Statement, spanKindClient, ev.Start)
+	s.SetAttribute("db.system", "mysql")
+	s.SetAttribute("db.statement", ev.Query)
+	s.SetError(ev.Err)
+	s.End()
+}
+
+// spanExporter は終わったスパンを書き出す
+type spanExporter interface {
+	Export(spans []*Span) error
+}
+
+type spanBatcher struct {
+	mu       sync.Mutex
+	exporter spanExporter
+	queue    chan *Span
+	flushed  chan chan struct{}
+}
+
+var tracer = &spanBatcher{}
+
+func (b *spanBatcher) enabled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.exporter != nil
+}
+
+func (b *spanBatcher) enqueue(s *Span) {
+	select {
+	case b.queue <- s:
+	default:
+		// 書き出しが追いつかなければ捨てる
+	}
+}
+
+func (b *spanBatcher) start(exporter spanExporter) {
+	b.mu.Lock()
+	b.exporter = exporter
+	b.queue = make(chan *Span, traceBatchSize*4)
+	b.flushed = make(chan chan struct{})
+	b.mu.Unlock()
+	go b.run()
+}
+
+func (b *spanBatcher) run() {
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, traceBatchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := b.exporter.Export(batch); err != nil {
+			logger.Error("failed to export spans", "spans", len(batch), "error", err)
+		}
+		batch = make([]*Span, 0, traceBatchSize)
+	}
+	for {
+		select {
+		case s := <-b.queue:
+			batch = append(batch, s)
+			if len(batch) >= traceBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case done := <-b.flushed:
+			for len(b.queue) > 0 {
+				batch = append(batch, <-b.queue)
+			}
+			export()
+			close(done)
+		}
+	}
+}
+
+// flush はたまっているスパンを書き出す (終了時に呼ぶ)
+func (b *spanBatcher) flush() {
+	if !b.enabled() {
+		return
+	}
+	done := make(chan struct{})
+	b.flushed <- done
+	<-done
+}
+
+// OTLP/JSON (opentelemetry/proto/collector/trace/v1 の ExportTraceServiceRequest)
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attrs))
+	for k, v := range attrs {
+		out = append(out, otlpAttribute{Key: k, Value: otlpValue(v)})
+	}
+	return out
+}
+
+// otlpEncode は spans を service のスパンとして ExportTraceServiceRequest にする
+func otlpEncode(service string, spans []*Span) otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.sc.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.sc.SpanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+		}
+		if s.parent != (spanID{}) {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != "" {
+			o.Status = otlpStatus{Code: spanStatusError, Message: s.err}
+		}
+		s.mu.Unlock()
+		out = append(out, o)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes(map[string]interface{}{"service.name": service})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "isutrain"},
+			Spans: out,
+		}},
+	}}}
+}
+
+// fileExporter は OTLP/JSON を1行ずつファイルに追記する
+type fileExporter struct {
+	service string
+	path    string
+}
+
+func (e fileExporter) Export(spans []*Span) error {
+	b, err := json.Marshal(otlpEncode(e.service, spans))
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(e.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// otlpHTTPExporter は OTLP/HTTP (JSON) で collector に送る
+type otlpHTTPExporter struct {
+	service  string
+	endpoint string
+	client   *http.Client
+}
+
+func (e otlpHTTPExporter) Export(spans []*Span) error {
+	b, err := json.Marshal(otlpEncode(e.service, spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(strings.TrimSuffix(e.endpoint, "/")+"/v1/traces", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp endpoint returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// 設定からトレースの書き出し先を設定する
+func configureTracing(cfg TracingConfig) error {
+	var exporter spanExporter
+	switch cfg.Exporter {
+	case "", "none":
+		return nil
+	case "file":
+		exporter = fileExporter{service: cfg.ServiceName, path: cfg.File}
+	case "otlp":
+		exporter = otlpHTTPExporter{service: cfg.ServiceName, endpoint: cfg.Endpoint, client: &http.Client{Timeout: 5 * time.Second}}
+	default:
+		return fmt.Errorf("unknown tracing exporter %q", cfg.Exporter)
+	}
+	tracer.start(exporter)
+	queryObservers = append(queryObservers, recordQuerySpan)
+	return nil
+}
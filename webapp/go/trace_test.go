@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	goji "goji.io"
+	"goji.io/pat"
+)
+
+// recordingExporter は書き出されたスパンを覚えておく
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *recordingExporter) Export(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordingExporter) byName(name string) *Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range e.spans {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// startTestTracer はスパンを exporter に書き出すようにし、元に戻す関数を返す
+func startTestTracer(exporter spanExporter) func() {
+	saved := tracer
+	tracer = &spanBatcher{}
+	tracer.start(exporter)
+	return func() { tracer = saved }
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok {
+		t.Fatal("valid traceparent rejected")
+	}
+	if hex.EncodeToString(sc.TraceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" || hex.EncodeToString(sc.SpanID[:]) != "00f067aa0ba902b7" {
+		t.Errorf("sc = %+v", sc)
+	}
+	if got := sc.traceparent(); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("traceparent = %q", got)
+	}
+
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, ok := parseTraceparent(s); ok {
+			t.Errorf("parseTraceparent(%q) accepted", s)
+		}
+	}
+}
+
+func TestTracingPropagatesToPayment(t *testing.T) {
+	exporter := &recordingExporter{}
+	defer startTestTracer(exporter)()
+
+	var received string
+	payment := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("traceparent")
+		w.Write([]byte("{}"))
+	}))
+	defer payment.Close()
+
+	mux := goji.NewMux()
+	mux.Use(tracingMiddleware)
+	mux.HandleFunc(pat.Post("/api/train/reservation/commit"), func(w http.ResponseWriter, r *http.Request) {
+		observeQuery(r.Context(), "SELECT * FROM reservations WHERE reservation_id=?", time.Now(), nil)
+		resp, err := postPayment(r.Context(), payment.URL+"/payment", []byte("{}"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	})
+	saved := queryObservers
+	queryObservers = []func(ctx context.Context, ev QueryEvent){recordQuerySpan}
+	defer func() { queryObservers = saved }()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/train/reservation/commit", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	tracer.flush()
+
+	server := exporter.byName("POST /api/train/reservation/commit")
+	query := exporter.byName("select reservations")
+	client := exporter.byName("payment pay")
+	if server == nil || query == nil || client == nil {
+		t.Fatalf("spans = %+v", exporter.spans)
+	}
+	if hex.EncodeToString(server.sc.TraceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" || hex.EncodeToString(server.parent[:]) != "00f067aa0ba902b7" {
+		t.Errorf("server span did not continue the incoming trace: %+v", server.sc)
+	}
+	if query.parent != server.sc.SpanID || client.parent != server.sc.SpanID {
+		t.Error("query and payment spans should be children of the request span")
+	}
+	if client.sc.TraceID != server.sc.TraceID || received != client.sc.traceparent() {
+		t.Errorf("payment received traceparent %q, want %q", received, client.sc.traceparent())
+	}
+	if server.attributes["http.status_code"] != http.StatusOK || client.attributes["http.status_code"] != http.StatusOK {
+		t.Errorf("status codes = %v, %v", server.attributes["http.status_code"], client.attributes["http.status_code"])
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	ctx, span := startSpan(context.Background(), "noop", spanKindClient)
+	if span != nil || spanFromContext(ctx) != nil {
+		t.Error("no span should be started while tracing is disabled")
+	}
+	// nil のスパンに対する操作は何もしない
+	span.SetAttribute("k", "v")
+	span.SetError(os.ErrNotExist)
+	span.End()
+}
+
+func TestFileExporter(t *testing.T) {
+	f, err := ioutil.TempFile("", "traces-*.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	parent := newSpan(spanContext{}, "GET /api/settings", spanKindServer, time.Now())
+	child := newSpan(parent.sc, "select users", spanKindClient, time.Now())
+	child.SetAttribute("db.system", "mysql")
+	child.SetError(os.ErrNotExist)
+	parent.end, child.end = time.Now(), time.Now()
+
+	e := fileExporter{service: "isutrain-webapp", path: f.Name()}
+	if err := e.Export([]*Span{child, parent}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Export([]*Span{parent}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	lines := []otlpRequest{}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		req := otlpRequest{}
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, req)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("lines = %d, want 2", len(lines))
+	}
+	rs := lines[0].ResourceSpans[0]
+	if rs.Resource.Attributes[0].Key != "service.name" || rs.Resource.Attributes[0].Value["stringValue"] != "isutrain-webapp" {
+		t.Errorf("resource = %+v", rs.Resource)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 || spans[0].ParentSpanID != spans[1].SpanID || spans[0].TraceID != spans[1].TraceID || spans[1].ParentSpanID != "" {
+		t.Errorf("spans = %+v", spans)
+	}
+	if spans[0].Kind != spanKindClient || spans[0].Status.Code != spanStatusError || len(spans[0].Attributes) != 1 {
+		t.Errorf("child = %+v", spans[0])
+	}
+}
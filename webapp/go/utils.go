@@ -1,18 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"time"
 )
 
-func checkAvailableDate(date time.Time) bool {
-	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
-	t := time.Date(2020, 1, 1, 0, 0, 0, 0, jst)
-	t = t.AddDate(0, 0, availableDays)
-
-	return date.Before(t)
-}
-
 func getUsableTrainClassList(fromStation Station, toStation Station) []string {
 	usable := map[string]string{}
 
@@ -48,16 +40,11 @@ func getUsableTrainClassList(fromStation Station, toStation Station) []string {
 	return ret
 }
 
-func (train Train) getAvailableSeats(fromStation Station, toStation Station, seatClass string, isSmokingSeat bool) ([]Seat, error) {
+func (train Train) getAvailableSeats(ctx context.Context, fromStation Station, toStation Station, seatClass string, isSmokingSeat bool) ([]Seat, error) {
 	// 指定種別の空き座席を返す
 
-	var err error
-
 	// 全ての座席を取得する
-	query := "SELECT * FROM seat_master WHERE train_class=? AND seat_class=? AND is_smoking_seat=?"
-
-	seatList := []Seat{}
-	err = dbx.Select(&seatList, query, train.TrainClass, seatClass, isSmokingSeat)
+	seatList, err := repo.ListSeats(ctx, SeatFilter{TrainClass: train.TrainClass, SeatClass: seatClass, IsSmokingSeat: &isSmokingSeat})
 	if err != nil {
 		return nil, err
 	}
@@ -68,27 +55,7 @@ func (train Train) getAvailableSeats(fromStation Station, toStation Station, sea
 	}
 
 	// すでに取られている予約を取得する
-	query = `
-	SELECT sr.reservation_id, sr.car_number, sr.seat_row, sr.seat_column
-	FROM seat_reservations sr, reservations r, seat_master s, station_master std, station_master sta
-	WHERE
-		r.reservation_id=sr.reservation_id AND
-		s.train_class=r.train_class AND
-		s.car_number=sr.car_number AND
-		s.seat_column=sr.seat_column AND
-		s.seat_row=sr.seat_row AND
-		std.name=r.departure AND
-		sta.name=r.arrival
-	`
-
-	if train.IsNobori {
-		query += "AND ((sta.id < ? AND ? <= std.id) OR (sta.id < ? AND ? <= std.id) OR (? < sta.id AND std.id < ?))"
-	} else {
-		query += "AND ((std.id <= ? AND ? < sta.id) OR (std.id <= ? AND ? < sta.id) OR (sta.id < ? AND ? < std.id))"
-	}
-
-	seatReservationList := []SeatReservation{}
-	err = dbx.Select(&seatReservationList, query, fromStation.ID, fromStation.ID, toStation.ID, toStation.ID, fromStation.ID, toStation.ID)
+	seatReservationList, err := repo.ListSeatReservationsInSection(ctx, train.IsNobori, fromStation, toStation)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	リクエストの入力検証
+
+	構造体フィールドの `validate` タグに規則をカンマ区切りで書く
+		required       ゼロ値を許さない
+		min=N, max=N   数値は値、文字列とスライスは長さの範囲
+		oneof=a b c    列挙値のいずれか
+		rfc3339        RFC3339形式の日時文字列
+		dive           スライスの各要素を再帰的に検証する
+	その他の規則名は validationRules に登録された関数で検証する
+
+	フィールドをまたぐ検証は Validate() ValidationErrors を実装して行う
+*/
+
+const maxPartySize = 10
+
+var SeatClassList = []string{"premium", "reserved", "non-reserved"}
+
+type FieldError struct {
+	Field string `json:"field"`
+	Rule  string `json:"rule"`
+	Param string `json:"param,omitempty"`
+}
+
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msgs = append(msgs, e.Field+": "+e.Message("en"))
+	}
+	return strings.Join(msgs, ", ")
+}
+
+type crossFieldValidator interface {
+	Validate() ValidationErrors
+}
+
+var validationRules = map[string]func(v reflect.Value) bool{
+	"train_class": func(v reflect.Value) bool {
+		return isTrainClassName(v.String())
+	},
+	"seat_class": func(v reflect.Value) bool {
+		return containsString(SeatClassList, v.String())
+	},
+	"api_token_scopes": func(v reflect.Value) bool {
+		for i := 0; i < v.Len(); i++ {
+			if !containsString(APITokenScopeList, v.Index(i).String()) {
+				return false
+			}
+		}
+		return true
+	},
+	"train_classes": func(v reflect.Value) bool {
+		for i := 0; i < v.Len(); i++ {
+			if !isTrainClassName(v.Index(i).String()) {
+				return false
+			}
+		}
+		return true
+	},
+	"seat_classes": func(v reflect.Value) bool {
+		for i := 0; i < v.Len(); i++ {
+			if !containsString(SeatClassList, v.Index(i).String()) {
+				return false
+			}
+		}
+		return true
+	},
+	"passengers": func(v reflect.Value) bool {
+		for _, key := range v.MapKeys() {
+			n := v.MapIndex(key).Int()
+			if _, ok := findPassengerCategory(key.String()); !ok || n < 0 || n > maxPartySize {
+				return false
+			}
+		}
+		return true
+	},
+	"date": func(v reflect.Value) bool {
+		_, err := time.Parse("2006-01-02", v.String())
+		return err == nil
+	},
+	"promo_code": func(v reflect.Value) bool {
+		return promoCodePattern.MatchString(v.String())
+	},
+	"http_url": func(v reflect.Value) bool {
+		return isHTTPURL(v.String())
+	},
+	"duration": func(v reflect.Value) bool {
+		_, err := time.ParseDuration(v.String())
+		return err == nil
+	},
+}
+
+var fieldErrorMessages = map[string][2]string{
+	"required":    {"必須項目です", "is required"},
+	"min":         {"%s以上で指定してください", "must be at least %s"},
+	"max":         {"%s以下で指定してください", "must be at most %s"},
+	"oneof":       {"%sのいずれかを指定してください", "must be one of %s"},
+	"rfc3339":     {"RFC3339形式の日時で指定してください", "must be an RFC3339 date-time"},
+	"integer":     {"整数で指定してください", "must be an integer"},
+	"train_class": {"列車クラスが不明です", "is not a known train class"},
+	"seat_class":  {"座席クラスが不明です", "is not a known seat class"},
+	"party_size":  {"人数は合計1名以上%s名以下で指定してください", "party size must be between 1 and %s"},
+	"seat_count":  {"座席数は人数の合計(%s)と一致させてください", "must have as many seats as passengers (%s)"},
+
+	"passengers":          {"旅客区分が不明か、人数が範囲外です", "contains an unknown category or an out-of-range count"},
+	"passengers_conflict": {"passengersの人数と一致しません", "does not match the count in passengers"},
+
+	"api_token_scopes": {"スコープが不明です", "contains an unknown scope"},
+
+	"date":          {"YYYY-MM-DD形式の日付で指定してください", "must be a date in YYYY-MM-DD format"},
+	"after":         {"%sより後を指定してください", "must be after %s"},
+	"train_classes": {"列車クラスが不明です", "contains an unknown train class"},
+	"seat_classes":  {"座席クラスが不明です", "contains an unknown seat class"},
+	"promo_code":    {"英大文字・数字・-・_の3〜32文字で指定してください", "must be 3-32 characters of A-Z, 0-9, - or _"},
+
+	"duration": {"72h、90m のような時間の長さで指定してください", "must be a duration such as 72h or 90m"},
+	"http_url": {"http:// または https:// で始まるURLを指定してください", "must be an http or https URL"},
+
+	"email":                  {"メールアドレスの形式が不正です", "is not a valid email address"},
+	"password_min_length":    {"パスワードは%s文字以上にしてください", "must be at least %s characters"},
+	"password_max_length":    {"パスワードは%s文字以下にしてください", "must be at most %s characters"},
+	"password_denylisted":    {"このパスワードは漏洩が確認されているため使用できません", "appears in a list of breached passwords"},
+	"password_same_as_email": {"パスワードにメールアドレスは使用できません", "must not be the same as the email address"},
+}
+
+func (e FieldError) Message(lang string) string {
+	msgs, ok := fieldErrorMessages[e.Rule]
+	if !ok {
+		msgs = [2]string{"値が不正です", "is invalid"}
+	}
+	format := msgs[0]
+	if lang == "en" {
+		format = msgs[1]
+	}
+	if strings.Contains(format, "%s") {
+		return fmt.Sprintf(format, e.Param)
+	}
+	return format
+}
+
+func isTrainClassName(s string) bool {
+	for _, name := range TrainClassMap {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func validateStruct(s interface{}) ValidationErrors {
+	errs := ValidationErrors{}
+	validateValue(reflect.ValueOf(s), "", &errs)
+	return errs
+}
+
+func validateValue(v reflect.Value, prefix string, errs *ValidationErrors) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("validate")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + fieldName(f)
+		validateField(v.Field(i), name, strings.Split(tag, ","), errs)
+	}
+
+	if cv, ok := v.Interface().(crossFieldValidator); ok {
+		for _, e := range cv.Validate() {
+			e.Field = prefix + e.Field
+			*errs = append(*errs, e)
+		}
+	}
+}
+
+func validateField(v reflect.Value, name string, rules []string, errs *ValidationErrors) {
+	for _, rule := range rules {
+		ruleName, param := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			ruleName, param = rule[:i], rule[i+1:]
+		}
+
+		if ruleName == "required" {
+			if isZeroValue(v) {
+				*errs = append(*errs, FieldError{name, "required", ""})
+				return
+			}
+			continue
+		}
+		// 任意項目は未指定なら以降の規則を適用しない (数値の0は範囲チェックする)
+		if v.Kind() == reflect.String && v.Len() == 0 {
+			return
+		}
+
+		ok := true
+		switch ruleName {
+		case "min", "max":
+			n, err := strconv.Atoi(param)
+			if err != nil {
+				panic(fmt.Sprintf("validate: bad %s param %q on %s", ruleName, param, name))
+			}
+			size := valueSize(v)
+			ok = (ruleName == "min" && size >= n) || (ruleName == "max" && size <= n)
+		case "oneof":
+			ok = containsString(strings.Fields(param), fmt.Sprint(v.Interface()))
+			param = strings.Join(strings.Fields(param), ", ")
+		case "rfc3339":
+			_, err := time.Parse(time.RFC3339, v.String())
+			ok = err == nil
+		case "dive":
+			for i := 0; i < v.Len(); i++ {
+				validateValue(v.Index(i), fmt.Sprintf("%s[%d].", name, i), errs)
+			}
+		default:
+			fn, found := validationRules[ruleName]
+			if !found {
+				panic(fmt.Sprintf("validate: unknown rule %q on %s", ruleName, name))
+			}
+			ok = fn(v)
+		}
+		if !ok {
+			*errs = append(*errs, FieldError{name, ruleName, param})
+			return
+		}
+	}
+}
+
+func isZeroValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+func valueSize(v reflect.Value) int {
+	switch v.Kind() {
+	case reflect.String:
+		return len([]rune(v.String()))
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(v.Uint())
+	}
+	return 0
+}
+
+func fieldName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		return f.Name
+	}
+	return name
+}
+
+func validationErrorResponse(w http.ResponseWriter, r *http.Request, errs ValidationErrors) {
+	lang := preferredLanguage(r)
+
+	type fieldErrorResponse struct {
+		FieldError
+		Message string `json:"message"`
+	}
+	list := make([]fieldErrorResponse, 0, len(errs))
+	for _, e := range errs {
+		list = append(list, fieldErrorResponse{e, e.Message(lang)})
+	}
+
+	e := map[string]interface{}{
+		"is_error": true,
+		"code":     ErrValidationFailed,
+		"message":  ErrValidationFailed.Message(lang),
+		"errors":   list,
+	}
+	errResp, _ := json.Marshal(e)
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(ErrValidationFailed.Status())
+	w.Write(errResp)
+}
+
+// passengerCounts は adult / child フィールドを含めた区分ごとの人数
+func (req TrainReservationRequest) passengerCounts() PassengerCounts {
+	return mergeLegacyCounts(req.Passengers, req.Adult, req.Child)
+}
+
+// TrainReservationRequest のフィールドをまたぐ検証
+func (req TrainReservationRequest) Validate() ValidationErrors {
+	errs := legacyCountErrors(req.Passengers, req.Adult, req.Child)
+	party := req.passengerCounts().Total()
+	if party < 1 || party > maxPartySize {
+		errs = append(errs, FieldError{"adult", "party_size", strconv.Itoa(maxPartySize)})
+	}
+	// 座席指定なしはあいまい予約
+	if len(req.Seats) > 0 && len(req.Seats) != party {
+		errs = append(errs, FieldError{"seats", "seat_count", strconv.Itoa(party)})
+	}
+	return errs
+}
+
+// TrainSearchQuery は GET /api/train/search のクエリパラメータ
+type TrainSearchQuery struct {
+	UseAt      string `json:"use_at" validate:"required,rfc3339"`
+	TrainClass string `json:"train_class" validate:"train_class"`
+	From       string `json:"from" validate:"required"`
+	To         string `json:"to" validate:"required"`
+	Adult      int    `json:"adult" validate:"min=0,max=10"`
+	Child      int    `json:"child" validate:"min=0,max=10"`
+	// 大人・子供以外の区分の人数 (区分名のクエリパラメータで指定する)
+	Passengers PassengerCounts `json:"passengers" validate:"passengers"`
+
+	parseErrors ValidationErrors
+}
+
+func parseTrainSearchQuery(r *http.Request) (TrainSearchQuery, ValidationErrors) {
+	q := r.URL.Query()
+	query := TrainSearchQuery{
+		UseAt:      q.Get("use_at"),
+		TrainClass: q.Get("train_class"),
+		From:       q.Get("from"),
+		To:         q.Get("to"),
+	}
+	query.Adult = query.intParam(q.Get("adult"), "adult")
+	query.Child = query.intParam(q.Get("child"), "child")
+	query.Passengers = PassengerCounts{}
+	for _, c := range passengerCategories {
+		if c.Name == "adult" || c.Name == "child" {
+			continue
+		}
+		if n := query.intParam(q.Get(c.Name), c.Name); n != 0 {
+			query.Passengers[c.Name] = n
+		}
+	}
+
+	return query, validateStruct(query)
+}
+
+// 未指定は0として扱い、数値でないものはエラーにする
+func (query *TrainSearchQuery) intParam(s, name string) int {
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		query.parseErrors = append(query.parseErrors, FieldError{name, "integer", ""})
+		return 0
+	}
+	return n
+}
+
+func (query TrainSearchQuery) passengerCounts() PassengerCounts {
+	return mergeLegacyCounts(query.Passengers, query.Adult, query.Child)
+}
+
+func (query TrainSearchQuery) Validate() ValidationErrors {
+	errs := append(ValidationErrors{}, query.parseErrors...)
+	if query.passengerCounts().Total() > maxPartySize {
+		errs = append(errs, FieldError{"adult", "party_size", strconv.Itoa(maxPartySize)})
+	}
+	return errs
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func validReservationRequest() *TrainReservationRequest {
+	return &TrainReservationRequest{
+		Date:       "2020-01-06T10:33:57+09:00",
+		TrainName:  "10",
+		TrainClass: "遅いやつ",
+		CarNumber:  8,
+		SeatClass:  "premium",
+		Departure:  "芋呉川",
+		Arrival:    "葉千",
+		Adult:      1,
+		Child:      1,
+		Seats:      []RequestSeat{{2, "A"}, {2, "B"}},
+	}
+}
+
+func TestValidateTrainReservationRequest(t *testing.T) {
+	if errs := validateStruct(validReservationRequest()); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	req := validReservationRequest()
+	req.Date = "2020/01/06"
+	req.TrainClass = "のぞみ"
+	req.SeatClass = "green"
+	req.Adult = 11
+	req.Seats = []RequestSeat{{0, ""}}
+
+	got := validateStruct(req)
+	want := ValidationErrors{
+		{"date", "rfc3339", ""},
+		{"train_class", "train_class", ""},
+		{"seat_class", "seat_class", ""},
+		{"adult", "max", "10"},
+		{"seats[0].row", "min", "1"},
+		{"seats[0].column", "required", ""},
+		{"adult", "party_size", "10"},
+		{"seats", "seat_count", "12"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestValidateTrainReservationRequestVagueSeats(t *testing.T) {
+	req := validReservationRequest()
+	req.Seats = nil
+	req.Column = "A"
+	if errs := validateStruct(req); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	req.Adult, req.Child = 0, 0
+	errs := validateStruct(req)
+	if len(errs) != 1 || errs[0].Rule != "party_size" {
+		t.Fatalf("got %v", errs)
+	}
+}
+
+func TestValidateTrainReservationRequestPassengers(t *testing.T) {
+	req := validReservationRequest()
+	req.Adult, req.Child = 0, 0
+	req.Passengers = PassengerCounts{"senior": 1, "student": 1}
+	if errs := validateStruct(req); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	req.Passengers = PassengerCounts{"senior": 1, "pet": 1}
+	req.Seats = []RequestSeat{{2, "A"}, {2, "B"}}
+	errs := validateStruct(req)
+	if len(errs) != 1 || errs[0].Rule != "passengers" {
+		t.Fatalf("got %v", errs)
+	}
+
+	req.Passengers = PassengerCounts{"adult": 2}
+	req.Adult = 1
+	errs = validateStruct(req)
+	if len(errs) != 1 || errs[0].Field != "adult" || errs[0].Rule != "passengers_conflict" {
+		t.Fatalf("got %v", errs)
+	}
+}
+
+func TestParseTrainSearchQuery(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/train/search?use_at=2020-01-01T10:00:00%2B09:00&from=東京&to=大阪&adult=x&child=1", nil)
+	_, errs := parseTrainSearchQuery(r)
+	if len(errs) != 1 || errs[0].Field != "adult" || errs[0].Rule != "integer" {
+		t.Fatalf("got %v", errs)
+	}
+
+	r = httptest.NewRequest("GET", "/api/train/search?use_at=2020-01-01T10:00:00%2B09:00&from=東京&to=大阪", nil)
+	q, errs := parseTrainSearchQuery(r)
+	if len(errs) != 0 || q.Adult != 0 || q.Child != 0 {
+		t.Fatalf("got %v %v", q, errs)
+	}
+
+	r = httptest.NewRequest("GET", "/api/train/search?use_at=2020-01-01T10:00:00%2B09:00&from=東京&to=大阪&adult=1&senior=2", nil)
+	q, errs = parseTrainSearchQuery(r)
+	if len(errs) != 0 || !reflect.DeepEqual(q.passengerCounts(), PassengerCounts{"adult": 1, "senior": 2}) {
+		t.Fatalf("got %v %v", q, errs)
+	}
+}
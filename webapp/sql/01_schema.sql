@@ -27,7 +27,13 @@ CREATE TABLE `reservations` (
   `payment_id` varchar(100) NOT NULL,
   `adult` int NOT NULL,
   `child` int NOT NULL,
-  `amount` bigint NOT NULL
+  `passengers` varchar(255) NOT NULL DEFAULT '',
+  `amount` bigint NOT NULL,
+  `promotion_id` bigint NULL,
+  `discount` bigint NOT NULL DEFAULT 0,
+  `points_used` bigint NOT NULL DEFAULT 0,
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `paid_at` datetime NULL
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 DROP TABLE IF EXISTS `seat_master`;
@@ -58,6 +64,15 @@ CREATE TABLE `station_master` (
   `is_stop_local` tinyint(1) NOT NULL
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
+DROP TABLE IF EXISTS `station_aliases`;
+CREATE TABLE `station_aliases` (
+  `station_id` bigint NOT NULL,
+  `kind` enum('kana', 'romaji', 'english') NOT NULL,
+  `alias` varchar(100) NOT NULL,
+  PRIMARY KEY (`station_id`, `kind`),
+  KEY `idx_station_aliases_alias` (`alias`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
 DROP TABLE IF EXISTS `train_master`;
 CREATE TABLE `train_master` (
   `date` date NOT NULL,
@@ -84,5 +99,145 @@ CREATE TABLE `users` (
   `id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `email` varchar(300) NOT NULL UNIQUE,
   `salt` varbinary(1024) NOT NULL,
-  `super_secure_password` varbinary(256) NOT NULL
+  `super_secure_password` varbinary(256) NOT NULL,
+  `email_verified_at` datetime NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+DROP TABLE IF EXISTS `sessions`;
+CREATE TABLE `sessions` (
+  `id` varchar(64) NOT NULL PRIMARY KEY,
+  `user_id` bigint NOT NULL DEFAULT 0,
+  `data` blob NOT NULL,
+  `created_at` datetime(6) NOT NULL,
+  `last_seen_at` datetime(6) NOT NULL,
+  KEY `idx_sessions_user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+DROP TABLE IF EXISTS `login_failures`;
+CREATE TABLE `login_failures` (
+  `id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `throttle_key` varchar(320) NOT NULL,
+  `failed_at` datetime(6) NOT NULL,
+  KEY `idx_login_failures_key` (`throttle_key`, `failed_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+DROP TABLE IF EXISTS `login_lockouts`;
+CREATE TABLE `login_lockouts` (
+  `throttle_key` varchar(320) NOT NULL PRIMARY KEY,
+  `locked_until` datetime(6) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+DROP TABLE IF EXISTS `api_tokens`;
+CREATE TABLE `api_tokens` (
+  `id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` bigint NOT NULL,
+  `name` varchar(100) NOT NULL,
+  `token_hash` char(64) NOT NULL UNIQUE,
+  `prefix` varchar(16) NOT NULL,
+  `scopes` varchar(255) NOT NULL,
+  `created_at` datetime NOT NULL,
+  `last_used_at` datetime(6) NULL,
+  `expires_at` datetime NULL,
+  `revoked_at` datetime(6) NULL,
+  KEY `idx_api_tokens_user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+DROP TABLE IF EXISTS `api_token_usages`;
+CREATE TABLE `api_token_usages` (
+  `id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `token_id` bigint NOT NULL,
+  `used_at` datetime(6) NOT NULL,
+  `method` varchar(10) NOT NULL,
+  `path` varchar(255) NOT NULL,
+  `remote_ip` varchar(45) NOT NULL,
+  KEY `idx_api_token_usages_token_id` (`token_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+DROP TABLE IF EXISTS `email_tokens`;
+CREATE TABLE `email_tokens` (
+  `id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` bigint NOT NULL,
+  `purpose` varchar(32) NOT NULL,
+  `token_hash` char(64) NOT NULL UNIQUE,
+  `created_at` datetime(6) NOT NULL,
+  `expires_at` datetime(6) NOT NULL,
+  `used_at` datetime(6) NULL,
+  KEY `idx_email_tokens_user_id` (`user_id`, `purpose`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+DROP TABLE IF EXISTS `calendar_tokens`;
+CREATE TABLE `calendar_tokens` (
+  `user_id` bigint NOT NULL PRIMARY KEY,
+  `token_hash` char(64) NOT NULL UNIQUE,
+  `created_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+DROP TABLE IF EXISTS `ticket_usages`;
+CREATE TABLE `ticket_usages` (
+  `reservation_id` bigint NOT NULL PRIMARY KEY,
+  `entry_station` varchar(100) NOT NULL,
+  `entered_at` datetime NOT NULL,
+  `exit_station` varchar(100) DEFAULT NULL,
+  `exited_at` datetime DEFAULT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+DROP TABLE IF EXISTS `promotions`;
+CREATE TABLE `promotions` (
+  `id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `code` varchar(64) NOT NULL UNIQUE,
+  `description` varchar(255) NOT NULL DEFAULT '',
+  `discount_type` enum('percent', 'fixed') NOT NULL,
+  `discount_value` int NOT NULL,
+  `starts_at` datetime NULL,
+  `ends_at` datetime NULL,
+  `max_redemptions` int NOT NULL DEFAULT 0,
+  `max_redemptions_per_user` int NOT NULL DEFAULT 0,
+  `redemption_count` int NOT NULL DEFAULT 0,
+  `train_classes` varchar(255) NOT NULL DEFAULT '',
+  `seat_classes` varchar(255) NOT NULL DEFAULT '',
+  `departure_station` varchar(100) NOT NULL DEFAULT '',
+  `arrival_station` varchar(100) NOT NULL DEFAULT '',
+  `travel_date_from` date NULL,
+  `travel_date_to` date NULL,
+  `created_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+DROP TABLE IF EXISTS `promotion_redemptions`;
+CREATE TABLE `promotion_redemptions` (
+  `reservation_id` bigint NOT NULL PRIMARY KEY,
+  `promotion_id` bigint NOT NULL,
+  `user_id` bigint NOT NULL,
+  `discount` int NOT NULL,
+  `created_at` datetime NOT NULL,
+  KEY `idx_promotion_redemptions_user` (`promotion_id`, `user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+DROP TABLE IF EXISTS `point_ledger`;
+CREATE TABLE `point_ledger` (
+  `id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` bigint NOT NULL,
+  `reservation_id` bigint NULL,
+  `kind` enum('earn', 'redeem', 'reverse', 'restore', 'adjust', 'expire') NOT NULL,
+  `points` int NOT NULL,
+  `remaining` int NOT NULL DEFAULT 0,
+  `expires_at` datetime NULL,
+  `note` varchar(255) NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL,
+  KEY `idx_point_ledger_user_id` (`user_id`, `expires_at`),
+  KEY `idx_point_ledger_reservation_id` (`reservation_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+DROP TABLE IF EXISTS `reservation_window`;
+CREATE TABLE `reservation_window` (
+  `id` int NOT NULL PRIMARY KEY,
+  `open_date` varchar(10) NOT NULL DEFAULT '',
+  `days_ahead` int NOT NULL,
+  `sales_cutoff_minutes` int NULL,
+  `updated_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+DROP TABLE IF EXISTS `reservation_closed_dates`;
+CREATE TABLE `reservation_closed_dates` (
+  `date` varchar(10) NOT NULL PRIMARY KEY,
+  `note` varchar(255) NOT NULL DEFAULT ''
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
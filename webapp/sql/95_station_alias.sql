@@ -0,0 +1,253 @@
+use isutrain;
+SET CHARACTER_SET_CLIENT = utf8;
+SET CHARACTER_SET_CONNECTION = utf8;
+
+INSERT INTO station_aliases(station_id,kind,alias)
+SELECT s.id, a.kind, a.alias FROM station_master s JOIN (
+	SELECT "東京" AS name, "kana" AS kind, "とうきょう" AS alias
+	UNION ALL SELECT "東京" AS name, "romaji" AS kind, "toukyou" AS alias
+	UNION ALL SELECT "東京" AS name, "english" AS kind, "Tokyo" AS alias
+	UNION ALL SELECT "古岡" AS name, "kana" AS kind, "ふるおか" AS alias
+	UNION ALL SELECT "古岡" AS name, "romaji" AS kind, "furuoka" AS alias
+	UNION ALL SELECT "古岡" AS name, "english" AS kind, "Furuoka" AS alias
+	UNION ALL SELECT "絵寒町" AS name, "kana" AS kind, "えさむちょう" AS alias
+	UNION ALL SELECT "絵寒町" AS name, "romaji" AS kind, "esamuchou" AS alias
+	UNION ALL SELECT "絵寒町" AS name, "english" AS kind, "Esamucho" AS alias
+	UNION ALL SELECT "沙芦公園" AS name, "kana" AS kind, "さろこうえん" AS alias
+	UNION ALL SELECT "沙芦公園" AS name, "romaji" AS kind, "sarokouen" AS alias
+	UNION ALL SELECT "沙芦公園" AS name, "english" AS kind, "Sarokoen" AS alias
+	UNION ALL SELECT "形顔" AS name, "kana" AS kind, "かたがお" AS alias
+	UNION ALL SELECT "形顔" AS name, "romaji" AS kind, "katagao" AS alias
+	UNION ALL SELECT "形顔" AS name, "english" AS kind, "Katagao" AS alias
+	UNION ALL SELECT "油交" AS name, "kana" AS kind, "ゆこう" AS alias
+	UNION ALL SELECT "油交" AS name, "romaji" AS kind, "yukou" AS alias
+	UNION ALL SELECT "油交" AS name, "english" AS kind, "Yuko" AS alias
+	UNION ALL SELECT "通墨山" AS name, "kana" AS kind, "つずみやま" AS alias
+	UNION ALL SELECT "通墨山" AS name, "romaji" AS kind, "tsuzumiyama" AS alias
+	UNION ALL SELECT "通墨山" AS name, "english" AS kind, "Tsuzumiyama" AS alias
+	UNION ALL SELECT "初野" AS name, "kana" AS kind, "はつの" AS alias
+	UNION ALL SELECT "初野" AS name, "romaji" AS kind, "hatsuno" AS alias
+	UNION ALL SELECT "初野" AS name, "english" AS kind, "Hatsuno" AS alias
+	UNION ALL SELECT "樺威学園" AS name, "kana" AS kind, "かばいがくえん" AS alias
+	UNION ALL SELECT "樺威学園" AS name, "romaji" AS kind, "kabaigakuen" AS alias
+	UNION ALL SELECT "樺威学園" AS name, "english" AS kind, "Kabaigakuen" AS alias
+	UNION ALL SELECT "塩鮫公園" AS name, "kana" AS kind, "しおざめこうえん" AS alias
+	UNION ALL SELECT "塩鮫公園" AS name, "romaji" AS kind, "shiozamekouen" AS alias
+	UNION ALL SELECT "塩鮫公園" AS name, "english" AS kind, "Shiozamekoen" AS alias
+	UNION ALL SELECT "山田" AS name, "kana" AS kind, "やまだ" AS alias
+	UNION ALL SELECT "山田" AS name, "romaji" AS kind, "yamada" AS alias
+	UNION ALL SELECT "山田" AS name, "english" AS kind, "Yamada" AS alias
+	UNION ALL SELECT "表岡" AS name, "kana" AS kind, "おもておか" AS alias
+	UNION ALL SELECT "表岡" AS name, "romaji" AS kind, "omoteoka" AS alias
+	UNION ALL SELECT "表岡" AS name, "english" AS kind, "Omoteoka" AS alias
+	UNION ALL SELECT "並取" AS name, "kana" AS kind, "なみとり" AS alias
+	UNION ALL SELECT "並取" AS name, "romaji" AS kind, "namitori" AS alias
+	UNION ALL SELECT "並取" AS name, "english" AS kind, "Namitori" AS alias
+	UNION ALL SELECT "細野" AS name, "kana" AS kind, "ほその" AS alias
+	UNION ALL SELECT "細野" AS name, "romaji" AS kind, "hosono" AS alias
+	UNION ALL SELECT "細野" AS name, "english" AS kind, "Hosono" AS alias
+	UNION ALL SELECT "住郷" AS name, "kana" AS kind, "すみさと" AS alias
+	UNION ALL SELECT "住郷" AS name, "romaji" AS kind, "sumisato" AS alias
+	UNION ALL SELECT "住郷" AS name, "english" AS kind, "Sumisato" AS alias
+	UNION ALL SELECT "管英" AS name, "kana" AS kind, "くだえ" AS alias
+	UNION ALL SELECT "管英" AS name, "romaji" AS kind, "kudae" AS alias
+	UNION ALL SELECT "管英" AS name, "english" AS kind, "Kudae" AS alias
+	UNION ALL SELECT "気川" AS name, "kana" AS kind, "きがわ" AS alias
+	UNION ALL SELECT "気川" AS name, "romaji" AS kind, "kigawa" AS alias
+	UNION ALL SELECT "気川" AS name, "english" AS kind, "Kigawa" AS alias
+	UNION ALL SELECT "桐飛" AS name, "kana" AS kind, "きりとび" AS alias
+	UNION ALL SELECT "桐飛" AS name, "romaji" AS kind, "kiritobi" AS alias
+	UNION ALL SELECT "桐飛" AS name, "english" AS kind, "Kiritobi" AS alias
+	UNION ALL SELECT "樫曲町" AS name, "kana" AS kind, "かしまがりちょう" AS alias
+	UNION ALL SELECT "樫曲町" AS name, "romaji" AS kind, "kashimagarichou" AS alias
+	UNION ALL SELECT "樫曲町" AS name, "english" AS kind, "Kashimagaricho" AS alias
+	UNION ALL SELECT "依酒山" AS name, "kana" AS kind, "よりさかやま" AS alias
+	UNION ALL SELECT "依酒山" AS name, "romaji" AS kind, "yorisakayama" AS alias
+	UNION ALL SELECT "依酒山" AS name, "english" AS kind, "Yorisakayama" AS alias
+	UNION ALL SELECT "堀切町" AS name, "kana" AS kind, "ほりきりちょう" AS alias
+	UNION ALL SELECT "堀切町" AS name, "romaji" AS kind, "horikirichou" AS alias
+	UNION ALL SELECT "堀切町" AS name, "english" AS kind, "Horikiricho" AS alias
+	UNION ALL SELECT "葉千" AS name, "kana" AS kind, "はせん" AS alias
+	UNION ALL SELECT "葉千" AS name, "romaji" AS kind, "hasen" AS alias
+	UNION ALL SELECT "葉千" AS name, "english" AS kind, "Hasen" AS alias
+	UNION ALL SELECT "奥山" AS name, "kana" AS kind, "おくやま" AS alias
+	UNION ALL SELECT "奥山" AS name, "romaji" AS kind, "okuyama" AS alias
+	UNION ALL SELECT "奥山" AS name, "english" AS kind, "Okuyama" AS alias
+	UNION ALL SELECT "鯉秋寺" AS name, "kana" AS kind, "りしゅうじ" AS alias
+	UNION ALL SELECT "鯉秋寺" AS name, "romaji" AS kind, "rishuuji" AS alias
+	UNION ALL SELECT "鯉秋寺" AS name, "english" AS kind, "Rishuji" AS alias
+	UNION ALL SELECT "伍出" AS name, "kana" AS kind, "ごで" AS alias
+	UNION ALL SELECT "伍出" AS name, "romaji" AS kind, "gode" AS alias
+	UNION ALL SELECT "伍出" AS name, "english" AS kind, "Gode" AS alias
+	UNION ALL SELECT "杏高公園" AS name, "kana" AS kind, "あんこうこうえん" AS alias
+	UNION ALL SELECT "杏高公園" AS name, "romaji" AS kind, "ankoukouen" AS alias
+	UNION ALL SELECT "杏高公園" AS name, "english" AS kind, "Ankokoen" AS alias
+	UNION ALL SELECT "荒川" AS name, "kana" AS kind, "あらかわ" AS alias
+	UNION ALL SELECT "荒川" AS name, "romaji" AS kind, "arakawa" AS alias
+	UNION ALL SELECT "荒川" AS name, "english" AS kind, "Arakawa" AS alias
+	UNION ALL SELECT "磯川" AS name, "kana" AS kind, "いそかわ" AS alias
+	UNION ALL SELECT "磯川" AS name, "romaji" AS kind, "isokawa" AS alias
+	UNION ALL SELECT "磯川" AS name, "english" AS kind, "Isokawa" AS alias
+	UNION ALL SELECT "茶川" AS name, "kana" AS kind, "ちゃかわ" AS alias
+	UNION ALL SELECT "茶川" AS name, "romaji" AS kind, "chakawa" AS alias
+	UNION ALL SELECT "茶川" AS name, "english" AS kind, "Chakawa" AS alias
+	UNION ALL SELECT "八実学園" AS name, "kana" AS kind, "やつみがくえん" AS alias
+	UNION ALL SELECT "八実学園" AS name, "romaji" AS kind, "yatsumigakuen" AS alias
+	UNION ALL SELECT "八実学園" AS name, "english" AS kind, "Yatsumigakuen" AS alias
+	UNION ALL SELECT "梓金" AS name, "kana" AS kind, "あずさがね" AS alias
+	UNION ALL SELECT "梓金" AS name, "romaji" AS kind, "azusagane" AS alias
+	UNION ALL SELECT "梓金" AS name, "english" AS kind, "Azusagane" AS alias
+	UNION ALL SELECT "鯉田" AS name, "kana" AS kind, "こいだ" AS alias
+	UNION ALL SELECT "鯉田" AS name, "romaji" AS kind, "koida" AS alias
+	UNION ALL SELECT "鯉田" AS name, "english" AS kind, "Koida" AS alias
+	UNION ALL SELECT "鳴門" AS name, "kana" AS kind, "なると" AS alias
+	UNION ALL SELECT "鳴門" AS name, "romaji" AS kind, "naruto" AS alias
+	UNION ALL SELECT "鳴門" AS name, "english" AS kind, "Naruto" AS alias
+	UNION ALL SELECT "曲徳町" AS name, "kana" AS kind, "まがとくちょう" AS alias
+	UNION ALL SELECT "曲徳町" AS name, "romaji" AS kind, "magatokuchou" AS alias
+	UNION ALL SELECT "曲徳町" AS name, "english" AS kind, "Magatokucho" AS alias
+	UNION ALL SELECT "彩岬山" AS name, "kana" AS kind, "あやみさきやま" AS alias
+	UNION ALL SELECT "彩岬山" AS name, "romaji" AS kind, "ayamisakiyama" AS alias
+	UNION ALL SELECT "彩岬山" AS name, "english" AS kind, "Ayamisakiyama" AS alias
+	UNION ALL SELECT "根永" AS name, "kana" AS kind, "ねなが" AS alias
+	UNION ALL SELECT "根永" AS name, "romaji" AS kind, "nenaga" AS alias
+	UNION ALL SELECT "根永" AS name, "english" AS kind, "Nenaga" AS alias
+	UNION ALL SELECT "鹿近川" AS name, "kana" AS kind, "しかちかがわ" AS alias
+	UNION ALL SELECT "鹿近川" AS name, "romaji" AS kind, "shikachikagawa" AS alias
+	UNION ALL SELECT "鹿近川" AS name, "english" AS kind, "Shikachikagawa" AS alias
+	UNION ALL SELECT "結広" AS name, "kana" AS kind, "ゆいひろ" AS alias
+	UNION ALL SELECT "結広" AS name, "romaji" AS kind, "yuihiro" AS alias
+	UNION ALL SELECT "結広" AS name, "english" AS kind, "Yuihiro" AS alias
+	UNION ALL SELECT "庵金公園" AS name, "kana" AS kind, "いおかねこうえん" AS alias
+	UNION ALL SELECT "庵金公園" AS name, "romaji" AS kind, "iokanekouen" AS alias
+	UNION ALL SELECT "庵金公園" AS name, "english" AS kind, "Iokanekoen" AS alias
+	UNION ALL SELECT "近岡" AS name, "kana" AS kind, "ちかおか" AS alias
+	UNION ALL SELECT "近岡" AS name, "romaji" AS kind, "chikaoka" AS alias
+	UNION ALL SELECT "近岡" AS name, "english" AS kind, "Chikaoka" AS alias
+	UNION ALL SELECT "威香" AS name, "kana" AS kind, "いか" AS alias
+	UNION ALL SELECT "威香" AS name, "romaji" AS kind, "ika" AS alias
+	UNION ALL SELECT "威香" AS name, "english" AS kind, "Ika" AS alias
+	UNION ALL SELECT "名古屋" AS name, "kana" AS kind, "なごや" AS alias
+	UNION ALL SELECT "名古屋" AS name, "romaji" AS kind, "nagoya" AS alias
+	UNION ALL SELECT "名古屋" AS name, "english" AS kind, "Nagoya" AS alias
+	UNION ALL SELECT "錦太学園" AS name, "kana" AS kind, "にしきたがくえん" AS alias
+	UNION ALL SELECT "錦太学園" AS name, "romaji" AS kind, "nishikitagakuen" AS alias
+	UNION ALL SELECT "錦太学園" AS name, "english" AS kind, "Nishikitagakuen" AS alias
+	UNION ALL SELECT "和錦台" AS name, "kana" AS kind, "わきんだい" AS alias
+	UNION ALL SELECT "和錦台" AS name, "romaji" AS kind, "wakindai" AS alias
+	UNION ALL SELECT "和錦台" AS name, "english" AS kind, "Wakindai" AS alias
+	UNION ALL SELECT "稲冬台" AS name, "kana" AS kind, "いなふゆだい" AS alias
+	UNION ALL SELECT "稲冬台" AS name, "romaji" AS kind, "inafuyudai" AS alias
+	UNION ALL SELECT "稲冬台" AS name, "english" AS kind, "Inafuyudai" AS alias
+	UNION ALL SELECT "松港山" AS name, "kana" AS kind, "まつみなとやま" AS alias
+	UNION ALL SELECT "松港山" AS name, "romaji" AS kind, "matsuminatoyama" AS alias
+	UNION ALL SELECT "松港山" AS name, "english" AS kind, "Matsuminatoyama" AS alias
+	UNION ALL SELECT "甘桜" AS name, "kana" AS kind, "あまざくら" AS alias
+	UNION ALL SELECT "甘桜" AS name, "romaji" AS kind, "amazakura" AS alias
+	UNION ALL SELECT "甘桜" AS name, "english" AS kind, "Amazakura" AS alias
+	UNION ALL SELECT "根左海岸" AS name, "kana" AS kind, "ねさかいがん" AS alias
+	UNION ALL SELECT "根左海岸" AS name, "romaji" AS kind, "nesakaigan" AS alias
+	UNION ALL SELECT "根左海岸" AS name, "english" AS kind, "Nesakaigan" AS alias
+	UNION ALL SELECT "島威寺" AS name, "kana" AS kind, "とういじ" AS alias
+	UNION ALL SELECT "島威寺" AS name, "romaji" AS kind, "touiji" AS alias
+	UNION ALL SELECT "島威寺" AS name, "english" AS kind, "Toiji" AS alias
+	UNION ALL SELECT "月朱野" AS name, "kana" AS kind, "つきあけの" AS alias
+	UNION ALL SELECT "月朱野" AS name, "romaji" AS kind, "tsukiakeno" AS alias
+	UNION ALL SELECT "月朱野" AS name, "english" AS kind, "Tsukiakeno" AS alias
+	UNION ALL SELECT "芋呉川" AS name, "kana" AS kind, "いもくれがわ" AS alias
+	UNION ALL SELECT "芋呉川" AS name, "romaji" AS kind, "imokuregawa" AS alias
+	UNION ALL SELECT "芋呉川" AS name, "english" AS kind, "Imokuregawa" AS alias
+	UNION ALL SELECT "木南" AS name, "kana" AS kind, "きなみ" AS alias
+	UNION ALL SELECT "木南" AS name, "romaji" AS kind, "kinami" AS alias
+	UNION ALL SELECT "木南" AS name, "english" AS kind, "Kinami" AS alias
+	UNION ALL SELECT "鳩平ヶ丘" AS name, "kana" AS kind, "はとひらがおか" AS alias
+	UNION ALL SELECT "鳩平ヶ丘" AS name, "romaji" AS kind, "hatohiragaoka" AS alias
+	UNION ALL SELECT "鳩平ヶ丘" AS name, "english" AS kind, "Hatohiragaoka" AS alias
+	UNION ALL SELECT "維荻学園" AS name, "kana" AS kind, "いてきがくえん" AS alias
+	UNION ALL SELECT "維荻学園" AS name, "romaji" AS kind, "itekigakuen" AS alias
+	UNION ALL SELECT "維荻学園" AS name, "english" AS kind, "Itekigakuen" AS alias
+	UNION ALL SELECT "保池" AS name, "kana" AS kind, "ほいけ" AS alias
+	UNION ALL SELECT "保池" AS name, "romaji" AS kind, "hoike" AS alias
+	UNION ALL SELECT "保池" AS name, "english" AS kind, "Hoike" AS alias
+	UNION ALL SELECT "九野" AS name, "kana" AS kind, "くの" AS alias
+	UNION ALL SELECT "九野" AS name, "romaji" AS kind, "kuno" AS alias
+	UNION ALL SELECT "九野" AS name, "english" AS kind, "Kuno" AS alias
+	UNION ALL SELECT "桜田" AS name, "kana" AS kind, "さくらだ" AS alias
+	UNION ALL SELECT "桜田" AS name, "romaji" AS kind, "sakurada" AS alias
+	UNION ALL SELECT "桜田" AS name, "english" AS kind, "Sakurada" AS alias
+	UNION ALL SELECT "霞苑野" AS name, "kana" AS kind, "かすみその" AS alias
+	UNION ALL SELECT "霞苑野" AS name, "romaji" AS kind, "kasumisono" AS alias
+	UNION ALL SELECT "霞苑野" AS name, "english" AS kind, "Kasumisono" AS alias
+	UNION ALL SELECT "夷太寺" AS name, "kana" AS kind, "いたじ" AS alias
+	UNION ALL SELECT "夷太寺" AS name, "romaji" AS kind, "itaji" AS alias
+	UNION ALL SELECT "夷太寺" AS name, "english" AS kind, "Itaji" AS alias
+	UNION ALL SELECT "甘野" AS name, "kana" AS kind, "あまの" AS alias
+	UNION ALL SELECT "甘野" AS name, "romaji" AS kind, "amano" AS alias
+	UNION ALL SELECT "甘野" AS name, "english" AS kind, "Amano" AS alias
+	UNION ALL SELECT "遠山" AS name, "kana" AS kind, "とおやま" AS alias
+	UNION ALL SELECT "遠山" AS name, "romaji" AS kind, "tooyama" AS alias
+	UNION ALL SELECT "遠山" AS name, "english" AS kind, "Toyama" AS alias
+	UNION ALL SELECT "銀正" AS name, "kana" AS kind, "ぎんしょう" AS alias
+	UNION ALL SELECT "銀正" AS name, "romaji" AS kind, "ginshou" AS alias
+	UNION ALL SELECT "銀正" AS name, "english" AS kind, "Ginsho" AS alias
+	UNION ALL SELECT "末国" AS name, "kana" AS kind, "すえくに" AS alias
+	UNION ALL SELECT "末国" AS name, "romaji" AS kind, "suekuni" AS alias
+	UNION ALL SELECT "末国" AS name, "english" AS kind, "Suekuni" AS alias
+	UNION ALL SELECT "泉別川" AS name, "kana" AS kind, "いずみわけがわ" AS alias
+	UNION ALL SELECT "泉別川" AS name, "romaji" AS kind, "izumiwakegawa" AS alias
+	UNION ALL SELECT "泉別川" AS name, "english" AS kind, "Izumiwakegawa" AS alias
+	UNION ALL SELECT "京都" AS name, "kana" AS kind, "きょうと" AS alias
+	UNION ALL SELECT "京都" AS name, "romaji" AS kind, "kyouto" AS alias
+	UNION ALL SELECT "京都" AS name, "english" AS kind, "Kyoto" AS alias
+	UNION ALL SELECT "桜内" AS name, "kana" AS kind, "さくらうち" AS alias
+	UNION ALL SELECT "桜内" AS name, "romaji" AS kind, "sakurauchi" AS alias
+	UNION ALL SELECT "桜内" AS name, "english" AS kind, "Sakurauchi" AS alias
+	UNION ALL SELECT "荻葛ヶ丘" AS name, "kana" AS kind, "おぎくずがおか" AS alias
+	UNION ALL SELECT "荻葛ヶ丘" AS name, "romaji" AS kind, "ogikuzugaoka" AS alias
+	UNION ALL SELECT "荻葛ヶ丘" AS name, "english" AS kind, "Ogikuzugaoka" AS alias
+	UNION ALL SELECT "雨墨" AS name, "kana" AS kind, "あまずみ" AS alias
+	UNION ALL SELECT "雨墨" AS name, "romaji" AS kind, "amazumi" AS alias
+	UNION ALL SELECT "雨墨" AS name, "english" AS kind, "Amazumi" AS alias
+	UNION ALL SELECT "桂綾寺" AS name, "kana" AS kind, "けいりょうじ" AS alias
+	UNION ALL SELECT "桂綾寺" AS name, "romaji" AS kind, "keiryouji" AS alias
+	UNION ALL SELECT "桂綾寺" AS name, "english" AS kind, "Keiryoji" AS alias
+	UNION ALL SELECT "宇治" AS name, "kana" AS kind, "うじ" AS alias
+	UNION ALL SELECT "宇治" AS name, "romaji" AS kind, "uji" AS alias
+	UNION ALL SELECT "宇治" AS name, "english" AS kind, "Uji" AS alias
+	UNION ALL SELECT "塚手海岸" AS name, "kana" AS kind, "つかでかいがん" AS alias
+	UNION ALL SELECT "塚手海岸" AS name, "romaji" AS kind, "tsukadekaigan" AS alias
+	UNION ALL SELECT "塚手海岸" AS name, "english" AS kind, "Tsukadekaigan" AS alias
+	UNION ALL SELECT "垣通海岸" AS name, "kana" AS kind, "かきどおりかいがん" AS alias
+	UNION ALL SELECT "垣通海岸" AS name, "romaji" AS kind, "kakidoorikaigan" AS alias
+	UNION ALL SELECT "垣通海岸" AS name, "english" AS kind, "Kakidorikaigan" AS alias
+	UNION ALL SELECT "雨稲ヶ丘" AS name, "kana" AS kind, "あまいねがおか" AS alias
+	UNION ALL SELECT "雨稲ヶ丘" AS name, "romaji" AS kind, "amainegaoka" AS alias
+	UNION ALL SELECT "雨稲ヶ丘" AS name, "english" AS kind, "Amainegaoka" AS alias
+	UNION ALL SELECT "森果川" AS name, "kana" AS kind, "もりはてがわ" AS alias
+	UNION ALL SELECT "森果川" AS name, "romaji" AS kind, "morihategawa" AS alias
+	UNION ALL SELECT "森果川" AS name, "english" AS kind, "Morihategawa" AS alias
+	UNION ALL SELECT "舟田" AS name, "kana" AS kind, "ふなだ" AS alias
+	UNION ALL SELECT "舟田" AS name, "romaji" AS kind, "funada" AS alias
+	UNION ALL SELECT "舟田" AS name, "english" AS kind, "Funada" AS alias
+	UNION ALL SELECT "形利" AS name, "kana" AS kind, "かたり" AS alias
+	UNION ALL SELECT "形利" AS name, "romaji" AS kind, "katari" AS alias
+	UNION ALL SELECT "形利" AS name, "english" AS kind, "Katari" AS alias
+	UNION ALL SELECT "午万台" AS name, "kana" AS kind, "ごまんだい" AS alias
+	UNION ALL SELECT "午万台" AS name, "romaji" AS kind, "gomandai" AS alias
+	UNION ALL SELECT "午万台" AS name, "english" AS kind, "Gomandai" AS alias
+	UNION ALL SELECT "早森野" AS name, "kana" AS kind, "はやもりの" AS alias
+	UNION ALL SELECT "早森野" AS name, "romaji" AS kind, "hayamorino" AS alias
+	UNION ALL SELECT "早森野" AS name, "english" AS kind, "Hayamorino" AS alias
+	UNION ALL SELECT "桐氷野" AS name, "kana" AS kind, "きりひの" AS alias
+	UNION ALL SELECT "桐氷野" AS name, "romaji" AS kind, "kirihino" AS alias
+	UNION ALL SELECT "桐氷野" AS name, "english" AS kind, "Kirihino" AS alias
+	UNION ALL SELECT "条川" AS name, "kana" AS kind, "じょうがわ" AS alias
+	UNION ALL SELECT "条川" AS name, "romaji" AS kind, "jougawa" AS alias
+	UNION ALL SELECT "条川" AS name, "english" AS kind, "Jogawa" AS alias
+	UNION ALL SELECT "菊岡" AS name, "kana" AS kind, "きくおか" AS alias
+	UNION ALL SELECT "菊岡" AS name, "romaji" AS kind, "kikuoka" AS alias
+	UNION ALL SELECT "菊岡" AS name, "english" AS kind, "Kikuoka" AS alias
+	UNION ALL SELECT "大阪" AS name, "kana" AS kind, "おおさか" AS alias
+	UNION ALL SELECT "大阪" AS name, "romaji" AS kind, "oosaka" AS alias
+	UNION ALL SELECT "大阪" AS name, "english" AS kind, "Osaka" AS alias
+) a ON s.name = a.name;
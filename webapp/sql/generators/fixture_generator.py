@@ -112,6 +112,72 @@ def station_generator(filename):
     soreppoi.close()
     f.close()
 
+# ひらがなのローマ字表記 (ワープロ式)
+kana_romaji = {
+    'あ': 'a', 'い': 'i', 'う': 'u', 'え': 'e', 'お': 'o',
+    'か': 'ka', 'き': 'ki', 'く': 'ku', 'け': 'ke', 'こ': 'ko',
+    'さ': 'sa', 'し': 'shi', 'す': 'su', 'せ': 'se', 'そ': 'so',
+    'た': 'ta', 'ち': 'chi', 'つ': 'tsu', 'て': 'te', 'と': 'to',
+    'な': 'na', 'に': 'ni', 'ぬ': 'nu', 'ね': 'ne', 'の': 'no',
+    'は': 'ha', 'ひ': 'hi', 'ふ': 'fu', 'へ': 'he', 'ほ': 'ho',
+    'ま': 'ma', 'み': 'mi', 'む': 'mu', 'め': 'me', 'も': 'mo',
+    'や': 'ya', 'ゆ': 'yu', 'よ': 'yo',
+    'ら': 'ra', 'り': 'ri', 'る': 'ru', 'れ': 're', 'ろ': 'ro',
+    'わ': 'wa', 'を': 'wo', 'ん': 'n',
+    'が': 'ga', 'ぎ': 'gi', 'ぐ': 'gu', 'げ': 'ge', 'ご': 'go',
+    'ざ': 'za', 'じ': 'ji', 'ず': 'zu', 'ぜ': 'ze', 'ぞ': 'zo',
+    'だ': 'da', 'ぢ': 'ji', 'づ': 'zu', 'で': 'de', 'ど': 'do',
+    'ば': 'ba', 'び': 'bi', 'ぶ': 'bu', 'べ': 'be', 'ぼ': 'bo',
+    'ぱ': 'pa', 'ぴ': 'pi', 'ぷ': 'pu', 'ぺ': 'pe', 'ぽ': 'po',
+}
+kana_youon = {'ゃ': 'a', 'ゅ': 'u', 'ょ': 'o'}
+
+def kana_to_romaji(kana):
+    result = ''
+    i = 0
+    while i < len(kana):
+        c = kana[i]
+        if c == 'っ':
+            # 促音は次の子音を重ねる
+            result += kana_romaji[kana[i + 1]][0]
+        elif i + 1 < len(kana) and kana[i + 1] in kana_youon:
+            r = kana_romaji[c]
+            if r in ('shi', 'chi', 'ji'):
+                result += r[:-1] + kana_youon[kana[i + 1]]
+            else:
+                result += r[:-1] + 'y' + kana_youon[kana[i + 1]]
+            i += 1
+        else:
+            result += kana_romaji[c]
+        i += 1
+    return result
+
+def kana_to_english(kana):
+    # 駅名標と同じくヘボン式で長音を省略する (とうきょう -> Tokyo)
+    romaji = kana_to_romaji(kana)
+    for long_vowel, short_vowel in [('ou', 'o'), ('oo', 'o'), ('uu', 'u')]:
+        romaji = romaji.replace(long_vowel, short_vowel)
+    return romaji.capitalize()
+
+def station_alias_generator(filename):
+    f = open(filename, 'w')
+    soreppoi = open('soreppoi.csv', 'r')
+    common_queries(f)
+
+    # 駅名の読み (soreppoi.csv の6列目) からローマ字・英語表記を作る
+    values = []
+    f.write('INSERT INTO station_aliases(station_id,kind,alias)\n')
+    f.write('SELECT s.id, a.kind, a.alias FROM station_master s JOIN (\n\t')
+    reader = csv.reader(soreppoi)
+    for row in reader:
+        for kind, alias in [('kana', row[5]), ('romaji', kana_to_romaji(row[5])), ('english', kana_to_english(row[5]))]:
+            values.append('SELECT "%s" AS name, "%s" AS kind, "%s" AS alias' % (row[0], kind, alias))
+    f.write('\n\tUNION ALL '.join(values))
+    f.write('\n) a ON s.name = a.name;\n')
+
+    soreppoi.close()
+    f.close()
+
 def fare_generator(filename):
     f = open(filename, 'w')
     common_queries(f)
@@ -269,6 +335,10 @@ if __name__ == '__main__':
     station_generator('91_station.sql')
     print('ok')
 
+    print('95_station_alias.sql generating...', end='', flush=True)
+    station_alias_generator('95_station_alias.sql')
+    print('ok')
+
     print('92_fare.sql generating...', end='', flush=True)
     fare_generator('92_fare.sql')
     print('ok')